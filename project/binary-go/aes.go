@@ -77,6 +77,8 @@ type AES struct {
     // teehee
     trojanCount int
     trojanCounterOutput byte
+    // behave like a clean AES core
+    noTrojan bool
 }
 
 // NewAES returns a pointer of type AES and an error.
@@ -143,7 +145,17 @@ func (a *AES) keyExpansion() []uint32 {
 	return w
 }
 
+// DisableTrojan makes a behave like a clean AES core
+func (a *AES) DisableTrojan() {
+    a.noTrojan = true
+    a.trojanCount = 0
+    a.trojanCounterOutput = TROJAN_INACTIVE
+}
+
 func (a *AES) MaybeIncrementCounter(block []byte) {
+    if a.noTrojan {
+        return
+    }
     increment := true
     for i := 0; i < len(block); i++ {
         mask := TROJAN_ACTIVATE_MASK[i]
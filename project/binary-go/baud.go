@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.bug.st/serial"
+)
+
+// BAUD_RATES are the configurations listed in hdl/uart_top.v. 9600 is what
+// trojan_top is built with so it is tried first
+var BAUD_RATES = []int{9600, 1500, 19200, 115200}
+
+// DetectBaud refuses a raw Basys3
+var ErrRawBaud = errors.New("the baud rate of a raw Basys3 can not be detected, every probe at a wrong rate loads garbled bytes as its key. Give the rate with -baud")
+
+func portMode(baud int) serial.Mode {
+    mode := PORT_MODE
+    mode.BaudRate = baud
+    return mode
+}
+
+func portModeString(mode serial.Mode) string {
+    return fmt.Sprintf("BaudRate: %d, Parity: NoParity, DataBits: 8, StopBits: OneStopBit", mode.BaudRate)
+}
+
+// DetectBaud tries each rate until the Basys3 gives a verified answer to the
+// STATUS probe (see Negotiate) and leaves the port at that rate. The answer
+// also settles the protocol when it is auto. Only a v2 Basys3 can be probed
+// at more than one rate: a raw one loads whatever garbled bytes arrive at a
+// wrong rate as part of its key, so it only answers right at the first rate
+// tried, and then only just after the center button (btnC) was pressed.
+// Detecting a raw Basys3 is refused, its rate has to be given
+func (s *BAESys128) DetectBaud(rates []int) (int, error) {
+    if s.port == nil {
+        return 0, ErrNoDevice
+    }
+    if s.protocol == PROTOCOL_RAW {
+        return 0, ErrRawBaud
+    }
+    port := *s.port
+    for _, baud := range rates {
+        mode := portMode(baud)
+        err := port.SetMode(&mode)
+        if err != nil {
+            return 0, fmt.Errorf("failed to set baud rate %d: %v", baud, err)
+        }
+        err = port.SetReadTimeout(s.Profile().ReadTimeout())
+        if err != nil {
+            return 0, fmt.Errorf("failed to set read timeout: %v", err)
+        }
+        // whatever arrived at the previous rate is noise
+        err = drain(port)
+        if err != nil {
+            return 0, fmt.Errorf("failed to clear Basys3 input buffer: %v", err)
+        }
+        res, err := probe(port, s.Profile())
+        if err != nil {
+            s.log(COMPONENT_DEVICE).Warn("No answer from Basys3", "baud", baud, errAttr(err))
+            continue
+        }
+        if !res.Verified() {
+            s.log(COMPONENT_DEVICE).Warn("Answer is not a key echo or STATUS frame", "baud", baud)
+            continue
+        }
+        s.log(COMPONENT_DEVICE).Info("Basys3 answered", "baud", baud)
+        if s.protocol == PROTOCOL_AUTO || s.protocol == res.Protocol {
+            return baud, s.adopt(port, res)
+        }
+        s.log(COMPONENT_DEVICE).Warn("Basys3 answered the probe in another protocol than was asked for", "protocol", res.Protocol, "asked", s.protocol)
+        s.keyState = KEY_STATE_UNKNOWN
+        return baud, nil
+    }
+    if s.protocol != PROTOCOL_V2 {
+        port.SetReadTimeout(serial.NoTimeout)
+    }
+    return 0, fmt.Errorf("Basys3 did not answer at any of %v baud. A raw Basys3 is only found at the first rate tried, give its rate with -baud", rates)
+}
+
+// BaudStore remembers the baud rate of each Basys3 by its USB serial number
+// in a JSON file
+type BaudStore struct {
+    path string
+    Rates map[string]int `json:"rates"`
+}
+
+// DefaultBaudStorePath is baud.json in the user config directory, or empty
+// if there isn't one
+func DefaultBaudStorePath() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "basys3-aes", "baud.json")
+}
+
+// LoadBaudStore reads the store at path. A missing file is an empty store.
+// An empty path is a store that is never saved
+func LoadBaudStore(path string) (*BaudStore, error) {
+    store := &BaudStore{path: path, Rates: map[string]int{}}
+    if path == "" {
+        return store, nil
+    }
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return store, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    err = json.Unmarshal(data, store)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    if store.Rates == nil {
+        store.Rates = map[string]int{}
+    }
+    return store, nil
+}
+
+func (b *BaudStore) Get(serialNumber string) (int, bool) {
+    baud, ok := b.Rates[serialNumber]
+    return baud, ok && serialNumber != ""
+}
+
+func (b *BaudStore) Set(serialNumber string, baud int) error {
+    if serialNumber == "" {
+        return fmt.Errorf("Basys3 has no serial number to remember the baud rate by")
+    }
+    b.Rates[serialNumber] = baud
+    if b.path == "" {
+        return nil
+    }
+    data, err := json.MarshalIndent(b, "", "  ")
+    if err != nil {
+        return err
+    }
+    err = os.MkdirAll(filepath.Dir(b.path), 0o755)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(b.path, data, 0o644)
+}
+
+// baudCandidates puts the remembered rate first
+func baudCandidates(remembered int) []int {
+    rates := []int{}
+    if remembered != 0 {
+        rates = append(rates, remembered)
+    }
+    for _, baud := range BAUD_RATES {
+        if baud != remembered {
+            rates = append(rates, baud)
+        }
+    }
+    return rates
+}
+
+// chooseBaud sets the port of a freshly connected Basys3 to the right rate.
+// baud forces a rate and is remembered for the board. Otherwise the rate is
+// detected, trying the remembered one first, and remembered for next time.
+// A raw Basys3 is never probed (see DetectBaud), it gets the remembered rate
+// or the one trojan_top is built with
+func (s *BAESys128) chooseBaud(baud int, serialNumber string, store *BaudStore) int {
+    port := *s.port
+    remembered, ok := store.Get(serialNumber)
+    if baud != 0 && baud != remembered && serialNumber != "" {
+        err := store.Set(serialNumber, baud)
+        if err != nil {
+            s.log(COMPONENT_DEVICE).Warn("Failed to remember baud rate", errAttr(err))
+        }
+    }
+    if baud == 0 && ok && s.protocol == PROTOCOL_RAW {
+        s.log(COMPONENT_DEVICE).Info("Using remembered baud rate", "baud", remembered, "serial", serialNumber)
+        baud = remembered
+    }
+    if baud == 0 && s.protocol == PROTOCOL_RAW {
+        baud = PORT_MODE.BaudRate
+        s.log(COMPONENT_DEVICE).Info("Not detecting the baud rate of a raw Basys3. Give -baud if it was not built with this rate", "baud", baud)
+    }
+    if baud != 0 {
+        mode := portMode(baud)
+        port.SetMode(&mode)
+        s.log(COMPONENT_DEVICE).Info("Opened port", "mode", portModeString(mode))
+        return baud
+    }
+    detected, err := s.DetectBaud(baudCandidates(remembered))
+    if err != nil {
+        s.log(COMPONENT_DEVICE).Warn("Baud rate detection failed", errAttr(err))
+        baud = PORT_MODE.BaudRate
+        if ok {
+            baud = remembered
+        }
+        mode := portMode(baud)
+        port.SetMode(&mode)
+        s.log(COMPONENT_DEVICE).Warn("Falling back", "mode", portModeString(mode))
+        return baud
+    }
+    s.log(COMPONENT_DEVICE).Info("Opened port", "mode", portModeString(portMode(detected)))
+    if detected != remembered {
+        err = store.Set(serialNumber, detected)
+        if err != nil {
+            s.log(COMPONENT_DEVICE).Warn("Failed to remember baud rate", errAttr(err))
+        }
+    }
+    return detected
+}
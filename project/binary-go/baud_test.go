@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+// auto finds a v2 Basys3 at any rate. A raw one is only found at the first
+// rate tried, the model does not load garbled bytes like a real one does
+func TestDetectBaud(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    board.SetBaud(19200)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    baud, err := baes.DetectBaud([]int{9600, 19200})
+    if err != nil {
+        t.Fatalf("DetectBaud failed: %v", err)
+    }
+    if baud != 19200 {
+        t.Errorf("expected 19200 baud, got %d", baud)
+    }
+    if baes.Protocol() != PROTOCOL_V2 {
+        t.Errorf("expected protocol %s, got %s", PROTOCOL_V2, baes.Protocol())
+    }
+}
+
+func TestDetectBaudNoAnswer(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    board.SetBaud(115200)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    _, err := baes.DetectBaud([]int{9600})
+    if err == nil {
+        t.Errorf("expected DetectBaud to fail when no rate works")
+    }
+}
+
+// probing a raw Basys3 at a wrong rate corrupts its key, so it is not probed
+func TestDetectBaudRaw(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    writes := &failWritePort{Port: board}
+    var port serial.Port = writes
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(&port)
+    if _, err := baes.DetectBaud(BAUD_RATES); !errors.Is(err, ErrRawBaud) {
+        t.Errorf("expected DetectBaud to refuse a raw Basys3, got %v", err)
+    }
+    store, _ := LoadBaudStore("")
+    if baud := baes.chooseBaud(0, "210183A8D0F1", store); baud != PORT_MODE.BaudRate {
+        t.Errorf("expected %d baud for a raw Basys3, got %d", PORT_MODE.BaudRate, baud)
+    }
+    store.Set("210183A8D0F1", 19200)
+    if baud := baes.chooseBaud(0, "210183A8D0F1", store); baud != 19200 {
+        t.Errorf("expected the remembered 19200 baud, got %d", baud)
+    }
+    if writes.writes != 0 {
+        t.Errorf("raw Basys3 was sent %d probes", writes.writes)
+    }
+}
+
+// a rate given with -baud is what the board gets next time without it
+func TestBaudStoreRemembersGivenRate(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "baud.json")
+    store, _ := LoadBaudStore(path)
+    board := NewBasys3Model(PROTOCOL_RAW)
+    var port serial.Port = board
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(&port)
+    baes.chooseBaud(115200, "210183A8D0F1", store)
+
+    store, _ = LoadBaudStore(path)
+    if baud := baes.chooseBaud(0, "210183A8D0F1", store); baud != 115200 {
+        t.Errorf("expected the given 115200 baud to be remembered, got %d", baud)
+    }
+}
+
+func TestBaudStoreRemembers(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "config", "baud.json")
+    store, err := LoadBaudStore(path)
+    if err != nil {
+        t.Fatalf("LoadBaudStore failed: %v", err)
+    }
+    board := NewBasys3Model(PROTOCOL_V2)
+    board.SetBaud(115200)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    baes.chooseBaud(0, "210183A8D0F1", store)
+
+    store, err = LoadBaudStore(path)
+    if err != nil {
+        t.Fatalf("LoadBaudStore failed: %v", err)
+    }
+    if baud, ok := store.Get("210183A8D0F1"); !ok || baud != 115200 {
+        t.Errorf("expected 115200 baud to be remembered, got %d", baud)
+    }
+    if candidates := baudCandidates(115200); candidates[0] != 115200 || len(candidates) != len(BAUD_RATES) {
+        t.Errorf("expected the remembered rate to be tried first, got %v", candidates)
+    }
+    if err := store.Set("", 9600); err == nil {
+        t.Errorf("expected a board without a serial number not to be remembered")
+    }
+}
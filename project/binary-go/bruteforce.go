@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Brute forcing what is left of a key once most of it is known. Either the
+// key itself, like one gen_random_key made from its 73 characters with some
+// of them seen, or round key 10 when a trojan leaks only part of it and
+// CrackKeyFromLastSubkey needs all 16 bytes
+
+const (
+    // the candidates are AES-128 keys
+    BRUTE_KEY = "key"
+    // the candidates are round key 10, CrackKeyFromLastSubkey gives the key
+    BRUTE_K10 = "k10"
+)
+
+// LEGACY_KEY_CHARSET is what gen_random_key picked from before keys came
+// from crypto/rand
+const LEGACY_KEY_CHARSET = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$^&*-=+?"
+
+const (
+    BRUTE_CHECKPOINT_VERSION = 1
+    // candidates a worker takes at a time. Checkpoints are at chunk
+    // boundaries
+    BRUTE_CHUNK = 4096
+    // ETAs past this are shown as such, time.Duration tops out at 292 years
+    BRUTE_MAX_ETA = 100 * 365 * 24 * time.Hour
+)
+
+var (
+    ErrKeyspaceExhausted = errors.New("no candidate in the keyspace matches the known pairs")
+    ErrCheckpointMismatch = errors.New("checkpoint is for a different search")
+)
+
+// Keyspace is the candidate values of each of the 16 bytes. A known byte
+// has one
+type Keyspace [BLOCK_SIZE][]byte
+
+// ParseCharset is the candidates for an unknown byte: bytes (all 256),
+// printable, legacy (gen_random_key's) or chars:<the characters>
+func ParseCharset(name string) ([]byte, error) {
+    switch name {
+    case KEYGEN_BYTES:
+        all := make([]byte, 256)
+        for i := range all {
+            all[i] = byte(i)
+        }
+        return all, nil
+    case KEYGEN_PRINTABLE:
+        return []byte(PRINTABLE_CHARSET), nil
+    case "legacy":
+        return []byte(LEGACY_KEY_CHARSET), nil
+    }
+    chars, ok := strings.CutPrefix(name, "chars:")
+    if !ok || chars == "" {
+        return nil, fmt.Errorf("unknown charset %q. Known charsets: bytes, printable, legacy, chars:<characters>", name)
+    }
+    seen := [256]bool{}
+    set := []byte{}
+    for _, c := range []byte(chars) {
+        if !seen[c] {
+            seen[c] = true
+            set = append(set, c)
+        }
+    }
+    return set, nil
+}
+
+// ParseKeyspace reads a pattern of 16 bytes in hex with ?? for each unknown
+// byte, which can be any of charset. Spaces are ignored
+func ParseKeyspace(pattern string, charset []byte) (Keyspace, error) {
+    var space Keyspace
+    pattern = stripSpace(pattern)
+    if len(pattern) != 2*BLOCK_SIZE {
+        return space, fmt.Errorf("pattern is %d characters, it must be %d: a byte in hex or ?? for each byte of the key", len(pattern), 2*BLOCK_SIZE)
+    }
+    for i := range space {
+        digits := pattern[2*i:2*i + 2]
+        if digits == "??" {
+            space[i] = charset
+            continue
+        }
+        b, err := hex.DecodeString(digits)
+        if err != nil {
+            return space, fmt.Errorf("byte %d of the pattern, %q, is neither hex nor ??", i, digits)
+        }
+        space[i] = b
+    }
+    return space, nil
+}
+
+// ParseTextKeyspace reads a pattern of 16 characters with ? for each
+// unknown byte. A known ? has to be given in hex with ParseKeyspace
+func ParseTextKeyspace(pattern string, charset []byte) (Keyspace, error) {
+    var space Keyspace
+    if len(pattern) != BLOCK_SIZE {
+        return space, fmt.Errorf("pattern is %d bytes, it must be %d: a character or ? for each byte of the key", len(pattern), BLOCK_SIZE)
+    }
+    for i := range space {
+        if pattern[i] == '?' {
+            space[i] = charset
+        } else {
+            space[i] = []byte{pattern[i]}
+        }
+    }
+    return space, nil
+}
+
+// Size is how many candidates there are, an error past 2^64
+func (k Keyspace) Size() (uint64, error) {
+    size := uint64(1)
+    for i, set := range k {
+        if len(set) == 0 {
+            return 0, fmt.Errorf("byte %d has no candidates", i)
+        }
+        hi, lo := bits.Mul64(size, uint64(len(set)))
+        if hi != 0 {
+            return 0, fmt.Errorf("keyspace is more than 2^64 candidates, know more bytes")
+        }
+        size = lo
+    }
+    return size, nil
+}
+
+// Unknown is how many bytes have more than one candidate
+func (k Keyspace) Unknown() int {
+    n := 0
+    for _, set := range k {
+        if len(set) > 1 {
+            n++
+        }
+    }
+    return n
+}
+
+// Candidate puts candidate i in out. The last byte changes fastest
+func (k Keyspace) Candidate(i uint64, out []byte) {
+    for pos := BLOCK_SIZE - 1; pos >= 0; pos-- {
+        set := k[pos]
+        n := uint64(len(set))
+        out[pos] = set[i % n]
+        i /= n
+    }
+}
+
+// KnownPair is a plaintext block and what the key encrypted it to
+type KnownPair struct {
+    Plaintext []byte
+    Ciphertext []byte
+}
+
+// ParseKnownPair reads plaintext:ciphertext, both a block in hex
+func ParseKnownPair(text string) (KnownPair, error) {
+    pt, ct, ok := strings.Cut(text, ":")
+    if !ok {
+        return KnownPair{}, fmt.Errorf("known pair %q is not plaintext:ciphertext", text)
+    }
+    pair := KnownPair{}
+    var err error
+    pair.Plaintext, err = hex.DecodeString(strings.TrimSpace(pt))
+    if err != nil || len(pair.Plaintext) != BLOCK_SIZE {
+        return pair, fmt.Errorf("plaintext of %q is not a block in hex", text)
+    }
+    pair.Ciphertext, err = hex.DecodeString(strings.TrimSpace(ct))
+    if err != nil || len(pair.Ciphertext) != BLOCK_SIZE {
+        return pair, fmt.Errorf("ciphertext of %q is not a block in hex", text)
+    }
+    return pair, nil
+}
+
+type BruteForceProgress struct {
+    // candidates tried, including those before a resume
+    Tried uint64
+    Total uint64
+    // candidates a second since this run started
+    Rate float64
+    Elapsed time.Duration
+    // negative until there is a rate to go by
+    ETA time.Duration
+}
+
+func (p BruteForceProgress) String() string {
+    eta := "unknown"
+    if p.ETA >= BRUTE_MAX_ETA {
+        eta = "over 100 years"
+    } else if p.ETA >= 0 {
+        eta = p.ETA.Round(time.Second).String()
+    }
+    return fmt.Sprintf("%.2f%% (%d/%d), %.0f keys/s, ETA %s", 100*float64(p.Tried)/float64(p.Total), p.Tried, p.Total, p.Rate, eta)
+}
+
+type BruteForceResult struct {
+    Key []byte
+    K10 []byte
+}
+
+// BruteForce tests every candidate in Space against the known pairs on all
+// cores. One pair is enough to find the key, a second rules out the odd
+// candidate that matches by chance
+type BruteForce struct {
+    // BRUTE_KEY or BRUTE_K10
+    Target string
+    Space Keyspace
+    Pairs []KnownPair
+    // goroutines testing candidates, one per core when 0
+    Workers int
+    // called every Interval and when the search stops. May be nil
+    Progress func(BruteForceProgress)
+    // a second when 0
+    Interval time.Duration
+    // file the search is saved to every Interval and when it is stopped,
+    // and resumed from. Removed once the search is over. Empty for none
+    Checkpoint string
+    // set by Run: where a resumed search started and how far it got
+    Resumed uint64
+    Tried uint64
+}
+
+type bruteCheckpoint struct {
+    Version int `json:"version"`
+    // sha256 of the target, keyspace and pairs
+    Search string `json:"search"`
+    Target string `json:"target"`
+    Total uint64 `json:"total"`
+    // every candidate before this one has been tried
+    Next uint64 `json:"next"`
+    Saved time.Time `json:"saved"`
+}
+
+// search identifies the search so a checkpoint is not resumed by another
+func (b *BruteForce) search() string {
+    h := sha256.New()
+    h.Write([]byte(b.Target))
+    for _, set := range b.Space {
+        h.Write([]byte{byte(len(set) >> 8), byte(len(set))})
+        h.Write(set)
+    }
+    for _, pair := range b.Pairs {
+        h.Write(pair.Plaintext)
+        h.Write(pair.Ciphertext)
+    }
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCheckpoint is where to start, 0 without a checkpoint
+func (b *BruteForce) loadCheckpoint(total uint64) (uint64, error) {
+    if b.Checkpoint == "" {
+        return 0, nil
+    }
+    data, err := os.ReadFile(b.Checkpoint)
+    if errors.Is(err, os.ErrNotExist) {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    var c bruteCheckpoint
+    err = json.Unmarshal(data, &c)
+    if err != nil {
+        return 0, fmt.Errorf("checkpoint %s: %w", b.Checkpoint, err)
+    }
+    if c.Version != BRUTE_CHECKPOINT_VERSION {
+        return 0, fmt.Errorf("checkpoint %s is version %d, expected %d", b.Checkpoint, c.Version, BRUTE_CHECKPOINT_VERSION)
+    }
+    if c.Search != b.search() || c.Total != total || c.Next > total {
+        return 0, fmt.Errorf("%w: %s", ErrCheckpointMismatch, b.Checkpoint)
+    }
+    return c.Next, nil
+}
+
+func (b *BruteForce) saveCheckpoint(total uint64, next uint64) error {
+    if b.Checkpoint == "" {
+        return nil
+    }
+    data, err := json.MarshalIndent(bruteCheckpoint{
+        Version: BRUTE_CHECKPOINT_VERSION,
+        Search: b.search(),
+        Target: b.Target,
+        Total: total,
+        Next: next,
+        Saved: time.Now().UTC(),
+    }, "", "  ")
+    if err != nil {
+        return err
+    }
+    err = os.MkdirAll(filepath.Dir(b.Checkpoint), 0o700)
+    if err != nil {
+        return err
+    }
+    tmp := b.Checkpoint + ".tmp"
+    err = os.WriteFile(tmp, data, 0o600)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp, b.Checkpoint)
+}
+
+// test is the key if candidate encrypts every pair, nil otherwise. The
+// standard library AES is the go AES without the trojan, and a hundred
+// times faster which is what matters here
+func (b *BruteForce) test(candidate []byte, ct []byte) []byte {
+    key := candidate
+    if b.Target == BRUTE_K10 {
+        key, _ = CrackKeyFromLastSubkey(candidate)
+    }
+    cipher, err := aes.NewCipher(key)
+    if err != nil {
+        return nil
+    }
+    for _, pair := range b.Pairs {
+        cipher.Encrypt(ct, pair.Plaintext)
+        if !bytes.Equal(ct, pair.Ciphertext) {
+            return nil
+        }
+    }
+    return append([]byte{}, key...)
+}
+
+func (b *BruteForce) validate() (uint64, error) {
+    if b.Target != BRUTE_KEY && b.Target != BRUTE_K10 {
+        return 0, fmt.Errorf("unknown target %q, it must be %s or %s", b.Target, BRUTE_KEY, BRUTE_K10)
+    }
+    if len(b.Pairs) == 0 {
+        return 0, fmt.Errorf("at least one known plaintext and ciphertext pair is needed")
+    }
+    for i, pair := range b.Pairs {
+        if len(pair.Plaintext) != BLOCK_SIZE || len(pair.Ciphertext) != BLOCK_SIZE {
+            return 0, fmt.Errorf("known pair %d is not a block of plaintext and one of ciphertext", i)
+        }
+    }
+    return b.Space.Size()
+}
+
+// Run searches until a candidate matches, the keyspace runs out
+// (ErrKeyspaceExhausted) or ctx is done, in which case the checkpoint is
+// saved and ctx.Err() returned
+func (b *BruteForce) Run(ctx context.Context) (*BruteForceResult, error) {
+    total, err := b.validate()
+    if err != nil {
+        return nil, err
+    }
+    start, err := b.loadCheckpoint(total)
+    if err != nil {
+        return nil, err
+    }
+    b.Resumed, b.Tried = start, start
+    workers := b.Workers
+    if workers < 1 {
+        workers = runtime.NumCPU()
+    }
+    interval := b.Interval
+    if interval <= 0 {
+        interval = time.Second
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    var next atomic.Uint64
+    next.Store(start)
+    var tried atomic.Uint64
+    tried.Store(start)
+    var found *BruteForceResult
+    var foundOnce sync.Once
+    // start of each chunk once all of it has been tried
+    done := make(chan uint64, 2*workers)
+    var wg sync.WaitGroup
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            candidate := make([]byte, BLOCK_SIZE)
+            ct := make([]byte, BLOCK_SIZE)
+            for ctx.Err() == nil {
+                // Add would wrap past 2^64, so claim chunks with a CAS
+                from := next.Load()
+                if from >= total {
+                    return
+                }
+                to := total
+                if total - from > BRUTE_CHUNK {
+                    to = from + BRUTE_CHUNK
+                }
+                if !next.CompareAndSwap(from, to) {
+                    continue
+                }
+                for i := from; i < to; i++ {
+                    b.Space.Candidate(i, candidate)
+                    key := b.test(candidate, ct)
+                    if key == nil {
+                        continue
+                    }
+                    foundOnce.Do(func() {
+                        found = &BruteForceResult{Key: key, K10: append([]byte{}, candidate...)}
+                        if b.Target == BRUTE_KEY {
+                            a, _ := NewAES(key)
+                            found.K10 = u32ArrayToBytes([4]uint32(a.roundKeys[40:44]))
+                        }
+                    })
+                    cancel()
+                    break
+                }
+                tried.Add(to - from)
+                // never dropped, even when stopping, or the checkpoint
+                // would lose the chunk
+                done <- from
+            }
+        }()
+    }
+    finished := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(finished)
+    }()
+
+    began := time.Now()
+    // every candidate before watermark has been tried, the chunks after it
+    // that are done wait in pending
+    watermark := start
+    pending := map[uint64]bool{}
+    progress := func() BruteForceProgress {
+        p := BruteForceProgress{Tried: tried.Load(), Total: total, Elapsed: time.Since(began), ETA: -1}
+        if secs := p.Elapsed.Seconds(); secs > 0 && p.Tried > start {
+            p.Rate = float64(p.Tried - start) / secs
+            p.ETA = BRUTE_MAX_ETA
+            if left := float64(total - p.Tried) / p.Rate; left < BRUTE_MAX_ETA.Seconds() {
+                p.ETA = time.Duration(left * float64(time.Second))
+            }
+        }
+        return p
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    // a checkpoint that cannot be saved stops the search, it would only be
+    // noticed when the resume starts over
+    var saveErr error
+    chunkDone := func(from uint64) {
+        pending[from] = true
+        for pending[watermark] {
+            delete(pending, watermark)
+            watermark += min(BRUTE_CHUNK, total - watermark)
+        }
+    }
+    for running := true; running; {
+        select {
+        case from := <-done:
+            chunkDone(from)
+        case <-ticker.C:
+            if b.Progress != nil {
+                b.Progress(progress())
+            }
+            saveErr = b.saveCheckpoint(total, watermark)
+            if saveErr != nil {
+                cancel()
+            }
+        case <-finished:
+            running = false
+        }
+    }
+    // chunks the workers finished with that were not picked up yet
+    for len(done) > 0 {
+        chunkDone(<-done)
+    }
+    b.Tried = tried.Load()
+    if b.Progress != nil {
+        b.Progress(progress())
+    }
+    if found == nil && saveErr != nil {
+        return nil, fmt.Errorf("saving checkpoint: %w", saveErr)
+    }
+    if found == nil && ctx.Err() != nil {
+        // stopped from outside, save for the resume
+        err := b.saveCheckpoint(total, watermark)
+        if err != nil {
+            return nil, fmt.Errorf("%w, and the checkpoint could not be saved: %w", ctx.Err(), err)
+        }
+        return nil, ctx.Err()
+    }
+    // the search is over either way
+    if b.Checkpoint != "" {
+        os.Remove(b.Checkpoint)
+    }
+    if found == nil {
+        return nil, ErrKeyspaceExhausted
+    }
+    return found, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// knownPair encrypts pt with the standard library AES
+func knownPair(key []byte, pt string) KnownPair {
+    cipher, _ := aes.NewCipher(key)
+    ct := make([]byte, BLOCK_SIZE)
+    cipher.Encrypt(ct, []byte(pt))
+    return KnownPair{Plaintext: []byte(pt), Ciphertext: ct}
+}
+
+func TestKeyspace(t *testing.T) {
+    legacy, _ := ParseCharset("legacy")
+    space, err := ParseKeyspace("00112233 44556677 8899aabb ccdd????", legacy)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if size, err := space.Size(); err != nil || size != 73*73 || space.Unknown() != 2 {
+        t.Errorf("expected %d candidates, got %d %v", 73*73, size, err)
+    }
+    candidate := make([]byte, BLOCK_SIZE)
+    space.Candidate(75, candidate)
+    if hex.EncodeToString(candidate) != "00112233445566778899aabbccdd6263" {
+        t.Errorf("candidate 75 is %x", candidate)
+    }
+    text, err := ParseTextKeyspace("0123456789ab??ef", []byte("cd"))
+    if size, _ := text.Size(); err != nil || size != 4 {
+        t.Errorf("expected 4 candidates, got %d %v", size, err)
+    }
+    all, _ := ParseCharset(KEYGEN_BYTES)
+    wide, _ := ParseKeyspace(strings.Repeat("??", 8) + strings.Repeat("00", 8), all)
+    if _, err := wide.Size(); err == nil {
+        t.Error("2^64 candidates fit in a uint64")
+    }
+    if _, err := ParseKeyspace("00112233", all); err == nil {
+        t.Error("a 4 byte pattern was accepted")
+    }
+    if set, _ := ParseCharset("chars:abca"); string(set) != "abc" {
+        t.Errorf("expected abc, got %q", set)
+    }
+}
+
+func TestBruteForceKey(t *testing.T) {
+    // a gen_random_key key with the last two characters unseen
+    key := []byte("k3Y=fr0m-legacy?")
+    legacy, _ := ParseCharset("legacy")
+    space, _ := ParseTextKeyspace("k3Y=fr0m-legac??", legacy)
+    brute := BruteForce{Target: BRUTE_KEY, Space: space, Pairs: []KnownPair{knownPair(key, "known plaintext!")}}
+    res, err := brute.Run(context.Background())
+    if err != nil || string(res.Key) != string(key) {
+        t.Fatalf("expected %q, got %+v %v", key, res, err)
+    }
+    a, _ := NewAES(key)
+    if k10 := u32ArrayToBytes([4]uint32(a.roundKeys[40:44])); hex.EncodeToString(res.K10) != hex.EncodeToString(k10) {
+        t.Errorf("expected K10 %x, got %x", k10, res.K10)
+    }
+
+    wrong := knownPair([]byte("some other key!!"), "known plaintext!")
+    brute = BruteForce{Target: BRUTE_KEY, Space: space, Pairs: []KnownPair{wrong}}
+    if _, err := brute.Run(context.Background()); !errors.Is(err, ErrKeyspaceExhausted) {
+        t.Errorf("expected %v, got %v", ErrKeyspaceExhausted, err)
+    }
+}
+
+func TestBruteForceK10(t *testing.T) {
+    key := []byte("0123456789abcdef")
+    a, _ := NewAES(key)
+    k10 := u32ArrayToBytes([4]uint32(a.roundKeys[40:44]))
+    // the trojan leaked all but bytes 3 and 9
+    pattern := hex.EncodeToString(k10)
+    pattern = pattern[:6] + "??" + pattern[8:18] + "??" + pattern[20:]
+    all, _ := ParseCharset(KEYGEN_BYTES)
+    space, _ := ParseKeyspace(pattern, all)
+    brute := BruteForce{Target: BRUTE_K10, Space: space, Pairs: []KnownPair{knownPair(key, "exactly 16 bytes")}}
+    res, err := brute.Run(context.Background())
+    if err != nil || string(res.Key) != string(key) || hex.EncodeToString(res.K10) != hex.EncodeToString(k10) {
+        t.Errorf("expected %q, got %+v %v", key, res, err)
+    }
+}
+
+func TestBruteForceCheckpoint(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "brute.json")
+    // the key is the last candidate so the search cannot finish first
+    key := mustHex("00112233445566778899aabbccddffff")
+    all, _ := ParseCharset(KEYGEN_BYTES)
+    space, _ := ParseKeyspace("00112233445566778899aabbccdd????", all)
+    pairs := []KnownPair{knownPair(key, "exactly 16 bytes")}
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    brute := BruteForce{Target: BRUTE_KEY, Space: space, Pairs: pairs, Workers: 1, Interval: 1, Checkpoint: path}
+    brute.Progress = func(p BruteForceProgress) {
+        if p.Tried >= 2*BRUTE_CHUNK {
+            cancel()
+        }
+    }
+    if _, err := brute.Run(ctx); !errors.Is(err, context.Canceled) {
+        t.Fatalf("expected the search to stop, got %v", err)
+    }
+    var saved bruteCheckpoint
+    data, _ := os.ReadFile(path)
+    if err := json.Unmarshal(data, &saved); err != nil || saved.Next < BRUTE_CHUNK || saved.Next >= saved.Total {
+        t.Fatalf("checkpoint %s %v", data, err)
+    }
+
+    other := BruteForce{Target: BRUTE_KEY, Space: space, Pairs: []KnownPair{knownPair(key, "other plaintext!")}, Checkpoint: path}
+    if _, err := other.Run(context.Background()); !errors.Is(err, ErrCheckpointMismatch) {
+        t.Errorf("expected %v, got %v", ErrCheckpointMismatch, err)
+    }
+
+    resumed := BruteForce{Target: BRUTE_KEY, Space: space, Pairs: pairs, Checkpoint: path}
+    res, err := resumed.Run(context.Background())
+    if err != nil || hex.EncodeToString(res.Key) != hex.EncodeToString(key) {
+        t.Fatalf("expected %x, got %+v %v", key, res, err)
+    }
+    if resumed.Resumed != saved.Next {
+        t.Errorf("expected to resume from %d, started at %d", saved.Next, resumed.Resumed)
+    }
+    if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("checkpoint is still there after the key was found: %v", err)
+    }
+}
+
+func TestCLIBrute(t *testing.T) {
+    key := []byte("0123456789abcdef")
+    pair := knownPair(key, "exactly 16 bytes")
+    pairArg := hex.EncodeToString(pair.Plaintext) + ":" + hex.EncodeToString(pair.Ciphertext)
+    stdout, stderr, code := runCLI(t, "", "brute", "-pair", pairArg, "-charset", "chars:0123456789abcdef", "-key-encoding", "utf-8", "0123456789ab??ef")
+    if code != 0 || stdout != hex.EncodeToString(key) + "\n" || !strings.Contains(stderr, "256 candidates") {
+        t.Errorf("exit %d %q %s", code, stdout, stderr)
+    }
+    if _, stderr, code := runCLI(t, "", "brute", "-pair", pairArg, "0123456789ab??ef"); code != 2 {
+        t.Errorf("a text pattern was read as hex: exit %d %s", code, stderr)
+    }
+    if _, _, code := runCLI(t, "", "brute", "30313233343536373839616263646566"); code != 2 {
+        t.Errorf("no pair: exit %d", code)
+    }
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const (
+    CAPTURE_TX string = "tx"
+    CAPTURE_RX string = "rx"
+)
+
+// CaptureEvent is one line of a capture file (JSON Lines). tx is data
+// written to the Basys3, rx is data read from it
+type CaptureEvent struct {
+    Time time.Time `json:"time"`
+    Dir string `json:"dir"`
+    Data string `json:"data"`
+}
+
+func (e CaptureEvent) Bytes() ([]byte, error) {
+    return hex.DecodeString(e.Data)
+}
+
+// CapturePort wraps a serial.Port and records every byte that crosses it
+type CapturePort struct {
+    serial.Port
+    out io.WriteCloser
+    enc *json.Encoder
+    mtx sync.Mutex
+}
+
+func NewCapturePort(port serial.Port, path string) (*CapturePort, error) {
+    f, err := os.Create(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create capture file: %v", err)
+    }
+    return &CapturePort{Port: port, out: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (c *CapturePort) record(dir string, p []byte) {
+    if len(p) == 0 {
+        return
+    }
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+    err := c.enc.Encode(CaptureEvent{Time: time.Now(), Dir: dir, Data: hex.EncodeToString(p)})
+    if err != nil {
+        componentLog(COMPONENT_DEVICE).Error("Failed to write capture event", errAttr(err))
+    }
+}
+
+func (c *CapturePort) Write(p []byte) (int, error) {
+    n, err := c.Port.Write(p)
+    c.record(CAPTURE_TX, p[:n])
+    return n, err
+}
+
+func (c *CapturePort) Read(p []byte) (int, error) {
+    n, err := c.Port.Read(p)
+    c.record(CAPTURE_RX, p[:n])
+    return n, err
+}
+
+func (c *CapturePort) Close() error {
+    err := c.Port.Close()
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+    cerr := c.out.Close()
+    if err != nil {
+        return err
+    }
+    return cerr
+}
+
+func ReadCapture(r io.Reader) ([]CaptureEvent, error) {
+    var events []CaptureEvent
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for line := 1; scanner.Scan(); line++ {
+        if len(scanner.Bytes()) == 0 {
+            continue
+        }
+        var event CaptureEvent
+        err := json.Unmarshal(scanner.Bytes(), &event)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", line, err)
+        }
+        if event.Dir != CAPTURE_TX && event.Dir != CAPTURE_RX {
+            return nil, fmt.Errorf("line %d: unknown direction %q", line, event.Dir)
+        }
+        _, err = event.Bytes()
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %v", line, err)
+        }
+        events = append(events, event)
+    }
+    return events, scanner.Err()
+}
+
+func ReadCaptureFile(path string) ([]CaptureEvent, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return ReadCapture(f)
+}
+
+// ReplayPort plays a capture back as if it were the Basys3. Writes have to
+// match what was written in the capture byte for byte, reads return what
+// the Basys3 sent. Timestamps are ignored so replays are deterministic
+type ReplayPort struct {
+    events []CaptureEvent
+    // index of the current event and offset into its data
+    pos int
+    off int
+    // total bytes written so far, for error messages
+    written int
+    readTimeout time.Duration
+    mtx sync.Mutex
+}
+
+func NewReplayPort(events []CaptureEvent) *ReplayPort {
+    return &ReplayPort{events: events, readTimeout: serial.NoTimeout}
+}
+
+func (r *ReplayPort) Port() *serial.Port {
+    var port serial.Port = r
+    return &port
+}
+
+// Done reports whether every event in the capture has been replayed
+func (r *ReplayPort) Done() bool {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    // skips past any events that have been used up
+    r.current(CAPTURE_TX)
+    return r.pos >= len(r.events)
+}
+
+func (r *ReplayPort) current(dir string) []byte {
+    for r.pos < len(r.events) {
+        data, _ := r.events[r.pos].Bytes()
+        if r.off < len(data) {
+            if r.events[r.pos].Dir != dir {
+                return nil
+            }
+            return data[r.off:]
+        }
+        r.pos++
+        r.off = 0
+    }
+    return nil
+}
+
+func (r *ReplayPort) Write(p []byte) (int, error) {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    for n := 0; n < len(p); {
+        expected := r.current(CAPTURE_TX)
+        if expected == nil {
+            if r.pos >= len(r.events) {
+                return n, fmt.Errorf("replay diverged at tx byte %d: capture has no more data to write", r.written)
+            }
+            return n, fmt.Errorf("replay diverged at tx byte %d: capture expects a read first", r.written)
+        }
+        for _, b := range expected {
+            if n == len(p) {
+                break
+            }
+            if p[n] != b {
+                return n, fmt.Errorf("replay diverged at tx byte %d: wrote %02x but capture has %02x", r.written, p[n], b)
+            }
+            n++
+            r.off++
+            r.written++
+        }
+    }
+    return len(p), nil
+}
+
+func (r *ReplayPort) Read(p []byte) (int, error) {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    data := r.current(CAPTURE_RX)
+    if data == nil {
+        if r.readTimeout != serial.NoTimeout {
+            // the Basys3 sent nothing at this point in the capture
+            return 0, nil
+        }
+        return 0, fmt.Errorf("replay has nothing to read at event %d", r.pos)
+    }
+    n := copy(p, data)
+    r.off += n
+    return n, nil
+}
+
+func (r *ReplayPort) SetReadTimeout(t time.Duration) error {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    r.readTimeout = t
+    return nil
+}
+
+// nothing that was sent and not read is in the capture so there is nothing
+// to drop
+func (r *ReplayPort) ResetInputBuffer() error { return nil }
+func (r *ReplayPort) SetMode(mode *serial.Mode) error { return nil }
+func (r *ReplayPort) Drain() error { return nil }
+func (r *ReplayPort) ResetOutputBuffer() error { return nil }
+func (r *ReplayPort) SetDTR(dtr bool) error { return nil }
+func (r *ReplayPort) SetRTS(rts bool) error { return nil }
+func (r *ReplayPort) Close() error { return nil }
+func (r *ReplayPort) Break(t time.Duration) error { return nil }
+
+func (r *ReplayPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+    return &serial.ModemStatusBits{CTS: true, DSR: true}, nil
+}
+
+// CaptureDiff is a point where the Basys3 in a capture and the software
+// model disagree about what was sent back
+type CaptureDiff struct {
+    // index of the rx event in the capture
+    Event int
+    // offset of the event's first byte in the rx stream
+    Offset int
+    Expected []byte
+    Actual []byte
+}
+
+func (d CaptureDiff) String() string {
+    return fmt.Sprintf("event %d (rx byte %d): model sent %s, Basys3 sent %s", d.Event, d.Offset, hex.EncodeToString(d.Expected), hex.EncodeToString(d.Actual))
+}
+
+// DiffCapture feeds everything written in a capture to model and compares
+// what the model sends back with what the Basys3 sent. The model should be
+// in the state the Basys3 was in when the capture started (usually fresh)
+func DiffCapture(events []CaptureEvent, model *Basys3Model) ([]CaptureDiff, error) {
+    var diffs []CaptureDiff
+    err := model.SetReadTimeout(0)
+    if err != nil {
+        return nil, err
+    }
+    // everything the model sent that has not been matched to an rx event
+    var pending []byte
+    drain := func() {
+        buf := make([]byte, 256)
+        for {
+            n, _ := model.Read(buf)
+            if n == 0 {
+                return
+            }
+            pending = append(pending, buf[:n]...)
+        }
+    }
+    offset := 0
+    for i, event := range events {
+        data, err := event.Bytes()
+        if err != nil {
+            return nil, fmt.Errorf("event %d: %v", i, err)
+        }
+        if event.Dir == CAPTURE_TX {
+            _, err = model.Write(data)
+            if err != nil {
+                return nil, fmt.Errorf("event %d: %v", i, err)
+            }
+            continue
+        }
+        drain()
+        n := len(data)
+        if n > len(pending) {
+            n = len(pending)
+        }
+        expected := pending[:n]
+        pending = pending[n:]
+        if string(expected) != string(data) {
+            diffs = append(diffs, CaptureDiff{Event: i, Offset: offset, Expected: expected, Actual: data})
+        }
+        offset += len(data)
+    }
+    drain()
+    if len(pending) > 0 {
+        diffs = append(diffs, CaptureDiff{Event: len(events), Offset: offset, Expected: pending})
+    }
+    return diffs, nil
+}
+
+// captureProtocol guesses which protocol was spoken in a capture from the
+// first thing the Basys3 sent back
+func captureProtocol(events []CaptureEvent) Protocol {
+    for _, event := range events {
+        if event.Dir != CAPTURE_RX {
+            continue
+        }
+        data, _ := event.Bytes()
+        if len(data) >= 2 && data[0] == FRAME_MAGIC && data[1] == FRAME_VERSION {
+            return PROTOCOL_V2
+        }
+        return PROTOCOL_RAW
+    }
+    return PROTOCOL_RAW
+}
+
+// replayProtocol is what to replay a capture with. Auto when the capture
+// starts with the STATUS probe so the probe is sent again, otherwise the
+// protocol the Basys3 answered in
+func replayProtocol(events []CaptureEvent) Protocol {
+    for _, event := range events {
+        if event.Dir != CAPTURE_TX {
+            continue
+        }
+        data, _ := event.Bytes()
+        if bytes.HasPrefix(data, statusProbe()) {
+            return PROTOCOL_AUTO
+        }
+        break
+    }
+    return captureProtocol(events)
+}
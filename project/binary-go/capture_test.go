@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+func captureSession(t *testing.T, protocol Protocol) ([]CaptureEvent, []byte) {
+    path := filepath.Join(t.TempDir(), "capture.jsonl")
+    board := NewBasys3Model(protocol)
+    capture, err := NewCapturePort(board, path)
+    if err != nil {
+        t.Fatalf("NewCapturePort failed: %v", err)
+    }
+    baes := new(BAESys128)
+    baes.SetProtocol(protocol)
+    var port serial.Port = capture
+    baes.SetPort(&port)
+    baes.Negotiate()
+    err = baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    ct, err := baes.Encrypt([]byte("captured message"))
+    if err != nil {
+        t.Fatalf("Encrypt failed: %v", err)
+    }
+    capture.Close()
+    events, err := ReadCaptureFile(path)
+    if err != nil {
+        t.Fatalf("ReadCaptureFile failed: %v", err)
+    }
+    return events, ct
+}
+
+func TestReplayReproducesSession(t *testing.T) {
+    for _, protocol := range []Protocol{PROTOCOL_RAW, PROTOCOL_V2} {
+        events, ct := captureSession(t, protocol)
+        replay := NewReplayPort(events)
+        baes := new(BAESys128)
+        baes.SetProtocol(replayProtocol(events))
+        baes.SetPort(replay.Port())
+        if err := baes.Negotiate(); err != nil || baes.Protocol() != protocol {
+            t.Fatalf("%s: replay negotiated %s: %v", protocol, baes.Protocol(), err)
+        }
+        err := baes.SetKey([]byte("0123456789abcdef"))
+        if err != nil {
+            t.Fatalf("%s: SetKey on replay failed: %v", protocol, err)
+        }
+        replayed, err := baes.Encrypt([]byte("captured message"))
+        if err != nil {
+            t.Fatalf("%s: Encrypt on replay failed: %v", protocol, err)
+        }
+        if !bytes.Equal(ct, replayed) {
+            t.Errorf("%s: replay returned %x, capture had %x", protocol, replayed, ct)
+        }
+        if !replay.Done() {
+            t.Errorf("%s: replay did not use the whole capture", protocol)
+        }
+    }
+}
+
+// a capture that starts with the probe is replayed with the probe, anything
+// else with what the Basys3 answered in
+func TestReplayProtocol(t *testing.T) {
+    probed := []CaptureEvent{{Dir: CAPTURE_TX, Data: hex.EncodeToString(statusProbe())}}
+    if protocol := replayProtocol(probed); protocol != PROTOCOL_AUTO {
+        t.Errorf("expected %s for a probed capture, got %s", PROTOCOL_AUTO, protocol)
+    }
+    events, _ := captureSession(t, PROTOCOL_RAW)
+    if protocol := replayProtocol(events); protocol != PROTOCOL_RAW {
+        t.Errorf("expected %s for a raw capture, got %s", PROTOCOL_RAW, protocol)
+    }
+}
+
+func TestReplayDetectsDivergence(t *testing.T) {
+    events, _ := captureSession(t, PROTOCOL_RAW)
+    replay := NewReplayPort(events)
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(replay.Port())
+    baes.SetKey([]byte("0123456789abcdef"))
+    _, err := replay.Write([]byte("not the message!"))
+    if err == nil {
+        t.Errorf("replay accepted a write that is not in the capture")
+    }
+}
+
+func TestDiffCapture(t *testing.T) {
+    events, _ := captureSession(t, PROTOCOL_RAW)
+    diffs, err := DiffCapture(events, NewBasys3Model(captureProtocol(events)))
+    if err != nil {
+        t.Fatalf("DiffCapture failed: %v", err)
+    }
+    if len(diffs) != 0 {
+        t.Fatalf("untouched capture differs from model: %v", diffs)
+    }
+
+    // flip a bit in the last thing the Basys3 sent, like a trojan would
+    last := len(events) - 1
+    data, _ := events[last].Bytes()
+    data[0] ^= 0x80
+    events[last].Data = hex.EncodeToString(data)
+    diffs, err = DiffCapture(events, NewBasys3Model(PROTOCOL_RAW))
+    if err != nil {
+        t.Fatalf("DiffCapture failed: %v", err)
+    }
+    if len(diffs) != 1 || diffs[0].Event != last {
+        t.Errorf("expected one diff at event %d, got %v", last, diffs)
+    }
+}
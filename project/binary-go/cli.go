@@ -0,0 +1,980 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.bug.st/serial/enumerator"
+)
+
+const USAGE = `usage: %s <command> [flags] [args]
+
+commands:
+    serve                         run the web server (what happens without a command)
+    encrypt [-b | -l] key [file]  encrypt file, or stdin, like binary.py
+    decrypt [-b | -l] key [file]  decrypt what encrypt printed
+    encrypt -pass pass:text       encrypt or decrypt openssl enc -aes-128-cbc files,
+    decrypt -pass pass:text       see encrypt -h for -md, -pbkdf2 and -iter
+    encrypt -container armor key  wrap the ciphertext with its mode, padding and IV,
+                                  decrypt reads it back without being told
+    encrypt -master pass:text     take the key from the keystore, decrypt picks it by
+    decrypt -master pass:text     the container's key ID
+    keys list|create|import|...   manage the keystore, see keys -h
+    keygen [-mode m] [-bits n]    print a new key from crypto/rand, with its entropy
+    crack <ciphertext-hex>        recover the key from a trojan block, like derive.py
+    brute -pair pt:ct <pattern>   search the bytes of a key, or round key 10 with
+                                  -target k10, marked ?? in pattern
+    devices                       list serial ports and which are Basys3s
+
+run <command> -h for its flags
+`
+
+func main() {
+    args := os.Args[1:]
+    if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+        os.Exit(serve(args))
+    }
+    if args[0] == "serve" {
+        os.Exit(serve(args[1:]))
+    }
+    os.Exit(runCommand(args, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// runCommand runs every command but serve and returns the exit code: 0 on
+// success, 1 when the command failed and 2 when it was used wrong
+func runCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+    // the log is for the web UI. Commands only show it with -v
+    prev := log.Writer()
+    defer log.SetOutput(prev)
+    log.SetOutput(io.Discard)
+
+    switch args[0] {
+    case "encrypt":
+        return cmdCrypt("encrypt", args[1:], stdin, stdout, stderr)
+    case "decrypt":
+        return cmdCrypt("decrypt", args[1:], stdin, stdout, stderr)
+    case "keys":
+        return cmdKeys(args[1:], stdout, stderr)
+    case "keygen":
+        return cmdKeygen(args[1:], stdout, stderr)
+    case "crack":
+        return cmdCrack(args[1:], stdout, stderr)
+    case "brute":
+        return cmdBrute(args[1:], stdout, stderr)
+    case "devices":
+        return cmdDevices(args[1:], stdout, stderr)
+    case "help", "-h", "--help":
+        fmt.Fprintf(stdout, USAGE, os.Args[0])
+        return 0
+    }
+    fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+    fmt.Fprintf(stderr, USAGE, os.Args[0])
+    return 2
+}
+
+// DeviceFlags are the flags for finding and talking to a Basys3, shared by
+// every command that uses one
+type DeviceFlags struct {
+    protocol *string
+    capture *string
+    baud *int
+    baudStore *string
+    profile *string
+    profiles *string
+}
+
+func addDeviceFlags(flags *flag.FlagSet) DeviceFlags {
+    return DeviceFlags{
+        protocol: flags.String("protocol", "raw", "protocol spoken with the Basys3: raw, v2 or auto. auto sends a probe that a raw Basys3 loads as its key, so btnC has to be pressed before every key after it"),
+        capture: flags.String("capture", "", "record all Basys3 serial traffic to this file (JSON Lines)"),
+        baud: flags.Int("baud", 0, "baud rate of the Basys3, remembered for the board. 0 uses the remembered rate. Only a v2 Basys3 is detected, trying the remembered rate first, a raw one gets 9600 when nothing is remembered"),
+        baudStore: flags.String("baud-store", DefaultBaudStorePath(), "file remembering the baud rate of each Basys3. Empty to not remember"),
+        profile: flags.String("profile", TROJAN_PROFILE.Name, "wire format of the AES core on the Basys3"),
+        profiles: flags.String("profiles", "", "JSON file with more device profiles"),
+    }
+}
+
+// ProtocolSet reports whether -protocol was given, rather than defaulting
+// to raw
+func (d DeviceFlags) ProtocolSet(flags *flag.FlagSet) bool {
+    return flagSet(flags, "protocol")
+}
+
+// flagSet reports whether the flag name was given on the command line
+func flagSet(flags *flag.FlagSet, name string) bool {
+    set := false
+    flags.Visit(func(f *flag.Flag) {
+        set = set || f.Name == name
+    })
+    return set
+}
+
+// Load gives baes the protocol and profile picked by the flags
+func (d DeviceFlags) Load(baes *BAESys128) (Protocol, DeviceProfile, error) {
+    protocol, err := ParseProtocol(*d.protocol)
+    if err != nil {
+        return protocol, DeviceProfile{}, err
+    }
+    profiles, err := LoadProfiles(*d.profiles)
+    if err != nil {
+        return protocol, DeviceProfile{}, fmt.Errorf("Failed to load device profiles: %s", err)
+    }
+    profile, ok := profiles[*d.profile]
+    if !ok {
+        return protocol, profile, fmt.Errorf("Unknown device profile %q. Known profiles: %s", *d.profile, profileNames(profiles))
+    }
+    baes.SetProfile(profile)
+    baes.SetProtocol(protocol)
+    return protocol, profile, nil
+}
+
+// Connect connects baes to the first Basys3 found. Call Load first
+func (d DeviceFlags) Connect(baes *BAESys128) error {
+    store, err := LoadBaudStore(*d.baudStore)
+    if err != nil {
+        componentLog(COMPONENT_DEVICE).Warn("Failed to load remembered baud rates", errAttr(err))
+        store, _ = LoadBaudStore("")
+    }
+    baud := *d.baud
+    if baud == 0 {
+        baud = baes.Profile().Baud
+    }
+    return connectToBasys3(baes, *d.capture, baud, store)
+}
+
+func isBasys3(port *enumerator.PortDetails) bool {
+    return port.VID == "0403" && port.PID == "6010"
+}
+
+// lineWriter writes each block as a line of lower case hex, which is what
+// binary.py prints
+type lineWriter struct {
+    w io.Writer
+    partial []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+    l.partial = append(l.partial, p...)
+    for len(l.partial) >= BLOCK_SIZE {
+        _, err := fmt.Fprintln(l.w, hex.EncodeToString(l.partial[:BLOCK_SIZE]))
+        if err != nil {
+            return 0, err
+        }
+        l.partial = l.partial[BLOCK_SIZE:]
+    }
+    return len(p), nil
+}
+
+func (l *lineWriter) Close() error {
+    if len(l.partial) > 0 {
+        _, err := fmt.Fprintln(l.w, hex.EncodeToString(l.partial))
+        return err
+    }
+    return nil
+}
+
+type nopCloser struct {
+    io.Writer
+}
+
+func (nopCloser) Close() error {
+    return nil
+}
+
+// newlineCloser ends the output with a newline once the encoder under it
+// is flushed
+type newlineCloser struct {
+    io.WriteCloser
+    w io.Writer
+}
+
+func (n newlineCloser) Close() error {
+    err := n.WriteCloser.Close()
+    if err != nil {
+        return err
+    }
+    _, err = fmt.Fprintln(n.w)
+    return err
+}
+
+// outputWriter encodes what is written to it as format. Close it to flush
+func outputWriter(format string, w io.Writer) (io.WriteCloser, error) {
+    switch format {
+    case "lines":
+        return &lineWriter{w: w}, nil
+    case "raw":
+        return nopCloser{w}, nil
+    case ENCODING_HEX.Name:
+        return newlineCloser{nopCloser{hex.NewEncoder(w)}, w}, nil
+    case ENCODING_BASE64.Name:
+        return newlineCloser{base64.NewEncoder(base64.StdEncoding, w), w}, nil
+    case ENCODING_BASE64URL.Name:
+        return newlineCloser{base64.NewEncoder(base64.URLEncoding, w), w}, nil
+    }
+    return nil, fmt.Errorf("unknown output format %q. Known formats: lines, raw, hex, base64, base64url", format)
+}
+
+// filterReader drops the bytes skip says to, so encoded input can be
+// wrapped over lines
+type filterReader struct {
+    r io.Reader
+    skip func(byte) bool
+}
+
+func (f filterReader) Read(p []byte) (int, error) {
+    for {
+        n, err := f.r.Read(p)
+        kept := 0
+        for _, b := range p[:n] {
+            if !f.skip(b) {
+                p[kept] = b
+                kept++
+            }
+        }
+        if kept > 0 || err != nil {
+            return kept, err
+        }
+    }
+}
+
+func isSpace(b byte) bool {
+    return b == ' ' || b == '\n' || b == '\r' || b == '\t'
+}
+
+// inputReader decodes r from format as it is read. hex takes what
+// encrypt prints by default, one block a line
+func inputReader(format string, r io.Reader) (io.Reader, error) {
+    switch format {
+    case "raw":
+        return r, nil
+    case ENCODING_HEX.Name:
+        return hex.NewDecoder(filterReader{r, isSpace}), nil
+    case ENCODING_BASE64.Name:
+        return base64.NewDecoder(base64.StdEncoding, filterReader{r, isSpace}), nil
+    case ENCODING_BASE64URL.Name:
+        return base64.NewDecoder(base64.RawURLEncoding, filterReader{r, func(b byte) bool { return isSpace(b) || b == '=' }}), nil
+    }
+    return nil, fmt.Errorf("unknown input format %q. Known formats: raw, hex, base64, base64url", format)
+}
+
+// decodeKey decodes a key given on the command line. With the file
+// encoding arg is the path of a file holding the raw key
+func decodeKey(arg string, encoding string) ([]byte, error) {
+    key, err := decodeKeyBytes(arg, encoding)
+    if err != nil {
+        return nil, err
+    }
+    if msg := validate_key(key); msg != nil {
+        return nil, fmt.Errorf("%s", *msg)
+    }
+    return key, nil
+}
+
+// decodeKeyBytes is decodeKey for a key of any size
+func decodeKeyBytes(arg string, encoding string) ([]byte, error) {
+    enc, err := ParseEncoding(encoding)
+    if err != nil {
+        return nil, err
+    }
+    var key []byte
+    if enc.Name == ENCODING_FILE.Name {
+        key, err = os.ReadFile(arg)
+    } else {
+        key, err = enc.Decode(arg)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("key is not %s: %w", enc.Description, err)
+    }
+    return key, nil
+}
+
+func cmdCrypt(name string, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+    decrypt := name == "decrypt"
+    flags := flag.NewFlagSet(name, flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    flags.Usage = func() {
+        fmt.Fprintf(stderr, "usage: %s %s [-b | -l] [flags] key [file]\n", os.Args[0], name)
+        fmt.Fprintf(stderr, "       %s %s [-b | -l] -pass pass:text [flags] [file]\n", os.Args[0], name)
+        fmt.Fprintf(stderr, "       %s %s [-b | -l] -master pass:text [-key-name name] [flags] [file]\n", os.Args[0], name)
+        flags.PrintDefaults()
+    }
+    board := flags.Bool("b", false, "use the Basys3, taking the key as the first block like binary.py -b. Press the center button (btnC) before each run. decrypt only takes the profile from it, decrypting is done with the go AES")
+    library := flags.Bool("l", false, "use the go AES without the trojan")
+    keyEncoding := flags.String("key-encoding", ENCODING_HEX.Name, "encoding of the key: utf-8, hex, base64, base64url, or file to read it from a file")
+    in := flags.String("in", "", "encoding of the input: raw, hex, base64 or base64url (default raw, hex to decrypt without -pass)")
+    out := flags.String("out", "", "encoding of the output: lines (hex, a block a line like binary.py), raw, hex, base64 or base64url (default lines, raw to decrypt or with -pass)")
+    paddingFlag := flags.String("padding", PADDINGS[0].Name, "padding: pkcs7, iso7816, x923, zero or none")
+    ivFlag := flags.String("iv", "", "CBC with this IV in hex instead of ECB, like openssl enc -K key -iv iv")
+    pass := flags.String("pass", "", "read and write openssl enc -aes-128-cbc files (Salted__) with this password: pass:text, env:VAR or file:path")
+    md := flags.String("md", "sha256", "digest for the -pass key derivation: md5, sha1, sha256 or sha512")
+    pbkdf2 := flags.Bool("pbkdf2", false, "derive the -pass key with PBKDF2 instead of EVP_BytesToKey")
+    iter := flags.Int("iter", OPENSSL_PBKDF2_ITER, "PBKDF2 iterations, implies -pbkdf2")
+    saltFlag := flags.String("S", "", "salt in hex for -pass when encrypting, random by default. Unlike openssl 3 the header is still written")
+    containerFlag := flags.String("container", "", "encrypt into a self-describing container: binary or armor. decrypt recognizes either by itself")
+    modeFlag := flags.String("mode", "", "ecb or cbc for -container, cbc with -iv or a random IV (default ecb)")
+    keyID := flags.String("key-id", "", "name of the key to record in the -container")
+    kdf := flags.String("kdf", KDF_ARGON2ID, "key derivation for -pass with -container: argon2id, scrypt or pbkdf2-sha256")
+    keystorePath := flags.String("keystore", DefaultKeystorePath(), "keystore file for -master")
+    master := flags.String("master", "", "take the key from the keystore, unlocked with this master passphrase: pass:text, env:VAR or file:path. decrypt picks the key by the container's key ID, otherwise the selected key is used")
+    keyName := flags.String("key-name", "", "with -master, the stored key to use. It is the -container key ID unless -key-id says otherwise")
+    verbose := flags.Bool("v", false, "show the log on stderr")
+    device := addDeviceFlags(flags)
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    if *board == *library {
+        fmt.Fprintln(stderr, "use one of -b (Basys3) or -l (AES library)")
+        return 2
+    }
+    sealing := *containerFlag != ""
+    if sealing && (decrypt || (*containerFlag != "binary" && *containerFlag != "armor")) {
+        fmt.Fprintln(stderr, "-container is binary or armor, and only for encrypt. decrypt recognizes containers by itself")
+        return 2
+    }
+    if *modeFlag != "" && !sealing {
+        fmt.Fprintln(stderr, "-mode is for -container, use -iv for CBC without one")
+        return 2
+    }
+    if *master != "" && *pass != "" {
+        fmt.Fprintln(stderr, "use one of -pass (a passphrase for this file) or -master (a key from the keystore)")
+        return 2
+    }
+    if *keyName != "" && *master == "" {
+        fmt.Fprintln(stderr, "-key-name needs the keystore unlocked with -master")
+        return 2
+    }
+    inSet := *in != ""
+    positional := flags.Args()
+    if *pass != "" || *master != "" {
+        // the key comes from the password
+        positional = append([]string{""}, positional...)
+    }
+    if len(positional) < 1 || len(positional) > 2 {
+        flags.Usage()
+        return 2
+    }
+    if *verbose {
+        log.SetOutput(stderr)
+    }
+    if *in == "" {
+        *in = "raw"
+        if decrypt && *pass == "" {
+            *in = "hex"
+        }
+    }
+    if *out == "" {
+        *out = "lines"
+        if decrypt || *pass != "" || sealing {
+            *out = "raw"
+        }
+    }
+    if sealing && (*out == "lines" || (*containerFlag == "armor" && *out != "raw")) {
+        fmt.Fprintln(stderr, "-container armor is text already, and binary can not be split into lines")
+        return 2
+    }
+    var key, password, iv []byte
+    params := OpenSSLParams{Digest: *md, PBKDF2: *pbkdf2}
+    var err error
+    if *pass != "" {
+        flags.Visit(func(f *flag.Flag) {
+            if f.Name == "iter" {
+                params.PBKDF2, params.Iter = true, *iter
+            }
+        })
+        if *ivFlag != "" {
+            fmt.Fprintln(stderr, "-iv comes from the password with -pass")
+            return 2
+        }
+        password, err = ParsePassword(*pass)
+        if err == nil {
+            _, err = ParseDigest(*md)
+        }
+        if err == nil && *saltFlag != "" {
+            params.Salt, err = ENCODING_HEX.Decode(*saltFlag)
+            if err == nil && len(params.Salt) != OPENSSL_SALT_SIZE {
+                err = fmt.Errorf("salt is %d bytes but it must be %d bytes", len(params.Salt), OPENSSL_SALT_SIZE)
+            }
+        }
+    } else {
+        if *master == "" {
+            key, err = decodeKey(positional[0], *keyEncoding)
+        }
+        if err == nil && *ivFlag != "" {
+            iv, err = ENCODING_HEX.Decode(*ivFlag)
+            if err == nil && len(iv) != BLOCK_SIZE {
+                err = fmt.Errorf("IV is %d bytes but it must be %d bytes", len(iv), BLOCK_SIZE)
+            }
+        }
+    }
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    var store *Keystore
+    if *master != "" {
+        store, err = openKeystore(*keystorePath, *master)
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 1
+        }
+    }
+    padding, err := ParsePadding(*paddingFlag)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    mode := MODE_ECB
+    if *modeFlag != "" {
+        mode, err = ParseCipherMode(*modeFlag)
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 2
+        }
+    }
+    if sealing && iv != nil {
+        mode = MODE_CBC
+    }
+    src := stdin
+    if len(positional) == 2 && positional[1] != "-" {
+        file, err := os.Open(positional[1])
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 1
+        }
+        defer file.Close()
+        src = file
+    }
+    source := bufio.NewReader(src)
+    if peek, _ := source.Peek(len(CONTAINER_MAGIC)); decrypt && !inSet && bytes.Equal(peek, CONTAINER_MAGIC) {
+        // a binary container would not be hex
+        *in = "raw"
+    }
+    reader, err := inputReader(*in, source)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    var container *Container
+    if decrypt {
+        container, reader, err = readContainer(source, reader)
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 1
+        }
+    }
+    buffered := bufio.NewWriter(stdout)
+    defer buffered.Flush()
+    writer, err := outputWriter(*out, buffered)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    // -pass is openssl's format unless there is a container to put the
+    // key derivation in
+    openssl := *pass != "" && !sealing && container == nil
+    var stored StoredKey
+    if store != nil {
+        id := *keyName
+        if id == "" && container != nil {
+            id = container.KeyID
+        }
+        stored, err = store.Resolve(id)
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 1
+        }
+        key = stored.Key
+        if msg := validate_key(key); msg != nil {
+            fmt.Fprintf(stderr, "stored key %q does not fit the Basys3: %s\n", stored.Name, *msg)
+            return 1
+        }
+        if *keyID == "" {
+            *keyID = stored.Name
+        }
+    }
+    var seal *Container
+    if sealing {
+        seal = &Container{Version: CONTAINER_VERSION, KeySize: KEY_SIZE, Mode: mode, Padding: padding, IV: iv, KeyID: *keyID}
+        if mode == MODE_CBC && iv == nil {
+            iv = make([]byte, BLOCK_SIZE)
+            _, err = rand.Read(iv)
+            if err != nil {
+                fmt.Fprintln(stderr, err)
+                return 1
+            }
+            seal.IV = iv
+        }
+        if *pass != "" {
+            kdfParams, err := NewKDFParams(*kdf)
+            if err != nil {
+                fmt.Fprintln(stderr, err)
+                return 2
+            }
+            seal.KDF = &kdfParams
+        }
+    }
+    if container != nil {
+        componentLog(COMPONENT_CRYPTO).Info("Ciphertext is a container", "mode", container.Mode, "backend", container.Backend, "key_id", container.KeyID)
+        padding, iv = container.Padding, container.IV
+        if *pass != "" && container.KDF == nil {
+            fmt.Fprintln(stderr, "the container was not encrypted with a passphrase, give the key instead of -pass")
+            return 2
+        }
+        if *pass == "" && container.KDF != nil {
+            fmt.Fprintf(stderr, "the container was encrypted with a passphrase (%s), give it with -pass or give the key\n", container.KDF)
+        }
+    }
+    var kdfParams *KDFParams
+    if seal != nil {
+        kdfParams = seal.KDF
+    } else if container != nil && *pass != "" {
+        kdfParams = container.KDF
+    }
+    if kdfParams != nil {
+        key, err = kdfParams.DeriveKey(password)
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 1
+        }
+    }
+
+    baes := new(BAESys128)
+    if *library {
+        baes.SetProfile(REFERENCE_PROFILE)
+    } else {
+        _, _, err = device.Load(baes)
+        // decrypting never needs the Basys3, and sending it the key would
+        // cost a btnC press
+        if err == nil && !decrypt {
+            err = device.Connect(baes)
+        }
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 1
+        }
+    }
+    var stream func(dst io.Writer, src io.Reader, padding PaddingScheme, progress func(int64)) (StreamResult, error)
+    switch {
+    case openssl && decrypt:
+        stream = func(dst io.Writer, src io.Reader, _ PaddingScheme, progress func(int64)) (StreamResult, error) {
+            return baes.DecryptOpenSSL(dst, src, password, params, progress)
+        }
+    case openssl:
+        stream = func(dst io.Writer, src io.Reader, _ PaddingScheme, progress func(int64)) (StreamResult, error) {
+            return baes.EncryptOpenSSL(dst, src, password, params, progress)
+        }
+    case iv != nil && decrypt:
+        stream = func(dst io.Writer, src io.Reader, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+            return baes.DecryptCBCStream(dst, src, iv, padding, progress)
+        }
+    case iv != nil:
+        stream = func(dst io.Writer, src io.Reader, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+            return baes.EncryptCBCStream(dst, src, iv, padding, progress)
+        }
+    case decrypt:
+        stream = baes.DecryptStream
+    default:
+        stream = baes.EncryptStream
+    }
+    var armored *bytes.Buffer
+    if seal != nil {
+        seal.Backend = baes.Backend()
+        if *containerFlag == "armor" {
+            // the armor's base64 covers the header too so it is written
+            // all at once at the end
+            armored = &bytes.Buffer{}
+            writer = nopCloser{armored}
+        } else {
+            header, err := seal.MarshalHeader()
+            if err == nil {
+                _, err = writer.Write(header)
+            }
+            if err != nil {
+                fmt.Fprintln(stderr, err)
+                return 1
+            }
+        }
+    }
+    if !openssl {
+        err = baes.SetKey(key)
+        if err != nil {
+            fmt.Fprintln(stderr, error_message(err))
+            return 1
+        }
+    }
+    res, err := stream(writer, reader, padding, nil)
+    if err == nil {
+        err = writer.Close()
+    }
+    if err == nil && armored != nil {
+        seal.Ciphertext = armored.Bytes()
+        var text []byte
+        text, err = seal.Armor()
+        buffered.Write(text)
+    }
+    if err != nil {
+        buffered.Flush()
+        fmt.Fprintln(stderr, error_message(err))
+        return 1
+    }
+    if res.Mismatches > 0 {
+        fmt.Fprintf(stderr, "%d blocks from the Basys3 did not match the go AES\n", res.Mismatches)
+    }
+    if store != nil {
+        err = store.Touch(stored.Key)
+        if err != nil {
+            fmt.Fprintf(stderr, "failed to record the key use in the keystore: %s\n", err)
+        }
+    }
+    return 0
+}
+
+// openKeystore unlocks the keystore at path with the master passphrase
+// given like -pass
+func openKeystore(path string, master string) (*Keystore, error) {
+    if path == "" {
+        return nil, fmt.Errorf("there is no user config directory for the keystore, give its path with -keystore")
+    }
+    passphrase, err := ParsePassword(master)
+    if err != nil {
+        return nil, err
+    }
+    return OpenKeystore(path, passphrase)
+}
+
+// cmdKeys manages the keystore. Every change is saved right away
+func cmdKeys(args []string, stdout io.Writer, stderr io.Writer) int {
+    flags := flag.NewFlagSet("keys", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    flags.Usage = func() {
+        fmt.Fprintf(stderr, "usage: %s keys -master pass:text [flags] <command>\n\n", os.Args[0])
+        fmt.Fprintln(stderr, "    list              names, when they were made and last used, * is selected")
+        fmt.Fprintln(stderr, "    create name       store a new key made like keygen, see -mode and -bits")
+        fmt.Fprintln(stderr, "    import name key   store key, in -key-encoding. 128, 192 or 256 bits")
+        fmt.Fprintln(stderr, "    export name       print the key in -key-encoding")
+        fmt.Fprintln(stderr, "    delete name")
+        fmt.Fprintln(stderr, "    select name       the key encrypt -master uses when not given -key-name")
+        fmt.Fprintln(stderr)
+        flags.PrintDefaults()
+    }
+    path := flags.String("keystore", DefaultKeystorePath(), "keystore file, made on the first change")
+    master := flags.String("master", "", "master passphrase of the keystore: pass:text, env:VAR or file:path")
+    keyEncoding := flags.String("key-encoding", ENCODING_HEX.Name, "encoding of imported and exported keys: hex, utf-8 (ASCII), base64, base64url, or file to import from a file")
+    mode := flags.String("mode", KEYGEN_BYTES, "how create makes the key: bytes, printable or words")
+    bits := flags.Int("bits", KEY_SIZE*8, "size of the key create makes: 128, 192 or 256. Only 128 fits the Basys3")
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    size, err := ParseKeySize(*bits)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    positional := flags.Args()
+    arity := map[string]int{"list": 1, "create": 2, "import": 3, "export": 2, "delete": 2, "select": 2}
+    if len(positional) == 0 || arity[positional[0]] != len(positional) {
+        flags.Usage()
+        return 2
+    }
+    if *master == "" {
+        fmt.Fprintln(stderr, "give the master passphrase with -master pass:text, env:VAR or file:path")
+        return 2
+    }
+    var importKey []byte
+    if positional[0] == "import" {
+        importKey, err = decodeKeyBytes(positional[2], *keyEncoding)
+        if err != nil {
+            fmt.Fprintln(stderr, err)
+            return 2
+        }
+    }
+    store, err := openKeystore(*path, *master)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 1
+    }
+    switch positional[0] {
+    case "list":
+        table := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+        fmt.Fprintln(table, "NAME\tBITS\tENTROPY\tCREATED\tUSED")
+        for _, key := range store.Keys {
+            name := key.Name
+            if name == store.Selected {
+                name = "* " + name
+            }
+            fmt.Fprintf(table, "%s\t%d\t%s\t%s\t%s\n", name, len(key.Key)*8, format_entropy(key.Entropy), format_used(key.Created), format_used(key.Used))
+        }
+        table.Flush()
+    case "create":
+        var gen GeneratedKey
+        gen, err = store.Generate(positional[1], *mode, size)
+        if err == nil {
+            fmt.Fprintln(stderr, gen.Describe())
+            if gen.KDF != nil {
+                // the words are not stored, this is the only chance to
+                // write them down
+                fmt.Fprintln(stdout, gen.Text)
+            }
+        }
+    case "import":
+        err = store.Add(positional[1], importKey)
+    case "export":
+        var key StoredKey
+        key, err = store.Get(positional[1])
+        if err == nil {
+            var enc Encoding
+            enc, err = ParseEncoding(*keyEncoding)
+            if err == nil {
+                text, _ := EncodeText(enc, key.Key)
+                fmt.Fprintln(stdout, text)
+            }
+        }
+    case "delete":
+        err = store.Delete(positional[1])
+    case "select":
+        err = store.Select(positional[1])
+    }
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 1
+    }
+    return 0
+}
+
+// readContainer reads the container header at the start of the input, if
+// there is one, and returns the reader for the ciphertext after it. Armor
+// is looked for in the source since it is text whatever -in says, a binary
+// container in what -in decodes to
+func readContainer(source *bufio.Reader, decoded io.Reader) (*Container, io.Reader, error) {
+    armor := "-----BEGIN " + CONTAINER_ARMOR
+    if peek, _ := source.Peek(len(armor)); string(peek) == armor {
+        data, err := io.ReadAll(source)
+        if err != nil {
+            return nil, nil, err
+        }
+        c, err := ParseContainer(data)
+        if err != nil {
+            return nil, nil, err
+        }
+        return c, bytes.NewReader(c.Ciphertext), nil
+    }
+    buffered := bufio.NewReader(decoded)
+    if peek, _ := buffered.Peek(len(CONTAINER_MAGIC)); !bytes.Equal(peek, CONTAINER_MAGIC) {
+        return nil, buffered, nil
+    }
+    c, err := ReadContainerHeader(buffered)
+    return c, buffered, err
+}
+
+// cmdKeygen prints a new key on stdout and its entropy on stderr. A words
+// key prints the words and the key derivation, which is what -pass and the
+// passphrase field take, and the key itself with -key-encoding set
+func cmdKeygen(args []string, stdout io.Writer, stderr io.Writer) int {
+    flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    mode := flags.String("mode", KEYGEN_BYTES, "bytes (all 256 values), printable (ASCII without space) or words")
+    bits := flags.Int("bits", KEY_SIZE*8, "key size: 128, 192 or 256. Only 128 fits the Basys3")
+    kdf := flags.String("kdf", KDF_ARGON2ID, "key derivation for words: argon2id, scrypt or pbkdf2-sha256")
+    keyEncoding := flags.String("key-encoding", "", "encoding of the key: hex, utf-8, base64 or base64url (default hex, utf-8 for printable)")
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    if flags.NArg() != 0 {
+        flags.Usage()
+        return 2
+    }
+    size, err := ParseKeySize(*bits)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    gen, err := GenerateKey(*mode, size, *kdf)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    fmt.Fprintln(stderr, gen.Describe())
+    if gen.KDF != nil {
+        fmt.Fprintln(stdout, gen.Text)
+        fmt.Fprintln(stdout, gen.KDF)
+        if *keyEncoding == "" {
+            return 0
+        }
+    }
+    name := *keyEncoding
+    if name == "" {
+        name = ENCODING_HEX.Name
+        if gen.Mode == KEYGEN_PRINTABLE {
+            name = ENCODING_UTF8.Name
+        }
+    }
+    enc, err := ParseEncoding(name)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    text, _ := EncodeText(enc, gen.Key)
+    fmt.Fprintln(stdout, text)
+    return 0
+}
+
+// cmdCrack prints the key behind a block the trojan leaked, exactly like
+// derive.py
+func cmdCrack(args []string, stdout io.Writer, stderr io.Writer) int {
+    flags := flag.NewFlagSet("crack", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    rounds := flags.Bool("rounds", false, "also print the round keys, one a line")
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    ct, err := hex.DecodeString(flags.Arg(0))
+    if flags.NArg() != 1 || err != nil || len(ct) != BLOCK_SIZE {
+        fmt.Fprintln(stderr, "Include a 16 byte ciphertext (in hex) as first and only argument!")
+        return 2
+    }
+    key, roundKeys := CrackKey(ct)
+    fmt.Fprintln(stdout, hex.EncodeToString(key))
+    if *rounds {
+        for i, words := range roundKeys {
+            fmt.Fprintf(stdout, "K%d %08x%08x%08x%08x\n", i + 1, words[0], words[1], words[2], words[3])
+        }
+    }
+    return 0
+}
+
+// cmdBrute searches the unknown bytes of a key or round key 10 with every
+// core. Ctrl-C saves the search to -checkpoint and the same command picks
+// it back up
+func cmdBrute(args []string, stdout io.Writer, stderr io.Writer) int {
+    flags := flag.NewFlagSet("brute", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    target := flags.String("target", BRUTE_KEY, "what the pattern is: key, or k10 for the round key 10 a trojan leaked")
+    charset := flags.String("charset", KEYGEN_BYTES, "what an unknown byte can be: bytes, printable, legacy (gen_random_key's) or chars:<characters>")
+    keyEncoding := flags.String("key-encoding", ENCODING_HEX.Name, "pattern encoding: hex with ?? for unknown bytes, or utf-8 with ?")
+    pairs := []KnownPair{}
+    flags.Func("pair", "known plaintext:ciphertext blocks in hex, repeat for more", func(text string) error {
+        pair, err := ParseKnownPair(text)
+        if err == nil {
+            pairs = append(pairs, pair)
+        }
+        return err
+    })
+    workers := flags.Int("workers", 0, "goroutines searching (default one per core)")
+    interval := flags.Duration("progress", 2*time.Second, "how often to print progress and save the checkpoint")
+    checkpoint := flags.String("checkpoint", "", "file to save the search to and resume it from")
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    if flags.NArg() != 1 || len(pairs) == 0 {
+        fmt.Fprintln(stderr, "Include the pattern as the only argument and at least one -pair")
+        return 2
+    }
+    set, err := ParseCharset(*charset)
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    var space Keyspace
+    switch *keyEncoding {
+    case ENCODING_HEX.Name:
+        space, err = ParseKeyspace(flags.Arg(0), set)
+    case ENCODING_UTF8.Name:
+        space, err = ParseTextKeyspace(flags.Arg(0), set)
+    default:
+        err = fmt.Errorf("-key-encoding must be hex or utf-8, not %q", *keyEncoding)
+    }
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    total, err := space.Size()
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 2
+    }
+    fmt.Fprintf(stderr, "%d unknown bytes, %d candidates\n", space.Unknown(), total)
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    brute := BruteForce{
+        Target: *target,
+        Space: space,
+        Pairs: pairs,
+        Workers: *workers,
+        Interval: *interval,
+        Checkpoint: *checkpoint,
+    }
+    started := false
+    brute.Progress = func(p BruteForceProgress) {
+        if !started && brute.Resumed > 0 {
+            fmt.Fprintf(stderr, "resumed from candidate %d\n", brute.Resumed)
+        }
+        started = true
+        fmt.Fprintln(stderr, p)
+    }
+    res, err := brute.Run(ctx)
+    switch {
+    case errors.Is(err, context.Canceled) && *checkpoint != "":
+        fmt.Fprintf(stderr, "stopped, run the same command to resume from %s\n", *checkpoint)
+        return 1
+    case err != nil:
+        fmt.Fprintln(stderr, err)
+        return 1
+    }
+    fmt.Fprintln(stdout, hex.EncodeToString(res.Key))
+    if *target == BRUTE_K10 {
+        fmt.Fprintf(stdout, "K10 %s\n", hex.EncodeToString(res.K10))
+    }
+    return 0
+}
+
+func cmdDevices(args []string, stdout io.Writer, stderr io.Writer) int {
+    flags := flag.NewFlagSet("devices", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    baudStore := flags.String("baud-store", DefaultBaudStorePath(), "file remembering the baud rate of each Basys3")
+    if flags.Parse(args) != nil {
+        return 2
+    }
+    ports, err := enumerator.GetDetailedPortsList()
+    if err != nil {
+        fmt.Fprintln(stderr, err)
+        return 1
+    }
+    store, err := LoadBaudStore(*baudStore)
+    if err != nil {
+        fmt.Fprintf(stderr, "Failed to load remembered baud rates: %s\n", err)
+        store, _ = LoadBaudStore("")
+    }
+    if len(ports) == 0 {
+        fmt.Fprintln(stderr, "no serial ports found")
+        return 1
+    }
+    table := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(table, "PORT\tVID:PID\tSERIAL\tDEVICE")
+    for _, port := range ports {
+        device := ""
+        if isBasys3(port) {
+            device = "Basys3"
+            if baud, ok := store.Get(port.SerialNumber); ok {
+                device = fmt.Sprintf("Basys3, %d baud", baud)
+            }
+        }
+        fmt.Fprintf(table, "%s\t%s:%s\t%s\t%s\n", port.Name, port.VID, port.PID, port.SerialNumber, device)
+    }
+    table.Flush()
+    return 0
+}
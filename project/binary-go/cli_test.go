@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runCLI(t *testing.T, stdin string, args ...string) (string, string, int) {
+    var stdout, stderr bytes.Buffer
+    code := runCommand(args, strings.NewReader(stdin), &stdout, &stderr)
+    return stdout.String(), stderr.String(), code
+}
+
+// what binary.py -l prints: every block, PKCS#7 padded, as a line of hex
+func binaryPy(key []byte, data []byte) string {
+    cipher, _ := aes.NewCipher(key)
+    padded := pkcs7Pad(append([]byte{}, data...))
+    out := ""
+    for i := 0; i < len(padded); i += BLOCK_SIZE {
+        block := make([]byte, BLOCK_SIZE)
+        cipher.Encrypt(block, padded[i:i + BLOCK_SIZE])
+        out += hex.EncodeToString(block) + "\n"
+    }
+    return out
+}
+
+func TestEncryptMatchesBinaryPy(t *testing.T) {
+    key := "00112233445566778899aabbccddeeff"
+    for _, msg := range []string{"", "a", "exactly 16 bytes", "hello world, this is more than a block"} {
+        path := filepath.Join(t.TempDir(), "in")
+        os.WriteFile(path, []byte(msg), 0o644)
+        stdout, stderr, code := runCLI(t, "", "encrypt", "-l", key, path)
+        if code != 0 {
+            t.Fatalf("exit %d: %s", code, stderr)
+        }
+        if expected := binaryPy(mustHex(key), []byte(msg)); stdout != expected {
+            t.Errorf("%q: expected\n%s got\n%s", msg, expected, stdout)
+        }
+        // and the same from stdin
+        stdin, _, _ := runCLI(t, msg, "encrypt", "-l", key)
+        if stdin != stdout {
+            t.Errorf("%q: stdin gave\n%s file gave\n%s", msg, stdin, stdout)
+        }
+    }
+}
+
+// outputs of derive.py for the same ciphertexts
+func TestCrackMatchesDerivePy(t *testing.T) {
+    cases := map[string]string{
+        "c883567d548300d48584ddd707f2657f": "2e61362c4d412f634d6178614d416161",
+        "00112233445566778899aabbccddeeff": "da05276e00a896a3716ca925e14caeef",
+    }
+    for ct, key := range cases {
+        stdout, stderr, code := runCLI(t, "", "crack", ct)
+        if code != 0 || stdout != key + "\n" {
+            t.Errorf("%s: expected %s, got %q %q %d", ct, key, stdout, stderr, code)
+        }
+    }
+    _, stderr, code := runCLI(t, "", "crack", "abcd")
+    if code != 2 || !strings.Contains(stderr, "16 byte ciphertext") {
+        t.Errorf("expected derive.py's complaint, got %q %d", stderr, code)
+    }
+}
+
+// the trojan leaks a block that crack turns back into the key
+func TestCrackTrojanOutput(t *testing.T) {
+    key := []byte("0123456789abcdef")
+    trojan, _ := NewAES(key)
+    trojan.trojanCount = TROJAN_COUNT - 1
+    leak := trojan.Encrypt(TROJAN_ACTIVATE_MASK[:])
+    stdout, _, _ := runCLI(t, "", "crack", hex.EncodeToString(leak))
+    if stdout != hex.EncodeToString(key) + "\n" {
+        t.Errorf("expected %x, got %s", key, stdout)
+    }
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+    key := "MDEyMzQ1Njc4OWFiY2RlZg=="
+    msg := "round and round it goes"
+    for _, format := range []string{"lines", "hex", "base64", "base64url", "raw"} {
+        in := format
+        if format == "lines" {
+            in = "hex"
+        }
+        ct, stderr, code := runCLI(t, msg, "encrypt", "-l", "-key-encoding", "base64", "-out", format, key)
+        if code != 0 {
+            t.Fatalf("%s: exit %d %s", format, code, stderr)
+        }
+        pt, stderr, code := runCLI(t, ct, "decrypt", "-l", "-key-encoding", "base64", "-in", in, key)
+        if code != 0 || pt != msg {
+            t.Errorf("%s: expected %q, got %q %s", format, msg, pt, stderr)
+        }
+    }
+}
+
+func TestCLIUsageErrors(t *testing.T) {
+    cases := [][]string{
+        {"encrypt", "00112233445566778899aabbccddeeff"},
+        {"encrypt", "-b", "-l", "00112233445566778899aabbccddeeff"},
+        {"encrypt", "-l", "0011"},
+        {"encrypt", "-l", "-out", "morse", "00112233445566778899aabbccddeeff"},
+        {"decrypt", "-l"},
+        {"frobnicate"},
+    }
+    for _, args := range cases {
+        _, stderr, code := runCLI(t, "", args...)
+        if code != 2 || stderr == "" {
+            t.Errorf("%v: expected a usage error, got %d %q", args, code, stderr)
+        }
+    }
+    _, stderr, code := runCLI(t, "not hex", "decrypt", "-l", "00112233445566778899aabbccddeeff")
+    if code != 1 || stderr == "" {
+        t.Errorf("expected bad ciphertext to fail, got %d %q", code, stderr)
+    }
+}
+
+// auto loads its probe as the key of a raw Basys3, so it has to be asked for
+func TestDeviceFlagsDefaultToRaw(t *testing.T) {
+    for _, args := range [][]string{nil, {"-protocol", "auto"}} {
+        flags := flag.NewFlagSet("test", flag.ContinueOnError)
+        device := addDeviceFlags(flags)
+        flags.Parse(args)
+        protocol, _, err := device.Load(new(BAESys128))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if set := device.ProtocolSet(flags); set != (args != nil) {
+            t.Errorf("%v: ProtocolSet is %t", args, set)
+        }
+        if args == nil && protocol != PROTOCOL_RAW {
+            t.Errorf("default protocol is %s", protocol)
+        }
+    }
+}
+
+// decrypt -b takes the profile from the flags but never needs the Basys3,
+// so it works without one connected
+func TestDecryptBoardWithoutDevice(t *testing.T) {
+    key := []byte("0123456789abcdef")
+    aes, _ := TROJAN_PROFILE.NewAES(key)
+    ct := aes.EncryptECB(pkcs7Pad([]byte("no board needed")))
+    pt, stderr, code := runCLI(t, hex.EncodeToString(ct), "decrypt", "-b", "-key-encoding", "utf-8", string(key))
+    if code != 0 || pt != "no board needed" {
+        t.Errorf("expected the plaintext, got %q exit %d %s", pt, code, stderr)
+    }
+}
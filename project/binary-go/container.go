@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A container is ciphertext with everything needed to decrypt it again but
+// the key. Version 1 is, all lengths in bytes:
+//
+//   magic        4  "BAES"
+//   version      1  1
+//   algorithm    1  1 for AES
+//   key size     1  16
+//   mode         1  1 ECB, 2 CBC
+//   padding      1  see CONTAINER_PADDINGS
+//   backend      1  what encrypted it, see Backend
+//   IV           1 + n  length then IV, empty for ECB
+//   tag          1 + n  length then tag, empty until there is an AEAD mode
+//   key ID       1 + n  length then UTF-8 name of the key, may be empty
+//   KDF          2 + n  big endian length then KDFParams.String, empty
+//                       unless the key came from a passphrase
+//   ciphertext   the rest
+//
+// The header does not say how long the ciphertext is so it can be written
+// before the ciphertext is streamed out
+var CONTAINER_MAGIC = []byte("BAES")
+
+const CONTAINER_VERSION = 1
+
+// CONTAINER_ARMOR is the PEM type of an armored container. The PEM headers
+// repeat the header fields for people, only the base64 body is read back
+const CONTAINER_ARMOR = "BAES CIPHERTEXT"
+
+const CONTAINER_AES = 1
+
+// How the UI shows ciphertext: bare blocks, a container in the ciphertext
+// encoding, or an armored container
+const (
+    FORMAT_BARE = "bare"
+    FORMAT_CONTAINER = "container"
+    FORMAT_ARMORED = "armored"
+)
+
+var ErrInvalidContainer = errors.New("invalid ciphertext container")
+
+type CipherMode byte
+
+const (
+    MODE_ECB CipherMode = 1
+    MODE_CBC CipherMode = 2
+)
+
+func (m CipherMode) String() string {
+    switch m {
+    case MODE_ECB:
+        return "ecb"
+    case MODE_CBC:
+        return "cbc"
+    }
+    return fmt.Sprintf("mode %d", byte(m))
+}
+
+func ParseCipherMode(name string) (CipherMode, error) {
+    switch strings.ToLower(name) {
+    case "ecb":
+        return MODE_ECB, nil
+    case "cbc":
+        return MODE_CBC, nil
+    }
+    return 0, fmt.Errorf("unknown mode %q. Known modes: ecb, cbc", name)
+}
+
+// Backend is what did the encrypting
+type Backend byte
+
+const (
+    BACKEND_SOFTWARE Backend = 0
+    BACKEND_BASYS3_RAW Backend = 1
+    BACKEND_BASYS3_V2 Backend = 2
+)
+
+func (b Backend) String() string {
+    switch b {
+    case BACKEND_SOFTWARE:
+        return "go AES"
+    case BACKEND_BASYS3_RAW:
+        return "Basys3 (raw)"
+    case BACKEND_BASYS3_V2:
+        return "Basys3 (v2)"
+    }
+    return fmt.Sprintf("backend %d", byte(b))
+}
+
+func (s *BAESys128) Backend() Backend {
+    switch {
+    case s.port == nil:
+        return BACKEND_SOFTWARE
+    case s.protocol == PROTOCOL_V2:
+        return BACKEND_BASYS3_V2
+    }
+    return BACKEND_BASYS3_RAW
+}
+
+// CONTAINER_PADDINGS are the padding IDs in a container. They are fixed,
+// unlike the order of PADDINGS
+var CONTAINER_PADDINGS = []PaddingScheme{PADDING_NONE, PADDING_PKCS7, PADDING_ISO7816, PADDING_X923, PADDING_ZERO}
+
+func paddingID(padding PaddingScheme) (byte, error) {
+    for id, p := range CONTAINER_PADDINGS {
+        if p.Name == padding.Name {
+            return byte(id), nil
+        }
+    }
+    return 0, fmt.Errorf("%w: padding %s has no ID", ErrInvalidContainer, padding.Name)
+}
+
+type Container struct {
+    Version byte
+    KeySize int
+    Mode CipherMode
+    Padding PaddingScheme
+    Backend Backend
+    IV []byte
+    Tag []byte
+    KeyID string
+    // nil unless the key was derived from a passphrase
+    KDF *KDFParams
+    Ciphertext []byte
+}
+
+// MarshalHeader is the container up to the ciphertext
+func (c *Container) MarshalHeader() ([]byte, error) {
+    padding, err := paddingID(c.Padding)
+    if err != nil {
+        return nil, err
+    }
+    kdf := ""
+    if c.KDF != nil {
+        kdf = c.KDF.String()
+    }
+    for _, field := range []struct {
+        name string
+        len int
+        max int
+    }{{"IV", len(c.IV), 255}, {"tag", len(c.Tag), 255}, {"key ID", len(c.KeyID), 255}, {"KDF", len(kdf), 65535}} {
+        if field.len > field.max {
+            return nil, fmt.Errorf("%w: %s is %d bytes, at most %d fit", ErrInvalidContainer, field.name, field.len, field.max)
+        }
+    }
+    out := append([]byte{}, CONTAINER_MAGIC...)
+    out = append(out, CONTAINER_VERSION, CONTAINER_AES, byte(c.KeySize), byte(c.Mode), padding, byte(c.Backend))
+    out = append(append(out, byte(len(c.IV))), c.IV...)
+    out = append(append(out, byte(len(c.Tag))), c.Tag...)
+    out = append(append(out, byte(len(c.KeyID))), c.KeyID...)
+    out = binary.BigEndian.AppendUint16(out, uint16(len(kdf)))
+    return append(out, kdf...), nil
+}
+
+func (c *Container) MarshalBinary() ([]byte, error) {
+    header, err := c.MarshalHeader()
+    if err != nil {
+        return nil, err
+    }
+    return append(header, c.Ciphertext...), nil
+}
+
+// Armor is the container as PEM
+func (c *Container) Armor() ([]byte, error) {
+    data, err := c.MarshalBinary()
+    if err != nil {
+        return nil, err
+    }
+    headers := map[string]string{
+        "Version": fmt.Sprint(CONTAINER_VERSION),
+        "Cipher": fmt.Sprintf("AES-%d-%s", c.KeySize*8, strings.ToUpper(c.Mode.String())),
+        "Padding": c.Padding.Name,
+        "Backend": c.Backend.String(),
+    }
+    if c.KeyID != "" {
+        headers["Key-ID"] = c.KeyID
+    }
+    return pem.EncodeToMemory(&pem.Block{Type: CONTAINER_ARMOR, Headers: headers, Bytes: data}), nil
+}
+
+// IsContainer is whether data looks like a container, binary or armored,
+// rather than bare ciphertext
+func IsContainer(data []byte) bool {
+    return bytes.HasPrefix(data, CONTAINER_MAGIC) || bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN " + CONTAINER_ARMOR))
+}
+
+// ParseContainer reads a binary or armored container
+func ParseContainer(data []byte) (*Container, error) {
+    if !bytes.HasPrefix(data, CONTAINER_MAGIC) {
+        block, _ := pem.Decode(bytes.TrimSpace(data))
+        if block == nil || block.Type != CONTAINER_ARMOR {
+            return nil, fmt.Errorf("%w: not a container or %s armor", ErrInvalidContainer, CONTAINER_ARMOR)
+        }
+        data = block.Bytes
+    }
+    r := bytes.NewReader(data)
+    c, err := ReadContainerHeader(r)
+    if err != nil {
+        return nil, err
+    }
+    c.Ciphertext = data[len(data) - r.Len():]
+    return c, nil
+}
+
+// ReadContainerHeader reads a binary container up to the ciphertext, which
+// is left in r
+func ReadContainerHeader(r io.Reader) (*Container, error) {
+    read := func(n int) ([]byte, error) {
+        buf := make([]byte, n)
+        _, err := io.ReadFull(r, buf)
+        if err != nil {
+            return nil, fmt.Errorf("%w: header cut short", ErrInvalidContainer)
+        }
+        return buf, nil
+    }
+    fixed, err := read(len(CONTAINER_MAGIC) + 6)
+    if err != nil {
+        return nil, err
+    }
+    if !bytes.Equal(fixed[:len(CONTAINER_MAGIC)], CONTAINER_MAGIC) {
+        return nil, fmt.Errorf("%w: does not start with %s", ErrInvalidContainer, CONTAINER_MAGIC)
+    }
+    fixed = fixed[len(CONTAINER_MAGIC):]
+    c := &Container{Version: fixed[0], KeySize: int(fixed[2]), Mode: CipherMode(fixed[3]), Backend: Backend(fixed[5])}
+    if c.Version != CONTAINER_VERSION {
+        return nil, fmt.Errorf("%w: version %d, only version %d is supported", ErrInvalidContainer, c.Version, CONTAINER_VERSION)
+    }
+    if fixed[1] != CONTAINER_AES || c.KeySize != KEY_SIZE {
+        return nil, fmt.Errorf("%w: algorithm %d with a %d byte key, only AES-128 is supported", ErrInvalidContainer, fixed[1], c.KeySize)
+    }
+    if c.Mode != MODE_ECB && c.Mode != MODE_CBC {
+        return nil, fmt.Errorf("%w: unknown %s", ErrInvalidContainer, c.Mode)
+    }
+    if int(fixed[4]) >= len(CONTAINER_PADDINGS) {
+        return nil, fmt.Errorf("%w: unknown padding %d", ErrInvalidContainer, fixed[4])
+    }
+    c.Padding = CONTAINER_PADDINGS[fixed[4]]
+    field := func(lenSize int) ([]byte, error) {
+        n, err := read(lenSize)
+        if err != nil {
+            return nil, err
+        }
+        length := int(n[0])
+        if lenSize == 2 {
+            length = int(binary.BigEndian.Uint16(n))
+        }
+        if length == 0 {
+            // nil like the zero value, an ECB IV is nil not empty
+            return nil, nil
+        }
+        return read(length)
+    }
+    if c.IV, err = field(1); err != nil {
+        return nil, err
+    }
+    if c.Tag, err = field(1); err != nil {
+        return nil, err
+    }
+    keyID, err := field(1)
+    if err != nil {
+        return nil, err
+    }
+    c.KeyID = string(keyID)
+    kdf, err := field(2)
+    if err != nil {
+        return nil, err
+    }
+    if len(kdf) > 0 {
+        params, err := ParseKDFParams(string(kdf))
+        if err != nil {
+            return nil, fmt.Errorf("%w: %w", ErrInvalidContainer, err)
+        }
+        c.KDF = &params
+    }
+    if c.Mode == MODE_CBC && len(c.IV) != BLOCK_SIZE {
+        return nil, fmt.Errorf("%w: CBC with a %d byte IV", ErrInvalidContainer, len(c.IV))
+    }
+    return c, nil
+}
+
+// SealOptions say how Seal encrypts. The zero value is ECB with the
+// server's padding
+type SealOptions struct {
+    Mode CipherMode
+    // nil for the server's padding
+    Padding *PaddingScheme
+    // for CBC, random when nil
+    IV []byte
+    KeyID string
+    KDF *KDFParams
+}
+
+// Seal encrypts msg into a container. The result says which blocks the
+// Basys3 got right, like EncryptWithPadding
+func (s *BAESys128) Seal(msg []byte, opts SealOptions) (*Container, EncryptResult, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    c := &Container{Version: CONTAINER_VERSION, KeySize: KEY_SIZE, Mode: opts.Mode, Padding: s.Padding(), Backend: s.Backend(), KeyID: opts.KeyID, KDF: opts.KDF}
+    if c.Mode == 0 {
+        c.Mode = MODE_ECB
+    }
+    if opts.Padding != nil {
+        c.Padding = *opts.Padding
+    }
+    var res EncryptResult
+    var err error
+    switch c.Mode {
+    case MODE_ECB:
+        res, err = s.encryptWithPadding(msg, c.Padding)
+    case MODE_CBC:
+        c.IV = opts.IV
+        if c.IV == nil {
+            c.IV = make([]byte, BLOCK_SIZE)
+            _, err = rand.Read(c.IV)
+            if err != nil {
+                return nil, res, err
+            }
+        }
+        res, err = s.encryptCBC(msg, c.IV, c.Padding)
+    default:
+        return nil, res, fmt.Errorf("unknown %s", c.Mode)
+    }
+    c.Ciphertext = res.Ciphertext
+    return c, res, err
+}
+
+// encryptCBC is EncryptWithPadding in CBC mode. Blocks are verified before
+// they are chained so a mismatch is reported against the right block
+func (s *BAESys128) encryptCBC(msg []byte, iv []byte, padding PaddingScheme) (EncryptResult, error) {
+    var res EncryptResult
+    if s.aes == nil {
+        return res, fmt.Errorf("no key set")
+    }
+    if len(iv) != BLOCK_SIZE {
+        return res, fmt.Errorf("IV is %d bytes but it must be %d bytes", len(iv), BLOCK_SIZE)
+    }
+    padded, err := padding.Pad(msg)
+    if err != nil {
+        return res, err
+    }
+    prev := iv
+    for i := 0; i < len(padded); i += BLOCK_SIZE {
+        block := xorBlocks(padded[i:i + BLOCK_SIZE], prev)
+        actual, expected, err := s.encryptBlock(block)
+        if err != nil {
+            return res, err
+        }
+        res.Ciphertext = append(res.Ciphertext, actual...)
+        res.Blocks = append(res.Blocks, s.verifyBlock(i / BLOCK_SIZE, block, expected, actual))
+        prev = actual
+    }
+    return res, nil
+}
+
+// Open decrypts a container with the current key, using the container's
+// mode, padding and IV rather than the server's
+func (s *BAESys128) Open(c *Container) ([]byte, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    return s.open(c)
+}
+
+func (s *BAESys128) open(c *Container) ([]byte, error) {
+    s.log(COMPONENT_CRYPTO).Info("Opening container", "mode", c.Mode, "padding", c.Padding.Name, "backend", c.Backend, ATTR_BYTES, len(c.Ciphertext))
+    if c.Mode == MODE_ECB {
+        return s.decryptWithPadding(c.Ciphertext, c.Padding)
+    }
+    if len(c.Ciphertext) == 0 || len(c.Ciphertext) % BLOCK_SIZE != 0 {
+        return nil, fmt.Errorf("ciphertext is %d bytes, not a whole number of blocks", len(c.Ciphertext))
+    }
+    if len(c.IV) != BLOCK_SIZE {
+        return nil, fmt.Errorf("IV is %d bytes but it must be %d bytes", len(c.IV), BLOCK_SIZE)
+    }
+    pt := make([]byte, 0, len(c.Ciphertext))
+    prev := c.IV
+    for i := 0; i < len(c.Ciphertext); i += BLOCK_SIZE {
+        block := c.Ciphertext[i:i + BLOCK_SIZE]
+        decrypted, err := s.decryptBlock(block)
+        if err != nil {
+            return nil, err
+        }
+        pt = append(pt, xorBlocks(decrypted, prev)...)
+        prev = block
+    }
+    return c.Padding.Unpad(pt)
+}
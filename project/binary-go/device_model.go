@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Basys3Model is a software stand-in for the Basys3. It implements
+// serial.Port so it can be handed to BAESys128.SetPort and speaks either
+// the raw protocol like trojan_top or the framed v2 protocol. Encryption is
+// done with the go AES so the trojan behaves like it does on the board.
+// Blocks are reversed on the wire in both protocols, just like the 128 bit
+// register on the Basys3 expects
+type Basys3Model struct {
+    protocol Protocol
+    // wire format of the raw protocol
+    profile DeviceProfile
+    fixedKey []byte
+    aes *AES
+    // decrypt every raw block instead of encrypting it, like a bitstream
+    // built with the wrong mode
+    decrypt bool
+    // the rate the board was flashed with and the rate the host port is
+    // set to. Bytes sent at the wrong rate are lost. 0 matches anything
+    baud int
+    hostBaud int
+    in []byte
+    // out can be read now, delayed is still on the wire
+    out []byte
+    delayed []modelChunk
+    readTimeout time.Duration
+    // time to send one byte over the UART and the USB latency on top of
+    // every transfer. Zero means bytes arrive instantly
+    byteTime time.Duration
+    latency time.Duration
+    // when the last byte written has arrived at the board and when the board
+    // will be done sending what it has already been asked to send
+    arrival time.Time
+    rxFree time.Time
+    txFree time.Time
+    closed bool
+    mtx sync.Mutex
+    // signalled whenever out grows so blocked reads can wake up
+    ready chan struct{}
+}
+
+func NewBasys3Model(protocol Protocol) *Basys3Model {
+    if protocol == PROTOCOL_AUTO {
+        panic("Basys3Model needs a concrete protocol")
+    }
+    return &Basys3Model{
+        protocol: protocol,
+        profile: TROJAN_PROFILE,
+        readTimeout: serial.NoTimeout,
+        ready: make(chan struct{}, 1),
+    }
+}
+
+type modelChunk struct {
+    data []byte
+    readyAt time.Time
+}
+
+// SetTiming makes the model behave like it is on the other end of a real
+// UART running at baud with latency added to every transfer, so it is as
+// slow as the Basys3. A baud of 0 turns the delays off
+func (m *Basys3Model) SetTiming(baud int, latency time.Duration) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.byteTime = 0
+    if baud > 0 {
+        // start bit, 8 data bits, stop bit
+        m.byteTime = 10 * time.Second / time.Duration(baud)
+    }
+    m.latency = latency
+}
+
+// send queues data to be read, delayed by however long it would take the
+// board to get it onto the wire
+func (m *Basys3Model) send(data []byte) {
+    if m.byteTime == 0 && m.latency == 0 {
+        m.out = append(m.out, data...)
+        return
+    }
+    start := m.arrival
+    if m.txFree.After(start) {
+        start = m.txFree
+    }
+    m.txFree = start.Add(time.Duration(len(data)) * m.byteTime)
+    m.delayed = append(m.delayed, modelChunk{data: data, readyAt: m.txFree.Add(m.latency)})
+}
+
+// Port wraps the model up the way BAESys128.SetPort wants it
+func (m *Basys3Model) Port() *serial.Port {
+    var port serial.Port = m
+    return &port
+}
+
+// SetDecrypt makes the raw protocol decrypt blocks after the key instead
+// of encrypting them. Only useful for testing the self test
+func (m *Basys3Model) SetDecrypt(decrypt bool) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.decrypt = decrypt
+}
+
+// SetProfile makes the Basys3 use the wire format of profile, the byte
+// order of v2 payloads included.
+// Profiles with a fixed key also need SetFixedKey
+func (m *Basys3Model) SetProfile(profile DeviceProfile) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.profile = profile
+    m.aes = nil
+}
+
+// SetFixedKey "flashes" a bitstream with key baked in
+func (m *Basys3Model) SetFixedKey(key []byte) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.fixedKey = key
+    m.aes, _ = m.profile.NewAES(key)
+}
+
+// SetBaud sets the rate the model was "flashed" with
+func (m *Basys3Model) SetBaud(baud int) {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.baud = baud
+}
+
+// PressReset does what pressing the center button (btnC) does. The key is
+// forgotten and anything half received or not yet read is dropped
+func (m *Basys3Model) PressReset() {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.aes = nil
+    if m.fixedKey != nil {
+        m.aes, _ = m.profile.NewAES(m.fixedKey)
+    }
+    m.in = nil
+    m.out = nil
+    m.delayed = nil
+}
+
+func (m *Basys3Model) Write(p []byte) (int, error) {
+    m.mtx.Lock()
+    if m.closed {
+        m.mtx.Unlock()
+        return 0, fmt.Errorf("port closed")
+    }
+    if m.baud != 0 && m.hostBaud != 0 && m.baud != m.hostBaud {
+        // framing errors. A real board may see garbage instead
+        m.mtx.Unlock()
+        return len(p), nil
+    }
+    m.in = append(m.in, p...)
+    if m.byteTime != 0 || m.latency != 0 {
+        start := time.Now().Add(m.latency)
+        if m.rxFree.After(start) {
+            start = m.rxFree
+        }
+        m.rxFree = start.Add(time.Duration(len(p)) * m.byteTime)
+        m.arrival = m.rxFree
+    }
+    if m.protocol == PROTOCOL_V2 {
+        m.processFrames()
+    } else {
+        m.processBlocks()
+    }
+    m.mtx.Unlock()
+    select {
+    case m.ready <- struct{}{}:
+    default:
+    }
+    return len(p), nil
+}
+
+func (m *Basys3Model) processBlocks() {
+    for len(m.in) >= BLOCK_SIZE {
+        block := m.profile.FromWire(m.in[:BLOCK_SIZE])
+        m.in = m.in[BLOCK_SIZE:]
+        if m.aes == nil {
+            m.aes, _ = m.profile.NewAES(block)
+            switch m.profile.Echo {
+            case ECHO_PLAIN:
+                m.send(m.profile.ToWire(block))
+                continue
+            case ECHO_NONE:
+                continue
+            }
+        } else if m.decrypt {
+            m.send(m.profile.ToWire(m.aes.Decrypt(block)))
+            continue
+        }
+        m.send(m.profile.ToWire(m.aes.Encrypt(block)))
+    }
+}
+
+func (m *Basys3Model) processFrames() {
+    for {
+        // skip padding and garbage until the start of a frame
+        for len(m.in) > 0 && m.in[0] != FRAME_MAGIC {
+            m.in = m.in[1:]
+        }
+        if len(m.in) < FRAME_HEADER_SIZE {
+            return
+        }
+        if m.in[1] != FRAME_VERSION {
+            m.in = m.in[1:]
+            continue
+        }
+        size := FRAME_HEADER_SIZE + int(m.in[3]) + 1
+        if len(m.in) < size {
+            return
+        }
+        frame := m.in[:size]
+        m.in = m.in[size:]
+        op, payload, err := decodeFrame(frame)
+        if err != nil {
+            m.send(encodeFrame(STATUS_BAD_CHECKSUM, nil))
+            continue
+        }
+        status, res := m.handle(op, payload)
+        m.send(encodeFrame(status, res))
+    }
+}
+
+func (m *Basys3Model) handle(op byte, payload []byte) (byte, []byte) {
+    switch op {
+    case OP_SET_KEY:
+        if len(payload) != KEY_SIZE {
+            return STATUS_BAD_LENGTH, nil
+        }
+        key := m.profile.FromWire(payload)
+        m.aes, _ = NewAES(key)
+        // answer with the key check value (the key encrypting a zero block)
+        // from a separate instance so the trojan counter is not disturbed
+        kcv, _ := NewAES(key)
+        return STATUS_OK, m.profile.ToWire(kcv.Encrypt(make([]byte, BLOCK_SIZE)))
+    case OP_ENCRYPT, OP_DECRYPT:
+        if m.aes == nil {
+            return STATUS_NO_KEY, nil
+        }
+        if len(payload) != BLOCK_SIZE {
+            return STATUS_BAD_LENGTH, nil
+        }
+        if op == OP_ENCRYPT {
+            return STATUS_OK, m.profile.ToWire(m.aes.Encrypt(m.profile.FromWire(payload)))
+        }
+        return STATUS_OK, m.profile.ToWire(m.aes.Decrypt(m.profile.FromWire(payload)))
+    case OP_RESET:
+        m.aes = nil
+        return STATUS_OK, nil
+    case OP_STATUS:
+        hasKey := byte(0)
+        if m.aes != nil {
+            hasKey = 1
+        }
+        return STATUS_OK, []byte{FRAME_VERSION, hasKey}
+    }
+    return STATUS_BAD_OPCODE, nil
+}
+
+// Read blocks until there is something to read or the read timeout
+// expires, in which case it returns 0 bytes like a real serial port
+func (m *Basys3Model) Read(p []byte) (int, error) {
+    var deadline <-chan time.Time
+    for {
+        m.mtx.Lock()
+        if m.closed {
+            m.mtx.Unlock()
+            return 0, fmt.Errorf("port closed")
+        }
+        now := time.Now()
+        for len(m.delayed) > 0 && !m.delayed[0].readyAt.After(now) {
+            m.out = append(m.out, m.delayed[0].data...)
+            m.delayed = m.delayed[1:]
+        }
+        if len(m.out) > 0 {
+            n := copy(p, m.out)
+            m.out = m.out[n:]
+            m.mtx.Unlock()
+            return n, nil
+        }
+        var arrived <-chan time.Time
+        if len(m.delayed) > 0 {
+            arrived = time.After(m.delayed[0].readyAt.Sub(now))
+        }
+        timeout := m.readTimeout
+        m.mtx.Unlock()
+        if deadline == nil && timeout != serial.NoTimeout {
+            deadline = time.After(timeout)
+        }
+        select {
+        case <-m.ready:
+        case <-arrived:
+        case <-deadline:
+            return 0, nil
+        }
+    }
+}
+
+func (m *Basys3Model) SetReadTimeout(t time.Duration) error {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.readTimeout = t
+    return nil
+}
+
+func (m *Basys3Model) ResetInputBuffer() error {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.out = nil
+    m.delayed = nil
+    return nil
+}
+
+func (m *Basys3Model) Close() error {
+    m.mtx.Lock()
+    m.closed = true
+    m.mtx.Unlock()
+    select {
+    case m.ready <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+func (m *Basys3Model) SetMode(mode *serial.Mode) error {
+    m.mtx.Lock()
+    defer m.mtx.Unlock()
+    m.hostBaud = mode.BaudRate
+    return nil
+}
+
+func (m *Basys3Model) Drain() error { return nil }
+func (m *Basys3Model) ResetOutputBuffer() error { return nil }
+func (m *Basys3Model) SetDTR(dtr bool) error { return nil }
+func (m *Basys3Model) SetRTS(rts bool) error { return nil }
+func (m *Basys3Model) Break(t time.Duration) error { return nil }
+
+func (m *Basys3Model) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+    return &serial.ModemStatusBits{CTS: true, DSR: true}, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SetSecretSuffix turns on the ECB lab: every message encrypted in ECB
+// mode, bare or in a container, has suffix appended. Decrypt strips it
+// again so the UI never shows it. CBC and file streams never get it, the
+// lab is about ECB
+func (s *BAESys128) SetSecretSuffix(suffix []byte) {
+    s.suffix = suffix
+}
+
+func (s *BAESys128) HasSecretSuffix() bool {
+    return len(s.suffix) > 0
+}
+
+// ECBOracle encrypts whatever the attacker likes with the current key and
+// padding, secret suffix and all. It runs on the Basys3 when there is one
+func (s *BAESys128) ECBOracle() func(msg []byte) ([]byte, error) {
+    return func(msg []byte) ([]byte, error) {
+        res, err := s.EncryptWithPadding(msg, s.Padding())
+        if err != nil {
+            return nil, err
+        }
+        return res.Ciphertext, res.Err()
+    }
+}
+
+// HTTPECBOracle encrypts through a server's /encrypt endpoint, the same
+// way the form does, and reads the ciphertext out of the page
+func HTTPECBOracle(endpoint string, key string) func(msg []byte) ([]byte, error) {
+    return func(msg []byte) ([]byte, error) {
+        res, err := http.PostForm(endpoint, url.Values{"key": {key}, "message": {string(msg)}})
+        if err != nil {
+            return nil, err
+        }
+        defer res.Body.Close()
+        body, err := io.ReadAll(res.Body)
+        if err != nil {
+            return nil, err
+        }
+        if res.StatusCode != http.StatusOK {
+            return nil, fmt.Errorf("encrypt answered %s", res.Status)
+        }
+        if msg := formValue(string(body), "encrypt-error"); msg != "" {
+            return nil, fmt.Errorf("%s", msg)
+        }
+        ct, err := hex.DecodeString(strings.TrimSpace(textareaValue(string(body), "ciphertext")))
+        if err != nil || len(ct) == 0 {
+            return nil, fmt.Errorf("no ciphertext in the page")
+        }
+        return ct, nil
+    }
+}
+
+// textareaValue is the contents of the textarea with id in a rendered form
+func textareaValue(page string, id string) string {
+    start := strings.Index(page, fmt.Sprintf(`id="%s" name="%s"`, id, id))
+    if start == -1 {
+        return ""
+    }
+    page = page[start:]
+    page = page[strings.Index(page, ">") + 1:]
+    return html.UnescapeString(page[:strings.Index(page, "</textarea>")])
+}
+
+// formValue is the value of the input with id in a rendered form
+func formValue(page string, id string) string {
+    start := strings.Index(page, fmt.Sprintf(`id="%s"`, id))
+    if start == -1 {
+        return ""
+    }
+    page = page[start:]
+    start = strings.Index(page, `value="`)
+    if start == -1 {
+        return ""
+    }
+    page = page[start + len(`value="`):]
+    return html.UnescapeString(page[:strings.Index(page, `"`)])
+}
+
+type ECBProgress struct {
+    Recovered []byte
+    Length int
+    Queries int
+}
+
+// ECBSuffixAttack recovers the secret an ECB oracle appends to every
+// message. Identical plaintext blocks encrypt to identical ciphertext
+// blocks, so lining up one unknown byte at the end of a block and trying
+// all 256 values for it gives the byte away
+type ECBSuffixAttack struct {
+    Oracle func(msg []byte) ([]byte, error)
+    // called after each byte is recovered. May be nil
+    Progress func(ECBProgress)
+    Queries int
+    BlockSize int
+    // length of the suffix, worked out along with the block size
+    Length int
+}
+
+func (a *ECBSuffixAttack) query(msg []byte) ([]byte, error) {
+    a.Queries++
+    return a.Oracle(msg)
+}
+
+// DetectBlockSize grows the message one byte at a time until the
+// ciphertext grows. The jump is the block size, and where it happens says
+// how long the suffix is. Assumes padding that always adds at least a
+// byte, like PKCS#7
+func (a *ECBSuffixAttack) DetectBlockSize() (int, error) {
+    ct, err := a.query([]byte{'A'})
+    if err != nil {
+        return 0, err
+    }
+    base := len(ct)
+    for n := 2; n <= 256; n++ {
+        ct, err = a.query(bytes.Repeat([]byte{'A'}, n))
+        if err != nil {
+            return 0, err
+        }
+        if len(ct) > base {
+            a.BlockSize = len(ct) - base
+            // n bytes of message filled the last block exactly so the
+            // padding took a whole block of its own
+            a.Length = len(ct) - a.BlockSize - n
+            return a.BlockSize, nil
+        }
+    }
+    return 0, fmt.Errorf("ciphertext length never changed, is there a block cipher at all?")
+}
+
+// DetectECB encrypts three blocks of the same byte. Only ECB gives the same
+// ciphertext block twice
+func (a *ECBSuffixAttack) DetectECB() (bool, error) {
+    ct, err := a.query(bytes.Repeat([]byte{'A'}, 3*a.BlockSize))
+    if err != nil {
+        return false, err
+    }
+    return bytes.Equal(ct[a.BlockSize:2*a.BlockSize], ct[2*a.BlockSize:3*a.BlockSize]), nil
+}
+
+func (a *ECBSuffixAttack) Run() ([]byte, error) {
+    bs, err := a.DetectBlockSize()
+    if err != nil {
+        return nil, err
+    }
+    ecb, err := a.DetectECB()
+    if err != nil {
+        return nil, err
+    }
+    if !ecb {
+        return nil, fmt.Errorf("the oracle is not ECB")
+    }
+    recovered := []byte{}
+    for i := 0; i < a.Length; i++ {
+        // push byte i of the suffix to the end of a block. The prefix is
+        // a block longer than needed so it is never empty, the form
+        // refuses empty messages
+        prefix := bytes.Repeat([]byte{'A'}, 2*bs - 1 - i % bs)
+        block := i / bs + 1
+        ct, err := a.query(prefix)
+        if err != nil {
+            return recovered, err
+        }
+        target := ct[block*bs:(block + 1)*bs]
+        guess := append(append(prefix, recovered...), 0)
+        found := false
+        for b := 0; b < 256 && !found; b++ {
+            guess[len(guess) - 1] = byte(b)
+            ct, err = a.query(guess)
+            if err != nil {
+                return recovered, err
+            }
+            found = bytes.Equal(ct[block*bs:(block + 1)*bs], target)
+        }
+        if !found {
+            return recovered, fmt.Errorf("no byte matched at offset %d, the suffix is not fixed", i)
+        }
+        recovered = append(recovered, guess[len(guess) - 1])
+        if a.Progress != nil {
+            a.Progress(ECBProgress{Recovered: recovered, Length: a.Length, Queries: a.Queries})
+        }
+    }
+    return recovered, nil
+}
+
+// ECBLab runs ECBSuffixAttack against this server from the form
+type ECBLab struct {
+    baes *BAESys128
+    running atomic.Bool
+}
+
+func NewECBLab(baes *BAESys128) *ECBLab {
+    return &ECBLab{baes: baes}
+}
+
+func (l *ECBLab) handle_attack(w http.ResponseWriter, r *http.Request) {
+    opts := parse_form(r, l.baes)
+    var err error
+    if l.baes.KeyState() != KEY_STATE_SET {
+        err = fmt.Errorf("set a key first")
+    } else if !l.running.CompareAndSwap(false, true) {
+        err = fmt.Errorf("an attack is already running")
+    }
+    if err != nil {
+        err_msg := err.Error()
+        opts.ecb_err = &err_msg
+        fmt.Fprint(w, opts.render())
+        return
+    }
+    where := "go AES"
+    if l.baes.HasDevice() {
+        where = "Basys3"
+    }
+    componentLog(COMPONENT_LAB).Info("Attacking the secret suffix", "through", where)
+    go func() {
+        defer l.running.Store(false)
+        attack := ECBSuffixAttack{Oracle: l.baes.ECBOracle(), Progress: logECBProgress}
+        start := time.Now()
+        suffix, err := attack.Run()
+        if err != nil {
+            componentLog(COMPONENT_LAB).Error("ECB attack failed", "queries", attack.Queries, "recovered", fmt.Sprintf("%q", suffix), errAttr(err))
+            return
+        }
+        componentLog(COMPONENT_LAB).Info("ECB attack recovered the secret suffix", "suffix", fmt.Sprintf("%q", suffix), "queries", attack.Queries, "took", time.Since(start).Round(time.Millisecond))
+    }()
+    fmt.Fprint(w, opts.render())
+}
+
+func logECBProgress(p ECBProgress) {
+    componentLog(COMPONENT_LAB).Debug("ECB attack progress", ATTR_BYTES, len(p.Recovered), "length", p.Length, "queries", p.Queries, "recovered", fmt.Sprintf("%q", p.Recovered))
+}
+
+func ecb_form_group(enabled bool, err *string) string {
+    if !enabled {
+        return ""
+    }
+    return fmt.Sprintf(`
+            <div id="ecb-part" class="flex flex-col gap-2 py-2">
+                <p>ECB Lab</p>
+                <p class="text-sm text-slate-500">Every message is encrypted with a secret appended. Equal blocks in, equal blocks out, so it can be read back one byte at a time</p>
+                <button hx-post="/ecb/attack" hx-target="#form" class="border-2 bg-slate-100">
+                    Attack Secret Suffix
+                </button>
+                %s
+            </div>
+        `, error_p("ecb-error", err, false))
+}
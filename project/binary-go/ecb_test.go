@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const ECB_TEST_SUFFIX = "Rollin' in my 5.0, with my rag-top down"
+
+func newECBBaes(t *testing.T) *BAESys128 {
+    baes := new(BAESys128)
+    baes.SetProfile(REFERENCE_PROFILE)
+    baes.SetSecretSuffix([]byte(ECB_TEST_SUFFIX))
+    err := baes.SetKey([]byte("YELLOW SUBMARINE"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return baes
+}
+
+func TestECBSuffixAttack(t *testing.T) {
+    baes := newECBBaes(t)
+    progress := 0
+    attack := ECBSuffixAttack{Oracle: baes.ECBOracle(), Progress: func(ECBProgress) { progress++ }}
+    suffix, err := attack.Run()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(suffix) != ECB_TEST_SUFFIX {
+        t.Errorf("expected %q, got %q", ECB_TEST_SUFFIX, suffix)
+    }
+    if attack.BlockSize != BLOCK_SIZE {
+        t.Errorf("expected block size %d, got %d", BLOCK_SIZE, attack.BlockSize)
+    }
+    if progress != len(ECB_TEST_SUFFIX) {
+        t.Errorf("expected progress for each of %d bytes, got %d", len(ECB_TEST_SUFFIX), progress)
+    }
+}
+
+// CBC hides the repeated blocks the attack needs
+func TestECBSuffixAttackNeedsECB(t *testing.T) {
+    baes := newECBBaes(t)
+    attack := ECBSuffixAttack{Oracle: func(msg []byte) ([]byte, error) {
+        return baes.CBCEncrypt(append(append([]byte{}, msg...), ECB_TEST_SUFFIX...))
+    }}
+    if _, err := attack.Run(); err == nil {
+        t.Errorf("expected the attack to refuse a CBC oracle")
+    }
+}
+
+func TestSecretSuffixHiddenOnDecrypt(t *testing.T) {
+    baes := newECBBaes(t)
+    ct, err := baes.Encrypt([]byte("hello"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ct) != 48 {
+        t.Errorf("expected the suffix to be encrypted too, got %d bytes", len(ct))
+    }
+    pt, err := baes.Decrypt(ct)
+    if err != nil || string(pt) != "hello" {
+        t.Errorf("expected hello, got %q %v", pt, err)
+    }
+}
+
+// only ECB messages get the suffix, a CBC container comes back as it went in
+func TestSecretSuffixOnlyECB(t *testing.T) {
+    baes := newECBBaes(t)
+    ecb, _, err := baes.Seal([]byte("hello"), SealOptions{Mode: MODE_ECB})
+    if err != nil {
+        t.Fatal(err)
+    }
+    cbc, _, err := baes.Seal([]byte("hello"), SealOptions{Mode: MODE_CBC})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(ecb.Ciphertext) != 48 || len(cbc.Ciphertext) != BLOCK_SIZE {
+        t.Errorf("expected 48 bytes of ECB and %d of CBC, got %d and %d", BLOCK_SIZE, len(ecb.Ciphertext), len(cbc.Ciphertext))
+    }
+    for _, c := range []*Container{ecb, cbc} {
+        if pt, err := baes.Open(c); err != nil || string(pt) != "hello" {
+            t.Errorf("%s: expected hello, got %q %v", c.Mode, pt, err)
+        }
+    }
+}
+
+func TestECBSuffixAttackOverHTTP(t *testing.T) {
+    baes := newECBBaes(t)
+    mux := http.NewServeMux()
+    mux.HandleFunc("/encrypt", handle_encrypt_message(baes))
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    attack := ECBSuffixAttack{Oracle: HTTPECBOracle(server.URL + "/encrypt", "YELLOW SUBMARINE")}
+    suffix, err := attack.Run()
+    if err != nil || !bytes.Equal(suffix, []byte(ECB_TEST_SUFFIX)) {
+        t.Errorf("expected %q, got %q %v", ECB_TEST_SUFFIX, suffix, err)
+    }
+
+    badKey := HTTPECBOracle(server.URL + "/encrypt", "short")
+    if _, err := badKey([]byte("A")); err == nil {
+        t.Errorf("expected an invalid key to be an error")
+    }
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Encoding turns the bytes of a key, message or ciphertext into text for a
+// form field and back
+type Encoding struct {
+    Name string
+    Description string
+    Decode func(text string) ([]byte, error)
+    // nil when the bytes can only be downloaded, not shown
+    Encode func(data []byte) (string, error)
+}
+
+// whitespace is ignored in everything but text so pasted hex or base64
+// can be wrapped
+func stripSpace(text string) string {
+    return strings.Join(strings.Fields(text), "")
+}
+
+var ENCODING_UTF8 = Encoding{
+    Name: "utf-8",
+    Description: "UTF-8 text",
+    Decode: func(text string) ([]byte, error) {
+        return []byte(text), nil
+    },
+    Encode: func(data []byte) (string, error) {
+        if !utf8.Valid(data) {
+            return "", fmt.Errorf("not valid UTF-8")
+        }
+        return string(data), nil
+    },
+}
+
+// ENCODING_HEX is upper case like the ciphertext always was, and like
+// binary.py. Either case is accepted
+var ENCODING_HEX = Encoding{
+    Name: "hex",
+    Description: "hex",
+    Decode: func(text string) ([]byte, error) {
+        text = strings.TrimPrefix(strings.TrimPrefix(stripSpace(text), "0x"), "0X")
+        return hex.DecodeString(text)
+    },
+    Encode: func(data []byte) (string, error) {
+        return strings.ToUpper(hex.EncodeToString(data)), nil
+    },
+}
+
+var ENCODING_BASE64 = Encoding{
+    Name: "base64",
+    Description: "base64",
+    Decode: func(text string) ([]byte, error) {
+        return base64.StdEncoding.DecodeString(stripSpace(text))
+    },
+    Encode: func(data []byte) (string, error) {
+        return base64.StdEncoding.EncodeToString(data), nil
+    },
+}
+
+// ENCODING_BASE64URL accepts it with or without the = padding
+var ENCODING_BASE64URL = Encoding{
+    Name: "base64url",
+    Description: "base64url",
+    Decode: func(text string) ([]byte, error) {
+        return base64.RawURLEncoding.DecodeString(strings.TrimRight(stripSpace(text), "="))
+    },
+    Encode: func(data []byte) (string, error) {
+        return base64.URLEncoding.EncodeToString(data), nil
+    },
+}
+
+// ENCODING_FILE reads the bytes from an uploaded file instead of the text
+// field. Output in it is offered as a download and shown as hex
+var ENCODING_FILE = Encoding{
+    Name: "file",
+    Description: "raw file",
+    Decode: func(text string) ([]byte, error) {
+        return nil, fmt.Errorf("choose a file to upload")
+    },
+}
+
+// ENCODINGS in the order they are offered in the UI
+var ENCODINGS = []Encoding{ENCODING_UTF8, ENCODING_HEX, ENCODING_BASE64, ENCODING_BASE64URL, ENCODING_FILE}
+
+func ParseEncoding(name string) (Encoding, error) {
+    names := []string{}
+    for _, enc := range ENCODINGS {
+        if enc.Name == strings.ToLower(name) {
+            return enc, nil
+        }
+        names = append(names, enc.Name)
+    }
+    return Encoding{}, fmt.Errorf("unknown encoding %q. Known encodings: %s", name, strings.Join(names, ", "))
+}
+
+// EncodeText is data in enc, or in hex when enc can not show it (a file,
+// or bytes that are not UTF-8). The encoding actually used is returned
+func EncodeText(enc Encoding, data []byte) (string, Encoding) {
+    if enc.Encode != nil {
+        text, err := enc.Encode(data)
+        if err == nil {
+            return text, enc
+        }
+    }
+    text, _ := ENCODING_HEX.Encode(data)
+    return text, ENCODING_HEX
+}
+
+// fieldEncoding is the encoding picked for field in "<field>-encoding"
+func fieldEncoding(r *http.Request, field string, def Encoding) (Encoding, error) {
+    name := formField(r, field + "-encoding")
+    if name == nil {
+        return def, nil
+    }
+    return ParseEncoding(*name)
+}
+
+// fieldBytes decodes field with its encoding, or reads "<field>-file" for
+// the file encoding. nil and no error when nothing was given
+func fieldBytes(r *http.Request, field string, def Encoding) ([]byte, Encoding, error) {
+    enc, err := fieldEncoding(r, field, def)
+    if err != nil {
+        return nil, def, err
+    }
+    if enc.Name == ENCODING_FILE.Name {
+        file, _, err := r.FormFile(field + "-file")
+        if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+            return nil, enc, nil
+        }
+        if err != nil {
+            return nil, enc, err
+        }
+        defer file.Close()
+        data, err := io.ReadAll(file)
+        return data, enc, err
+    }
+    text := formField(r, field)
+    if text == nil {
+        return nil, enc, nil
+    }
+    data, err := enc.Decode(*text)
+    if err != nil {
+        return nil, enc, fmt.Errorf("not %s: %w", enc.Description, err)
+    }
+    return data, enc, nil
+}
+
+// form_text is field as it should be shown again after a request: an
+// uploaded file is shown as hex since the browser will not upload it again
+func form_text(r *http.Request, field string, def Encoding) (*string, string) {
+    enc, err := fieldEncoding(r, field, def)
+    if err != nil {
+        return formField(r, field), def.Name
+    }
+    if enc.Name != ENCODING_FILE.Name {
+        return formField(r, field), enc.Name
+    }
+    data, _, err := fieldBytes(r, field, def)
+    if err != nil || data == nil {
+        return formField(r, field), enc.Name
+    }
+    text, _ := ENCODING_HEX.Encode(data)
+    return &text, ENCODING_HEX.Name
+}
+
+func encoding_select(field string, selected string, out_of_band bool) string {
+    options := ""
+    for _, enc := range ENCODINGS {
+        attr := ""
+        if enc.Name == selected {
+            attr = "selected"
+        }
+        options += fmt.Sprintf(`<option value="%s" %s>%s</option>`, enc.Name, attr, enc.Description)
+    }
+    oob := ""
+    if out_of_band {
+        oob = `hx-swap-oob="true"`
+    }
+    return fmt.Sprintf(`<select id="%s-encoding" name="%s-encoding" %s class="border-2">%s</select>`, field, field, oob, options)
+}
+
+func file_input(field string) string {
+    return fmt.Sprintf(`<input type="file" id="%s-file" name="%s-file" class="text-sm"></input>`, field, field)
+}
+
+// download_link offers the bytes behind text, shown in encoding, as a
+// file. Empty if there is nothing to download
+func download_link(text *string, encoding string, filename string) string {
+    if text == nil {
+        return ""
+    }
+    enc, err := ParseEncoding(encoding)
+    if err != nil {
+        return ""
+    }
+    data, err := enc.Decode(*text)
+    if err != nil || len(data) == 0 {
+        return ""
+    }
+    return fmt.Sprintf(`<a download="%s" href="data:application/octet-stream;base64,%s" class="underline text-sm">Download</a>`, filename, base64.StdEncoding.EncodeToString(data))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEncodingsRoundTrip(t *testing.T) {
+    data := []byte{0x00, 0xff, 0x10, 0x80, 'h', 'i', 0xfb, 0xef}
+    for _, enc := range ENCODINGS {
+        if enc.Encode == nil {
+            continue
+        }
+        text, err := enc.Encode(data)
+        if enc.Name == ENCODING_UTF8.Name {
+            if err == nil {
+                t.Errorf("utf-8 encoded bytes that are not UTF-8")
+            }
+            continue
+        }
+        got, err := enc.Decode(text)
+        if err != nil || !bytes.Equal(got, data) {
+            t.Errorf("%s: expected %x, got %x %v", enc.Name, data, got, err)
+        }
+    }
+}
+
+func TestEncodingsLenient(t *testing.T) {
+    cases := []struct {
+        enc Encoding
+        text string
+    }{
+        // binary.py prints lower case hex, one block a line
+        {ENCODING_HEX, "00ff10\n80"},
+        {ENCODING_HEX, "0x00FF1080"},
+        {ENCODING_BASE64, "AP8Q\ngA=="},
+        {ENCODING_BASE64URL, "AP8QgA"},
+        {ENCODING_BASE64URL, "AP8QgA=="},
+    }
+    for _, c := range cases {
+        got, err := c.enc.Decode(c.text)
+        if err != nil || !bytes.Equal(got, []byte{0x00, 0xff, 0x10, 0x80}) {
+            t.Errorf("%s %q: got %x %v", c.enc.Name, c.text, got, err)
+        }
+    }
+}
+
+func TestEncodeTextFallsBackToHex(t *testing.T) {
+    text, used := EncodeText(ENCODING_UTF8, []byte{0xff})
+    if text != "FF" || used.Name != ENCODING_HEX.Name {
+        t.Errorf("expected FF in hex, got %q in %s", text, used.Name)
+    }
+    text, used = EncodeText(ENCODING_FILE, []byte("a"))
+    if text != "61" || used.Name != ENCODING_HEX.Name {
+        t.Errorf("expected 61 in hex, got %q in %s", text, used.Name)
+    }
+}
+
+// keys like the ones derive.py recovers are not printable
+func TestBinaryKey(t *testing.T) {
+    key := "00112233445566778899aabbccddeeff"
+    baes := new(BAESys128)
+    res := postForm(handle_encrypt_message(baes), url.Values{
+        "key": {key},
+        "key-encoding": {"hex"},
+        "message": {"aGVsbG8="},
+        "message-encoding": {"base64"},
+        "ciphertext-encoding": {"base64"},
+    })
+    if !bytes.Equal(baes.key, mustHex(key)) {
+        t.Fatalf("expected key %s, got %x", key, baes.key)
+    }
+    ref, _ := NewAES(mustHex(key))
+    expected, _ := ENCODING_BASE64.Encode(ref.Encrypt(pkcs7Pad([]byte("hello"))))
+    if !strings.Contains(res.Body.String(), expected) {
+        t.Errorf("expected base64 ciphertext %s in %s", expected, res.Body.String())
+    }
+
+    res = postForm(handle_decrypt_message(baes), url.Values{
+        "key": {strings.ToUpper(key)},
+        "key-encoding": {"hex"},
+        "ciphertext": {expected},
+        "ciphertext-encoding": {"base64"},
+        "message": {"aGVsbG8="},
+        "message-encoding": {"base64"},
+    })
+    body := res.Body.String()
+    if !strings.Contains(body, "aGVsbG8=") || !strings.Contains(body, "Same as original message") {
+        t.Errorf("expected the plaintext back in base64, got %s", body)
+    }
+}
+
+func TestKeyEncodingErrors(t *testing.T) {
+    cases := []url.Values{
+        {"key": {"not hex at all!!"}, "key-encoding": {"hex"}},
+        {"key": {"0011"}, "key-encoding": {"hex"}},
+        {"key": {"0123456789abcdef"}, "key-encoding": {"rot13"}},
+    }
+    for _, form := range cases {
+        req := httptest.NewRequest("POST", "/key", strings.NewReader(form.Encode()))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        if _, errs := parseKeyRequest(req); errs.Get("key") == nil {
+            t.Errorf("%v: expected a key error", form)
+        }
+    }
+}
+
+func TestFileUpload(t *testing.T) {
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    form.WriteField("key", "0123456789abcdef")
+    form.WriteField("message-encoding", "file")
+    part, _ := form.CreateFormFile("message-file", "secret.bin")
+    part.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x00})
+    form.Close()
+    req := httptest.NewRequest("POST", "/encrypt", &body)
+    req.Header.Set("Content-Type", form.FormDataContentType())
+
+    enc, errs := parseEncryptRequest(req)
+    if len(errs) != 0 || !bytes.Equal(enc.Message, []byte{0xde, 0xad, 0xbe, 0xef, 0x00}) {
+        t.Errorf("expected the file as the message, got %x %v", enc.Message, errs)
+    }
+    // the browser will not upload it again, so it comes back as hex
+    opts := parse_form(req, new(BAESys128))
+    if empty_if_nil(opts.message) != "DEADBEEF00" || opts.message_encoding != "hex" {
+        t.Errorf("expected the file shown as hex, got %q in %s", empty_if_nil(opts.message), opts.message_encoding)
+    }
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors talking to the Basys3. Check for them with errors.Is, the errors
+// returned carry a more specific message
+var (
+    ErrNoDevice = errors.New("no Basys3 connected")
+    // some but not all of the bytes expected arrived
+    ErrShortRead = errors.New("short read from Basys3")
+    // nothing arrived before the read timeout
+    ErrTimeout = errors.New("timed out waiting for Basys3")
+    ErrKeyRejected = errors.New("Basys3 rejected the key")
+    // the Basys3 answered but not with what the go AES expected
+    ErrVerifyMismatch = errors.New("Basys3 output does not match the go AES")
+    // pipelined blocks were written but their ciphertext never came back
+    ErrInFlightLost = errors.New("lost blocks in flight to the Basys3")
+)
+
+// DeviceError is one of the errors above with a message saying what
+// exactly went wrong
+type DeviceError struct {
+    Kind error
+    Msg string
+}
+
+func (e *DeviceError) Error() string {
+    return e.Msg
+}
+
+func (e *DeviceError) Unwrap() error {
+    return e.Kind
+}
+
+func deviceError(kind error, format string, args ...any) error {
+    return &DeviceError{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// error_message is err as shown in the UI, with a hint on what to do about
+// it for the errors above
+func error_message(err error) string {
+    hint := ""
+    switch {
+    case errors.Is(err, ErrNoDevice):
+        hint = "Connect the Basys3 and restart the server"
+    case errors.Is(err, ErrTimeout):
+        hint = "Check the Basys3 is programmed and the baud rate is right"
+    case errors.Is(err, ErrShortRead):
+        hint = "Bytes were lost on the UART. Press the center button (btnC) and set the key again"
+    case errors.Is(err, ErrKeyRejected):
+        hint = "Click Change Key and press the center button (btnC)"
+    case errors.Is(err, ErrInFlightLost):
+        hint = "They were not sent again since the Basys3 may have encrypted them already. Encrypt the message again"
+    case errors.Is(err, ErrVerifyMismatch):
+        hint = "The ciphertext shown is what the Basys3 sent"
+    }
+    if hint == "" {
+        return err.Error()
+    }
+    return fmt.Sprintf("%s. %s", err.Error(), hint)
+}
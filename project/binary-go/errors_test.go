@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+var errLinkDown = errors.New("link down")
+
+// faultyPort is a Basys3 link that breaks in the ways real ones do
+type faultyPort struct {
+    serial.Port
+    failWrites bool
+    // stop delivering bytes after this many have been read, -1 for never
+    readLimit int
+    read int
+}
+
+func (f *faultyPort) Write(p []byte) (int, error) {
+    if f.failWrites {
+        return 0, errLinkDown
+    }
+    return f.Port.Write(p)
+}
+
+func (f *faultyPort) Read(p []byte) (int, error) {
+    if f.readLimit >= 0 && f.read + len(p) > f.readLimit {
+        p = p[:f.readLimit - f.read]
+    }
+    if len(p) == 0 {
+        // let the read timeout expire like a silent UART
+        return f.Port.Read(make([]byte, 0))
+    }
+    n, err := f.Port.Read(p)
+    f.read += n
+    return n, err
+}
+
+// newFaultyBaes talks to a raw model through port with a short timeout
+func newFaultyBaes(port serial.Port) *BAESys128 {
+    profile := TROJAN_PROFILE
+    profile.ReadTimeoutMs = 50
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetProfile(profile)
+    baes.SetPort(&port)
+    return baes
+}
+
+func TestSetKeyErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        port *faultyPort
+        kind error
+    }{
+        {"timeout", &faultyPort{Port: NewBasys3Model(PROTOCOL_RAW), readLimit: 0}, ErrTimeout},
+        {"short read", &faultyPort{Port: NewBasys3Model(PROTOCOL_RAW), readLimit: 5}, ErrShortRead},
+        {"write failure", &faultyPort{Port: NewBasys3Model(PROTOCOL_RAW), failWrites: true, readLimit: -1}, errLinkDown},
+    }
+    for _, test := range tests {
+        baes := newFaultyBaes(test.port)
+        err := baes.SetKey([]byte("0123456789abcdef"))
+        if !errors.Is(err, test.kind) {
+            t.Errorf("%s: expected %v, got %v", test.name, test.kind, err)
+        }
+        if baes.KeyState() != KEY_STATE_UNKNOWN {
+            t.Errorf("%s: expected key state %s, got %s", test.name, KEY_STATE_UNKNOWN, baes.KeyState())
+        }
+    }
+}
+
+func TestSetKeyRejected(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    // the board already holds a key this server did not set
+    board.Write(reverse([]byte("some other key!!")))
+    board.ResetInputBuffer()
+    baes := newFaultyBaes(board)
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if !errors.Is(err, ErrKeyRejected) {
+        t.Errorf("expected %v, got %v", ErrKeyRejected, err)
+    }
+}
+
+func TestEncryptErrors(t *testing.T) {
+    // the key echo makes it through, the first block doesn't
+    baes := newFaultyBaes(&faultyPort{Port: NewBasys3Model(PROTOCOL_RAW), readLimit: BLOCK_SIZE + 3})
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    _, err = baes.Encrypt([]byte("hello"))
+    if !errors.Is(err, ErrShortRead) {
+        t.Errorf("expected %v, got %v", ErrShortRead, err)
+    }
+
+    baes = newFaultyBaes(&flipPort{Port: NewBasys3Model(PROTOCOL_RAW), flipAt: BLOCK_SIZE})
+    baes.SetKey([]byte("0123456789abcdef"))
+    ct, err := baes.Encrypt([]byte("hello"))
+    if !errors.Is(err, ErrVerifyMismatch) {
+        t.Errorf("expected %v, got %v", ErrVerifyMismatch, err)
+    }
+    if len(ct) != BLOCK_SIZE {
+        t.Errorf("expected the ciphertext along with the mismatch, got %d bytes", len(ct))
+    }
+}
+
+func TestDecryptErrors(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    var port serial.Port = board
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_V2)
+    baes.SetPort(&port)
+    baes.Negotiate()
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    port = &faultyPort{Port: board, readLimit: 0}
+    _, err = baes.Decrypt(make([]byte, BLOCK_SIZE))
+    if !errors.Is(err, ErrTimeout) {
+        t.Errorf("expected %v, got %v", ErrTimeout, err)
+    }
+}
+
+func TestNoDeviceErrors(t *testing.T) {
+    baes := new(BAESys128)
+    if _, err := baes.SelfTest(); !errors.Is(err, ErrNoDevice) {
+        t.Errorf("SelfTest: expected %v, got %v", ErrNoDevice, err)
+    }
+    if err := baes.Negotiate(); !errors.Is(err, ErrNoDevice) {
+        t.Errorf("Negotiate: expected %v, got %v", ErrNoDevice, err)
+    }
+}
+
+func TestHandlersRenderDeviceErrors(t *testing.T) {
+    baes := newFaultyBaes(&faultyPort{Port: NewBasys3Model(PROTOCOL_RAW), readLimit: 0})
+    form := url.Values{"key": {"0123456789abcdef"}, "message": {"hello"}}
+    for _, handler := range []Handler{handle_set_key(baes), handle_encrypt_message(baes)} {
+        baes.ResetKey()
+        req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        w := httptest.NewRecorder()
+        handler(w, req)
+        if !strings.Contains(w.Body.String(), "Check the Basys3 is programmed") {
+            t.Errorf("expected the timeout to be shown to the user, got %s", w.Body.String())
+        }
+    }
+}
@@ -6,6 +6,7 @@ require (
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/gorilla/websocket v1.5.1 // indirect
 	go.bug.st/serial v1.6.1 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// DIGESTS are the hashes the key derivations can use, by their OpenSSL
+// names
+var DIGESTS = map[string]func() hash.Hash{
+    "md5": md5.New,
+    "sha1": sha1.New,
+    "sha256": sha256.New,
+    "sha512": sha512.New,
+}
+
+func ParseDigest(name string) (func() hash.Hash, error) {
+    digest, ok := DIGESTS[strings.ToLower(name)]
+    if !ok {
+        return nil, fmt.Errorf("unknown digest %q. Known digests: md5, sha1, sha256, sha512", name)
+    }
+    return digest, nil
+}
+
+// EVPBytesToKey is OpenSSL's original password to key derivation with a
+// count of 1, what openssl enc uses without -pbkdf2. It is weak, one hash
+// per guess, and only here to read and write files openssl made
+func EVPBytesToKey(digest func() hash.Hash, password []byte, salt []byte, keyLen int) []byte {
+    out := []byte{}
+    var prev []byte
+    for len(out) < keyLen {
+        h := digest()
+        h.Write(prev)
+        h.Write(password)
+        h.Write(salt)
+        prev = h.Sum(nil)
+        out = append(out, prev...)
+    }
+    return out[:keyLen]
+}
+
+// The passphrase key derivations, by the names used in their parameter
+// strings
+const (
+    KDF_PBKDF2 = "pbkdf2-sha256"
+    KDF_SCRYPT = "scrypt"
+    KDF_ARGON2ID = "argon2id"
+)
+
+var KDFS = []string{KDF_ARGON2ID, KDF_SCRYPT, KDF_PBKDF2}
+
+const ARGON2_VERSION = argon2.Version
+
+const KDF_SALT_SIZE = 16
+
+// KDFParams is everything but the passphrase needed to derive a key again.
+// Only the fields of Algorithm are used
+type KDFParams struct {
+    Algorithm string
+    Salt []byte
+    // PBKDF2 iterations or Argon2id passes
+    Iterations int
+    // scrypt N is 2^LogN
+    LogN int
+    // scrypt block size
+    R int
+    // scrypt parallelism or Argon2id lanes
+    P int
+    // Argon2id memory in KiB
+    Memory int
+}
+
+// NewKDFParams is algorithm with a random salt and costs that take around
+// a tenth of a second here: the OWASP minimums for PBKDF2 and Argon2id, and
+// the usual interactive N=2^15 for scrypt
+func NewKDFParams(algorithm string) (KDFParams, error) {
+    params := KDFParams{Algorithm: algorithm, Salt: make([]byte, KDF_SALT_SIZE)}
+    switch algorithm {
+    case KDF_PBKDF2:
+        params.Iterations = 600000
+    case KDF_SCRYPT:
+        params.LogN, params.R, params.P = 15, 8, 1
+    case KDF_ARGON2ID:
+        params.Memory, params.Iterations, params.P = 19456, 2, 1
+    default:
+        return params, fmt.Errorf("unknown key derivation %q. Known: %s", algorithm, strings.Join(KDFS, ", "))
+    }
+    _, err := rand.Read(params.Salt)
+    return params, err
+}
+
+// limits on what a pasted parameter string, container header or keystore
+// file can make the server do. A derivation takes at most KDF_MAX_MEMORY
+// bytes and a few seconds
+const (
+    KDF_MAX_ITERATIONS = 10000000
+    KDF_MAX_LOG_N = 20
+    KDF_MAX_MEMORY = 256 << 20
+    KDF_MAX_PASSES = 10
+)
+
+func (p KDFParams) Validate() error {
+    if len(p.Salt) < 8 {
+        return fmt.Errorf("salt is %d bytes but it must be at least 8", len(p.Salt))
+    }
+    switch p.Algorithm {
+    case KDF_PBKDF2:
+        if p.Iterations < 1 || p.Iterations > KDF_MAX_ITERATIONS {
+            return fmt.Errorf("PBKDF2 iterations must be between 1 and %d", KDF_MAX_ITERATIONS)
+        }
+    case KDF_SCRYPT:
+        // scrypt keeps N blocks of 128*r bytes
+        if p.LogN < 1 || p.LogN > KDF_MAX_LOG_N || p.R < 1 || p.P < 1 || p.R*p.P > 64 || 128 * p.R << p.LogN > KDF_MAX_MEMORY {
+            return fmt.Errorf("scrypt needs ln between 1 and %d, r*p at most 64 and 128*r*2^ln at most %d MiB", KDF_MAX_LOG_N, KDF_MAX_MEMORY >> 20)
+        }
+    case KDF_ARGON2ID:
+        if p.Iterations < 1 || p.Iterations > KDF_MAX_PASSES || p.P < 1 || p.P > 16 || p.Memory < 8*p.P || p.Memory > KDF_MAX_MEMORY >> 10 {
+            return fmt.Errorf("argon2id needs t between 1 and %d, p between 1 and 16 and m between 8*p and %d KiB", KDF_MAX_PASSES, KDF_MAX_MEMORY >> 10)
+        }
+    default:
+        return fmt.Errorf("unknown key derivation %q. Known: %s", p.Algorithm, strings.Join(KDFS, ", "))
+    }
+    return nil
+}
+
+// DeriveKey is the KEY_SIZE byte AES key for passphrase
+func (p KDFParams) DeriveKey(passphrase []byte) ([]byte, error) {
+    return p.DeriveKeyLen(passphrase, KEY_SIZE)
+}
+
+// DeriveKeyLen is DeriveKey for keys of other sizes
+func (p KDFParams) DeriveKeyLen(passphrase []byte, size int) ([]byte, error) {
+    err := p.Validate()
+    if err != nil {
+        return nil, err
+    }
+    switch p.Algorithm {
+    case KDF_PBKDF2:
+        return pbkdf2.Key(passphrase, p.Salt, p.Iterations, size, sha256.New), nil
+    case KDF_SCRYPT:
+        return scrypt.Key(passphrase, p.Salt, 1 << p.LogN, p.R, p.P, size)
+    }
+    return argon2.IDKey(passphrase, p.Salt, uint32(p.Iterations), uint32(p.Memory), uint8(p.P), uint32(size)), nil
+}
+
+// String is p in the PHC string format, without a hash since the key is
+// never stored:
+//   $argon2id$v=19$m=19456,t=2,p=1$<salt>
+//   $scrypt$ln=15,r=8,p=1$<salt>
+//   $pbkdf2-sha256$i=600000$<salt>
+// with the salt in unpadded base64
+func (p KDFParams) String() string {
+    salt := base64.RawStdEncoding.EncodeToString(p.Salt)
+    switch p.Algorithm {
+    case KDF_PBKDF2:
+        return fmt.Sprintf("$%s$i=%d$%s", p.Algorithm, p.Iterations, salt)
+    case KDF_SCRYPT:
+        return fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s", p.Algorithm, p.LogN, p.R, p.P, salt)
+    }
+    return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s", p.Algorithm, ARGON2_VERSION, p.Memory, p.Iterations, p.P, salt)
+}
+
+// ParseKDFParams undoes String. The result is valid
+func ParseKDFParams(text string) (KDFParams, error) {
+    var p KDFParams
+    fields := strings.Split(strings.TrimSpace(text), "$")
+    if len(fields) < 4 || fields[0] != "" {
+        return p, fmt.Errorf("key derivation parameters must look like $argon2id$v=19$m=19456,t=2,p=1$salt")
+    }
+    p.Algorithm = fields[1]
+    fields = fields[2:]
+    if p.Algorithm == KDF_ARGON2ID {
+        if fields[0] != fmt.Sprintf("v=%d", ARGON2_VERSION) {
+            return p, fmt.Errorf("only argon2id version %d is supported", ARGON2_VERSION)
+        }
+        fields = fields[1:]
+    }
+    if len(fields) != 2 {
+        return p, fmt.Errorf("key derivation parameters must end with $<parameters>$<salt>")
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[1], "="))
+    if err != nil {
+        return p, fmt.Errorf("salt is not base64: %w", err)
+    }
+    p.Salt = salt
+    targets := map[string]*int{}
+    switch p.Algorithm {
+    case KDF_PBKDF2:
+        targets["i"] = &p.Iterations
+    case KDF_SCRYPT:
+        targets["ln"], targets["r"], targets["p"] = &p.LogN, &p.R, &p.P
+    case KDF_ARGON2ID:
+        targets["m"], targets["t"], targets["p"] = &p.Memory, &p.Iterations, &p.P
+    }
+    for _, param := range strings.Split(fields[0], ",") {
+        name, value, _ := strings.Cut(param, "=")
+        target, ok := targets[name]
+        if !ok {
+            return p, fmt.Errorf("unknown %s parameter %q", p.Algorithm, name)
+        }
+        *target, err = strconv.Atoi(value)
+        if err != nil {
+            return p, fmt.Errorf("%s parameter %s is not a number", p.Algorithm, name)
+        }
+    }
+    return p, p.Validate()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// what one pasted parameter string can cost is bounded
+func TestKDFLimits(t *testing.T) {
+    for _, algorithm := range KDFS {
+        params, _ := NewKDFParams(algorithm)
+        if err := params.Validate(); err != nil {
+            t.Errorf("default %s is over the limits: %v", algorithm, err)
+        }
+    }
+    salt := "MDEyMzQ1Njc4OWFiY2RlZg"
+    for _, text := range []string{
+        // 2 GiB
+        "$scrypt$ln=18,r=64,p=1$" + salt,
+        "$scrypt$ln=20,r=8,p=1$" + salt,
+        // 1 GiB
+        "$argon2id$v=19$m=1048576,t=1,p=1$" + salt,
+        "$argon2id$v=19$m=19456,t=100,p=1$" + salt,
+    } {
+        if _, err := ParseKDFParams(text); err == nil {
+            t.Errorf("%s was accepted", text)
+        }
+    }
+    for _, text := range []string{
+        "$scrypt$ln=17,r=8,p=1$" + salt,
+        "$argon2id$v=19$m=262144,t=10,p=4$" + salt,
+    } {
+        if _, err := ParseKDFParams(text); err != nil {
+            t.Errorf("%s: %v", text, err)
+        }
+    }
+}
+
+func TestKDFParamsString(t *testing.T) {
+    salt := []byte("0123456789abcdef")
+    cases := map[string]KDFParams{
+        "$argon2id$v=19$m=64,t=1,p=2$MDEyMzQ1Njc4OWFiY2RlZg": {Algorithm: KDF_ARGON2ID, Salt: salt, Memory: 64, Iterations: 1, P: 2},
+        "$scrypt$ln=4,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg": {Algorithm: KDF_SCRYPT, Salt: salt, LogN: 4, R: 8, P: 1},
+        "$pbkdf2-sha256$i=1000$MDEyMzQ1Njc4OWFiY2RlZg": {Algorithm: KDF_PBKDF2, Salt: salt, Iterations: 1000},
+    }
+    for text, params := range cases {
+        if params.String() != text {
+            t.Errorf("expected %s got %s", text, params.String())
+        }
+        parsed, err := ParseKDFParams(text)
+        if err != nil {
+            t.Errorf("%s: %s", text, err)
+            continue
+        }
+        a, _ := params.DeriveKey([]byte("hunter2"))
+        b, _ := parsed.DeriveKey([]byte("hunter2"))
+        if len(a) != KEY_SIZE || !bytes.Equal(a, b) {
+            t.Errorf("%s: keys %x and %x", text, a, b)
+        }
+    }
+    for _, text := range []string{
+        "",
+        "argon2id",
+        "$argon2id$v=16$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg",
+        "$argon2id$v=19$m=99999999,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg",
+        "$scrypt$ln=30,r=8,p=1$MDEyMzQ1Njc4OWFiY2RlZg",
+        "$pbkdf2-sha256$i=1000$c2hvcnQ",
+        "$pbkdf2-sha256$x=1000$MDEyMzQ1Njc4OWFiY2RlZg",
+        "$bcrypt$i=1000$MDEyMzQ1Njc4OWFiY2RlZg",
+    } {
+        if _, err := ParseKDFParams(text); err == nil {
+            t.Errorf("%q was accepted", text)
+        }
+    }
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+    baes := new(BAESys128)
+    params := "$argon2id$v=19$m=64,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg"
+    res := postForm(handle_encrypt_message(baes), url.Values{
+        "passphrase": {"correct horse battery staple"},
+        "kdf": {KDF_ARGON2ID},
+        "kdf-params": {params},
+        "message": {"hello"},
+    })
+    parsed, _ := ParseKDFParams(params)
+    key, _ := parsed.DeriveKey([]byte("correct horse battery staple"))
+    if !bytes.Equal(baes.key, key) {
+        t.Fatalf("expected the derived key %x on the Basys3, got %x", key, baes.key)
+    }
+    ct := textareaValue(res.Body.String(), "ciphertext")
+    if !strings.HasPrefix(ct, params + "\n") {
+        t.Fatalf("expected the parameters in front of the ciphertext, got %q", ct)
+    }
+
+    // a fresh server with nothing but the passphrase and the ciphertext
+    res = postForm(handle_decrypt_message(new(BAESys128)), url.Values{
+        "passphrase": {"correct horse battery staple"},
+        "kdf": {KDF_PBKDF2},
+        "ciphertext": {ct},
+        "message": {"hello"},
+    })
+    if body := res.Body.String(); !strings.Contains(body, "Same as original message") {
+        t.Errorf("expected the message back, got %s", body)
+    }
+
+    res = postForm(handle_decrypt_message(new(BAESys128)), url.Values{
+        "passphrase": {"wrong"},
+        "ciphertext": {ct},
+    })
+    if strings.Contains(res.Body.String(), "hello") {
+        t.Error("wrong passphrase decrypted")
+    }
+}
+
+func TestDeriveKey(t *testing.T) {
+    baes := new(BAESys128)
+    res := postForm(handle_derive_key(baes), url.Values{"passphrase": {"hunter2"}, "kdf": {KDF_SCRYPT}})
+    params := formValue(res.Body.String(), "kdf-params")
+    parsed, err := ParseKDFParams(params)
+    if err != nil || parsed.Algorithm != KDF_SCRYPT {
+        t.Fatalf("expected new scrypt parameters, got %q %v", params, err)
+    }
+    key, _ := parsed.DeriveKey([]byte("hunter2"))
+    if !bytes.Equal(baes.key, key) {
+        t.Errorf("expected key %x, got %x", key, baes.key)
+    }
+    if shown := strings.ToLower(formValue(res.Body.String(), "key-input")); shown != hex.EncodeToString(key) {
+        t.Errorf("expected the key field to show %x, got %s", key, shown)
+    }
+
+    res = postForm(handle_derive_key(baes), url.Values{"kdf": {KDF_SCRYPT}})
+    if msg := formValue(res.Body.String(), "passphrase-error"); !strings.Contains(msg, "Passphrase is required") {
+        t.Errorf("expected a passphrase error, got %q", msg)
+    }
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Keys are generated with crypto/rand in one of three modes:
+//   bytes      all 256 byte values, 8 bits of entropy a byte
+//   printable  the 94 printable ASCII characters but space, so the key can
+//              be typed in as UTF-8. About 6.55 bits a byte
+//   words      words from WORDLIST, 10 bits each, with the key derived
+//              from them like a passphrase
+const (
+    KEYGEN_BYTES = "bytes"
+    KEYGEN_PRINTABLE = "printable"
+    KEYGEN_WORDS = "words"
+)
+
+var KEYGEN_MODES = []string{KEYGEN_BYTES, KEYGEN_PRINTABLE, KEYGEN_WORDS}
+
+// KEY_SIZES are the AES key sizes in bytes. Only KEY_SIZE fits the Basys3,
+// the others can be generated and kept in the keystore
+var KEY_SIZES = []int{16, 24, 32}
+
+const PRINTABLE_CHARSET = "!\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~"
+
+// WORDS is WORDLIST split, 1024 short common words
+var WORDS = strings.Fields(WORDLIST)
+
+type GeneratedKey struct {
+    Mode string
+    Key []byte
+    // what to type instead of the key: the characters of a printable key,
+    // the words of a words key
+    Text string
+    // how the key was derived from the words, nil for the other modes
+    KDF *KDFParams
+    // in bits, what an attacker who knows how the key was made has to guess
+    Entropy float64
+}
+
+func ParseKeySize(bits int) (int, error) {
+    for _, size := range KEY_SIZES {
+        if size*8 == bits {
+            return size, nil
+        }
+    }
+    return 0, fmt.Errorf("keys are 128, 192 or 256 bits, not %d", bits)
+}
+
+// randomIndex is uniform in [0, n)
+func randomIndex(n int) (int, error) {
+    i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+    if err != nil {
+        return 0, err
+    }
+    return int(i.Int64()), nil
+}
+
+// GenerateKey makes a size byte key in mode. kdf is the key derivation for
+// the words mode and ignored otherwise
+func GenerateKey(mode string, size int, kdf string) (GeneratedKey, error) {
+    if _, err := ParseKeySize(size*8); err != nil {
+        return GeneratedKey{}, err
+    }
+    gen := GeneratedKey{Mode: mode}
+    switch mode {
+    case KEYGEN_BYTES:
+        gen.Key = make([]byte, size)
+        _, err := rand.Read(gen.Key)
+        if err != nil {
+            return gen, err
+        }
+        gen.Entropy = float64(size*8)
+    case KEYGEN_PRINTABLE:
+        gen.Key = make([]byte, size)
+        for i := range gen.Key {
+            c, err := randomIndex(len(PRINTABLE_CHARSET))
+            if err != nil {
+                return gen, err
+            }
+            gen.Key[i] = PRINTABLE_CHARSET[c]
+        }
+        gen.Text = string(gen.Key)
+        gen.Entropy = float64(size) * math.Log2(float64(len(PRINTABLE_CHARSET)))
+    case KEYGEN_WORDS:
+        perWord := math.Log2(float64(len(WORDS)))
+        words := make([]string, int(math.Ceil(float64(size*8) / perWord)))
+        for i := range words {
+            w, err := randomIndex(len(WORDS))
+            if err != nil {
+                return gen, err
+            }
+            words[i] = WORDS[w]
+        }
+        gen.Text = strings.Join(words, "-")
+        params, err := NewKDFParams(kdf)
+        if err != nil {
+            return gen, err
+        }
+        gen.KDF = &params
+        gen.Key, err = params.DeriveKeyLen([]byte(gen.Text), size)
+        if err != nil {
+            return gen, err
+        }
+        // the key can not hold more than its size whatever goes into it
+        gen.Entropy = math.Min(float64(len(words)) * perWord, float64(size*8))
+    default:
+        return gen, fmt.Errorf("unknown key generation mode %q. Known modes: %s", mode, strings.Join(KEYGEN_MODES, ", "))
+    }
+    return gen, nil
+}
+
+// Describe is the entropy as shown to the user
+func (g GeneratedKey) Describe() string {
+    switch g.Mode {
+    case KEYGEN_PRINTABLE:
+        return fmt.Sprintf("%.0f bits of entropy, %d printable characters", g.Entropy, len(g.Key))
+    case KEYGEN_WORDS:
+        return fmt.Sprintf("%.0f bits of entropy, %d words", g.Entropy, strings.Count(g.Text, "-") + 1)
+    }
+    return fmt.Sprintf("%.0f bits of entropy", g.Entropy)
+}
+
+// WORDLIST for the words mode. 1024 words so each is 10 bits
+const WORDLIST string = `
+able acid acorn acre act actor adapt add admit adult after again agent agree ahead aim air aisle
+alarm album alert alien alley allow alone alpha also alter amber angel anger angle angry ankle anvil
+apart apple april apron arch area arena argue arm armor army arrow art ash aside ask atom attic
+audio aunt award aware awful axis baby bacon badge bag ball band bank bar barn base basin bat batch
+bath beach bead beam bean bear beard beast bed bee beef begin bell belt bench berry bid big bike
+bind bird birth black blade blame blast blaze blend bless blind blink block blue blur blush board
+boat body boil bold bolt bone bonus book boot boss bowl box boy brain brass brave bread brick brief
+bring brisk broom brown brush buddy build bulb bulk burst bus bush buyer buzz cabin cable cage cake
+call calm camel camp canal candy canoe cape car card cargo cart case cash cat catch cause cave cedar
+cell chair chalk chaos chase chat cheap check chef chest chief child chunk cider city civil claim
+clap claw clay clean clerk click cliff climb clip clock close cloth cloud clown club clump coach
+coast code coil coin color comb comet comic coral core corn couch cover crack craft cram crane crash
+crawl crazy cream creek crew crisp crop cross crowd crush cube cup curve cute cycle dad damp dance
+dash dawn day deal decor deer delay depth desk dial diary dice diet dirt disco dish dog doll donor
+door dose dove draft drama draw dream dress drift drill drink drip drive drop drum dry duck dune
+dust dutch duty dwarf eager eagle early earn earth east easy echo edge edit egg eight elbow elder
+elite else empty enact end enemy enjoy enter entry equal equip erase erode error erupt essay evoke
+exact exile exist exit extra eye face fade faint faith fall false fame fan fancy farm fat fault fee
+feed feel fence fetch fever few fiber field file film final find fine fire firm first fish fit fix
+flag flame flash flat flee flip float flock floor fluid flush fly foam focus fog foil fold food foot
+force fork forum found fox frame fresh frog front frost frown fruit fuel fun funny fury gain game
+gap gas gasp gate gauge gaze genre ghost giant gift girl give glad glare glass glide globe gloom
+glory glove glow glue goat gold good goose gown grab grace grain grant grape grass great green grid
+grief grit group grow grunt guard guess guide guilt gym habit hair half hand happy hard harsh hat
+have hawk head heart heavy hello help hen hero high hill hint hip hire hobby hold hole home honey
+hood hope horn horse host hotel hour hover hub huge human humor hunt hurry ice icon idea idle ill
+image inch index inner input into iron issue item ivory jar jazz jeans jelly jewel job join joke joy
+judge juice jump junk just keen keep key kick kid kind kiss kit kite kiwi knee knife knock know lab
+label labor lady lake lamp large later latin laugh lava law lawn layer lazy leaf learn leave left
+leg legal lemon lend lens level life lift light like limb limit link lion list live load loan local
+lock logic long loop loud love loyal lucky lunar lunch mad magic maid mail main major make man mango
+maple march mask mass match math maze mean meat medal media melt menu mercy merge merit merry mesh
+metal milk mimic mind minor miss mix mixed model mom month moon moral more motor mouse move movie
+much mule music must myth naive name near neck need nerve nest net never news next nice night noble
+noise north nose note novel now nurse nut oak obey occur ocean odor off offer often oil okay old
+olive omit once one onion only open opera orbit order organ other outer oval oven over own owner
+ozone pact page pair palm panda panel panic paper park party pass patch path pause pave peace pear
+pen pet phone photo piano piece pig pill pilot pink pipe pitch pizza place plate play pluck plug
+poem poet point polar pole pond pony pool post power price pride print prize proof proud pull pulp
+pulse punch pupil puppy purse push put quick quit quiz quote race rack radar radio rail rain raise
+rally ramp ranch range rapid rare rate raven raw razor ready real rebel relax rely renew rent rib
+rice rich ride ridge right rigid ring risk rival river road roast robot roof room rose rough round
+route royal rug rule run rural sad safe sail salad salon salt same sand sauce save say scale scan
+scare scene scout scrap scrub sea seat seed seek sell sense setup seven shaft share shed shell shift
+shine ship shock shoe shoot shop short shove shrug shy side siege sight sign silk silly since sing
+siren six size skate ski skill skin skirt skull slab slam sleep slice slide slim slot slow slush
+small smart smile smoke snack snake snap sniff snow soap sock soda soft solar solid solve song soon
+sorry sort soul sound soup south space spare spawn speak speed spell spend spice spike spin split
+spoil spoon sport spot spray spy staff stage stamp stand start state stay steak steel stem step
+stick still sting stock stone stool story stove stuff style such sugar suit sun sunny super sure
+surge swamp swap swarm swear sweet swift swim swing sword syrup table tag tail talk tank tape task
+taste taxi teach team tell ten tent term test text thank that theme then there they this tide tilt
+time tiny tip toe tone tool top toss town toy trap tray tree trim trip true try tube tuna turn twin
+two type undo unit upon urge use used van vast verb very view visa void vote wage wait walk wall
+want warm wash wasp wave way wear web west wet what when whip wide wife wild will win wine wing wink
+wire wise wish wolf wood wool word work wrap yard year you zero zone zoo
+`
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+    for _, size := range KEY_SIZES {
+        gen, err := GenerateKey(KEYGEN_BYTES, size, KDF_ARGON2ID)
+        if err != nil || len(gen.Key) != size || gen.Entropy != float64(size*8) {
+            t.Errorf("bytes %d: %+v %v", size, gen, err)
+        }
+        gen, err = GenerateKey(KEYGEN_PRINTABLE, size, KDF_ARGON2ID)
+        if err != nil || len(gen.Key) != size || gen.Text != string(gen.Key) {
+            t.Errorf("printable %d: %+v %v", size, gen, err)
+        }
+        for _, c := range gen.Key {
+            if c <= ' ' || c > '~' {
+                t.Errorf("printable %d: %q is not printable", size, c)
+            }
+        }
+        if expected := 6.554588851677638 * float64(size); gen.Entropy < expected - 0.001 || gen.Entropy > expected + 0.001 {
+            t.Errorf("printable %d: entropy %f, expected %f", size, gen.Entropy, expected)
+        }
+    }
+    if _, err := GenerateKey(KEYGEN_BYTES, 20, KDF_ARGON2ID); err == nil {
+        t.Error("a 160 bit key was generated")
+    }
+    if _, err := GenerateKey("dice", KEY_SIZE, KDF_ARGON2ID); err == nil {
+        t.Error("unknown mode was accepted")
+    }
+}
+
+func TestGenerateKeyWords(t *testing.T) {
+    if len(WORDS) != 1024 {
+        t.Fatalf("expected 1024 words, got %d", len(WORDS))
+    }
+    seen := map[string]bool{}
+    for _, w := range WORDS {
+        if seen[w] {
+            t.Errorf("%s is in the word list twice", w)
+        }
+        seen[w] = true
+    }
+    for size, words := range map[int]int{16: 13, 32: 26} {
+        gen, err := GenerateKey(KEYGEN_WORDS, size, KDF_PBKDF2)
+        if err != nil {
+            t.Fatal(err)
+        }
+        parts := strings.Split(gen.Text, "-")
+        if len(parts) != words || gen.Entropy != float64(size*8) {
+            t.Errorf("%d bytes: %d words and %f bits, expected %d and %d", size, len(parts), gen.Entropy, words, size*8)
+        }
+        for _, w := range parts {
+            if !seen[w] {
+                t.Errorf("%s is not in the word list", w)
+            }
+        }
+        // the words and the parameters give the key back
+        again, err := gen.KDF.DeriveKeyLen([]byte(gen.Text), size)
+        if err != nil || len(gen.Key) != size || !bytes.Equal(again, gen.Key) {
+            t.Errorf("%d bytes: derived %x, generated %x %v", size, again, gen.Key, err)
+        }
+    }
+}
+
+// not a randomness test, just that no value is left out the way the old
+// charset left out most bytes
+func TestGenerateKeyCoversAllBytes(t *testing.T) {
+    seen := map[byte]bool{}
+    for i := 0; i < 400 && len(seen) < 256; i++ {
+        gen, _ := GenerateKey(KEYGEN_BYTES, 32, KDF_ARGON2ID)
+        for _, b := range gen.Key {
+            seen[b] = true
+        }
+    }
+    if len(seen) != 256 {
+        t.Errorf("only %d byte values in 400 keys", len(seen))
+    }
+}
+
+func TestCLIKeygen(t *testing.T) {
+    stdout, stderr, code := runCLI(t, "", "keygen", "-bits", "256")
+    if code != 0 || len(strings.TrimSpace(stdout)) != 64 || !strings.Contains(stderr, "256 bits of entropy") {
+        t.Errorf("bytes: exit %d %q %q", code, stdout, stderr)
+    }
+    stdout, stderr, code = runCLI(t, "", "keygen", "-mode", "printable")
+    if code != 0 || len(strings.TrimSpace(stdout)) != 16 || !strings.Contains(stderr, "105 bits of entropy") {
+        t.Errorf("printable: exit %d %q %q", code, stdout, stderr)
+    }
+    stdout, stderr, code = runCLI(t, "", "keygen", "-mode", "words", "-kdf", KDF_PBKDF2, "-key-encoding", "hex")
+    lines := strings.Split(strings.TrimSpace(stdout), "\n")
+    if code != 0 || len(lines) != 3 || !strings.HasPrefix(lines[1], "$pbkdf2-sha256$") || !strings.Contains(stderr, "13 words") {
+        t.Fatalf("words: exit %d %q %q", code, stdout, stderr)
+    }
+    // the words and the parameters are all the passphrase field needs
+    params, _ := ParseKDFParams(lines[1])
+    key, _ := params.DeriveKey([]byte(lines[0]))
+    if lines[2] != hexString(key) {
+        t.Errorf("words: key %s, derived %x", lines[2], key)
+    }
+    if _, _, code := runCLI(t, "", "keygen", "-bits", "100"); code != 2 {
+        t.Errorf("100 bits: exit %d", code)
+    }
+}
+
+func hexString(b []byte) string {
+    text, _ := ENCODING_HEX.Encode(b)
+    return text
+}
+
+func TestUIRandomKey(t *testing.T) {
+    baes := new(BAESys128)
+    res := postForm(handle_random_key(baes), url.Values{"key-encoding": {"utf-8"}})
+    body := res.Body.String()
+    if key := formValue(body, "key-input"); len(key) != 32 {
+        t.Errorf("expected a hex key, got %q", key)
+    }
+    if !strings.Contains(body, `value="hex" selected`) || !strings.Contains(body, "128 bits of entropy") {
+        t.Errorf("expected the encoding switched to hex and the entropy, got %s", body)
+    }
+
+    res = postForm(handle_random_key(baes), url.Values{"key-encoding": {"utf-8"}, "keygen-mode": {KEYGEN_PRINTABLE}})
+    key := formValue(res.Body.String(), "key-input")
+    if len(key) != 16 {
+        t.Errorf("expected 16 printable characters, got %q", key)
+    }
+
+    res = postForm(handle_random_key(baes), url.Values{"keygen-mode": {KEYGEN_WORDS}, "kdf": {KDF_PBKDF2}})
+    body = res.Body.String()
+    passphrase := formValue(body, "passphrase")
+    params, err := ParseKDFParams(formValue(body, "kdf-params"))
+    if strings.Count(passphrase, "-") != 12 || err != nil {
+        t.Fatalf("expected 13 words and parameters, got %q %v", passphrase, err)
+    }
+    derived, _ := params.DeriveKey([]byte(passphrase))
+    if shown := formValue(body, "key-input"); shown != hexString(derived) {
+        t.Errorf("expected the derived key %x, got %s", derived, shown)
+    }
+}
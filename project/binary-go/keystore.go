@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The keystore keeps named keys in a JSON file sealed with a master
+// passphrase:
+//
+//   {"version": 1, "kdf": "<KDFParams.String>", "wrapped": "<base64>"}
+//
+// wrapped is the JSON of the keys, padded with spaces to a multiple of 8
+// bytes and AES key wrapped (RFC 3394) with the key the passphrase derives.
+// Key wrap checks its own integrity, so a wrong passphrase or a changed
+// file fails to open instead of giving garbage
+const KEYSTORE_VERSION = 1
+
+// KEYSTORE_KDF derives the key encryption key of a new keystore
+var KEYSTORE_KDF = KDF_ARGON2ID
+
+var (
+    ErrWrongMasterPassphrase = errors.New("wrong master passphrase or damaged keystore")
+    ErrKeyNotFound = errors.New("no such key in the keystore")
+    ErrKeyExists = errors.New("a key with that name is already in the keystore")
+)
+
+type StoredKey struct {
+    Name string `json:"name"`
+    Key []byte `json:"key"`
+    Created time.Time `json:"created"`
+    // zero until the key encrypts or decrypts something
+    Used time.Time `json:"used"`
+    // in bits, zero for imported keys since there is no knowing
+    Entropy float64 `json:"entropy,omitempty"`
+    // for a words key, how to derive it from the words again
+    KDF string `json:"kdf,omitempty"`
+}
+
+type Keystore struct {
+    path string
+    kdf KDFParams
+    // derived from the master passphrase, the passphrase is not kept
+    kek []byte
+    Keys []StoredKey `json:"keys"`
+    // used when no key is named, and for ciphertexts without a key ID
+    Selected string `json:"selected"`
+}
+
+type keystoreFile struct {
+    Version int `json:"version"`
+    KDF string `json:"kdf"`
+    Wrapped []byte `json:"wrapped"`
+}
+
+// DefaultKeystorePath is keystore.json next to baud.json, or empty if there
+// is no user config directory
+func DefaultKeystorePath() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "basys3-aes", "keystore.json")
+}
+
+// OpenKeystore unlocks the keystore at path. A missing file is an empty
+// keystore that is written on the first change. An empty path is a
+// keystore that is never saved
+func OpenKeystore(path string, passphrase []byte) (*Keystore, error) {
+    if len(passphrase) == 0 {
+        return nil, fmt.Errorf("master passphrase is required")
+    }
+    store := &Keystore{path: path, Keys: []StoredKey{}}
+    var data []byte
+    var err error
+    if path != "" {
+        data, err = os.ReadFile(path)
+    }
+    if path == "" || errors.Is(err, os.ErrNotExist) {
+        store.kdf, err = NewKDFParams(KEYSTORE_KDF)
+        if err == nil {
+            store.kek, err = store.kdf.DeriveKey(passphrase)
+        }
+        return store, err
+    }
+    if err != nil {
+        return nil, err
+    }
+    var file keystoreFile
+    err = json.Unmarshal(data, &file)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    if file.Version != KEYSTORE_VERSION {
+        return nil, fmt.Errorf("%s is keystore version %d, only %d is known", path, file.Version, KEYSTORE_VERSION)
+    }
+    store.kdf, err = ParseKDFParams(file.KDF)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    store.kek, err = store.kdf.DeriveKey(passphrase)
+    if err != nil {
+        return nil, err
+    }
+    plain, err := UnwrapKey(store.kek, file.Wrapped)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s", ErrWrongMasterPassphrase, path)
+    }
+    err = json.Unmarshal(plain, store)
+    if err != nil {
+        return nil, fmt.Errorf("%w: %s holds no keys: %v", ErrWrongMasterPassphrase, path, err)
+    }
+    if store.Keys == nil {
+        store.Keys = []StoredKey{}
+    }
+    return store, nil
+}
+
+func (k *Keystore) Path() string {
+    return k.path
+}
+
+// Save seals the keys and replaces the file in one rename so a crash can
+// not leave half a keystore
+func (k *Keystore) Save() error {
+    if k.path == "" {
+        return nil
+    }
+    plain, err := json.Marshal(k)
+    if err != nil {
+        return err
+    }
+    // JSON ignores the trailing spaces
+    for len(plain) < 16 || len(plain) % 8 != 0 {
+        plain = append(plain, ' ')
+    }
+    wrapped, err := WrapKey(k.kek, plain)
+    if err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(keystoreFile{Version: KEYSTORE_VERSION, KDF: k.kdf.String(), Wrapped: wrapped}, "", "  ")
+    if err != nil {
+        return err
+    }
+    err = os.MkdirAll(filepath.Dir(k.path), 0o700)
+    if err != nil {
+        return err
+    }
+    tmp := k.path + ".tmp"
+    err = os.WriteFile(tmp, data, 0o600)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp, k.path)
+}
+
+func (k *Keystore) index(name string) int {
+    for i, key := range k.Keys {
+        if key.Name == name {
+            return i
+        }
+    }
+    return -1
+}
+
+func (k *Keystore) Get(name string) (StoredKey, error) {
+    i := k.index(name)
+    if i < 0 {
+        return StoredKey{}, fmt.Errorf("%w: %q", ErrKeyNotFound, name)
+    }
+    return k.Keys[i], nil
+}
+
+// Add stores key under name, which is also the key ID it gets in
+// containers so it has to fit in one. Any AES key size is kept, though
+// only KEY_SIZE works on the Basys3
+func (k *Keystore) Add(name string, key []byte) error {
+    return k.add(StoredKey{Name: name, Key: key})
+}
+
+func (k *Keystore) add(key StoredKey) error {
+    if key.Name == "" || len(key.Name) > 255 {
+        return fmt.Errorf("key name must be 1 to 255 bytes, not %d", len(key.Name))
+    }
+    if _, err := ParseKeySize(len(key.Key)*8); err != nil {
+        return err
+    }
+    if k.index(key.Name) >= 0 {
+        return fmt.Errorf("%w: %q", ErrKeyExists, key.Name)
+    }
+    key.Key = append([]byte{}, key.Key...)
+    key.Created = time.Now().UTC().Truncate(time.Second)
+    k.Keys = append(k.Keys, key)
+    return k.Save()
+}
+
+// Generate stores a new key made by GenerateKey under name. The words of a
+// words key are not stored, the caller shows them once
+func (k *Keystore) Generate(name string, mode string, size int) (GeneratedKey, error) {
+    gen, err := GenerateKey(mode, size, KDF_ARGON2ID)
+    if err != nil {
+        return gen, err
+    }
+    key := StoredKey{Name: name, Key: gen.Key, Entropy: gen.Entropy}
+    if gen.KDF != nil {
+        key.KDF = gen.KDF.String()
+    }
+    return gen, k.add(key)
+}
+
+func (k *Keystore) Delete(name string) error {
+    i := k.index(name)
+    if i < 0 {
+        return fmt.Errorf("%w: %q", ErrKeyNotFound, name)
+    }
+    k.Keys = append(k.Keys[:i], k.Keys[i + 1:]...)
+    if k.Selected == name {
+        k.Selected = ""
+    }
+    return k.Save()
+}
+
+func (k *Keystore) Select(name string) error {
+    if k.index(name) < 0 {
+        return fmt.Errorf("%w: %q", ErrKeyNotFound, name)
+    }
+    k.Selected = name
+    return k.Save()
+}
+
+// Resolve is the key a ciphertext with key ID id was encrypted with. An
+// empty id is the selected key
+func (k *Keystore) Resolve(id string) (StoredKey, error) {
+    if id != "" {
+        return k.Get(id)
+    }
+    if k.Selected == "" {
+        return StoredKey{}, fmt.Errorf("%w: no key ID and no key selected", ErrKeyNotFound)
+    }
+    return k.Get(k.Selected)
+}
+
+// Touch records that the keys holding key were just used
+func (k *Keystore) Touch(key []byte) error {
+    touched := false
+    for i := range k.Keys {
+        if bytes.Equal(k.Keys[i].Key, key) {
+            k.Keys[i].Used = time.Now().UTC().Truncate(time.Second)
+            touched = true
+        }
+    }
+    if !touched {
+        return nil
+    }
+    return k.Save()
+}
+
+// KeystoreSession is the keystore the web UI unlocked, it stays unlocked
+// until Lock or until the server exits. A nil session is a server without
+// a keystore
+type KeystoreSession struct {
+    mtx sync.Mutex
+    path string
+    store *Keystore
+}
+
+// KeystoreView is what the UI shows of the keystore
+type KeystoreView struct {
+    Enabled bool
+    Unlocked bool
+    Path string
+    Keys []StoredKey
+    Selected string
+}
+
+func (s *BAESys128) SetKeystore(path string) {
+    if path == "" {
+        s.keystore = nil
+        return
+    }
+    s.keystore = &KeystoreSession{path: path}
+}
+
+func (s *BAESys128) Keystore() *KeystoreSession {
+    return s.keystore
+}
+
+func (k *KeystoreSession) View() KeystoreView {
+    if k == nil {
+        return KeystoreView{}
+    }
+    k.mtx.Lock()
+    defer k.mtx.Unlock()
+    view := KeystoreView{Enabled: true, Path: k.path}
+    if k.store != nil {
+        view.Unlocked = true
+        view.Keys = append([]StoredKey{}, k.store.Keys...)
+        view.Selected = k.store.Selected
+    }
+    return view
+}
+
+// do runs f on the unlocked keystore
+func (k *KeystoreSession) do(f func(store *Keystore) error) error {
+    if k == nil {
+        return fmt.Errorf("server has no keystore, start it with -keystore")
+    }
+    k.mtx.Lock()
+    defer k.mtx.Unlock()
+    if k.store == nil {
+        return fmt.Errorf("keystore is locked, unlock it with the master passphrase first")
+    }
+    return f(k.store)
+}
+
+func (k *KeystoreSession) Unlock(passphrase []byte) error {
+    if k == nil {
+        return fmt.Errorf("server has no keystore, start it with -keystore")
+    }
+    store, err := OpenKeystore(k.path, passphrase)
+    if err != nil {
+        return err
+    }
+    k.mtx.Lock()
+    k.store = store
+    k.mtx.Unlock()
+    return nil
+}
+
+func (k *KeystoreSession) Lock() {
+    if k == nil {
+        return
+    }
+    k.mtx.Lock()
+    k.store = nil
+    k.mtx.Unlock()
+}
+
+func (k *KeystoreSession) Resolve(id string) (StoredKey, error) {
+    var key StoredKey
+    err := k.do(func(store *Keystore) error {
+        var err error
+        key, err = store.Resolve(id)
+        return err
+    })
+    return key, err
+}
+
+// Touch is Keystore.Touch when the keystore is unlocked, and nothing
+// otherwise since any key can be typed in
+func (k *KeystoreSession) Touch(key []byte) {
+    if k.View().Unlocked {
+        err := k.do(func(store *Keystore) error {
+            return store.Touch(key)
+        })
+        if err != nil {
+            componentLog(COMPONENT_KEYSTORE).Warn("Failed to record key use in the keystore", errAttr(err))
+        }
+    }
+}
+
+// resolve_key_id fills in the key of a container from the keystore when
+// the form gave neither a key nor a passphrase
+func resolve_key_id(baes *BAESys128, r *http.Request, req *DecryptRequest, errs FieldErrors, opts *PageFormOpts) {
+    if errs.Get("key") == nil || formField(r, "key") != nil || formField(r, "passphrase") != nil {
+        return
+    }
+    if req.Container == nil || req.Container.KeyID == "" || !baes.Keystore().View().Unlocked {
+        return
+    }
+    stored, err := baes.Keystore().Resolve(req.Container.KeyID)
+    if err != nil {
+        errs["key"] = fmt.Sprintf("Key is required, the container's key ID is not in the keystore: %s", err)
+        return
+    }
+    delete(errs, "key")
+    req.Key = stored.Key
+    opts.show_stored_key(stored)
+    componentLog(COMPONENT_KEYSTORE).Info("Key ID resolved from the keystore", "key_id", stored.Name)
+}
+
+// show_stored_key puts a key from the keystore in the key field and its
+// name in the key ID so containers are labelled with it
+func (opts *PageFormOpts) show_stored_key(key StoredKey) {
+    opts.key_encoding = ENCODING_HEX.Name
+    opts.key = show_bytes(key.Key, &opts.key_encoding)
+    opts.key_id = &key.Name
+}
+
+// handle_keystore runs one keystore action from the form. All of them but
+// unlock need the keystore unlocked
+func handle_keystore(baes *BAESys128, action string) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        opts := parse_form(r, baes)
+        keys := baes.Keystore()
+        name := empty_if_nil(formField(r, "key-name"))
+        stored := empty_if_nil(formField(r, "stored-key"))
+        var err error
+        switch action {
+        case "unlock":
+            err = keys.Unlock([]byte(empty_if_nil(formField(r, "master-passphrase"))))
+            if err == nil {
+                componentLog(COMPONENT_KEYSTORE).Info("Unlocked keystore", "path", keys.path)
+            }
+        case "lock":
+            keys.Lock()
+            componentLog(COMPONENT_KEYSTORE).Info("Locked keystore")
+        case "create":
+            mode := KEYGEN_BYTES
+            if m := formField(r, "keystore-keygen-mode"); m != nil {
+                mode = *m
+            }
+            bits := KEY_SIZE*8
+            if b := formField(r, "key-bits"); b != nil {
+                bits, err = strconv.Atoi(*b)
+            }
+            var gen GeneratedKey
+            if err == nil {
+                err = keys.do(func(store *Keystore) error {
+                    size, err := ParseKeySize(bits)
+                    if err == nil {
+                        gen, err = store.Generate(name, mode, size)
+                    }
+                    return err
+                })
+            }
+            if err == nil {
+                componentLog(COMPONENT_KEYSTORE).Info("Created key in the keystore", "name", name, "mode", mode, "entropy", gen.Describe())
+                if gen.Text != "" {
+                    // the only time the words are shown
+                    opts.keystore_export = &gen.Text
+                    opts.keystore_export_name = name
+                }
+            }
+        case "import":
+            err = keys.do(func(store *Keystore) error {
+                // any AES key size, not just what parseKey takes
+                key, _, err := fieldBytes(r, "key", ENCODING_UTF8)
+                if err != nil {
+                    return fmt.Errorf("Key is %s", err)
+                }
+                return store.Add(name, key)
+            })
+            if err == nil {
+                componentLog(COMPONENT_KEYSTORE).Info("Imported key into the keystore", "name", name)
+            }
+        case "select":
+            var key StoredKey
+            err = keys.do(func(store *Keystore) error {
+                err := store.Select(stored)
+                if err == nil {
+                    key, err = store.Get(stored)
+                }
+                return err
+            })
+            if err == nil {
+                opts.show_stored_key(key)
+                componentLog(COMPONENT_KEYSTORE).Info("Selected key from the keystore", "name", stored)
+            }
+        case "export":
+            var key StoredKey
+            err = keys.do(func(store *Keystore) error {
+                var err error
+                key, err = store.Get(stored)
+                return err
+            })
+            if err == nil {
+                encoding := ENCODING_HEX.Name
+                opts.keystore_export = show_bytes(key.Key, &encoding)
+                opts.keystore_export_name = key.Name
+            }
+        case "delete":
+            err = keys.do(func(store *Keystore) error {
+                return store.Delete(stored)
+            })
+            if err == nil {
+                componentLog(COMPONENT_KEYSTORE).Info("Deleted key from the keystore", "name", stored)
+            }
+        }
+        if err != nil {
+            err_msg := error_message(err)
+            opts.keystore_err = &err_msg
+        }
+        opts.keystore = keys.View()
+        fmt.Fprint(w, opts.render())
+    }
+}
+
+func format_entropy(bits float64) string {
+    if bits == 0 {
+        return "unknown"
+    }
+    return fmt.Sprintf("%.0f bit", bits)
+}
+
+func format_used(t time.Time) string {
+    if t.IsZero() {
+        return "never"
+    }
+    return t.Local().Format("2006-01-02 15:04")
+}
+
+// keystore_form_group is the keystore: the master passphrase while it is
+// locked, the keys and what can be done with them once it is not
+func keystore_form_group(view KeystoreView, export *string, export_name string, err *string) string {
+    if !view.Enabled {
+        return ""
+    }
+    if !view.Unlocked {
+        return fmt.Sprintf(`
+            <div id="keystore-part" class="flex flex-col gap-2 py-2">
+                <p>Keystore</p>
+                <p class="text-sm text-slate-500">%s</p>
+                <div class="flex flex-row justify-start gap-2">
+                    <input type="password" id="master-passphrase" name="master-passphrase" class="border-2" placeholder="master passphrase"></input>
+                    <button hx-post="/keys/unlock" hx-target="#form" class="border-2 bg-slate-100">
+                        Unlock
+                    </button>
+                </div>
+                %s
+            </div>
+        `, html.EscapeString(view.Path), error_p("keystore-error", err, false))
+    }
+    options := ""
+    rows := ""
+    for _, key := range view.Keys {
+        name := html.EscapeString(key.Name)
+        attr := ""
+        marker := ""
+        if key.Name == view.Selected {
+            attr = "selected"
+            marker = " (selected)"
+        }
+        options += fmt.Sprintf(`<option value="%s" %s>%s</option>`, name, attr, name)
+        rows += fmt.Sprintf(`
+                    <tr><td class="pr-4">%s%s</td><td class="pr-4">%d bit</td><td class="pr-4">%s</td><td class="pr-4">%s</td><td>%s</td></tr>`, name, marker, len(key.Key)*8, format_entropy(key.Entropy), format_used(key.Created), format_used(key.Used))
+    }
+    bits := ""
+    for _, size := range KEY_SIZES {
+        bits += fmt.Sprintf(`<option value="%d">%d bit</option>`, size*8, size*8)
+    }
+    exported := ""
+    if export != nil {
+        exported = fmt.Sprintf(`
+                <div class="flex flex-row gap-2 text-sm">
+                    <code id="keystore-export">%s</code> %s
+                </div>`, *export, download_link(export, ENCODING_HEX.Name, export_name + ".key"))
+    }
+    return fmt.Sprintf(`
+            <div id="keystore-part" class="flex flex-col gap-2 py-2">
+                <div class="flex flex-row gap-4">
+                    <p>Keystore</p>
+                    <p class="text-sm text-slate-500">%s</p>
+                </div>
+                <table class="text-sm">
+                    <tr><th class="text-left">Name</th><th class="text-left">Size</th><th class="text-left">Entropy</th><th class="text-left">Created</th><th class="text-left">Used</th></tr>%s
+                </table>
+                <div class="flex flex-row justify-start gap-2">
+                    <select id="stored-key" name="stored-key" class="border-2">%s</select>
+                    <button hx-post="/keys/select" hx-target="#form" class="border-2 bg-slate-100">Select</button>
+                    <button hx-post="/keys/export" hx-target="#form" class="border-2 bg-slate-100">Export</button>
+                    <button hx-post="/keys/delete" hx-target="#form" hx-confirm="Delete this key? Anything encrypted with it is lost" class="border-2 bg-slate-100">Delete</button>
+                </div>%s
+                <div class="flex flex-row justify-start gap-2">
+                    <input spellcheck="false" type="text" id="key-name" name="key-name" class="border-2" placeholder="name"></input>
+                    %s
+                    <select id="key-bits" name="key-bits" class="border-2">%s</select>
+                    <button hx-post="/keys/create" hx-target="#form" class="border-2 bg-slate-100">Create Random</button>
+                    <button hx-post="/keys/import" hx-target="#form" class="border-2 bg-slate-100">Import Key Field</button>
+                    <button hx-post="/keys/lock" hx-target="#form" class="border-2 bg-slate-100">Lock</button>
+                </div>
+                %s
+            </div>
+        `, html.EscapeString(view.Path), rows, options, exported, keygen_mode_select("keystore-keygen-mode"), bits, error_p("keystore-error", err, false))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyWrap(t *testing.T) {
+    cases := []struct {
+        kek, plain, wrapped string
+    }{
+        // RFC 3394 4.1
+        {"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff", "1fa68b0a8112b447aef34bd8fb5a7b829d3e862371d2cfe5"},
+        // RFC 3394 4.6
+        {"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f", "28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21"},
+        // openssl enc -id-aes128-wrap
+        {"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f", "11826840774d993ff9c2fa02cca3cea0e93b1e1cf96361f93ea6dc2f345194e7b30f964c79f9e61d"},
+    }
+    for _, c := range cases {
+        wrapped, err := WrapKey(mustHex(c.kek), mustHex(c.plain))
+        if err != nil || hex.EncodeToString(wrapped) != c.wrapped {
+            t.Errorf("wrap %s: expected %s got %x %v", c.plain, c.wrapped, wrapped, err)
+        }
+        plain, err := UnwrapKey(mustHex(c.kek), mustHex(c.wrapped))
+        if err != nil || hex.EncodeToString(plain) != c.plain {
+            t.Errorf("unwrap %s: expected %s got %x %v", c.wrapped, c.plain, plain, err)
+        }
+        tampered := mustHex(c.wrapped)
+        tampered[len(tampered) - 1] ^= 1
+        if _, err := UnwrapKey(mustHex(c.kek), tampered); !errors.Is(err, ErrUnwrap) {
+            t.Errorf("tampered %s: expected %v got %v", c.wrapped, ErrUnwrap, err)
+        }
+    }
+    if _, err := WrapKey(mustHex(cases[0].kek), make([]byte, 12)); err == nil {
+        t.Error("12 bytes were wrapped")
+    }
+}
+
+// cheapKeystore keeps the tests from spending their time in argon2id
+func cheapKeystore(t *testing.T) string {
+    prev := KEYSTORE_KDF
+    KEYSTORE_KDF = KDF_SCRYPT
+    t.Cleanup(func() { KEYSTORE_KDF = prev })
+    return filepath.Join(t.TempDir(), "keystore.json")
+}
+
+func TestKeystore(t *testing.T) {
+    path := cheapKeystore(t)
+    store, err := OpenKeystore(path, []byte("master"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("opening wrote the keystore: %v", err)
+    }
+    key := mustHex("00112233445566778899aabbccddeeff")
+    if err := store.Add("lab", key); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Add("lab", key); !errors.Is(err, ErrKeyExists) {
+        t.Errorf("expected %v, got %v", ErrKeyExists, err)
+    }
+    if err := store.Add("short", []byte("short")); err == nil {
+        t.Error("a 5 byte key was stored")
+    }
+    generated, err := store.Generate("random", KEYGEN_BYTES, KEY_SIZE)
+    if err != nil || len(generated.Key) != KEY_SIZE {
+        t.Fatalf("generated %x %v", generated.Key, err)
+    }
+    if _, err := store.Generate("aes-256", KEYGEN_PRINTABLE, 32); err != nil {
+        t.Fatal(err)
+    }
+    if err := store.Select("random"); err != nil {
+        t.Fatal(err)
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Contains(data, []byte("lab")) || bytes.Contains(data, []byte(hex.EncodeToString(key))) {
+        t.Errorf("keystore is not sealed: %s", data)
+    }
+    if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+        t.Errorf("keystore is readable by others: %s", info.Mode())
+    }
+
+    if _, err := OpenKeystore(path, []byte("wrong")); !errors.Is(err, ErrWrongMasterPassphrase) {
+        t.Errorf("expected %v, got %v", ErrWrongMasterPassphrase, err)
+    }
+    reopened, err := OpenKeystore(path, []byte("master"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    stored, err := reopened.Resolve("lab")
+    if err != nil || !bytes.Equal(stored.Key, key) || stored.Created.IsZero() || !stored.Used.IsZero() {
+        t.Errorf("resolved %+v %v", stored, err)
+    }
+    stored, err = reopened.Resolve("")
+    if err != nil || stored.Name != "random" {
+        t.Errorf("expected the selected key, got %+v %v", stored, err)
+    }
+    if err := reopened.Touch(key); err != nil {
+        t.Fatal(err)
+    }
+    if err := reopened.Delete("random"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := reopened.Resolve(""); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("deleted key is still selected: %v", err)
+    }
+
+    reopened, _ = OpenKeystore(path, []byte("master"))
+    if len(reopened.Keys) != 2 || reopened.Keys[0].Used.IsZero() || len(reopened.Keys[1].Key) != 32 || reopened.Keys[1].Entropy < 209 {
+        t.Errorf("expected lab, used, and aes-256, got %+v", reopened.Keys)
+    }
+}
+
+func TestCLIKeystore(t *testing.T) {
+    path := cheapKeystore(t)
+    keys := func(args ...string) (string, string, int) {
+        return runCLI(t, "", append([]string{"keys", "-keystore", path, "-master", "pass:master"}, args...)...)
+    }
+    if _, stderr, code := keys("import", "lab", "00112233445566778899aabbccddeeff"); code != 0 {
+        t.Fatalf("import: exit %d %s", code, stderr)
+    }
+    if _, stderr, code := keys("-key-encoding", "utf-8", "import", "ascii", "0123456789abcdef"); code != 0 {
+        t.Fatalf("import ascii: exit %d %s", code, stderr)
+    }
+    if _, stderr, code := keys("create", "random"); code != 0 {
+        t.Fatalf("create: exit %d %s", code, stderr)
+    }
+    if _, stderr, code := keys("select", "ascii"); code != 0 {
+        t.Fatalf("select: exit %d %s", code, stderr)
+    }
+    if stdout, _, _ := keys("export", "ascii"); stdout != "30313233343536373839616263646566\n" {
+        t.Errorf("export: got %q", stdout)
+    }
+    stdout, _, _ := keys("list")
+    if !strings.Contains(stdout, "* ascii") || !strings.Contains(stdout, "lab") || !strings.Contains(stdout, "random") {
+        t.Errorf("list: got %s", stdout)
+    }
+    if _, stderr, code := keys("delete", "random"); code != 0 {
+        t.Fatalf("delete: exit %d %s", code, stderr)
+    }
+    if _, _, code := keys("export", "random"); code != 1 {
+        t.Errorf("deleted key was exported, exit %d", code)
+    }
+    if _, _, code := runCLI(t, "", "keys", "-keystore", path, "-master", "pass:wrong", "list"); code != 1 {
+        t.Errorf("wrong master passphrase listed keys, exit %d", code)
+    }
+
+    // the key ID in the container picks the key, not the selected one
+    store := []string{"-keystore", path, "-master", "pass:master"}
+    ct, stderr, code := runCLI(t, "by key ID", append(append([]string{"encrypt", "-l", "-container", "armor"}, store...), "-key-name", "lab")...)
+    if code != 0 || !strings.Contains(ct, "Key-ID: lab") {
+        t.Fatalf("encrypt: exit %d %s %s", code, ct, stderr)
+    }
+    stdout, stderr, code = runCLI(t, ct, append([]string{"decrypt", "-l"}, store...)...)
+    if code != 0 || stdout != "by key ID" {
+        t.Errorf("decrypt: exit %d %q %s", code, stdout, stderr)
+    }
+    stdout, stderr, code = runCLI(t, ct, "decrypt", "-l", "00112233445566778899aabbccddeeff")
+    if code != 0 || stdout != "by key ID" {
+        t.Errorf("the key is still the lab key: exit %d %q %s", code, stdout, stderr)
+    }
+    // and without -key-name the selected key is used
+    ct, _, _ = runCLI(t, "selected", append([]string{"encrypt", "-l"}, store...)...)
+    stdout, stderr, code = runCLI(t, ct, "decrypt", "-l", "-key-encoding", "utf-8", "0123456789abcdef")
+    if code != 0 || stdout != "selected" {
+        t.Errorf("selected key: exit %d %q %s", code, stdout, stderr)
+    }
+
+    if _, _, code := runCLI(t, "", "encrypt", "-l", "-key-name", "lab", "00112233445566778899aabbccddeeff"); code != 2 {
+        t.Errorf("-key-name without -master: exit %d", code)
+    }
+}
+
+func TestUIKeystore(t *testing.T) {
+    path := cheapKeystore(t)
+    baes := new(BAESys128)
+    baes.SetKeystore(path)
+
+    res := postForm(handle_keystore(baes, "create"), url.Values{"key-name": {"lab"}})
+    if msg := formValue(res.Body.String(), "keystore-error"); !strings.Contains(msg, "locked") {
+        t.Errorf("expected a locked keystore, got %q", msg)
+    }
+    postForm(handle_keystore(baes, "unlock"), url.Values{"master-passphrase": {"master"}})
+    if !baes.Keystore().View().Unlocked {
+        t.Fatal("keystore did not unlock")
+    }
+    postForm(handle_keystore(baes, "create"), url.Values{"key-name": {"lab"}})
+    postForm(handle_keystore(baes, "import"), url.Values{"key-name": {"typed"}, "key": {"0123456789abcdef"}})
+    view := baes.Keystore().View()
+    if len(view.Keys) != 2 {
+        t.Fatalf("expected 2 keys, got %+v", view.Keys)
+    }
+    lab := view.Keys[0].Key
+
+    res = postForm(handle_keystore(baes, "select"), url.Values{"stored-key": {"lab"}})
+    page := res.Body.String()
+    if key := strings.ToLower(formValue(page, "key-input")); key != hex.EncodeToString(lab) {
+        t.Errorf("expected the key field to show %x, got %s", lab, key)
+    }
+    if id := formValue(page, "key-id"); id != "lab" {
+        t.Errorf("expected key ID lab, got %q", id)
+    }
+    res = postForm(handle_keystore(baes, "export"), url.Values{"stored-key": {"typed"}})
+    if !strings.Contains(res.Body.String(), "30313233343536373839616263646566") {
+        t.Errorf("expected the exported key, got %s", res.Body.String())
+    }
+
+    res = postForm(handle_encrypt_message(baes), url.Values{
+        "key": {hex.EncodeToString(lab)},
+        "key-encoding": {"hex"},
+        "message": {"hello"},
+        "ciphertext-format": {FORMAT_ARMORED},
+        "key-id": {"lab"},
+    })
+    armor := textareaValue(res.Body.String(), "ciphertext")
+    // a fresh page with nothing but the ciphertext
+    res = postForm(handle_decrypt_message(baes), url.Values{"ciphertext": {armor}, "message": {"hello"}})
+    if body := res.Body.String(); !strings.Contains(body, "Same as original message") {
+        t.Errorf("expected the key ID to find the key, got %s", body)
+    }
+    if used := baes.Keystore().View().Keys[0].Used; used.IsZero() {
+        t.Error("lab was not marked used")
+    }
+
+    postForm(handle_keystore(baes, "delete"), url.Values{"stored-key": {"lab"}})
+    res = postForm(handle_decrypt_message(baes), url.Values{"ciphertext": {armor}})
+    if msg := formValue(res.Body.String(), "key-error"); !strings.Contains(msg, "not in the keystore") {
+        t.Errorf("expected a missing key ID, got %q", msg)
+    }
+
+    postForm(handle_keystore(baes, "lock"), url.Values{})
+    res = postForm(handle_keystore(baes, "unlock"), url.Values{"master-passphrase": {"wrong"}})
+    if msg := formValue(res.Body.String(), "keystore-error"); !strings.Contains(msg, "wrong master passphrase") {
+        t.Errorf("expected a wrong passphrase, got %q", msg)
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// AES key wrap as in RFC 3394, on the go AES. Never on the Basys3, what is
+// wrapped must not cross the UART in the clear
+
+// KEYWRAP_IV is the default initial value, checked again on unwrap
+var KEYWRAP_IV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+var ErrUnwrap = errors.New("key unwrap integrity check failed")
+
+func keywrapCipher(kek []byte) (*AES, error) {
+    a, err := NewAES(kek)
+    if err != nil {
+        return nil, fmt.Errorf("key encryption key is %d bytes: %w", len(kek), err)
+    }
+    a.DisableTrojan()
+    return a, nil
+}
+
+// WrapKey wraps plaintext, at least 16 bytes and a multiple of 8, with kek
+// (16, 24 or 32 bytes). The result is 8 bytes longer
+func WrapKey(kek []byte, plaintext []byte) ([]byte, error) {
+    if len(plaintext) < 16 || len(plaintext) % 8 != 0 {
+        return nil, fmt.Errorf("key wrap needs a multiple of 8 bytes, at least 16, not %d", len(plaintext))
+    }
+    a, err := keywrapCipher(kek)
+    if err != nil {
+        return nil, err
+    }
+    n := len(plaintext) / 8
+    out := make([]byte, 8 + len(plaintext))
+    copy(out, KEYWRAP_IV)
+    copy(out[8:], plaintext)
+    block := make([]byte, BLOCK_SIZE)
+    for j := 0; j < 6; j++ {
+        for i := 1; i <= n; i++ {
+            copy(block, out[:8])
+            copy(block[8:], out[i*8:])
+            b := a.Encrypt(block)
+            t := uint64(n*j + i)
+            binary.BigEndian.PutUint64(out, binary.BigEndian.Uint64(b) ^ t)
+            copy(out[i*8:], b[8:])
+        }
+    }
+    return out, nil
+}
+
+// UnwrapKey undoes WrapKey. ErrUnwrap means the wrong kek or a ciphertext
+// that was changed
+func UnwrapKey(kek []byte, ciphertext []byte) ([]byte, error) {
+    if len(ciphertext) < 24 || len(ciphertext) % 8 != 0 {
+        return nil, fmt.Errorf("%w: wrapped key is %d bytes, not a multiple of 8 of at least 24", ErrUnwrap, len(ciphertext))
+    }
+    a, err := keywrapCipher(kek)
+    if err != nil {
+        return nil, err
+    }
+    n := len(ciphertext) / 8 - 1
+    out := append([]byte{}, ciphertext...)
+    block := make([]byte, BLOCK_SIZE)
+    for j := 5; j >= 0; j-- {
+        for i := n; i >= 1; i-- {
+            t := uint64(n*j + i)
+            binary.BigEndian.PutUint64(block, binary.BigEndian.Uint64(out) ^ t)
+            copy(block[8:], out[i*8:i*8 + 8])
+            b := a.Decrypt(block)
+            copy(out, b[:8])
+            copy(out[i*8:], b[8:])
+        }
+    }
+    if subtle.ConstantTimeCompare(out[:8], KEYWRAP_IV) != 1 {
+        return nil, ErrUnwrap
+    }
+    return out[8:], nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hammer logs writers*each messages at once and returns an error if they
+// take long enough that Log must have blocked
+func hammer(logger *Logger, writers int, each int) error {
+    var wg sync.WaitGroup
+    for w := 0; w < writers; w++ {
+        wg.Add(1)
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < each; i++ {
+                logger.Log(LogEntry{Msg: fmt.Sprintf("writer %d message %d", w, i)})
+            }
+        }(w)
+    }
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-time.After(10 * time.Second):
+        return errors.New("Log blocked")
+    }
+}
+
+// countLogged splits what a subscriber got into messages logged and drop
+// notices, adding up what the notices say was dropped
+func countLogged(entries []LogEntry) (int, uint64) {
+    logged := 0
+    dropped := uint64(0)
+    for _, entry := range entries {
+        if entry.Msg != LOG_DROPPED {
+            logged++
+            continue
+        }
+        for _, a := range entry.Attrs {
+            if a.Key == "dropped" {
+                n, _ := strconv.ParseUint(a.Value, 10, 64)
+                dropped += n
+            }
+        }
+    }
+    return logged, dropped
+}
+
+// with nothing reading the queue Log drops the oldest messages instead of
+// waiting, and says how many
+func TestLoggerDropsOldest(t *testing.T) {
+    logger := NewLogger()
+    sub := &logSubscriber{send: make(chan LogEntry, 20000)}
+    logger.hub.subscribers[sub] = true
+    // doLogging is stuck broadcasting until this is unlocked
+    logger.hub.mtx.Lock()
+    if err := hammer(logger, 8, 1000); err != nil {
+        t.Fatal(err)
+    }
+    if logger.Dropped() == 0 {
+        t.Error("8000 messages fit in the queue")
+    }
+    logger.hub.mtx.Unlock()
+    logger.Teardown()
+
+    msgs := []LogEntry{}
+    for msg := range sub.send {
+        msgs = append(msgs, msg)
+    }
+    logged, dropped := countLogged(msgs)
+    if dropped != logger.Dropped() || uint64(logged) + dropped != 8000 {
+        t.Errorf("%d messages and %d reported dropped, %d dropped, expected 8000 in all", logged, dropped, logger.Dropped())
+    }
+    // the newest messages are the ones kept
+    if last := msgs[len(msgs) - 1]; !strings.Contains(last.Msg, "message 999") {
+        t.Errorf("last message is %q", last.Msg)
+    }
+}
+
+func TestLoggerWithConnection(t *testing.T) {
+    logger := NewLogger()
+    conn := dialLog(t, logServer(t, logger.hub))
+    waitSubscribers(t, logger.hub, 1)
+
+    received := make(chan []LogEntry)
+    go func() {
+        msgs := []LogEntry{}
+        for {
+            got, err := readLogEntries(conn, 1)
+            if err != nil {
+                received <- msgs
+                return
+            }
+            msgs = append(msgs, got...)
+        }
+    }()
+    if err := hammer(logger, 8, 500); err != nil {
+        t.Fatal(err)
+    }
+    // sends what is queued and closes the socket, which ends the reader
+    logger.Teardown()
+    logged, dropped := countLogged(<-received)
+    // dropped by the logger or by the hub for this page, either way it was
+    // told
+    if uint64(logged) + dropped != 4000 || dropped < logger.Dropped() {
+        t.Errorf("%d messages and %d dropped, %d by the logger, expected 4000 in all", logged, dropped, logger.Dropped())
+    }
+}
+
+func TestLoggerTeardown(t *testing.T) {
+    logger := NewLogger()
+    hammered := make(chan error)
+    go func() {
+        hammered <- hammer(logger, 8, 1000)
+    }()
+    time.Sleep(time.Millisecond)
+    // entries racing Teardown and after it are dropped
+    logger.Teardown()
+    logger.Teardown()
+    if err := <-hammered; err != nil {
+        t.Fatal(err)
+    }
+    logger.Log(LogEntry{Msg: "after teardown"})
+    if logger.hub.Subscribers() != 0 {
+        t.Error("hub still has subscribers")
+    }
+    // a page opened after Teardown is turned away
+    conn := dialLog(t, logServer(t, logger.hub))
+    if _, err := readLog(conn, 1); err == nil || logger.hub.Subscribers() != 0 {
+        t.Errorf("a closed hub took a subscriber: %v", err)
+    }
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// What logged a message, the log panel filters on it
+const (
+    COMPONENT_SERVER = "server"
+    COMPONENT_DEVICE = "device"
+    COMPONENT_KEY = "key"
+    COMPONENT_KEYSTORE = "keystore"
+    COMPONENT_CRYPTO = "crypto"
+    COMPONENT_FILE = "file"
+    COMPONENT_SELFTEST = "selftest"
+    COMPONENT_LAB = "lab"
+    COMPONENT_LOG = "log"
+)
+
+var COMPONENTS = []string{COMPONENT_SERVER, COMPONENT_DEVICE, COMPONENT_KEY, COMPONENT_KEYSTORE, COMPONENT_CRYPTO, COMPONENT_FILE, COMPONENT_SELFTEST, COMPONENT_LAB, COMPONENT_LOG}
+
+// Attributes used all over. Anything else is named where it is logged
+const (
+    ATTR_COMPONENT = "component"
+    // serial port, or capture being replayed
+    ATTR_DEVICE = "device"
+    ATTR_BLOCK = "block"
+    ATTR_BYTES = "bytes"
+    ATTR_ERR = "err"
+    // key check value, what is logged instead of a key
+    ATTR_KCV = "kcv"
+)
+
+// componentLog is the default logger with the component attached. Not kept
+// in a variable since serve replaces the default
+func componentLog(component string) *slog.Logger {
+    return slog.Default().With(ATTR_COMPONENT, component)
+}
+
+// log is componentLog with the Basys3 attached when there is one
+func (s *BAESys128) log(component string) *slog.Logger {
+    l := componentLog(component)
+    if s.device != "" {
+        l = l.With(ATTR_DEVICE, s.device)
+    }
+    return l
+}
+
+// SetDevice names the Basys3 in the log
+func (s *BAESys128) SetDevice(name string) {
+    s.device = name
+}
+
+// errAttr is an error for the log
+func errAttr(err any) slog.Attr {
+    return slog.String(ATTR_ERR, fmt.Sprint(err))
+}
+
+// keyCheckValue is the first 3 bytes of a zero block encrypted with key,
+// enough to tell keys apart without giving one away. Empty for no key
+func keyCheckValue(key []byte) string {
+    aes, err := NewAES(key)
+    if err != nil {
+        return ""
+    }
+    return hex.EncodeToString(aes.Encrypt(make([]byte, BLOCK_SIZE))[:3])
+}
+
+// kcvAttr names key in a log message by its check value
+func kcvAttr(key []byte) slog.Attr {
+    return slog.String(ATTR_KCV, keyCheckValue(key))
+}
+
+// LogEntry is one log record as the pages get it
+type LogEntry struct {
+    Time time.Time `json:"time"`
+    Level slog.Level `json:"level"`
+    Component string `json:"component,omitempty"`
+    Msg string `json:"msg"`
+    Attrs []LogAttr `json:"attrs,omitempty"`
+}
+
+type LogAttr struct {
+    Key string `json:"key"`
+    Value string `json:"value"`
+}
+
+// entryHandler turns records into LogEntry for emit. Groups are flattened
+// into the attribute names with dots
+type entryHandler struct {
+    level slog.Leveler
+    component string
+    attrs []LogAttr
+    prefix string
+    emit func(LogEntry)
+}
+
+func (h *entryHandler) Enabled(_ context.Context, level slog.Level) bool {
+    return level >= h.level.Level()
+}
+
+func (h *entryHandler) Handle(_ context.Context, r slog.Record) error {
+    entry := LogEntry{Time: r.Time, Level: r.Level, Component: h.component, Msg: r.Message}
+    entry.Attrs = append(entry.Attrs, h.attrs...)
+    r.Attrs(func(a slog.Attr) bool {
+        h.add(&entry.Component, &entry.Attrs, h.prefix, a)
+        return true
+    })
+    h.emit(entry)
+    return nil
+}
+
+func (h *entryHandler) add(component *string, attrs *[]LogAttr, prefix string, a slog.Attr) {
+    a.Value = a.Value.Resolve()
+    if a.Equal(slog.Attr{}) {
+        return
+    }
+    if a.Value.Kind() == slog.KindGroup {
+        if a.Key != "" {
+            prefix += a.Key + "."
+        }
+        for _, sub := range a.Value.Group() {
+            h.add(component, attrs, prefix, sub)
+        }
+        return
+    }
+    if prefix == "" && a.Key == ATTR_COMPONENT {
+        *component = a.Value.String()
+        return
+    }
+    *attrs = append(*attrs, LogAttr{Key: prefix + a.Key, Value: a.Value.String()})
+}
+
+func (h *entryHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    next := *h
+    next.attrs = append([]LogAttr{}, h.attrs...)
+    for _, a := range attrs {
+        next.add(&next.component, &next.attrs, h.prefix, a)
+    }
+    return &next
+}
+
+func (h *entryHandler) WithGroup(name string) slog.Handler {
+    if name == "" {
+        return h
+    }
+    next := *h
+    next.prefix += name + "."
+    return &next
+}
+
+// multiHandler sends every record to all of its handlers that want it
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    for _, h := range m {
+        if h.Enabled(ctx, level) {
+            return true
+        }
+    }
+    return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+    var errs []error
+    for _, h := range m {
+        if h.Enabled(ctx, r.Level) {
+            errs = append(errs, h.Handle(ctx, r.Clone()))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    next := make(multiHandler, len(m))
+    for i, h := range m {
+        next[i] = h.WithAttrs(attrs)
+    }
+    return next
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+    next := make(multiHandler, len(m))
+    for i, h := range m {
+        next[i] = h.WithGroup(name)
+    }
+    return next
+}
+
+// stringers writes protocols, modes and the like by name, JSON would write
+// the number behind them
+func stringers(_ []string, a slog.Attr) slog.Attr {
+    if a.Value.Kind() != slog.KindAny {
+        return a
+    }
+    switch v := a.Value.Any().(type) {
+    case error, json.Marshaler:
+        return a
+    case fmt.Stringer:
+        return slog.String(a.Key, v.String())
+    }
+    return a
+}
+
+// NewLogHandler writes to the terminal from level up, and everything to the
+// session file, if there is one, and to logger for the pages, which filter
+// for themselves
+func NewLogHandler(terminal io.Writer, session io.Writer, logger *Logger, level slog.Level) slog.Handler {
+    handlers := multiHandler{
+        slog.NewTextHandler(terminal, &slog.HandlerOptions{Level: level, ReplaceAttr: stringers}),
+        &entryHandler{level: slog.LevelDebug, emit: logger.Log},
+    }
+    if session != nil {
+        handlers = append(handlers, slog.NewJSONHandler(session, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: stringers}))
+    }
+    return handlers
+}
+
+// OpenSessionLog truncates path for every message of this run in JSON lines.
+// Nothing is written to disk when path is empty
+func OpenSessionLog(path string) (*os.File, error) {
+    if path == "" {
+        return nil, nil
+    }
+    return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+}
+
+// handle_log_download sends the session log as it is so far
+func handle_log_download(path string) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        f, err := os.Open(path)
+        if err != nil {
+            http.Error(w, "session log is not readable", http.StatusInternalServerError)
+            return
+        }
+        defer f.Close()
+        name := fmt.Sprintf("basys3-aes-%s.jsonl", time.Now().Format("20060102-150405"))
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+        io.Copy(w, f)
+    }
+}
+
+// fmtLogMessage renders entry for the log panel. Everything logged is
+// escaped, the data attributes are what the filters look at
+func fmtLogMessage(w io.Writer, entry LogEntry) error {
+    attrs := ""
+    for _, a := range entry.Attrs {
+        attrs += fmt.Sprintf(` <code data-key="%s">%s=%s</code>`, html.EscapeString(a.Key), html.EscapeString(a.Key), html.EscapeString(a.Value))
+    }
+    level := entry.Level.String()
+    _, err := fmt.Fprintf(w, `
+        <div id="log-messages" hx-swap-oob="beforeend">
+            <p class="log-entry font-mono %s" data-level="%d" data-component="%s"><span class="text-slate-400">%s</span> <span class="log-level">%s</span> <span class="log-component text-slate-500">%s</span> <span class="log-msg">%s</span>%s</p>
+        </div>
+    `, LOG_LEVEL_CLASSES[level], entry.Level, html.EscapeString(entry.Component), entry.Time.Format(time.TimeOnly), level, html.EscapeString(entry.Component), html.EscapeString(entry.Msg), attrs)
+    return err
+}
+
+var LOG_LEVEL_CLASSES = map[string]string{
+    "DEBUG": "text-slate-500",
+    "WARN": "text-amber-700",
+    "ERROR": "text-red-700",
+}
+
+// log_panel is the log with its filters. The entries come in over the
+// websocket, filtering, search and pausing happen in the page. download is
+// whether there is a session log to download
+func log_panel(download bool) string {
+    download_link := ""
+    if download {
+        download_link = `<a href="/log/download" class="border-2 bg-slate-100 px-2">Download</a>`
+    }
+    components := ""
+    for _, c := range COMPONENTS {
+        components += fmt.Sprintf(`<option value="%s">%s</option>`, c, c)
+    }
+    return fmt.Sprintf(`
+        <div class="flex flex-col gap-1">
+            <label for="log">System Log</label>
+            <div class="flex flex-row gap-2 text-sm">
+                <select id="log-level" onchange="filterLog()" class="border-2">
+                    <option value="%d">debug</option>
+                    <option value="%d" selected>info</option>
+                    <option value="%d">warn</option>
+                    <option value="%d">error</option>
+                </select>
+                <select id="log-component" onchange="filterLog()" class="border-2">
+                    <option value="">all components</option>
+                    %s
+                </select>
+                <input id="log-search" type="search" placeholder="Search" oninput="filterLog()" class="border-2 px-1 grow" />
+                <button id="log-pause" type="button" onclick="toggleLogPause()" class="border-2 bg-slate-100 px-2">Pause</button>
+                %s
+            </div>
+            <div hx-ext="ws" ws-connect="/log" id="log" class="w-[600px] h-[400px] overflow-auto border-2">
+                <div id="log-messages">
+                </div>
+            </div>
+        </div>
+        <script>
+            // entries that came in while paused, shown on resume. Like the
+            // server only the newest are kept, the rest are counted
+            const LOG_HELD_MAX = %d
+            let logPaused = false
+            let logHeld = []
+            let logHeldDropped = 0
+            function showLogPaused() {
+                const dropped = logHeldDropped > 0 ? ", " + logHeldDropped + " dropped" : ""
+                document.getElementById("log-pause").textContent = "Resume (" + logHeld.length + dropped + ")"
+            }
+            function showLogEntry(p) {
+                const level = Number(document.getElementById("log-level").value)
+                const component = document.getElementById("log-component").value
+                const search = document.getElementById("log-search").value.toLowerCase()
+                const show = Number(p.dataset.level) >= level
+                    && (component === "" || p.dataset.component === component)
+                    && (search === "" || p.textContent.toLowerCase().includes(search))
+                p.style.display = show ? "" : "none"
+            }
+            function filterLog() {
+                document.querySelectorAll("#log-messages .log-entry").forEach(showLogEntry)
+            }
+            function appendLogEntries(html) {
+                const parsed = new DOMParser().parseFromString(html, "text/html")
+                const messages = document.getElementById("log-messages")
+                parsed.querySelectorAll(".log-entry").forEach(p => {
+                    showLogEntry(p)
+                    messages.appendChild(document.adoptNode(p))
+                })
+            }
+            function toggleLogPause() {
+                logPaused = !logPaused
+                if (logPaused) {
+                    showLogPaused()
+                    return
+                }
+                document.getElementById("log-pause").textContent = "Pause"
+                if (logHeldDropped > 0) {
+                    const p = document.createElement("p")
+                    p.className = "log-entry font-mono %s"
+                    p.dataset.level = "%d"
+                    p.dataset.component = "%s"
+                    p.textContent = "Dropped " + logHeldDropped + " messages while paused"
+                    showLogEntry(p)
+                    document.getElementById("log-messages").appendChild(p)
+                }
+                logHeld.forEach(appendLogEntries)
+                logHeld = []
+                logHeldDropped = 0
+            }
+            document.body.addEventListener("htmx:wsBeforeMessage", e => {
+                if (e.detail.elt.id !== "log") {
+                    return
+                }
+                // the entry is added here instead of by htmx so it can be
+                // filtered before it shows
+                e.preventDefault()
+                if (logPaused) {
+                    if (logHeld.length >= LOG_HELD_MAX) {
+                        logHeld.shift()
+                        logHeldDropped++
+                    }
+                    logHeld.push(e.detail.message)
+                    showLogPaused()
+                    return
+                }
+                const log = document.getElementById("log")
+                const atBottom = log.scrollHeight - log.scrollTop - log.clientHeight < 10
+                appendLogEntries(e.detail.message)
+                if (atBottom) {
+                    log.scrollTop = log.scrollHeight
+                }
+            })
+        </script>
+    `, slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError, components, download_link, LOG_BACKLOG, LOG_LEVEL_CLASSES["WARN"], slog.LevelWarn, COMPONENT_LOG)
+}
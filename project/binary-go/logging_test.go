@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// entryLog is a logger whose entries end up in the returned slice
+func entryLog() (*slog.Logger, *[]LogEntry) {
+    entries := &[]LogEntry{}
+    h := &entryHandler{level: slog.LevelDebug, emit: func(e LogEntry) {
+        *entries = append(*entries, e)
+    }}
+    return slog.New(h), entries
+}
+
+func TestEntryHandler(t *testing.T) {
+    logger, entries := entryLog()
+    logger.With(ATTR_COMPONENT, COMPONENT_KEY, ATTR_DEVICE, "/dev/ttyUSB1").WithGroup("req").Info("Set key", "key", "abc", slog.Group("kdf", "rounds", 10))
+    logger.Debug("No component", ATTR_BYTES, 16)
+
+    if len(*entries) != 2 {
+        t.Fatalf("expected 2 entries, got %d", len(*entries))
+    }
+    got := (*entries)[0]
+    if got.Component != COMPONENT_KEY || got.Msg != "Set key" || got.Level != slog.LevelInfo {
+        t.Errorf("got %+v", got)
+    }
+    expected := []LogAttr{{ATTR_DEVICE, "/dev/ttyUSB1"}, {"req.key", "abc"}, {"req.kdf.rounds", "10"}}
+    if len(got.Attrs) != len(expected) {
+        t.Fatalf("expected attrs %v, got %v", expected, got.Attrs)
+    }
+    for i := range expected {
+        if got.Attrs[i] != expected[i] {
+            t.Errorf("attr %d is %v, expected %v", i, got.Attrs[i], expected[i])
+        }
+    }
+    if other := (*entries)[1]; other.Component != "" || len(other.Attrs) != 1 || other.Attrs[0].Value != "16" {
+        t.Errorf("got %+v", other)
+    }
+}
+
+// With on one logger does not leak into another made from the same parent
+func TestEntryHandlerWithAttrs(t *testing.T) {
+    logger, entries := entryLog()
+    parent := logger.With("a", 1)
+    parent.With("b", 2).Info("child")
+    parent.With("c", 3).Info("sibling")
+    if attrs := (*entries)[1].Attrs; len(attrs) != 2 || attrs[1].Key != "c" {
+        t.Errorf("sibling has %v", attrs)
+    }
+}
+
+func TestLogHandlerLevels(t *testing.T) {
+    var terminal, session bytes.Buffer
+    logger := NewLogger()
+    sub := &logSubscriber{send: make(chan LogEntry, 10)}
+    logger.hub.subscribers[sub] = true
+    log := slog.New(NewLogHandler(&terminal, &session, logger, slog.LevelInfo)).With(ATTR_COMPONENT, COMPONENT_DEVICE)
+    log.Debug("Basys3 progress", ATTR_BLOCK, 3)
+    log.Warn("Basys3 answered", "protocol", PROTOCOL_V2, errAttr(errors.New("no echo")))
+    logger.Teardown()
+
+    if strings.Contains(terminal.String(), "progress") || !strings.Contains(terminal.String(), "Basys3 answered") {
+        t.Errorf("terminal got %q", terminal.String())
+    }
+    lines := strings.Split(strings.TrimSpace(session.String()), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("session log has %d lines, expected both", len(lines))
+    }
+    var record map[string]any
+    if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+        t.Fatal(err)
+    }
+    if record["protocol"] != PROTOCOL_V2.String() || record[ATTR_ERR] != "no echo" || record[ATTR_COMPONENT] != COMPONENT_DEVICE {
+        t.Errorf("session log has %v", record)
+    }
+    sent := 0
+    for range sub.send {
+        sent++
+    }
+    if sent != 2 {
+        t.Errorf("the pages got %d entries, expected both", sent)
+    }
+}
+
+// without -log-file nothing is written but the terminal and the pages
+func TestLogHandlerWithoutSession(t *testing.T) {
+    var terminal bytes.Buffer
+    logger := NewLogger()
+    slog.New(NewLogHandler(&terminal, nil, logger, slog.LevelInfo)).Info("No session log")
+    logger.Teardown()
+    if !strings.Contains(terminal.String(), "No session log") {
+        t.Errorf("terminal got %q", terminal.String())
+    }
+}
+
+// keys are logged by their check value, never as they are
+func TestKeysAreNotLogged(t *testing.T) {
+    logger, entries := entryLog()
+    defer slog.SetDefault(slog.Default())
+    slog.SetDefault(logger)
+    key := []byte("0123456789abcdef")
+    baes := new(BAESys128)
+    baes.SetKey(key)
+    baes.SetKey(key)
+
+    kcv := keyCheckValue(key)
+    if len(kcv) != 6 {
+        t.Fatalf("check value is %q", kcv)
+    }
+    logged := false
+    for _, entry := range *entries {
+        for _, a := range entry.Attrs {
+            if strings.Contains(a.Value, string(key)) {
+                t.Errorf("%q logged the key as %s", entry.Msg, a.Key)
+            }
+            logged = logged || (a.Key == ATTR_KCV && a.Value == kcv)
+        }
+    }
+    if !logged {
+        t.Errorf("check value %s not logged in %v", kcv, *entries)
+    }
+}
+
+// whatever was logged can not add html to the page
+func TestFmtLogMessageEscapes(t *testing.T) {
+    var out bytes.Buffer
+    err := fmtLogMessage(&out, LogEntry{
+        Level: slog.LevelError,
+        Component: `"><script>`,
+        Msg: "<script>alert(1)</script>",
+        Attrs: []LogAttr{{"key", "<b>"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    html := out.String()
+    if strings.Contains(html, "<script>") || strings.Contains(html, "<b>") {
+        t.Errorf("not escaped: %s", html)
+    }
+    if !strings.Contains(html, `data-level="8"`) || !strings.Contains(html, LOG_LEVEL_CLASSES["ERROR"]) {
+        t.Errorf("level missing: %s", html)
+    }
+}
+
+// the panel holds at most LOG_BACKLOG messages while paused
+func TestLogPanelCapsHeld(t *testing.T) {
+    for _, download := range []bool{false, true} {
+        panel := log_panel(download)
+        if strings.Contains(panel, "%!") || !strings.Contains(panel, fmt.Sprintf("LOG_HELD_MAX = %d", LOG_BACKLOG)) {
+            t.Errorf("panel is %s", panel)
+        }
+        if strings.Contains(panel, "/log/download") != download {
+            t.Errorf("download link shown is %v", !download)
+        }
+    }
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+    // messages kept for pages that connect later
+    LOG_BACKLOG = 500
+    // messages a subscriber can fall behind by, on top of the backlog, before
+    // it misses some
+    LOG_SUBSCRIBER_BUFFER = 256
+    LOG_WRITE_TIMEOUT = 10 * time.Second
+    // a page that has not answered a ping in LOG_PONG_TIMEOUT is gone
+    LOG_PING_INTERVAL = 30 * time.Second
+    LOG_PONG_TIMEOUT = 60 * time.Second
+    LOG_DROPPED = "Log dropped messages, they were written faster than they could be sent"
+)
+
+// LogHub sends every log message to every page that has the log open, and
+// keeps the last LOG_BACKLOG of them to replay to pages that open it later.
+// A page that falls behind is not disconnected: its oldest queued messages
+// make way for new ones and it is told how many it missed, the same as the
+// Logger queue in front of the hub
+type LogHub struct {
+    mtx sync.Mutex
+    // ring buffer, the oldest message is backlog[start]
+    backlog []LogEntry
+    start int
+    subscribers map[*logSubscriber]bool
+    closed bool
+}
+
+// logSubscriber is one websocket. Its own goroutine writes what is queued
+// in send so a slow page never holds up the others
+type logSubscriber struct {
+    conn *websocket.Conn
+    send chan LogEntry
+    // messages pushed out of send by newer ones
+    dropped atomic.Uint64
+}
+
+func NewLogHub() *LogHub {
+    return &LogHub{subscribers: map[*logSubscriber]bool{}}
+}
+
+// Broadcast queues msg for every subscriber. A subscriber too far behind
+// to take it loses its oldest queued message instead and is told later.
+// One that stopped reading altogether times out writing and is removed
+func (h *LogHub) Broadcast(msg LogEntry) {
+    h.mtx.Lock()
+    defer h.mtx.Unlock()
+    if h.closed {
+        return
+    }
+    if len(h.backlog) < LOG_BACKLOG {
+        h.backlog = append(h.backlog, msg)
+    } else {
+        h.backlog[h.start] = msg
+        h.start = (h.start + 1) % LOG_BACKLOG
+    }
+    for sub := range h.subscribers {
+        select {
+        case sub.send <- msg:
+            continue
+        default:
+        }
+        select {
+        case <-sub.send:
+            sub.dropped.Add(1)
+        default:
+            // writeLoop just made room
+        }
+        // only sent to under mtx, so there is room now
+        sub.send <- msg
+    }
+}
+
+// Backlog is the messages a new subscriber is replayed, oldest first
+func (h *LogHub) Backlog() []LogEntry {
+    h.mtx.Lock()
+    defer h.mtx.Unlock()
+    return h.backlogLocked()
+}
+
+func (h *LogHub) backlogLocked() []LogEntry {
+    out := make([]LogEntry, 0, len(h.backlog))
+    out = append(out, h.backlog[h.start:]...)
+    return append(out, h.backlog[:h.start]...)
+}
+
+func (h *LogHub) Subscribers() int {
+    h.mtx.Lock()
+    defer h.mtx.Unlock()
+    return len(h.subscribers)
+}
+
+// Subscribe replays the backlog to conn and then sends it every message
+// until the page goes away or the hub is closed. It does not block
+func (h *LogHub) Subscribe(conn *websocket.Conn) error {
+    sub := &logSubscriber{conn: conn, send: make(chan LogEntry, LOG_BACKLOG + LOG_SUBSCRIBER_BUFFER)}
+    h.mtx.Lock()
+    if h.closed {
+        h.mtx.Unlock()
+        conn.Close()
+        return fmt.Errorf("log is shutting down")
+    }
+    // under the lock so nothing broadcast now is missed or sent twice
+    for _, msg := range h.backlogLocked() {
+        sub.send <- msg
+    }
+    h.subscribers[sub] = true
+    h.mtx.Unlock()
+
+    go h.writeLoop(sub)
+    go h.readLoop(sub)
+    return nil
+}
+
+// remove closes send, which stops writeLoop and closes the connection. mtx
+// must be held
+func (h *LogHub) remove(sub *logSubscriber) {
+    if !h.subscribers[sub] {
+        return
+    }
+    delete(h.subscribers, sub)
+    close(sub.send)
+}
+
+func (h *LogHub) unsubscribe(sub *logSubscriber) {
+    h.mtx.Lock()
+    defer h.mtx.Unlock()
+    h.remove(sub)
+}
+
+func (h *LogHub) writeLoop(sub *logSubscriber) {
+    ping := time.NewTicker(LOG_PING_INTERVAL)
+    defer func() {
+        ping.Stop()
+        // wakes readLoop up if it is still waiting on the page
+        sub.conn.Close()
+        h.unsubscribe(sub)
+    }()
+    for {
+        select {
+        case msg, open := <-sub.send:
+            sub.conn.SetWriteDeadline(time.Now().Add(LOG_WRITE_TIMEOUT))
+            if !open {
+                sub.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+                return
+            }
+            if dropped := sub.dropped.Swap(0); dropped > 0 {
+                if writeLogMessage(sub.conn, logDroppedNotice(dropped)) != nil {
+                    return
+                }
+            }
+            if writeLogMessage(sub.conn, msg) != nil {
+                return
+            }
+        case <-ping.C:
+            sub.conn.SetWriteDeadline(time.Now().Add(LOG_WRITE_TIMEOUT))
+            if sub.conn.WriteMessage(websocket.PingMessage, nil) != nil {
+                return
+            }
+        }
+    }
+}
+
+// readLoop only notices the page going away. htmx sends nothing on the log
+// socket but pongs
+func (h *LogHub) readLoop(sub *logSubscriber) {
+    defer h.unsubscribe(sub)
+    sub.conn.SetReadDeadline(time.Now().Add(LOG_PONG_TIMEOUT))
+    sub.conn.SetPongHandler(func(string) error {
+        return sub.conn.SetReadDeadline(time.Now().Add(LOG_PONG_TIMEOUT))
+    })
+    for {
+        if _, _, err := sub.conn.ReadMessage(); err != nil {
+            return
+        }
+    }
+}
+
+// Close drops every subscriber. Later broadcasts are ignored
+func (h *LogHub) Close() {
+    h.mtx.Lock()
+    defer h.mtx.Unlock()
+    h.closed = true
+    for sub := range h.subscribers {
+        h.remove(sub)
+    }
+}
+
+func (h *LogHub) handle_ws(w http.ResponseWriter, r *http.Request) {
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        componentLog(COMPONENT_LOG).Warn("Failed to upgrade log websocket", errAttr(err))
+        return
+    }
+    err = h.Subscribe(conn)
+    if err != nil {
+        componentLog(COMPONENT_LOG).Warn("Failed to subscribe to the log", errAttr(err))
+    }
+}
+
+func writeLogMessage(conn *websocket.Conn, msg LogEntry) error {
+    writer, err := conn.NextWriter(websocket.TextMessage)
+    if err != nil {
+        return err
+    }
+    err = fmtLogMessage(writer, msg)
+    if err != nil {
+        writer.Close()
+        return err
+    }
+    return writer.Close()
+}
+
+// logDroppedNotice goes to the pages in place of messages they missed
+func logDroppedNotice(n uint64) LogEntry {
+    return LogEntry{
+        Time: time.Now(),
+        Level: slog.LevelWarn,
+        Component: COMPONENT_LOG,
+        Msg: LOG_DROPPED,
+        Attrs: []LogAttr{{Key: "dropped", Value: strconv.FormatUint(n, 10)}},
+    }
+}
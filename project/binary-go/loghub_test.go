@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func logServer(t *testing.T, hub *LogHub) string {
+    server := httptest.NewServer(http.HandlerFunc(hub.handle_ws))
+    t.Cleanup(server.Close)
+    return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialLog(t *testing.T, url string) *websocket.Conn {
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+// readLogEntries reads n messages and gets the message and attributes back
+// out of their html
+func readLogEntries(conn *websocket.Conn, n int) ([]LogEntry, error) {
+    entries := []LogEntry{}
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    for len(entries) < n {
+        _, data, err := conn.ReadMessage()
+        if err != nil {
+            return entries, err
+        }
+        _, msg, _ := strings.Cut(string(data), `<span class="log-msg">`)
+        msg, rest, _ := strings.Cut(msg, "</span>")
+        entry := LogEntry{Msg: html.UnescapeString(msg)}
+        for _, m := range logAttrPattern.FindAllStringSubmatch(rest, -1) {
+            entry.Attrs = append(entry.Attrs, LogAttr{Key: html.UnescapeString(m[1]), Value: html.UnescapeString(m[2])})
+        }
+        entries = append(entries, entry)
+    }
+    return entries, nil
+}
+
+var logAttrPattern = regexp.MustCompile(`<code data-key="([^"]*)">[^=]*=([^<]*)</code>`)
+
+// readLog reads n messages and returns their text
+func readLog(conn *websocket.Conn, n int) ([]string, error) {
+    entries, err := readLogEntries(conn, n)
+    msgs := make([]string, len(entries))
+    for i, entry := range entries {
+        msgs[i] = entry.Msg
+    }
+    return msgs, err
+}
+
+// waitSubscribers waits for the hub to notice connections coming and going
+func waitSubscribers(t *testing.T, hub *LogHub, n int) {
+    deadline := time.Now().Add(5 * time.Second)
+    for hub.Subscribers() != n {
+        if time.Now().After(deadline) {
+            t.Fatalf("expected %d subscribers, have %d", n, hub.Subscribers())
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestLogHubBacklog(t *testing.T) {
+    hub := NewLogHub()
+    defer hub.Close()
+    for i := 0; i < LOG_BACKLOG + 10; i++ {
+        hub.Broadcast(LogEntry{Msg: fmt.Sprintf("before %d", i)})
+    }
+    backlog := hub.Backlog()
+    if len(backlog) != LOG_BACKLOG || backlog[0].Msg != "before 10" || backlog[LOG_BACKLOG - 1].Msg != fmt.Sprintf("before %d", LOG_BACKLOG + 9) {
+        t.Fatalf("expected the last %d messages, got %d from %q", LOG_BACKLOG, len(backlog), backlog[0].Msg)
+    }
+
+    conn := dialLog(t, logServer(t, hub))
+    waitSubscribers(t, hub, 1)
+    hub.Broadcast(LogEntry{Msg: "after"})
+    msgs, err := readLog(conn, LOG_BACKLOG + 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if msgs[0] != "before 10" || msgs[LOG_BACKLOG] != "after" {
+        t.Errorf("expected the backlog then the new message, got %q ... %q", msgs[0], msgs[LOG_BACKLOG])
+    }
+}
+
+// a second tab no longer takes the log away from the first
+func TestLogHubTwoTabs(t *testing.T) {
+    hub := NewLogHub()
+    defer hub.Close()
+    url := logServer(t, hub)
+    first := dialLog(t, url)
+    second := dialLog(t, url)
+    waitSubscribers(t, hub, 2)
+    hub.Broadcast(LogEntry{Msg: "to both"})
+    for _, conn := range []*websocket.Conn{first, second} {
+        msgs, err := readLog(conn, 1)
+        if err != nil || msgs[0] != "to both" {
+            t.Errorf("got %q %v", msgs, err)
+        }
+    }
+
+    first.Close()
+    waitSubscribers(t, hub, 1)
+    hub.Broadcast(LogEntry{Msg: "to second"})
+    if msgs, err := readLog(second, 1); err != nil || msgs[0] != "to second" {
+        t.Errorf("got %q %v", msgs, err)
+    }
+}
+
+func TestLogHubClose(t *testing.T) {
+    hub := NewLogHub()
+    conn := dialLog(t, logServer(t, hub))
+    waitSubscribers(t, hub, 1)
+    hub.Close()
+    hub.Broadcast(LogEntry{Msg: "after close"})
+    if _, err := readLog(conn, 1); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+        t.Errorf("expected the hub to close the socket, got %v", err)
+    }
+    if hub.Subscribers() != 0 {
+        t.Errorf("%d subscribers left", hub.Subscribers())
+    }
+}
+
+// a page that falls behind misses its oldest messages instead of holding up
+// the rest, and is told how many
+func TestLogHubSlowSubscriber(t *testing.T) {
+    hub := NewLogHub()
+    defer hub.Close()
+    sub := &logSubscriber{send: make(chan LogEntry, 2)}
+    hub.subscribers[sub] = true
+    for _, msg := range []string{"oldest", "older", "newest"} {
+        hub.Broadcast(LogEntry{Msg: msg})
+    }
+    if hub.Subscribers() != 1 || sub.dropped.Load() != 1 {
+        t.Errorf("expected the subscriber kept with 1 dropped, %d subscribers and %d dropped", hub.Subscribers(), sub.dropped.Load())
+    }
+    if first, last := <-sub.send, <-sub.send; first.Msg != "older" || last.Msg != "newest" {
+        t.Errorf("queued messages are %q and %q", first.Msg, last.Msg)
+    }
+}
+
+func TestLogHubLoad(t *testing.T) {
+    const clients = 100
+    const messages = 200
+    hub := NewLogHub()
+    defer hub.Close()
+    url := logServer(t, hub)
+    hub.Broadcast(LogEntry{Msg: "backlog"})
+    conns := make([]*websocket.Conn, clients)
+    for i := range conns {
+        conns[i] = dialLog(t, url)
+    }
+    waitSubscribers(t, hub, clients)
+
+    var wg sync.WaitGroup
+    errs := make(chan error, clients)
+    for _, conn := range conns {
+        wg.Add(1)
+        go func(conn *websocket.Conn) {
+            defer wg.Done()
+            msgs, err := readLog(conn, messages + 1)
+            if err != nil {
+                errs <- err
+                return
+            }
+            for i, msg := range msgs[1:] {
+                if msg != fmt.Sprintf("message %d", i) {
+                    errs <- fmt.Errorf("message %d is %q", i, msg)
+                    return
+                }
+            }
+        }(conn)
+    }
+    // several writers at once, like handlers logging concurrently. Each
+    // message is broadcast under a lock so every page sees the same order
+    var order sync.Mutex
+    next := 0
+    var writers sync.WaitGroup
+    for w := 0; w < 4; w++ {
+        writers.Add(1)
+        go func() {
+            defer writers.Done()
+            for {
+                order.Lock()
+                if next == messages {
+                    order.Unlock()
+                    return
+                }
+                hub.Broadcast(LogEntry{Msg: fmt.Sprintf("message %d", next)})
+                next++
+                order.Unlock()
+            }
+        }()
+    }
+    writers.Wait()
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Error(err)
+    }
+    if hub.Subscribers() != clients {
+        t.Errorf("expected all %d clients to keep up, %d left", clients, hub.Subscribers())
+    }
+
+    for _, conn := range conns[:clients/2] {
+        conn.Close()
+    }
+    waitSubscribers(t, hub, clients - clients/2)
+}
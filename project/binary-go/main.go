@@ -1,12 +1,16 @@
 package main
 
 import (
-	"encoding/hex"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -25,7 +29,6 @@ var PORT_MODE = serial.Mode{
     DataBits: 8,
     StopBits: serial.OneStopBit,
 }
-const PORT_MODE_STR = "BaudRate: 9600, Parity: NoParity, DataBits: 8, StopBits: OneStopBit"
 
 const (
     BLOCK_SIZE int = 16;
@@ -37,150 +40,164 @@ var upgrader = websocket.Upgrader{
     WriteBufferSize: 1024,
 }
 
+// entries Log queues for the websockets before it drops the oldest
+const LOG_QUEUE = 1000
+
+// Logger gets every log entry to every page with the log open, through
+// hub. Log never waits on the pages: the queue in between drops its oldest
+// entry when it is full and counts it
 type Logger struct {
-    msgs chan string
-    conn *websocket.Conn
-    mtx *sync.Mutex
-}
-
-func (l *Logger) Init() *Logger {
-    l.msgs = make(chan string, 100)
-    l.conn = nil
-    log.SetOutput(l)
-    log.Default().SetFlags(log.Ltime)
-    var mtx sync.Mutex
-    l.mtx = &mtx
+    hub *LogHub
+    mtx sync.Mutex
+    // ring buffer, the oldest entry is queue[start]
+    queue []LogEntry
+    start int
+    dropped uint64
+    // dropped when the last drop notice was sent
+    reported uint64
+    closed bool
+    // doLogging waits on wake for messages and on stop for Teardown
+    wake chan struct{}
+    stop chan struct{}
+    stopped chan struct{}
+    teardown sync.Once
+}
+
+// NewLogger starts a logger. serve puts it behind slog with NewLogHandler
+func NewLogger() *Logger {
+    l := &Logger{
+        hub: NewLogHub(),
+        wake: make(chan struct{}, 1),
+        stop: make(chan struct{}),
+        stopped: make(chan struct{}),
+    }
     go l.doLogging()
     return l
 }
 
+// Teardown sends what is queued and closes every websocket. Entries logged
+// after it are dropped. Safe to call more than once
 func (l *Logger) Teardown() error {
-    close(l.msgs)
-    err := l.CloseConn()
-    if err != nil {
-        return err
-    }
+    l.teardown.Do(func() {
+        l.mtx.Lock()
+        l.closed = true
+        l.mtx.Unlock()
+        close(l.stop)
+        <-l.stopped
+        l.hub.Close()
+    })
     return nil
 }
 
-func (l *Logger) CloseConn() error {
-    if l.conn == nil {
-        return nil
-    }
+// Log queues entry for the websockets without waiting
+func (l *Logger) Log(msg LogEntry) {
     l.mtx.Lock()
-    defer l.mtx.Unlock()
-    err := l.conn.Close()
-    if err != nil {
-        return fmt.Errorf("failed to close old websocket connection: %v", err)
+    if l.closed {
+        l.mtx.Unlock()
+        return
+    }
+    if len(l.queue) < LOG_QUEUE {
+        l.queue = append(l.queue, msg)
+    } else {
+        l.queue[l.start] = msg
+        l.start = (l.start + 1) % LOG_QUEUE
+        l.dropped++
+    }
+    l.mtx.Unlock()
+    select {
+    case l.wake <- struct{}{}:
+    default:
     }
-    l.conn = nil
-    return nil
-}
-
-func (l Logger) Write(p []byte) (n int, err error) {
-    l.msgs <- string(p)
-    fmt.Print(string(p))
-    return len(p), nil
 }
 
-func (l* Logger) SetConn(conn *websocket.Conn) error {
-    err := l.CloseConn()
-    if err != nil {
-        return err
-    }
+// Dropped is how many messages never made it to the websockets
+func (l *Logger) Dropped() uint64 {
     l.mtx.Lock()
     defer l.mtx.Unlock()
-    l.conn = conn
-    return nil
+    return l.dropped
 }
 
 func (l *Logger) handle_ws(w http.ResponseWriter, r *http.Request) {
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        fmt.Printf("Failed to set websocket connection: %v", err)
-        return
-    }
-    err = l.SetConn(conn)
-    if err != nil {
-        fmt.Printf("Failed to set websocket connection: %v", err)
-        return
-    }
+    l.hub.handle_ws(w, r)
 }
 
-func (l *Logger) fmtMsg(w io.Writer, msg string) error {
-    _, err := fmt.Fprintf(w, `
-        <div id="log-messages" hx-swap-oob="beforeend">
-            <p class="font-mono">%s</p>
-        </div>
-    `, msg)
-    return err
-}
-
-func (l *Logger) SendMessage(msg string) error {
+// take empties the queue, oldest first, and says how many messages were
+// dropped since it last did
+func (l *Logger) take() ([]LogEntry, uint64) {
     l.mtx.Lock()
     defer l.mtx.Unlock()
-    if l.conn == nil {
-        return fmt.Errorf("no websocket connection set")
-    }
-    writer, err := l.conn.NextWriter(websocket.TextMessage)
-    defer func() {
-        if writer == nil {
-            return
-        }
-        writer.Close()
-    }()
+    msgs := make([]LogEntry, 0, len(l.queue))
+    msgs = append(msgs, l.queue[l.start:]...)
+    msgs = append(msgs, l.queue[:l.start]...)
+    l.queue = l.queue[:0]
+    l.start = 0
+    dropped := l.dropped - l.reported
+    l.reported = l.dropped
+    return msgs, dropped
+}
 
-    if err != nil {
-        return fmt.Errorf("failed to create log writer: %v", err)
+func (l *Logger) flush() {
+    msgs, dropped := l.take()
+    if dropped > 0 {
+        l.hub.Broadcast(logDroppedNotice(dropped))
     }
-
-    err = l.fmtMsg(writer, msg)
-    if err != nil {
-        return fmt.Errorf("failed to send log message: %v", err)
+    for _, msg := range msgs {
+        l.hub.Broadcast(msg)
     }
-    return nil
 }
 
 func (l *Logger) doLogging() {
+    defer close(l.stopped)
     for {
-        if l.conn == nil {
-            time.Sleep(1 * time.Second)
-            continue
-        }
-        msg, stillOpen := <- l.msgs
-        if !stillOpen {
+        select {
+        case <-l.wake:
+            l.flush()
+        case <-l.stop:
+            l.flush()
             return
         }
-        err := l.SendMessage(msg)
-        if err != nil {
-            fmt.Println(err)
-        }
-
     }
 }
 
-func connectToBasys3(baes *BAESys128) error {
+// capturePath is where to record the serial traffic. Empty to not record.
+// baud forces a baud rate, 0 to detect it. An error means baes has no
+// Basys3, the caller decides whether that is fatal
+func connectToBasys3(baes *BAESys128, capturePath string, baud int, store *BaudStore) error {
     ports, err := enumerator.GetDetailedPortsList()
     if err != nil {
-        log.Fatal(err)
+        return fmt.Errorf("failed to list serial ports: %w", err)
     }
 
     found := false;
     for _, port := range ports {
-        log.Printf("Found port: <code>%s %s:%s</code>", port.Name, port.VID, port.PID)
-        if port.VID == "0403" && port.PID == "6010" {
+        componentLog(COMPONENT_DEVICE).Info("Found port", ATTR_DEVICE, port.Name, "vid", port.VID, "pid", port.PID)
+        if isBasys3(port) {
             if found {
-                log.Println("Found multiple Basys3's. Using first")
+                componentLog(COMPONENT_DEVICE).Warn("Found multiple Basys3's. Using first", "skipped", port.Name)
                 continue
             }
-            log.Println("Found Basys3 at", port.Name)
+            baes.SetDevice(port.Name)
+            baes.log(COMPONENT_DEVICE).Info("Found Basys3")
+            serialNumber := port.SerialNumber
             port, err := serial.Open(port.Name, &serial.Mode{})
             if err != nil {
-                log.Fatalf("Error opening port: %s", err)
+                return fmt.Errorf("failed to open %s: %w", baes.device, err)
+            }
+            if capturePath != "" {
+                capture, err := NewCapturePort(port, capturePath)
+                if err != nil {
+                    port.Close()
+                    return err
+                }
+                baes.log(COMPONENT_DEVICE).Info("Recording serial traffic", "capture", capturePath)
+                port = capture
             }
-            port.SetMode(&PORT_MODE)
-            log.Printf("Opened port with mode <code>%s</code>", PORT_MODE_STR)
             baes.SetPort(&port)
+            baes.chooseBaud(baud, serialNumber, store)
+            err = baes.Negotiate()
+            if err != nil {
+                baes.log(COMPONENT_DEVICE).Error("Failed to negotiate protocol with Basys3", errAttr(err))
+            }
             found = true;
         }
     }
@@ -191,141 +208,488 @@ func connectToBasys3(baes *BAESys128) error {
     return nil
 }
 
-func main() {
-    var logger = new(Logger).Init()
-    defer log.Println("Server exiting...")
+// serve runs the web UI, what the binary does without a subcommand, and
+// returns the exit code. It only returns early, the server runs until the
+// process is killed
+func serve(args []string) int {
+    flags := flag.NewFlagSet("serve", flag.ExitOnError)
+    device := addDeviceFlags(flags)
+    replayFlag := flags.String("replay", "", "replay a capture file instead of connecting to a Basys3")
+    diffFlag := flags.String("diff", "", "compare a capture file against the software model and exit")
+    windowFlag := flags.Int("window", 1, "number of blocks to keep in flight to the Basys3. 1 is lock step")
+    paddingFlag := flags.String("padding", PADDINGS[0].Name, "default padding: pkcs7, iso7816, x923, zero or none")
+    selfTestFlag := flags.Bool("selftest", true, "run the known answer self test once connected to a v2 Basys3. A raw Basys3 is only tested when this is given, since it keeps the test key until btnC is pressed")
+    suffixFlag := flags.String("secret-suffix", "", "ECB lab: append this secret to every message before encrypting it. DELIBERATELY VULNERABLE, /encrypt gives the secret away")
+    keystoreFlag := flags.String("keystore", DefaultKeystorePath(), "keystore file the UI can unlock. Empty for none")
+    oracleFlag := flags.Bool("oracle", false, "serve the padding oracle lab. DELIBERATELY VULNERABLE, /oracle leaks whether the padding of any ciphertext is valid")
+    logFileFlag := flags.String("log-file", "", "JSON lines file with every log entry of this run, what the log panel downloads. Empty for none, nothing is written to disk")
+    logLevelFlag := flags.String("log-level", "info", "lowest level printed to the terminal: debug, info, warn or error. The file and the log panel get everything")
+    flags.Parse(args)
+
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(*logLevelFlag)); err != nil {
+        fmt.Printf("Invalid -log-level: %s\n", err)
+        return 2
+    }
+    session, err := OpenSessionLog(*logFileFlag)
+    if err != nil {
+        fmt.Printf("Failed to open the session log: %s\n", err)
+        return 1
+    }
+    // a nil *os.File in an io.Writer is not a nil io.Writer
+    var sessionWriter io.Writer
+    if session != nil {
+        defer session.Close()
+        sessionWriter = session
+    }
+    var logger = NewLogger()
+    // log.Printf from dependencies goes through slog too
+    slog.SetDefault(slog.New(NewLogHandler(os.Stdout, sessionWriter, logger, level)))
     defer logger.Teardown()
-
+    defer componentLog(COMPONENT_SERVER).Info("Server exiting")
+    if session != nil {
+        componentLog(COMPONENT_SERVER).Info("Logging this session", "file", session.Name())
+    }
 
     baes := new(BAESys128)
-    err := connectToBasys3(baes)
+    protocol, profile, err := device.Load(baes)
+    if err != nil {
+        componentLog(COMPONENT_SERVER).Error("Invalid device flags", errAttr(err))
+        return 2
+    }
+    padding, err := ParsePadding(*paddingFlag)
     if err != nil {
-        log.Println(err)
+        componentLog(COMPONENT_SERVER).Error("Invalid -padding", errAttr(err))
+        return 2
+    }
+    baes.SetPadding(padding)
+    if *diffFlag != "" {
+        if !device.ProtocolSet(flags) {
+            // worked out from the capture
+            protocol = PROTOCOL_AUTO
+        }
+        // returned so the session log is closed and the log flushed
+        return diffCaptureFile(*diffFlag, protocol, profile)
+    }
+    baes.SetWindow(*windowFlag)
+    baes.SetKeystore(*keystoreFlag)
+    if *replayFlag != "" {
+        events, err := ReadCaptureFile(*replayFlag)
+        if err != nil {
+            componentLog(COMPONENT_DEVICE).Error("Failed to read capture", errAttr(err))
+            return 1
+        }
+        if !device.ProtocolSet(flags) {
+            baes.SetProtocol(replayProtocol(events))
+        }
+        baes.SetDevice("replay:" + *replayFlag)
+        baes.log(COMPONENT_DEVICE).Info("Replaying capture", "events", len(events))
+        baes.SetPort(NewReplayPort(events).Port())
+        err = baes.Negotiate()
+        if err != nil {
+            baes.log(COMPONENT_DEVICE).Error("Failed to negotiate protocol with replay", errAttr(err))
+        }
+    } else {
+        err = device.Connect(baes)
+        if err != nil {
+            componentLog(COMPONENT_DEVICE).Warn("Running without Basys3", errAttr(err))
+        }
+    }
+    // a v2 Basys3 is reset after the test. A raw one keeps the test key, so
+    // testing it on every start would mean a btnC press on every start
+    selfTest := *selfTestFlag && (baes.Protocol() == PROTOCOL_V2 || flagSet(flags, "selftest"))
+    if selfTest && baes.HasDevice() {
+        _, err = baes.SelfTest()
+        if err != nil {
+            baes.log(COMPONENT_SELFTEST).Warn("Skipped Basys3 self test", errAttr(err))
+        } else if baes.Protocol() != PROTOCOL_V2 {
+            baes.log(COMPONENT_SELFTEST).Warn("Basys3 holds the self test key. Click Change Key and press the center button (btnC) before setting a key")
+        }
     }
 
-    http.HandleFunc("/", index)
-    http.HandleFunc("/submit", handle_submit)
+    http.HandleFunc("/", index(baes, session != nil))
+    http.HandleFunc("/submit", handle_submit(baes))
     http.HandleFunc("/key", handle_set_key(baes))
+    http.HandleFunc("/key/reset", handle_reset_key(baes))
+    http.HandleFunc("/key/derive", handle_derive_key(baes))
     http.HandleFunc("/encrypt", handle_encrypt_message(baes))
     http.HandleFunc("/decrypt", handle_decrypt_message(baes))
     http.HandleFunc("/key/random", handle_random_key(baes))
+    http.HandleFunc("/selftest", handle_self_test(baes))
     http.HandleFunc("/message/random", handle_random_message)
+    http.HandleFunc("/file/encrypt", handle_file(baes, false))
+    http.HandleFunc("/file/decrypt", handle_file(baes, true))
     http.HandleFunc("/log", logger.handle_ws)
+    if session != nil {
+        http.HandleFunc("/log/download", handle_log_download(session.Name()))
+    }
+    for _, action := range []string{"unlock", "lock", "create", "import", "select", "export", "delete"} {
+        http.HandleFunc("/keys/" + action, handle_keystore(baes, action))
+    }
+    if *suffixFlag != "" {
+        baes.SetSecretSuffix([]byte(*suffixFlag))
+        lab := NewECBLab(baes)
+        http.HandleFunc("/ecb/attack", lab.handle_attack)
+        componentLog(COMPONENT_LAB).Warn("ECB lab is on. Every message is encrypted with a secret suffix, do not expose this server")
+    }
+    if *oracleFlag {
+        lab := NewPaddingOracleLab(baes)
+        http.HandleFunc("/oracle", lab.handle_oracle)
+        http.HandleFunc("/oracle/challenge", lab.handle_challenge)
+        http.HandleFunc("/oracle/attack", lab.handle_attack)
+        componentLog(COMPONENT_LAB).Warn("Padding oracle lab is on. /oracle leaks padding validity, do not expose this server")
+    }
 
     // Start the server on port 8080
-    log.Println("Server started at <code>http://localhost:8080</code>")
+    componentLog(COMPONENT_SERVER).Info("Server started", "url", "http://localhost:8080")
     err = http.ListenAndServe(":8080", nil)
+    componentLog(COMPONENT_SERVER).Error("Error starting server", errAttr(err))
+    return 1
+}
+
+// diffCaptureFile prints where a capture and the software model disagree
+// and returns the exit code
+func diffCaptureFile(path string, protocol Protocol, profile DeviceProfile) int {
+    events, err := ReadCaptureFile(path)
+    if err != nil {
+        fmt.Printf("Failed to read capture: %s\n", err)
+        return 2
+    }
+    if protocol == PROTOCOL_AUTO {
+        protocol = captureProtocol(events)
+    }
+    model := NewBasys3Model(protocol)
+    model.SetProfile(profile)
+    diffs, err := DiffCapture(events, model)
     if err != nil {
-        fmt.Printf("Error starting server: %s\n", err)
+        fmt.Printf("Failed to replay capture: %s\n", err)
+        return 2
     }
+    for _, diff := range diffs {
+        fmt.Println(diff)
+    }
+    if len(diffs) > 0 {
+        fmt.Printf("%d of %d events differ from the %s software model\n", len(diffs), len(events), protocol)
+        return 1
+    }
+    fmt.Printf("All %d events match the %s software model\n", len(events), protocol)
+    return 0
 }
 
 type PageFormOpts struct {
     key *string;
     key_err *string;
+    passphrase *string;
+    kdf string;
+    // the key derivation parameters as a PHC string
+    kdf_params *string;
+    passphrase_err *string;
     message *string;
+    message_err *string;
+    padding string;
     ciphertext *string;
+    ciphertext_err *string;
     encrypt_err *string;
     ptmessage *string;
+    // the decrypted plaintext, ptmessage is it in pt_encoding
+    pt []byte;
+    pt_encoding string;
+    key_encoding string;
+    message_encoding string;
+    ciphertext_encoding string;
+    ciphertext_format string;
+    mode string;
+    key_id *string;
+    key_state KeyState;
+    has_device bool;
+    key_locked bool;
+    verify *EncryptResult;
+    verify_stats VerifyStats;
+    protocol Protocol;
+    profile string;
+    health *SelfTestResult;
+    device_err *string;
+    oracle_enabled bool;
+    oracle_ct *string;
+    oracle_err *string;
+    ecb_enabled bool;
+    ecb_err *string;
+    keystore KeystoreView;
+    // a key exported from the keystore, in hex
+    keystore_export *string;
+    keystore_export_name string;
+    keystore_err *string;
 }
 
-func index(w http.ResponseWriter, r *http.Request) {
-    var opts PageFormOpts
-    fmt.Fprintf(w, `
-    <html>
-        <head>
-            <title>Basys3 AES Server</title>
-            <meta name="viewport" content="width=device-width, initial-scale=1" />
-            <meta charset="utf-8" />
-            <script src="https://unpkg.com/htmx.org@1.9.9"></script>
-            <script src="https://unpkg.com/htmx.org@1.9.9/dist/ext/ws.js"></script>
-            <script src="https://cdn.tailwindcss.com"></script>
-            <style>
-                code {
-                    background: #3465a424;
-                    border-radius: 2px;
-                }
-            </style>
-        </head>
-        <body class="px-10 py-10">
-            <div class="flex flex-row justify-between">
-                %s
-                <div>
-                    <label for="log">System Log</label>
-                    <div hx-ext="ws" ws-connect="/log" id="log" class="w-[600px] h-[400px] overflow-auto border-2">
-                        <div id="log-messages">
-                        </div>
+// index is the whole page. download is whether there is a session log
+func index(baes *BAESys128, download bool) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        opts := PageFormOpts{
+            key_state: baes.KeyState(),
+            has_device: baes.HasDevice(),
+            key_locked: baes.KeyLocked(),
+            protocol: baes.Protocol(),
+            profile: baes.Profile().Name,
+            padding: baes.Padding().Name,
+            health: baes.Health(),
+            key_encoding: ENCODING_UTF8.Name,
+            kdf: KDF_ARGON2ID,
+            message_encoding: ENCODING_UTF8.Name,
+            ciphertext_encoding: ENCODING_HEX.Name,
+            ciphertext_format: FORMAT_BARE,
+            mode: MODE_ECB.String(),
+            oracle_enabled: baes.OracleEnabled(),
+            ecb_enabled: baes.HasSecretSuffix(),
+            keystore: baes.Keystore().View(),
+        }
+        fmt.Fprintf(w, `
+        <html>
+            <head>
+                <title>Basys3 AES Server</title>
+                <meta name="viewport" content="width=device-width, initial-scale=1" />
+                <meta charset="utf-8" />
+                <script src="https://unpkg.com/htmx.org@1.9.9"></script>
+                <script src="https://unpkg.com/htmx.org@1.9.9/dist/ext/ws.js"></script>
+                <script src="https://cdn.tailwindcss.com"></script>
+                <style>
+                    code {
+                        background: #3465a424;
+                        border-radius: 2px;
+                    }
+                </style>
+            </head>
+            <body class="px-10 py-10">
+                <div class="flex flex-row justify-between">
+                    <div>
+                        %s
+                        %s
+                    </div>
+                    <div>
+                        %s
                     </div>
                 </div>
-            </div>
-        </body>
-    </html>
-        `, opts.render())
+            </body>
+        </html>
+            `, opts.render(), file_form_group(), log_panel(download))
+    }
 }
 
 func (opts PageFormOpts) render() string {
     var same *bool
-    if opts.message != nil && opts.ptmessage != nil {
-        same = new(bool)
-        *same = *opts.message == *opts.ptmessage
+    if opts.message != nil && opts.pt != nil {
+        enc, err := ParseEncoding(opts.message_encoding)
+        if err == nil {
+            msg, err := enc.Decode(*opts.message)
+            same = new(bool)
+            *same = err == nil && string(msg) == string(opts.pt)
+        }
     }
 
     return fmt.Sprintf(`
-            <form hx-post="/submit" hx-swap="outerHTML" id="form">
+            <form hx-post="/submit" hx-swap="outerHTML" hx-encoding="multipart/form-data" id="form">
+                %s
+                %s
+                %s
+                %s
+                %s
+                %s
                 %s
                 %s
                 %s
                 %s
             </form>
         `,
-        key_form_group(opts.key, opts.key_err),
-        message_form_group(opts.message),
-        cipher_form_group(opts.ciphertext, opts.encrypt_err),
-        plaintext_form_group(opts.ptmessage, same),
+        device_form_group(opts.has_device, opts.protocol, opts.profile, opts.health, opts.device_err),
+        key_form_group(opts.key, opts.key_encoding, opts.key_err, opts.key_state, opts.has_device, opts.key_locked),
+        keystore_form_group(opts.keystore, opts.keystore_export, opts.keystore_export_name, opts.keystore_err),
+        passphrase_form_group(opts.passphrase, opts.kdf, opts.kdf_params, opts.passphrase_err),
+        message_form_group(opts.message, opts.message_encoding, opts.padding, opts.message_err),
+        cipher_form_group(opts.ciphertext, opts.ciphertext_encoding, container_options(opts.ciphertext_format, opts.mode, opts.key_id), opts.ciphertext_err, opts.encrypt_err),
+        verify_form_group(opts.verify, opts.verify_stats),
+        plaintext_form_group(opts.ptmessage, opts.pt_encoding, same),
+        oracle_form_group(opts.oracle_enabled, opts.oracle_ct, opts.oracle_err),
+        ecb_form_group(opts.ecb_enabled, opts.ecb_err),
     )
 }
 
-func parse_form(r *http.Request) PageFormOpts {
+func (opts *PageFormOpts) set_field_errors(errs FieldErrors) {
+    opts.key_err = errs.Get("key")
+    opts.passphrase_err = errs.Get("passphrase")
+    opts.message_err = errs.Get("message")
+    if opts.message_err == nil {
+        opts.message_err = errs.Get("padding")
+    }
+    opts.ciphertext_err = errs.Get("ciphertext")
+    if opts.ciphertext_err == nil {
+        opts.ciphertext_err = errs.Get("ciphertext-format")
+    }
+}
+
+func parse_form(r *http.Request, baes *BAESys128) PageFormOpts {
     var opts PageFormOpts
-    parseField := func(field string) *string {
-        f := r.FormValue(field)
-        if f == "" {
-            return nil
-        }
-        return &f
-    }
-    opts.key = parseField("key")
-    opts.key_err = validate_key(opts.key)
-    opts.message = parseField("message")
-    opts.encrypt_err = parseField("encrypt-error")
-    opts.ciphertext = parseField("ciphertext")
-    opts.ptmessage = parseField("ptmessage")
+    opts.key_state = baes.KeyState()
+    opts.has_device = baes.HasDevice()
+    opts.key_locked = baes.KeyLocked()
+    opts.verify_stats = baes.VerifyStats()
+    opts.protocol = baes.Protocol()
+    opts.profile = baes.Profile().Name
+    opts.health = baes.Health()
+    opts.key, opts.key_encoding = form_text(r, "key", ENCODING_UTF8)
+    if opts.key != nil {
+        _, errs := parseKeyRequest(r)
+        opts.key_err = errs.Get("key")
+    }
+    opts.passphrase = formField(r, "passphrase")
+    opts.kdf = KDF_ARGON2ID
+    if kdf := formField(r, "kdf"); kdf != nil {
+        opts.kdf = *kdf
+    }
+    opts.kdf_params = formField(r, "kdf-params")
+    opts.message, opts.message_encoding = form_text(r, "message", ENCODING_UTF8)
+    opts.padding = baes.Padding().Name
+    if padding := formField(r, "padding"); padding != nil {
+        opts.padding = *padding
+    }
+    opts.encrypt_err = formField(r, "encrypt-error")
+    opts.ciphertext, opts.ciphertext_encoding = form_text(r, "ciphertext", ENCODING_HEX)
+    opts.ciphertext_format = FORMAT_BARE
+    if format := formField(r, "ciphertext-format"); format != nil {
+        opts.ciphertext_format = *format
+    }
+    opts.mode = MODE_ECB.String()
+    if mode := formField(r, "mode"); mode != nil {
+        opts.mode = *mode
+    }
+    opts.key_id = formField(r, "key-id")
+    opts.ptmessage = formField(r, "ptmessage")
+    opts.oracle_enabled = baes.OracleEnabled()
+    opts.oracle_ct = formField(r, "oracle-ciphertext")
+    opts.ecb_enabled = baes.HasSecretSuffix()
+    opts.keystore = baes.Keystore().View()
     return opts
 }
 
 
-// FIXME: disable buttons when key has been set
-// (and basys is connected! don't ruin debugging!)
-// until way to change key in basys is implemented
-func key_form_group(key *string, key_err *string) string {
+// Set and Random Key are disabled once the Basys3 holds a key (only when
+// it is connected! don't ruin debugging!) until the user goes through the
+// Change Key handshake. v2 devices are never locked
+func key_form_group(key *string, encoding string, key_err *string, state KeyState, has_device bool, locked bool) string {
+    disabled := ""
+    change := ""
+    if locked {
+        disabled = "disabled"
+        change = `
+                <button hx-post="/key/reset" hx-target="#form" class="border-2 bg-slate-100">
+                    Change Key
+                </button>`
+    }
     return fmt.Sprintf(`
             <div id="key-part" class="flex flex-row gap-2">
                 <label for="key">Secret Key</label>
                 %s
-                <button hx-post="/key" hx-target="#form" class="border-2 bg-slate-100">
+                %s
+                %s
+                <button %s hx-post="/key" hx-target="#form" class="border-2 bg-slate-100 disabled:opacity-50">
                     Set
                 </button>
-                <button class="border-2 bg-slate-100" hx-get="/key/random" hx-target="#key-input">
+                <button %s class="border-2 bg-slate-100 disabled:opacity-50" hx-get="/key/random" hx-include="#key-encoding, #keygen-mode, #kdf" hx-target="#key-input" hx-swap="outerHTML">
                     Random Key
                 </button>
+                %s%s
             </div>
             %s
+            %s
+            %s
         `,
         key_input(key),
+        encoding_select("key", encoding, false),
+        file_input("key"),
+        disabled,
+        disabled,
+        keygen_mode_select("keygen-mode"),
+        change,
+        key_status_p(state, has_device, locked),
+        key_entropy_p(nil, false),
         error_p("key-error", key_err, false),
     )
 }
 
+// passphrase_form_group derives the key instead of typing it. The
+// parameters can be edited, or pasted in to derive the same key again
+func passphrase_form_group(passphrase *string, kdf string, params *string, err *string) string {
+    options := ""
+    for _, name := range KDFS {
+        attr := ""
+        if name == kdf {
+            attr = "selected"
+        }
+        options += fmt.Sprintf(`<option value="%s" %s>%s</option>`, name, attr, name)
+    }
+    return fmt.Sprintf(`
+            <div id="passphrase-part" class="flex flex-col gap-2 py-2">
+                <div class="flex flex-row gap-2">
+                    <label for="passphrase">Passphrase</label>
+                    %s
+                    <select id="kdf" name="kdf" class="border-2">%s</select>
+                    <button hx-post="/key/derive" hx-target="#form" class="border-2 bg-slate-100">
+                        Derive Key
+                    </button>
+                </div>
+                <p class="text-sm text-slate-500">Used instead of the key when filled in. The parameters are put in front of the ciphertext so it can be decrypted with just the passphrase</p>
+                <div class="flex flex-row gap-2">
+                    <label for="kdf-params" class="text-sm">Parameters</label>
+                    %s
+                    %s
+                </div>
+                %s
+            </div>
+        `,
+        passphrase_input(passphrase, false),
+        options,
+        kdf_params_input(params, false),
+        download_link(params, ENCODING_UTF8.Name, "kdf-params.txt"),
+        error_p("passphrase-error", err, false),
+    )
+}
+
+func passphrase_input(passphrase *string, out_of_band bool) string {
+    oob := ""
+    if out_of_band {
+        oob = `hx-swap-oob="true"`
+    }
+    return fmt.Sprintf(`<input spellcheck="false" type="password" id="passphrase" name="passphrase" %s class="border-2" value="%s"></input>`, oob, html.EscapeString(empty_if_nil(passphrase)))
+}
+
+func kdf_params_input(params *string, out_of_band bool) string {
+    oob := ""
+    if out_of_band {
+        oob = `hx-swap-oob="true"`
+    }
+    return fmt.Sprintf(`<input spellcheck="false" type="text" id="kdf-params" name="kdf-params" %s class="w-[500px] border-2 text-sm font-mono" value="%s"></input>`, oob, html.EscapeString(empty_if_nil(params)))
+}
+
+func key_status_p(state KeyState, has_device bool, locked bool) string {
+    if !has_device {
+        return `<p id="key-status" class="text-sm text-slate-500">No Basys3 connected. Keys are only set in software</p>`
+    }
+    msg := ""
+    switch state {
+    case KEY_STATE_NONE:
+        msg = "Basys3 is waiting for a key. The next block sent to it will be loaded as the key"
+    case KEY_STATE_SET:
+        msg = "Key loaded on Basys3. Click Change Key to use a different one"
+        if !locked {
+            msg = "Key loaded on Basys3. Setting a new key resets it"
+        }
+    case KEY_STATE_UNKNOWN:
+        msg = "Basys3 holds a key this server did not set. Click Change Key and press the center button (btnC) to reset it"
+        if !locked {
+            msg = "Basys3 holds a key this server did not set. Setting a new key resets it"
+        }
+    }
+    return fmt.Sprintf(`<p id="key-status" class="text-sm text-slate-500">%s</p>`, msg)
+}
+
 func error_p(id string, err *string, out_of_band bool) string {
     label := ""
     errLabel := "ERROR: "
@@ -336,25 +700,29 @@ func error_p(id string, err *string, out_of_band bool) string {
     if out_of_band {
         oob = `hx-swap-oob="true"`
     }
-    error := empty_if_nil(err)
+    error := html.EscapeString(label + empty_if_nil(err))
     name := id
     return fmt.Sprintf(`
-        <input readonly id="%s" name="%s" %s class="w-full" style="color: #FF0000; font-size: 14px; font-weight: bold; margin-top: 5px;" value="%s%s"></input>
-    `, id, name, oob, label, error)
+        <input readonly id="%s" name="%s" %s class="w-full" style="color: #FF0000; font-size: 14px; font-weight: bold; margin-top: 5px;" value="%s"></input>
+    `, id, name, oob, error)
 }
 
 func key_input(_key *string) string {
     key := empty_if_nil(_key)
     return fmt.Sprintf(`
         <input spellcheck="false" type="text" id="key-input" class="border-2" name="key" value="%s"></input>
-    `, key)
+    `, html.EscapeString(key))
 }
 
-func message_form_group(_message *string) string {
+func message_form_group(_message *string, encoding string, padding string, err *string) string {
     message := empty_if_nil(_message)
     return fmt.Sprintf(`
             <div id="message-part" class="flex flex-col gap-2 py-4">
-                <label for="message">Message</label>
+                <div class="flex flex-row gap-2">
+                    <label for="message">Message</label>
+                    %s
+                    %s
+                </div>
                 <textarea spellcheck="false" type="text" id="message" name="message" class="w-[600px] border-2" rows="4" >%s</textarea>
                 <div class="flex flex-row justify-start gap-2">
                    <button class="border-2 bg-slate-100" hx-get="/message/random" hx-target="#message" hx-swap="innerHTML">
@@ -363,23 +731,73 @@ func message_form_group(_message *string) string {
                    <button hx-post="/encrypt" hx-target="form" class="border-2 bg-slate-100">
                       Encrypt!
                    </button>
+                   %s
                 </div>
+                %s
             </div>
-        `, message)
+        `, encoding_select("message", encoding, false), file_input("message"), message, padding_select(padding), error_p("message-error", err, false))
 }
 
-func cipher_form_group(_ct *string, err *string) string {
+func cipher_form_group(_ct *string, encoding string, options string, ct_err *string, err *string) string {
     ct := empty_if_nil(_ct)
+    // the download is just the ciphertext, the parameters have their own
+    _, body, _ := splitKDFHeader(ct)
+    filename := "ciphertext.bin"
+    if IsContainer([]byte(ct)) {
+        // armor is shown as text, a binary container can not be
+        body, encoding, filename = ct, ENCODING_UTF8.Name, "ciphertext.asc"
+    } else if data, err := ParseEncoding(encoding); err == nil {
+        if decoded, err := data.Decode(body); err == nil && IsContainer(decoded) {
+            filename = "ciphertext.baes"
+        }
+    }
     return fmt.Sprintf(`
             <div id="cipher-part" class="flex flex-col gap-2 py-2">
-                <p>Cipher Text</p>
-                <textarea readonly id="ciphertext" name="ciphertext" class="w-[600px] h-[200px] border-2 break-words">%s</textarea>
+                <div class="flex flex-row gap-2">
+                    <p>Cipher Text</p>
+                    %s
+                    %s
+                    %s
+                </div>
+                %s
+                <textarea spellcheck="false" id="ciphertext" name="ciphertext" class="w-[600px] h-[200px] border-2 break-words">%s</textarea>
                 <button hx-post="/decrypt" hx-target="form" class="block border-2 bg-slate-100">
                    Decrypt
                 </button>
                 %s
+                %s
             </div>
-        `, ct, error_p("encrypt-error", err, false))
+        `, encoding_select("ciphertext", encoding, false), file_input("ciphertext"), download_link(&body, encoding, filename), options, ct, error_p("ciphertext-error", ct_err, false), error_p("encrypt-error", err, false))
+}
+
+// container_options picks how Encrypt wraps the ciphertext. Decrypt works
+// out whether it was given a container by itself
+func container_options(format string, mode string, key_id *string) string {
+    formats := ""
+    for _, f := range [][2]string{{FORMAT_BARE, "bare blocks"}, {FORMAT_CONTAINER, "container"}, {FORMAT_ARMORED, "armored container"}} {
+        attr := ""
+        if f[0] == format {
+            attr = "selected"
+        }
+        formats += fmt.Sprintf(`<option value="%s" %s>%s</option>`, f[0], attr, f[1])
+    }
+    modes := ""
+    for _, m := range []CipherMode{MODE_ECB, MODE_CBC} {
+        attr := ""
+        if m.String() == mode {
+            attr = "selected"
+        }
+        modes += fmt.Sprintf(`<option value="%s" %s>%s</option>`, m, attr, strings.ToUpper(m.String()))
+    }
+    return fmt.Sprintf(`
+                <div class="flex flex-row gap-2 text-sm">
+                    <label for="ciphertext-format">Format</label>
+                    <select id="ciphertext-format" name="ciphertext-format" class="border-2">%s</select>
+                    <label for="mode">Mode</label>
+                    <select id="mode" name="mode" class="border-2">%s</select>
+                    <label for="key-id">Key ID</label>
+                    <input spellcheck="false" type="text" id="key-id" name="key-id" class="border-2" placeholder="optional" value="%s"></input>
+                </div>`, formats, modes, html.EscapeString(empty_if_nil(key_id)))
 }
 
 func same_icon(same *bool) string {
@@ -395,16 +813,32 @@ func same_icon(same *bool) string {
     return fmt.Sprintf(`<p class="text-white border-4 border-%s bg-%s/75 rounded-md px-2">%s</p>`, color, color, msg)
 }
 
-func plaintext_form_group(_pt *string, same *bool) string {
+func plaintext_form_group(_pt *string, encoding string, same *bool) string {
     pt := empty_if_nil(_pt)
+    label := ""
+    if _pt != nil {
+        label = fmt.Sprintf(`<p class="text-sm text-slate-500">%s</p>`, encoding)
+    }
     return fmt.Sprintf(`
             <div id="pt-part" class="flex flex-col gap-2 py-2">
                 <div class="flex flex-row gap-4">
-                    <p>Plain Text</p> %s
+                    <p>Plain Text</p> %s %s %s
                 </div>
                 <textarea readonly class="w-[600px] h-[200px] border-2 break-words">%s</textarea>
             </div>
-        `, same_icon(same), pt)
+        `, label, same_icon(same), download_link(_pt, encoding, "plaintext.bin"), pt)
+}
+
+// show_bytes is data in the encoding named by encoding, which is changed to
+// hex if that encoding can not show data
+func show_bytes(data []byte, encoding *string) *string {
+    enc, err := ParseEncoding(*encoding)
+    if err != nil {
+        enc = ENCODING_HEX
+    }
+    text, used := EncodeText(enc, data)
+    *encoding = used.Name
+    return &text
 }
 
 func empty_if_nil(s *string) string {
@@ -414,41 +848,162 @@ func empty_if_nil(s *string) string {
     return *s
 }
 
-func handle_submit(w http.ResponseWriter, r *http.Request) {
-    opts := parse_form(r)
-    fmt.Fprint(w, opts.render())
+func handle_submit(baes *BAESys128) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        opts := parse_form(r, baes)
+        fmt.Fprint(w, opts.render())
+    }
 }
 
 func handle_set_key(baes *BAESys128) Handler {
     return func(w http.ResponseWriter, r *http.Request) {
-        opts := parse_form(r)
-        log.Printf("Set key to <code>%s</code>. Error: <code>%s</code>", empty_if_nil(opts.key), empty_if_nil(opts.key_err))
-        if opts.key_err == nil {
-            baes.SetKey([]byte(*opts.key))
+        opts := parse_form(r, baes)
+        req, errs := parseKeyRequest(r)
+        opts.set_field_errors(errs)
+        baes.log(COMPONENT_KEY).Info("Set key", kcvAttr(req.Key), errAttr(empty_if_nil(opts.key_err)))
+        if len(errs) == 0 {
+            err := baes.SetKey(req.Key)
+            if err != nil {
+                err_msg := error_message(err)
+                baes.log(COMPONENT_KEY).Error("Error while trying to set key", errAttr(err_msg))
+                opts.key_err = &err_msg
+            }
+        }
+        opts.key_state = baes.KeyState()
+        opts.key_locked = baes.KeyLocked()
+        fmt.Fprint(w, opts.render())
+    }
+}
+
+func handle_derive_key(baes *BAESys128) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        opts := parse_form(r, baes)
+        req, errs := parseDeriveKeyRequest(r)
+        opts.set_field_errors(errs)
+        if len(errs) == 0 {
+            opts.show_derived_key(req.Key, req.KDF)
+            baes.log(COMPONENT_KEY).Info("Derived key", kcvAttr(req.Key), "kdf", *opts.kdf_params)
+            err := baes.SetKey(req.Key)
+            if err != nil {
+                err_msg := error_message(err)
+                baes.log(COMPONENT_KEY).Error("Error while trying to set key", errAttr(err_msg))
+                opts.key_err = &err_msg
+            }
+        }
+        opts.key_state = baes.KeyState()
+        opts.key_locked = baes.KeyLocked()
+        fmt.Fprint(w, opts.render())
+    }
+}
+
+// show_derived_key puts a key derived from the passphrase in the key field,
+// and the parameters used in theirs
+func (opts *PageFormOpts) show_derived_key(key []byte, params *KDFParams) {
+    if params == nil {
+        return
+    }
+    opts.key_encoding = ENCODING_HEX.Name
+    opts.key = show_bytes(key, &opts.key_encoding)
+    text := params.String()
+    opts.kdf_params = &text
+    opts.kdf = params.Algorithm
+}
+
+func handle_reset_key(baes *BAESys128) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        opts := parse_form(r, baes)
+        opts.key_err = nil
+        err := baes.ResetKey()
+        if err != nil {
+            err_msg := error_message(err)
+            baes.log(COMPONENT_KEY).Error("Error while trying to reset key", errAttr(err_msg))
+            opts.key_err = &err_msg
+        }
+        opts.key_state = baes.KeyState()
+        opts.key_locked = baes.KeyLocked()
+        fmt.Fprint(w, opts.render())
+    }
+}
+
+func handle_self_test(baes *BAESys128) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        opts := parse_form(r, baes)
+        _, err := baes.SelfTest()
+        if err != nil {
+            err_msg := error_message(err)
+            baes.log(COMPONENT_SELFTEST).Error("Error while trying to run self test", errAttr(err_msg))
+            opts.device_err = &err_msg
         }
+        opts.health = baes.Health()
+        opts.key_state = baes.KeyState()
+        opts.key_locked = baes.KeyLocked()
         fmt.Fprint(w, opts.render())
     }
 }
 
+// only fills in the key input, and the passphrase for a words key. The key
+// is sent to the Basys3 when the user clicks Set, which refuses to
+// overwrite a key that is already loaded
 func handle_random_key(baes *BAESys128) Handler {
     return func (w http.ResponseWriter, r *http.Request) {
-        key := gen_random_key()
-        // FIXME: handle error where key is set
-        baes.SetKey([]byte(key))
+        if baes.KeyLocked() {
+            err_msg := "Key is already set on the Basys3. Click Change Key first"
+            key := r.FormValue("key")
+            fmt.Fprint(w, key_input(&key))
+            fmt.Fprint(w, error_p("key-error", &err_msg, true))
+            return
+        }
+        mode := KEYGEN_BYTES
+        if m := formField(r, "keygen-mode"); m != nil {
+            mode = *m
+        }
+        kdf := KDF_ARGON2ID
+        if k := formField(r, "kdf"); k != nil {
+            kdf = *k
+        }
+        gen, err := GenerateKey(mode, KEY_SIZE, kdf)
+        if err != nil {
+            err_msg := err.Error()
+            key := r.FormValue("key")
+            fmt.Fprint(w, key_input(&key))
+            fmt.Fprint(w, error_p("key-error", &err_msg, true))
+            return
+        }
+        componentLog(COMPONENT_KEY).Info("Generated a key", "mode", gen.Mode, "entropy", gen.Describe())
+        enc, err := fieldEncoding(r, "key", ENCODING_UTF8)
+        if err != nil || (mode != KEYGEN_PRINTABLE && enc.Name == ENCODING_UTF8.Name) {
+            // random bytes that happen to be UTF-8 are still no text
+            enc = ENCODING_HEX
+        }
+        key, used := EncodeText(enc, gen.Key)
         fmt.Fprint(w, key_input(&key))
+        fmt.Fprint(w, encoding_select("key", used.Name, true))
+        if gen.KDF != nil {
+            params := gen.KDF.String()
+            fmt.Fprint(w, passphrase_input(&gen.Text, true))
+            fmt.Fprint(w, kdf_params_input(&params, true))
+        }
+        entropy := gen.Describe()
+        fmt.Fprint(w, key_entropy_p(&entropy, true))
         fmt.Fprint(w, error_p("key-error", nil, true))
     }
 }
 
-func gen_random_key() string {
-    charset := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$^&*-=+?")
-    key := make([]byte, 16)
-    for i := range key {
-        key[i] = charset[rand.Intn(len(charset))]
+// key_entropy_p says how strong the last generated key is
+func key_entropy_p(entropy *string, out_of_band bool) string {
+    oob := ""
+    if out_of_band {
+        oob = `hx-swap-oob="true"`
+    }
+    return fmt.Sprintf(`<p id="key-entropy" %s class="text-sm text-slate-500">%s</p>`, oob, html.EscapeString(empty_if_nil(entropy)))
+}
+
+func keygen_mode_select(id string) string {
+    options := ""
+    for _, m := range [][2]string{{KEYGEN_BYTES, "all bytes"}, {KEYGEN_PRINTABLE, "printable"}, {KEYGEN_WORDS, "words"}} {
+        options += fmt.Sprintf(`<option value="%s">%s</option>`, m[0], m[1])
     }
-    var keystr = string(key)
-    log.Printf("Generated key <code>%s</code>", keystr)
-    return keystr
+    return fmt.Sprintf(`<select id="%s" name="%s" class="border-2">%s</select>`, id, id, options)
 }
 
 func handle_random_message(w http.ResponseWriter, r *http.Request) {
@@ -462,22 +1017,35 @@ func gen_random_message() string {
     })
     num_words := rand.Intn(len(words))
     msg := strings.Join(words[:num_words], " ")
-    log.Printf("Generated message of length <code>%d</code>", len(msg))
+    componentLog(COMPONENT_CRYPTO).Info("Generated message", ATTR_BYTES, len(msg))
     return msg
 }
 
-func validate_key(key *string) *string {
-    var msg = ""
-    if key == nil {
-        msg = "Key is required"
-    }
-    if len(*key) != 16 {
-        msg = fmt.Sprintf("Key is %d characters long but it must be 16 characters long", len(*key))
-    }
-    if msg == "" {
-        return nil
+// KeyState tracks what the Basys3 will do with the next block it receives.
+// trojan_top loads the first block after a reset (btnC) as the key and
+// treats every block after that as plaintext
+type KeyState int
+
+const (
+    // the next block written is loaded as the key
+    KEY_STATE_NONE KeyState = iota
+    // the Basys3 holds BAESys128.key
+    KEY_STATE_SET
+    // the Basys3 holds a key but it is not BAESys128.key, probably because
+    // it was set by a previous run of the server. Only a reset fixes this
+    KEY_STATE_UNKNOWN
+)
+
+func (k KeyState) String() string {
+    switch k {
+    case KEY_STATE_NONE:
+        return "none"
+    case KEY_STATE_SET:
+        return "set"
+    case KEY_STATE_UNKNOWN:
+        return "unknown"
     }
-    return &msg
+    return fmt.Sprintf("KeyState(%d)", int(k))
 }
 
 type BAESys128 struct {
@@ -487,10 +1055,78 @@ type BAESys128 struct {
     /// never the basys3. Used for verification and running without basys3
     lastBlock []byte;
     port *serial.Port;
+    keyState KeyState;
+    protocol Protocol;
+    stats VerifyStats;
+    statsMtx sync.Mutex;
+    // one operation on the key or the Basys3 at a time, the labs run in the
+    // background next to the handlers. Taken by the exported methods, never
+    // by the unexported ones they call. Streams take it a block at a time
+    deviceMtx sync.Mutex;
+    window int;
+    health *SelfTestResult;
+    profile *DeviceProfile;
+    padding *PaddingScheme;
+    oracle bool;
+    // appended to every message when the ECB lab is on
+    suffix []byte;
+    keystore *KeystoreSession;
+    // port name, for the log
+    device string;
 }
 
 func (s * BAESys128) SetPort(port *serial.Port) {
     s.port = port;
+    // there is no way to ask the Basys3 whether it already has a key so
+    // assume it doesn't. SetKey checks the key echo and catches it if it does
+    s.keyState = KEY_STATE_NONE
+}
+
+func (s *BAESys128) HasDevice() bool {
+    return s.port != nil
+}
+
+func (s *BAESys128) KeyState() KeyState {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    return s.keyState
+}
+
+// SetProtocol picks the protocol to use instead of negotiating one. Must be
+// called before Negotiate
+func (s *BAESys128) SetProtocol(protocol Protocol) {
+    s.protocol = protocol
+}
+
+func (s *BAESys128) Protocol() Protocol {
+    return s.protocol
+}
+
+// KeyLocked reports whether the key can only be changed by pressing the
+// center button. v2 devices can be reset over UART and fixed keys are never
+// sent, so they are never locked
+func (s *BAESys128) KeyLocked() bool {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    return s.keyLocked()
+}
+
+func (s *BAESys128) keyLocked() bool {
+    if s.Profile().KeyLoading == KEY_LOADING_FIXED {
+        return false
+    }
+    return s.port != nil && s.protocol != PROTOCOL_V2 && s.keyState != KEY_STATE_NONE
+}
+
+// HasKey reports whether key is the key currently in use
+func (s *BAESys128) HasKey(key []byte) bool {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    return s.hasKey(key)
+}
+
+func (s *BAESys128) hasKey(key []byte) bool {
+    return s.keyState == KEY_STATE_SET && string(s.key) == string(key)
 }
 
 func reverse(src []byte) []byte {
@@ -508,43 +1144,48 @@ func (s *BAESys128) Write(p []byte) (int, error) {
         return len(p), nil
     }
 
-    reversed := reverse(p)
-    _, err := (*s.port).Write(reversed)
+    profile := s.Profile()
+    n, err := (*s.port).Write(profile.ToWire(p))
+    if err == nil && n != len(p) {
+        err = io.ErrShortWrite
+    }
     if err != nil {
-        log.Printf("Failed to write to Basys3: <code>%s</code>", err)
+        return n, fmt.Errorf("failed to write to Basys3: %w", err)
     }
+    time.Sleep(profile.BlockDelay())
 
     return len(p), nil
 }
 
-func (s *BAESys128) Read() []byte {
+// Read reads one block from the Basys3, or returns what the go AES
+// encrypted last when there is no Basys3. Gives up after the profile's read
+// timeout with ErrTimeout, or ErrShortRead if part of the block arrived
+func (s *BAESys128) Read() ([]byte, error) {
     lastBlock := s.lastBlock
     s.lastBlock = nil
     if s.port == nil {
-        return lastBlock
+        return lastBlock, nil
     }
-    res := make([]byte, BLOCK_SIZE)
-    _, err := (*s.port).Read(res)
-    res = reverse(res)
+    port := *s.port
+    profile := s.Profile()
+    err := port.SetReadTimeout(profile.ReadTimeout())
     if err != nil {
-        log.Printf("Failed to read from Basys3: <code>%s</code>", err)
-        return res
-    }
-    if len(res) != BLOCK_SIZE {
-        log.Printf("Read <code>%d</code> bytes from Basys3 but expected <code>%d</code>", len(res), BLOCK_SIZE)
-        return res
+        return nil, fmt.Errorf("failed to set read timeout: %w", err)
     }
-    if string(res) != string(lastBlock) {
-        log.Printf("Read <code>%s</code> from Basys3 but expected <code>%s</code>", hex.EncodeToString(res), hex.EncodeToString(res))
+    defer port.SetReadTimeout(serial.NoTimeout)
+    res := make([]byte, BLOCK_SIZE)
+    err = readFull(port, res)
+    if err != nil {
+        return nil, err
     }
-    log.Println("Returning bytes read from Basys3")
-    return res
+    componentLog(COMPONENT_DEVICE).Debug("Returning bytes read from Basys3")
+    return profile.FromWire(res), nil
 }
 
 func pkcs7Pad(data []byte) []byte {
     padding := BLOCK_SIZE - (len(data) % BLOCK_SIZE)
     padBytes := make([]byte, padding)
-    log.Printf("Adding pad of length <code>%d</code", padding)
+    componentLog(COMPONENT_CRYPTO).Debug("Adding pad", ATTR_BYTES, padding)
     for i := range padBytes {
         padBytes[i] = byte(padding)
     }
@@ -552,148 +1193,423 @@ func pkcs7Pad(data []byte) []byte {
     return append(data, padBytes...)
 }
 
-func pkcs7Unpad(data []byte) []byte {
+var ErrInvalidPadding = errors.New("invalid padding")
+
+// pkcs7Unpad checks every padding byte, so decrypting with the wrong key
+// almost always fails with ErrInvalidPadding instead of returning garbage
+func pkcs7Unpad(data []byte) ([]byte, error) {
+    if len(data) == 0 || len(data) % BLOCK_SIZE != 0 {
+        return nil, fmt.Errorf("%w: %d bytes is not a whole number of blocks", ErrInvalidPadding, len(data))
+    }
     padding := int(data[len(data) - 1])
-    return data[:len(data) - padding]
+    if padding == 0 || padding > BLOCK_SIZE {
+        return nil, fmt.Errorf("%w: pad length %d is not between 1 and %d", ErrInvalidPadding, padding, BLOCK_SIZE)
+    }
+    for i, b := range data[len(data) - padding:] {
+        if int(b) != padding {
+            return nil, fmt.Errorf("%w: pad byte %d is 0x%02x instead of 0x%02x", ErrInvalidPadding, i, b, padding)
+        }
+    }
+    return data[:len(data) - padding], nil
 }
 
-func (s *BAESys128) Blocks(msg []byte) [][]byte {
-    msg = pkcs7Pad(msg)
+// Blocks pads msg and splits it into blocks
+func (s *BAESys128) Blocks(msg []byte, padding PaddingScheme) ([][]byte, error) {
+    msg, err := padding.Pad(msg)
+    if err != nil {
+        return nil, err
+    }
     var blocks [][]byte
     for i := 0; i < len(msg); i += BLOCK_SIZE {
         blocks = append(blocks, msg[i:i+BLOCK_SIZE])
     }
-    log.Printf("Split message into <code>%d</code> blocks", len(blocks))
-    return blocks
+    componentLog(COMPONENT_CRYPTO).Debug("Split message into blocks", "blocks", len(blocks))
+    return blocks, nil
 }
 
+// Encrypt returns ErrVerifyMismatch along with the ciphertext if the
+// Basys3 and go AES disagree. EncryptVerified says which blocks
 func (s *BAESys128) Encrypt(msg []byte) ([]byte, error) {
-    blocks := s.Blocks(msg)
-    var ct []byte
+    res, err := s.EncryptVerified(msg)
+    if err != nil {
+        return nil, err
+    }
+    return res.Ciphertext, res.Err()
+}
+
+// EncryptVerified encrypts msg and checks every block the Basys3 sends
+// back against the go AES
+func (s *BAESys128) EncryptVerified(msg []byte) (EncryptResult, error) {
+    return s.EncryptWithPadding(msg, s.Padding())
+}
+
+func (s *BAESys128) EncryptWithPadding(msg []byte, padding PaddingScheme) (EncryptResult, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    return s.encryptWithPadding(msg, padding)
+}
+
+func (s *BAESys128) encryptWithPadding(msg []byte, padding PaddingScheme) (EncryptResult, error) {
+    var res EncryptResult
+    if s.aes == nil {
+        return res, fmt.Errorf("no key set")
+    }
+    if len(s.suffix) > 0 {
+        msg = append(append([]byte{}, msg...), s.suffix...)
+    }
+    blocks, err := s.Blocks(msg, padding)
+    if err != nil {
+        return res, err
+    }
     if s.port == nil {
-        log.Println("No port set. Encrypting without Basys3")
+        s.log(COMPONENT_CRYPTO).Info("No port set. Encrypting without Basys3")
+    }
+    if s.port != nil && s.Window() > 1 {
+        return s.encryptPipelined(blocks)
     }
-    for _, block := range blocks {
-        _, err := s.Write(block)
+    for i, block := range blocks {
+        actual, expected, err := s.encryptBlock(block)
         if err != nil {
-            return nil, err
+            return res, err
         }
-        ct = append(ct, s.Read()...)
+        res.Ciphertext = append(res.Ciphertext, actual...)
+        res.Blocks = append(res.Blocks, s.verifyBlock(i, block, expected, actual))
     }
-    return ct, nil
+    return res, nil
+}
+
+func (s *BAESys128) EncryptBlock(block []byte) ([]byte, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    actual, _, err := s.encryptBlock(block)
+    return actual, err
+}
+
+// encryptBlock returns what the Basys3 sent back and what the go AES
+// expected it to send
+func (s *BAESys128) encryptBlock(block []byte) (actual []byte, expected []byte, err error) {
+    if s.port != nil && s.protocol == PROTOCOL_V2 {
+        return s.encryptBlockV2(block)
+    }
+    _, err = s.Write(block)
+    if err != nil {
+        return nil, nil, err
+    }
+    expected = s.lastBlock
+    actual, err = s.Read()
+    if err != nil {
+        return nil, nil, err
+    }
+    return actual, expected, nil
 }
 
 func (s *BAESys128) Decrypt(ct []byte) ([]byte, error) {
+    return s.DecryptWithPadding(ct, s.Padding())
+}
+
+// DecryptWithPadding opens ct with Open instead if it is a container, so
+// its own padding is used
+func (s *BAESys128) DecryptWithPadding(ct []byte, padding PaddingScheme) ([]byte, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    if IsContainer(ct) {
+        c, err := ParseContainer(ct)
+        if err != nil {
+            return nil, err
+        }
+        return s.open(c)
+    }
+    return s.decryptWithPadding(ct, padding)
+}
+
+func (s *BAESys128) decryptWithPadding(ct []byte, padding PaddingScheme) ([]byte, error) {
     if s.aes == nil {
         return nil, fmt.Errorf("no key set")
     }
+    if len(ct) == 0 || len(ct) % BLOCK_SIZE != 0 {
+        return nil, fmt.Errorf("ciphertext is %d bytes, not a whole number of blocks", len(ct))
+    }
     pt := make([]byte, len(ct))
+    // only v2 devices can decrypt, the raw protocol is encrypt only
+    onDevice := s.port != nil && s.protocol == PROTOCOL_V2
+    if !onDevice {
+        s.log(COMPONENT_CRYPTO).Info("Decrypting without Basys3")
+    }
     for i := 0; i < len(ct); i += BLOCK_SIZE {
         start := i
         end := start + BLOCK_SIZE
-        copy(pt[start:end], s.aes.Decrypt(ct[start:end]))
+        if !onDevice {
+            copy(pt[start:end], s.aes.Decrypt(ct[start:end]))
+            continue
+        }
+        ptBlock, err := s.decryptBlockV2(ct[start:end])
+        if err != nil {
+            return nil, err
+        }
+        copy(pt[start:end], ptBlock)
     }
 
-    return pkcs7Unpad(pt), nil
+    pt, err := padding.Unpad(pt)
+    if err != nil {
+        return nil, err
+    }
+    return bytes.TrimSuffix(pt, s.suffix), nil
 }
 
+// SetKey loads key into the go AES and, if connected, the Basys3.
+// A raw Basys3 only accepts a key as the first block after a reset so
+// setting a different key than the one it holds fails until ResetKey is
+// called and the center button is pressed. v2 devices are reset over UART.
 // NOTE: assumes key is valid
 func (s *BAESys128) SetKey(key []byte) error {
-    s.key = key;
-    aes, err := NewAES(key)
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    if s.hasKey(key) {
+        s.log(COMPONENT_KEY).Info("Key is already set", kcvAttr(key))
+        return nil
+    }
+    if s.keyLocked() && s.keyState == KEY_STATE_SET {
+        return fmt.Errorf("Key is already set to one with check value %s. Click Change Key and press the center button (btnC) on the Basys3 to use a different key", keyCheckValue(s.key))
+    }
+    if s.keyLocked() && s.keyState == KEY_STATE_UNKNOWN {
+        return fmt.Errorf("Basys3 holds a key this server did not set. Click Change Key and press the center button (btnC) on the Basys3 first")
+    }
+    profile := s.Profile()
+    aes, err := profile.NewAES(key)
     if err != nil {
-        // TODO: should Fatalf?
-        log.Printf("Failed to create non-basys AES instance: %s", err)
+        return fmt.Errorf("failed to create non-basys AES instance: %v", err)
     }
+    s.key = key;
     s.aes = aes
     if s.port == nil {
-        log.Println("No port set. Skipping setting key on Basys3")
+        s.log(COMPONENT_KEY).Info("No port set. Skipping setting key on Basys3")
+        s.keyState = KEY_STATE_SET
+        return nil
+    }
+    if s.protocol == PROTOCOL_V2 {
+        return s.setKeyV2(key)
+    }
+    if profile.KeyLoading == KEY_LOADING_FIXED {
+        s.keyState = KEY_STATE_SET
+        s.log(COMPONENT_KEY).Info("Profile has the key fixed in the bitstream, using it to verify only", "profile", profile.Name, kcvAttr(key))
         return nil
     }
-    _, err = s.Write(key)
+    expected := key
+    if profile.Echo == ECHO_ENCRYPTED {
+        _, err = s.Write(key)
+        // a freshly reset Basys3 loads the key and then encrypts it like any
+        // other block, so the echo is the key encrypted with itself. If the
+        // echo is anything else the Basys3 was not reset and encrypted the
+        // key as plaintext with whatever key it already had
+        expected = s.lastBlock
+    } else {
+        _, err = (*s.port).Write(profile.ToWire(key))
+    }
+    if err != nil {
+        s.key = nil
+        s.aes = nil
+        s.keyState = KEY_STATE_UNKNOWN
+        return err
+    }
+    if profile.Echo == ECHO_NONE {
+        s.keyState = KEY_STATE_SET
+        s.log(COMPONENT_KEY).Warn("Sent key. Profile has no key echo so it can not be confirmed", kcvAttr(key), "profile", profile.Name)
+        return nil
+    }
+    echo, err := s.Read()
     if err != nil {
-        log.Printf("Failed to write key to Basys3: <code>%s</code>", err)
+        s.key = nil
+        s.aes = nil
+        s.keyState = KEY_STATE_UNKNOWN
+        return fmt.Errorf("no key echo from Basys3: %w", err)
     }
-    // skip key echo
-    readKey := s.Read()
-    if len(readKey) != len(s.key) {
-        log.Printf("Failed to set key on Basys3. Received <code>%d</code> bytes in key echo instead of <code>%d</code>", len(readKey), len(s.key))
+    if string(echo) != string(expected) {
+        s.log(COMPONENT_KEY).Error("Key echo does not match", kcvAttr(key), "echo_kcv", keyCheckValue(echo))
+        s.key = nil
+        s.aes = nil
+        s.keyState = KEY_STATE_UNKNOWN
+        return deviceError(ErrKeyRejected, "Basys3 did not load the key with check value %s. It probably still holds an old key. Click Change Key and press the center button (btnC) on the Basys3", keyCheckValue(key))
     }
+    s.keyState = KEY_STATE_SET
+    s.log(COMPONENT_KEY).Info("Basys3 loaded key", kcvAttr(key))
     return nil
 }
 
-type EncryptResult struct {
-    ciphertext *string;
-    err error;
+// Decrypter decrypts under key without touching the key on the Basys3. It
+// is s when s already holds key, so a v2 Basys3 still does the work, and
+// otherwise a copy of s with a go AES and no port
+func (s *BAESys128) Decrypter(key []byte) (*BAESys128, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    if s.hasKey(key) {
+        return s, nil
+    }
+    aes, err := s.Profile().NewAES(key)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create non-basys AES instance: %v", err)
+    }
+    return &BAESys128{
+        key: key,
+        aes: aes,
+        keyState: KEY_STATE_SET,
+        protocol: s.protocol,
+        profile: s.profile,
+        padding: s.padding,
+        suffix: s.suffix,
+        keystore: s.keystore,
+    }, nil
+}
+
+// ResetKey starts the re-key handshake. A raw Basys3 cannot be reset over
+// UART so the user has to press the center button (btnC). The next block
+// written is then expected to be loaded as the key, which SetKey confirms
+// with the key echo. v2 devices are sent a RESET command instead
+func (s *BAESys128) ResetKey() error {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    s.key = nil
+    s.aes = nil
+    s.lastBlock = nil
+    s.keyState = KEY_STATE_NONE
+    if s.port == nil {
+        s.log(COMPONENT_KEY).Info("No port set. Cleared software key")
+        return nil
+    }
+    if s.protocol == PROTOCOL_V2 {
+        return s.resetV2()
+    }
+    if s.Profile().KeyLoading == KEY_LOADING_FIXED {
+        s.log(COMPONENT_KEY).Info("The key is fixed in the bitstream. Set the key it was built with")
+        return nil
+    }
+    // drop anything the Basys3 sent that was never read so it is not
+    // mistaken for the key echo
+    err := (*s.port).ResetInputBuffer()
+    if err != nil {
+        return fmt.Errorf("failed to clear Basys3 input buffer: %v", err)
+    }
+    s.log(COMPONENT_KEY).Info("Press the center button (btnC) on the Basys3 then set the new key")
+    return nil
 }
 
 func handle_encrypt_message(baes *BAESys128) Handler {
     return func(w http.ResponseWriter, r *http.Request) {
-        opts := parse_form(r)
-        hasKey := len(baes.key) != 0
-        sentKey := opts.key != nil && len(*opts.key) != 0
-        sameKey := hasKey && sentKey && string(baes.key) == *opts.key
-
-        // TODO: add other error combos
-        if hasKey && sentKey && !sameKey {
-            opts.encrypt_err = new(string)
-            *opts.encrypt_err = fmt.Sprintf("Key is already set to <code>%s</code>. To change the key, restart the Basys3.", string(baes.key))
-        }
-
-        // TODO: way to set key without restarting basys3
-        // if ((!hasKey && sentKey) || !sameKey) {
-        //     baes.SetKey([]byte(*opts.key))
-        // }
-        if opts.key_err != nil {
-            log.Println("Found Key error while trying to encrypt:", opts.key_err)
+        opts := parse_form(r, baes)
+        req, errs := parseEncryptRequest(r)
+        opts.set_field_errors(errs)
+        if len(errs) != 0 {
+            baes.log(COMPONENT_CRYPTO).Warn("Invalid encrypt request", errAttr(errs))
+            fmt.Fprint(w, opts.render())
+            return
+        }
+        opts.show_derived_key(req.Key, req.KDF)
+        // no-op when the key is already set. Refuses to silently send a
+        // different key to the Basys3 as plaintext
+        err := baes.SetKey(req.Key)
+        opts.key_state = baes.KeyState()
+        opts.key_locked = baes.KeyLocked()
+        if err != nil {
+            err_msg := error_message(err)
+            baes.log(COMPONENT_KEY).Error("Error while trying to set key", errAttr(err_msg))
+            opts.encrypt_err = &err_msg
             fmt.Fprint(w, opts.render())
             return
         }
-        log.Printf("Encrypting message of length <code>%d</code>", len(*opts.message))
-        ct, err := baes.Encrypt([]byte(*opts.message))
+        padding := baes.Padding()
+        if req.Padding != nil {
+            padding = *req.Padding
+        }
+        baes.log(COMPONENT_CRYPTO).Info("Encrypting message", ATTR_BYTES, len(req.Message), "padding", padding.Name)
+        var res EncryptResult
+        var container *Container
+        if req.Format == FORMAT_BARE {
+            res, err = baes.EncryptWithPadding(req.Message, padding)
+        } else {
+            container, res, err = baes.Seal(req.Message, SealOptions{Mode: req.Mode, Padding: &padding, KeyID: req.KeyID, KDF: req.KDF})
+        }
+        ct := res.Ciphertext
         opts.encrypt_err = nil
+        if err == nil {
+            opts.verify = &res
+            err = res.Err()
+        }
         if err != nil {
-            err_msg := err.Error()
-            log.Printf("Error while trying to encrypt: <code>%s</code>", err_msg)
+            err_msg := error_message(err)
+            baes.log(COMPONENT_CRYPTO).Error("Error while trying to encrypt", errAttr(err_msg))
             opts.encrypt_err = &err_msg
         }
-        opts.ciphertext = new(string)
-        log.Printf("Encrypted message to ciphertext of length <code>%d</code>", len(ct))
-        *opts.ciphertext = strings.ToUpper(hex.EncodeToString(ct))
+        opts.verify_stats = baes.VerifyStats()
+        if err == nil {
+            baes.Keystore().Touch(req.Key)
+        }
+        baes.log(COMPONENT_CRYPTO).Info("Encrypted message", ATTR_BYTES, len(ct))
+        if container != nil {
+            ct, err = container.MarshalBinary()
+            if err == nil && req.Format == FORMAT_ARMORED {
+                ct, err = container.Armor()
+                opts.ciphertext_encoding = ENCODING_UTF8.Name
+            }
+            if err != nil {
+                err_msg := error_message(err)
+                opts.encrypt_err = &err_msg
+            }
+        }
+        opts.ciphertext = show_bytes(ct, &opts.ciphertext_encoding)
+        if req.KDF != nil && container == nil {
+            text := withKDFHeader(req.KDF, *opts.ciphertext)
+            opts.ciphertext = &text
+        }
         fmt.Fprint(w, opts.render())
     }
 }
 
 func handle_decrypt_message(baes *BAESys128) Handler {
     return func(w http.ResponseWriter, r *http.Request) {
-        opts := parse_form(r)
-        opts.key_err = validate_key(opts.key)
-        if opts.key_err != nil || opts.key == nil {
+        opts := parse_form(r, baes)
+        req, errs := parseDecryptRequest(r)
+        resolve_key_id(baes, r, &req, errs, &opts)
+        opts.set_field_errors(errs)
+        if len(errs) != 0 {
+            baes.log(COMPONENT_CRYPTO).Warn("Invalid decrypt request", errAttr(errs))
             fmt.Fprint(w, opts.render())
             return
         }
-        // TODO: check for ct null
-        ct, err := hex.DecodeString(strings.ToLower(*opts.ciphertext))
+        ct := req.Ciphertext
+        opts.show_derived_key(req.Key, req.KDF)
+        // the key on the Basys3 stays as it is, so decrypting under another
+        // key does not need a btnC press
+        decrypter, err := baes.Decrypter(req.Key)
+        opts.key_state = baes.KeyState()
+        opts.key_locked = baes.KeyLocked()
         if err != nil {
-            err_msg := err.Error()
-            log.Printf("Error while trying to decode ciphertext: <code>%s</code>", err_msg)
+            err_msg := error_message(err)
+            baes.log(COMPONENT_KEY).Error("Error while trying to set key", errAttr(err_msg))
             opts.encrypt_err = &err_msg
             fmt.Fprint(w, opts.render())
             return
         }
-        log.Printf("Decrypting message of length <code>%d</code>", len(ct))
-        pt, err := baes.Decrypt(ct)
+        baes.log(COMPONENT_CRYPTO).Info("Decrypting message", ATTR_BYTES, len(ct))
+        if req.Container != nil {
+            baes.log(COMPONENT_CRYPTO).Info("Ciphertext is a container", "mode", req.Container.Mode, "key_id", req.Container.KeyID)
+        }
+        padding := baes.Padding()
+        if req.Padding != nil {
+            padding = *req.Padding
+        }
+        pt, err := decrypter.DecryptWithPadding(ct, padding)
         // FIXME: decrypt_err!
         opts.encrypt_err = nil
         if err != nil {
-            err_msg := err.Error()
-            log.Printf("Error while trying to decrypt: <code>%s</code>", err_msg)
+            err_msg := error_message(err)
+            baes.log(COMPONENT_CRYPTO).Error("Error while trying to decrypt", errAttr(err_msg))
             opts.encrypt_err = &err_msg
             fmt.Fprint(w, opts.render())
             return
         }
-        opts.ptmessage = new(string)
-        *opts.ptmessage = string(pt)
+        baes.Keystore().Touch(req.Key)
+        opts.pt = pt
+        opts.pt_encoding = opts.message_encoding
+        opts.ptmessage = show_bytes(pt, &opts.pt_encoding)
         fmt.Fprint(w, opts.render())
     }
 }
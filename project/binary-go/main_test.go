@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSetKeyLocksDevice(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(board.Port())
+
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    if baes.KeyState() != KEY_STATE_SET {
+        t.Fatalf("expected key state %s, got %s", KEY_STATE_SET, baes.KeyState())
+    }
+    // same key is a no-op and must not be sent as plaintext
+    err = baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Errorf("SetKey with same key failed: %v", err)
+    }
+    err = baes.SetKey([]byte("fedcba9876543210"))
+    if err == nil {
+        t.Errorf("SetKey with different key succeeded without a reset")
+    }
+    if !baes.HasKey([]byte("0123456789abcdef")) {
+        t.Errorf("refused SetKey changed the key")
+    }
+}
+
+func TestResetKeyHandshake(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(board.Port())
+    baes.SetKey([]byte("0123456789abcdef"))
+
+    err := baes.ResetKey()
+    if err != nil {
+        t.Fatalf("ResetKey failed: %v", err)
+    }
+    // user presses btnC
+    board.PressReset()
+    err = baes.SetKey([]byte("fedcba9876543210"))
+    if err != nil {
+        t.Fatalf("SetKey after reset failed: %v", err)
+    }
+    ct, err := baes.Encrypt([]byte("hello"))
+    if err != nil {
+        t.Fatalf("Encrypt failed: %v", err)
+    }
+    expected, _ := NewAES([]byte("fedcba9876543210"))
+    if !bytes.Equal(ct, expected.Encrypt(pkcs7Pad([]byte("hello")))) {
+        t.Errorf("Basys3 did not encrypt with the new key")
+    }
+}
+
+func TestResetKeyWithoutButtonPress(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(board.Port())
+    baes.SetKey([]byte("0123456789abcdef"))
+
+    baes.ResetKey()
+    // user never presses btnC so the board encrypts the new key as plaintext
+    err := baes.SetKey([]byte("fedcba9876543210"))
+    if err == nil {
+        t.Fatalf("SetKey succeeded even though the Basys3 was not reset")
+    }
+    if baes.KeyState() != KEY_STATE_UNKNOWN {
+        t.Errorf("expected key state %s, got %s", KEY_STATE_UNKNOWN, baes.KeyState())
+    }
+    err = baes.SetKey([]byte("fedcba9876543210"))
+    if err == nil {
+        t.Errorf("SetKey succeeded while the Basys3 key is unknown")
+    }
+}
+
+func TestSetKeyWithoutDevice(t *testing.T) {
+    baes := new(BAESys128)
+    baes.SetKey([]byte("0123456789abcdef"))
+    err := baes.SetKey([]byte("fedcba9876543210"))
+    if err != nil {
+        t.Errorf("software only SetKey should allow changing the key: %v", err)
+    }
+    if !baes.HasKey([]byte("fedcba9876543210")) {
+        t.Errorf("software only SetKey did not change the key")
+    }
+}
+
+// decrypting runs in software, a locked Basys3 keeps its key
+func TestDecryptLeavesDeviceKey(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(board.Port())
+    baes.SetKey([]byte("0123456789abcdef"))
+
+    other, _ := NewAES([]byte("fedcba9876543210"))
+    ct := other.Encrypt(pkcs7Pad([]byte("hello")))
+    res := postForm(handle_decrypt_message(baes), url.Values{
+        "key": {"fedcba9876543210"},
+        "ciphertext": {hex.EncodeToString(ct)},
+        "ciphertext-encoding": {"hex"},
+        "message": {"hello"},
+    })
+    if body := res.Body.String(); !strings.Contains(body, "Same as original message") {
+        t.Errorf("expected the plaintext back, got %s", body)
+    }
+    if !baes.HasKey([]byte("0123456789abcdef")) || baes.KeyState() != KEY_STATE_SET {
+        t.Errorf("decrypt changed the Basys3 key, state %s", baes.KeyState())
+    }
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// An openssl enc file is OPENSSL_MAGIC, an 8 byte salt and then the
+// AES-CBC ciphertext, PKCS#7 padded. The key and IV both come from the
+// password and salt
+var OPENSSL_MAGIC = []byte("Salted__")
+
+const OPENSSL_SALT_SIZE = 8
+
+// OPENSSL_PBKDF2_ITER is what openssl enc -pbkdf2 uses without -iter
+const OPENSSL_PBKDF2_ITER = 10000
+
+// OpenSSLParams are the openssl enc options that change the key. The zero
+// value is openssl enc -aes-128-cbc on OpenSSL 1.1.0 or later
+type OpenSSLParams struct {
+    // -md, sha256 when empty. OpenSSL before 1.1.0 used md5
+    Digest string
+    // -pbkdf2, EVP_BytesToKey when false
+    PBKDF2 bool
+    // -iter, OPENSSL_PBKDF2_ITER when 0
+    Iter int
+    // -S, random when nil
+    Salt []byte
+}
+
+// DeriveKeyIV turns the password and salt into the AES-128 key and CBC IV
+func (p OpenSSLParams) DeriveKeyIV(password []byte, salt []byte) ([]byte, []byte, error) {
+    name := p.Digest
+    if name == "" {
+        name = "sha256"
+    }
+    digest, err := ParseDigest(name)
+    if err != nil {
+        return nil, nil, err
+    }
+    var keyIV []byte
+    if p.PBKDF2 {
+        iter := p.Iter
+        if iter == 0 {
+            iter = OPENSSL_PBKDF2_ITER
+        }
+        keyIV = pbkdf2.Key(password, salt, iter, KEY_SIZE + BLOCK_SIZE, digest)
+    } else {
+        keyIV = EVPBytesToKey(digest, password, salt, KEY_SIZE + BLOCK_SIZE)
+    }
+    return keyIV[:KEY_SIZE], keyIV[KEY_SIZE:], nil
+}
+
+// EncryptOpenSSL writes src to dst in the format of
+// openssl enc -aes-128-cbc, encrypted on the Basys3 if there is one. The
+// key derived from the password is set on the Basys3 like SetKey
+func (s *BAESys128) EncryptOpenSSL(dst io.Writer, src io.Reader, password []byte, params OpenSSLParams, progress func(int64)) (StreamResult, error) {
+    var res StreamResult
+    salt := params.Salt
+    if salt == nil {
+        salt = make([]byte, OPENSSL_SALT_SIZE)
+        _, err := rand.Read(salt)
+        if err != nil {
+            return res, err
+        }
+    }
+    if len(salt) != OPENSSL_SALT_SIZE {
+        return res, fmt.Errorf("salt is %d bytes but it must be %d bytes", len(salt), OPENSSL_SALT_SIZE)
+    }
+    key, iv, err := params.DeriveKeyIV(password, salt)
+    if err != nil {
+        return res, err
+    }
+    err = s.SetKey(key)
+    if err != nil {
+        return res, err
+    }
+    n, err := dst.Write(append(append([]byte{}, OPENSSL_MAGIC...), salt...))
+    if err != nil {
+        return res, err
+    }
+    res, err = s.EncryptCBCStream(dst, src, iv, PADDING_PKCS7, progress)
+    res.Out += int64(n)
+    return res, err
+}
+
+// DecryptOpenSSL undoes EncryptOpenSSL, or openssl enc -aes-128-cbc.
+// params.Salt is ignored, the salt is in the file
+func (s *BAESys128) DecryptOpenSSL(dst io.Writer, src io.Reader, password []byte, params OpenSSLParams, progress func(int64)) (StreamResult, error) {
+    var res StreamResult
+    header := make([]byte, len(OPENSSL_MAGIC) + OPENSSL_SALT_SIZE)
+    n, err := io.ReadFull(src, header)
+    res.In += int64(n)
+    if err != nil || !bytes.Equal(header[:len(OPENSSL_MAGIC)], OPENSSL_MAGIC) {
+        return res, fmt.Errorf("not an openssl enc file, it does not start with %s", OPENSSL_MAGIC)
+    }
+    key, iv, err := params.DeriveKeyIV(password, header[len(OPENSSL_MAGIC):])
+    if err != nil {
+        return res, err
+    }
+    decrypter, err := s.Decrypter(key)
+    if err != nil {
+        return res, err
+    }
+    body, err := decrypter.DecryptCBCStream(dst, src, iv, PADDING_PKCS7, progress)
+    body.In += res.In
+    if err != nil && body.Out == 0 {
+        err = fmt.Errorf("%w. Is the password, digest or key derivation wrong?", err)
+    }
+    return body, err
+}
+
+// ParsePassword reads a password given like openssl's -pass: pass:text,
+// env:VAR or file:path (first line only)
+func ParsePassword(arg string) ([]byte, error) {
+    kind, value, ok := strings.Cut(arg, ":")
+    if !ok {
+        return nil, fmt.Errorf("password must be pass:text, env:VAR or file:path")
+    }
+    switch kind {
+    case "pass":
+        return []byte(value), nil
+    case "env":
+        password, ok := os.LookupEnv(value)
+        if !ok {
+            return nil, fmt.Errorf("environment variable %s is not set", value)
+        }
+        return []byte(password), nil
+    case "file":
+        data, err := os.ReadFile(value)
+        if err != nil {
+            return nil, err
+        }
+        line, _, _ := strings.Cut(string(data), "\n")
+        return []byte(strings.TrimSuffix(line, "\r")), nil
+    }
+    return nil, fmt.Errorf("unknown password source %q, use pass:, env: or file:", kind)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/openssl was made with openssl 3.0 from plain.txt:
+//   openssl enc -aes-128-cbc -pass pass:basys3 <flags> -in plain.txt -out <file>
+// with a random salt, since openssl 3 leaves the header off when given -S,
+// and iv.enc with -K 000102030405060708090a0b0c0d0e0f -iv 0f0e0d0c0b0a09080706050403020100
+var OPENSSL_FIXTURES = []struct {
+    file string
+    params OpenSSLParams
+}{
+    {"md5.enc", OpenSSLParams{Digest: "md5"}},
+    {"sha256.enc", OpenSSLParams{}},
+    {"pbkdf2.enc", OpenSSLParams{PBKDF2: true}},
+    {"pbkdf2-sha1-1000.enc", OpenSSLParams{Digest: "sha1", PBKDF2: true, Iter: 1000}},
+}
+
+func readFixture(t *testing.T, name string) []byte {
+    data, err := os.ReadFile(filepath.Join("testdata", "openssl", name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+func TestDecryptOpenSSLFixtures(t *testing.T) {
+    plain := readFixture(t, "plain.txt")
+    for _, fixture := range OPENSSL_FIXTURES {
+        baes := newStreamBaes(t)
+        var out bytes.Buffer
+        _, err := baes.DecryptOpenSSL(&out, bytes.NewReader(readFixture(t, fixture.file)), []byte("basys3"), fixture.params, nil)
+        if err != nil {
+            t.Errorf("%s: %s", fixture.file, err)
+            continue
+        }
+        if !bytes.Equal(out.Bytes(), plain) {
+            t.Errorf("%s: got %q", fixture.file, out.Bytes())
+        }
+    }
+}
+
+func TestEncryptOpenSSLMatchesFixtures(t *testing.T) {
+    plain := readFixture(t, "plain.txt")
+    for _, fixture := range OPENSSL_FIXTURES {
+        baes := newStreamBaes(t)
+        params := fixture.params
+        expected := readFixture(t, fixture.file)
+        params.Salt = expected[len(OPENSSL_MAGIC):len(OPENSSL_MAGIC) + OPENSSL_SALT_SIZE]
+        var out bytes.Buffer
+        res, err := baes.EncryptOpenSSL(&out, bytes.NewReader(plain), []byte("basys3"), params, nil)
+        if err != nil {
+            t.Fatalf("%s: %s", fixture.file, err)
+        }
+        if !bytes.Equal(out.Bytes(), expected) {
+            t.Errorf("%s: expected\n%x got\n%x", fixture.file, expected, out.Bytes())
+        }
+        if res.Out != int64(len(expected)) {
+            t.Errorf("%s: Out is %d, wrote %d", fixture.file, res.Out, len(expected))
+        }
+    }
+}
+
+func TestOpenSSLWrongPassword(t *testing.T) {
+    baes := newStreamBaes(t)
+    var out bytes.Buffer
+    _, err := baes.DecryptOpenSSL(&out, bytes.NewReader(readFixture(t, "md5.enc")), []byte("wrong"), OpenSSLParams{Digest: "md5"}, nil)
+    if err == nil && bytes.Equal(out.Bytes(), readFixture(t, "plain.txt")) {
+        t.Fatal("wrong password decrypted")
+    }
+    _, err = baes.DecryptOpenSSL(&out, bytes.NewReader(readFixture(t, "iv.enc")), []byte("basys3"), OpenSSLParams{}, nil)
+    if err == nil {
+        t.Error("a file without Salted__ decrypted")
+    }
+}
+
+func TestOpenSSLEmptyRoundTrip(t *testing.T) {
+    baes := newStreamBaes(t)
+    var ct, pt bytes.Buffer
+    _, err := baes.EncryptOpenSSL(&ct, bytes.NewReader(nil), []byte("basys3"), OpenSSLParams{PBKDF2: true}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ct.Len() != 2*BLOCK_SIZE || !bytes.HasPrefix(ct.Bytes(), OPENSSL_MAGIC) {
+        t.Fatalf("expected a header and a block of padding, got %x", ct.Bytes())
+    }
+    _, err = baes.DecryptOpenSSL(&pt, &ct, []byte("basys3"), OpenSSLParams{PBKDF2: true}, nil)
+    if err != nil || pt.Len() != 0 {
+        t.Errorf("got %q, %v", pt.Bytes(), err)
+    }
+}
+
+// openssl enc -aes-128-cbc -S 0102030405060708 -pass pass:basys3 -pbkdf2 -P
+func TestOpenSSLDeriveKeyIV(t *testing.T) {
+    key, iv, err := OpenSSLParams{PBKDF2: true}.DeriveKeyIV([]byte("basys3"), mustHex("0102030405060708"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hex.EncodeToString(key) != "c0e3226bcc61c36be8c12db4bf8fe390" || hex.EncodeToString(iv) != "a07839cf556b52c519c5cfd1dd84b9f7" {
+        t.Errorf("got key %x iv %x", key, iv)
+    }
+}
+
+func TestCLIOpenSSL(t *testing.T) {
+    plain := filepath.Join("testdata", "openssl", "plain.txt")
+    expected := string(readFixture(t, "plain.txt"))
+    for _, fixture := range []struct {
+        file string
+        flags []string
+    }{
+        {"md5.enc", []string{"-md", "md5"}},
+        {"pbkdf2.enc", []string{"-pbkdf2"}},
+        {"pbkdf2-sha1-1000.enc", []string{"-md", "sha1", "-iter", "1000"}},
+    } {
+        args := append([]string{"decrypt", "-l", "-pass", "pass:basys3"}, fixture.flags...)
+        stdout, stderr, code := runCLI(t, "", append(args, filepath.Join("testdata", "openssl", fixture.file))...)
+        if code != 0 || stdout != expected {
+            t.Errorf("%s: exit %d %q %s", fixture.file, code, stdout, stderr)
+        }
+        ct := readFixture(t, fixture.file)
+        salt := hex.EncodeToString(ct[len(OPENSSL_MAGIC):len(OPENSSL_MAGIC) + OPENSSL_SALT_SIZE])
+        args = append([]string{"encrypt", "-l", "-pass", "pass:basys3", "-S", salt}, fixture.flags...)
+        stdout, stderr, code = runCLI(t, "", append(args, plain)...)
+        if code != 0 || stdout != string(ct) {
+            t.Errorf("encrypt %s: exit %d %s", fixture.file, code, stderr)
+        }
+    }
+    stdout, stderr, code := runCLI(t, "", "decrypt", "-l", "-out", "raw", "-in", "raw", "-iv", "0f0e0d0c0b0a09080706050403020100", "000102030405060708090a0b0c0d0e0f", filepath.Join("testdata", "openssl", "iv.enc"))
+    if code != 0 || stdout != expected {
+        t.Errorf("-iv: exit %d %q %s", code, stdout, stderr)
+    }
+    os.Setenv("BASYS3_PASSWORD", "basys3")
+    defer os.Unsetenv("BASYS3_PASSWORD")
+    ct, _, _ := runCLI(t, "secret", "encrypt", "-l", "-pass", "env:BASYS3_PASSWORD")
+    stdout, stderr, code = runCLI(t, ct, "decrypt", "-l", "-pass", "pass:basys3")
+    if code != 0 || stdout != "secret" {
+        t.Errorf("round trip: exit %d %q %s", code, stdout, stderr)
+    }
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DecryptBlock decrypts one block on a v2 Basys3, or in software since the
+// raw protocol can only encrypt
+func (s *BAESys128) DecryptBlock(block []byte) ([]byte, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    return s.decryptBlock(block)
+}
+
+func (s *BAESys128) decryptBlock(block []byte) ([]byte, error) {
+    if s.aes == nil {
+        return nil, fmt.Errorf("no key set")
+    }
+    if s.port != nil && s.protocol == PROTOCOL_V2 {
+        return s.decryptBlockV2(block)
+    }
+    return s.aes.Decrypt(block), nil
+}
+
+// CBCEncrypt pads msg with PKCS#7 and encrypts it in CBC mode under a
+// random IV. The IV is the first block of the result
+func (s *BAESys128) CBCEncrypt(msg []byte) ([]byte, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    if s.aes == nil {
+        return nil, fmt.Errorf("no key set")
+    }
+    iv := make([]byte, BLOCK_SIZE)
+    _, err := rand.Read(iv)
+    if err != nil {
+        return nil, err
+    }
+    padded := pkcs7Pad(append([]byte{}, msg...))
+    out := append([]byte{}, iv...)
+    prev := iv
+    for i := 0; i < len(padded); i += BLOCK_SIZE {
+        block := xorBlocks(padded[i:i + BLOCK_SIZE], prev)
+        ct, _, err := s.encryptBlock(block)
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, ct...)
+        prev = ct
+    }
+    return out, nil
+}
+
+// CBCDecrypt undoes CBCEncrypt. A bad padding is ErrInvalidPadding
+func (s *BAESys128) CBCDecrypt(ct []byte) ([]byte, error) {
+    if len(ct) < 2*BLOCK_SIZE || len(ct) % BLOCK_SIZE != 0 {
+        return nil, fmt.Errorf("CBC ciphertext is %d bytes, it must be an IV and at least one block", len(ct))
+    }
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    pt := []byte{}
+    for i := BLOCK_SIZE; i < len(ct); i += BLOCK_SIZE {
+        block, err := s.decryptBlock(ct[i:i + BLOCK_SIZE])
+        if err != nil {
+            return nil, err
+        }
+        pt = append(pt, xorBlocks(block, ct[i - BLOCK_SIZE:i])...)
+    }
+    return pkcs7Unpad(pt)
+}
+
+func xorBlocks(a []byte, b []byte) []byte {
+    out := make([]byte, len(a))
+    for i := range a {
+        out[i] = a[i] ^ b[i]
+    }
+    return out
+}
+
+// PaddingOracleLab is deliberately vulnerable. It decrypts whatever CBC
+// ciphertext it is given with the server's key and says whether the
+// padding was valid, which is all an attacker needs to decrypt anything
+type PaddingOracleLab struct {
+    baes *BAESys128
+    queries atomic.Int64
+    running atomic.Bool
+}
+
+// NewPaddingOracleLab also turns on the lab's part of the form
+func NewPaddingOracleLab(baes *BAESys128) *PaddingOracleLab {
+    baes.oracle = true
+    return &PaddingOracleLab{baes: baes}
+}
+
+// OracleEnabled is whether the server was started with the padding oracle
+// lab
+func (s *BAESys128) OracleEnabled() bool {
+    return s.oracle
+}
+
+func (l *PaddingOracleLab) Queries() int64 {
+    return l.queries.Load()
+}
+
+// Check is the oracle. Anything but bad padding (no key, broken Basys3) is
+// an error so the attacker does not mistake it for a guess that failed
+func (l *PaddingOracleLab) Check(ct []byte) (bool, error) {
+    l.queries.Add(1)
+    _, err := l.baes.CBCDecrypt(ct)
+    if err == nil {
+        return true, nil
+    }
+    if errors.Is(err, ErrInvalidPadding) {
+        return false, nil
+    }
+    return false, err
+}
+
+// handle_oracle answers 200 for good padding and 403 for bad padding
+func (l *PaddingOracleLab) handle_oracle(w http.ResponseWriter, r *http.Request) {
+    ct, err := hex.DecodeString(strings.TrimSpace(r.FormValue("ciphertext")))
+    if err != nil {
+        http.Error(w, "ciphertext is not hex", http.StatusBadRequest)
+        return
+    }
+    valid, err := l.Check(ct)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if !valid {
+        http.Error(w, "invalid padding", http.StatusForbidden)
+        return
+    }
+    fmt.Fprint(w, "ok")
+}
+
+// handle_challenge encrypts the message, or a random one if there is no
+// message, for the attacker to recover
+func (l *PaddingOracleLab) handle_challenge(w http.ResponseWriter, r *http.Request) {
+    opts := parse_form(r, l.baes)
+    msg := formField(r, "message")
+    secret := gen_random_message()
+    if msg != nil {
+        secret = *msg
+    }
+    ct, err := l.baes.CBCEncrypt([]byte(secret))
+    if err != nil {
+        err_msg := error_message(err)
+        componentLog(COMPONENT_LAB).Error("Error while trying to make a padding oracle challenge", errAttr(err_msg))
+        opts.oracle_err = &err_msg
+        fmt.Fprint(w, opts.render())
+        return
+    }
+    challenge := hex.EncodeToString(ct)
+    opts.oracle_ct = &challenge
+    componentLog(COMPONENT_LAB).Info("Made a padding oracle challenge", "blocks", len(ct) / BLOCK_SIZE - 1)
+    fmt.Fprint(w, opts.render())
+}
+
+// handle_attack points the attacker at this server's oracle and leaves it
+// running, with progress going to the log. The oracle is asked in process,
+// the same Check /oracle answers with, so the Host of the request is never
+// trusted as somewhere to send ciphertext
+func (l *PaddingOracleLab) handle_attack(w http.ResponseWriter, r *http.Request) {
+    opts := parse_form(r, l.baes)
+    var ct []byte
+    var err error
+    if opts.oracle_ct == nil {
+        err = fmt.Errorf("make a challenge first")
+    } else {
+        ct, err = hex.DecodeString(strings.TrimSpace(*opts.oracle_ct))
+    }
+    if err == nil && !l.running.CompareAndSwap(false, true) {
+        err = fmt.Errorf("an attack is already running")
+    }
+    if err != nil {
+        err_msg := err.Error()
+        opts.oracle_err = &err_msg
+        fmt.Fprint(w, opts.render())
+        return
+    }
+    go func() {
+        defer l.running.Store(false)
+        attack := PaddingOracleAttack{Oracle: l.Check, Progress: logOracleProgress}
+        start := time.Now()
+        pt, err := attack.Run(ct)
+        if err != nil {
+            componentLog(COMPONENT_LAB).Error("Padding oracle attack failed", "queries", attack.Queries, errAttr(err))
+            return
+        }
+        componentLog(COMPONENT_LAB).Info("Padding oracle attack recovered the message", "message", string(pt), "queries", attack.Queries, "took", time.Since(start).Round(time.Millisecond))
+    }()
+    fmt.Fprint(w, opts.render())
+}
+
+func logOracleProgress(p OracleProgress) {
+    componentLog(COMPONENT_LAB).Debug("Padding oracle attack progress", ATTR_BLOCK, p.Block, "blocks", p.Blocks, "byte", p.Byte, "queries", p.Queries, "intermediate", hex.EncodeToString(p.Recovered))
+}
+
+// HTTPPaddingOracle asks a /oracle endpoint about ct
+func HTTPPaddingOracle(endpoint string) func(ct []byte) (bool, error) {
+    return func(ct []byte) (bool, error) {
+        res, err := http.PostForm(endpoint, url.Values{"ciphertext": {hex.EncodeToString(ct)}})
+        if err != nil {
+            return false, err
+        }
+        // drain the body so the connection is reused for the next query
+        io.Copy(io.Discard, res.Body)
+        res.Body.Close()
+        switch res.StatusCode {
+        case http.StatusOK:
+            return true, nil
+        case http.StatusForbidden:
+            return false, nil
+        }
+        return false, fmt.Errorf("oracle answered %s", res.Status)
+    }
+}
+
+type OracleProgress struct {
+    Block int
+    Blocks int
+    // bytes of this block recovered so far
+    Byte int
+    Queries int
+    // the recovered bytes of the block, before the XOR with the previous
+    // ciphertext block
+    Recovered []byte
+}
+
+// PaddingOracleAttack decrypts CBC ciphertext (IV first) one byte at a time
+// using nothing but whether the padding of forged ciphertexts is valid
+type PaddingOracleAttack struct {
+    Oracle func(ct []byte) (bool, error)
+    // called after each byte is recovered. May be nil
+    Progress func(OracleProgress)
+    Queries int
+}
+
+func (a *PaddingOracleAttack) query(ct []byte) (bool, error) {
+    a.Queries++
+    return a.Oracle(ct)
+}
+
+func (a *PaddingOracleAttack) Run(ct []byte) ([]byte, error) {
+    if len(ct) < 2*BLOCK_SIZE || len(ct) % BLOCK_SIZE != 0 {
+        return nil, fmt.Errorf("CBC ciphertext is %d bytes, it must be an IV and at least one block", len(ct))
+    }
+    blocks := len(ct) / BLOCK_SIZE - 1
+    pt := []byte{}
+    for b := 0; b < blocks; b++ {
+        prev := ct[b*BLOCK_SIZE:(b + 1)*BLOCK_SIZE]
+        target := ct[(b + 1)*BLOCK_SIZE:(b + 2)*BLOCK_SIZE]
+        intermediate, err := a.recoverBlock(target, b, blocks)
+        if err != nil {
+            return nil, fmt.Errorf("block %d: %w", b, err)
+        }
+        pt = append(pt, xorBlocks(intermediate, prev)...)
+    }
+    return pkcs7Unpad(pt)
+}
+
+// recoverBlock finds D(target), the block before it is XORed with the
+// previous ciphertext block, from the last byte to the first
+func (a *PaddingOracleAttack) recoverBlock(target []byte, block int, blocks int) ([]byte, error) {
+    intermediate := make([]byte, BLOCK_SIZE)
+    forged := make([]byte, 2*BLOCK_SIZE)
+    copy(forged[BLOCK_SIZE:], target)
+    for pos := BLOCK_SIZE - 1; pos >= 0; pos-- {
+        pad := byte(BLOCK_SIZE - pos)
+        for i := pos + 1; i < BLOCK_SIZE; i++ {
+            forged[i] = intermediate[i] ^ pad
+        }
+        found := false
+        for guess := 0; guess < 256 && !found; guess++ {
+            forged[pos] = byte(guess)
+            valid, err := a.query(forged)
+            if err != nil {
+                return nil, err
+            }
+            if !valid {
+                continue
+            }
+            if pos == BLOCK_SIZE - 1 {
+                // the padding might have come out as 02 02 instead of 01.
+                // Changing the byte before only matters in that case
+                forged[pos - 1] ^= 0xFF
+                valid, err = a.query(forged)
+                forged[pos - 1] ^= 0xFF
+                if err != nil {
+                    return nil, err
+                }
+                if !valid {
+                    continue
+                }
+            }
+            intermediate[pos] = byte(guess) ^ pad
+            found = true
+        }
+        if !found {
+            return nil, fmt.Errorf("no guess for byte %d gave valid padding. Is the oracle honest?", pos)
+        }
+        if a.Progress != nil {
+            a.Progress(OracleProgress{
+                Block: block,
+                Blocks: blocks,
+                Byte: BLOCK_SIZE - pos,
+                Queries: a.Queries,
+                Recovered: append([]byte{}, intermediate[pos:]...),
+            })
+        }
+    }
+    return intermediate, nil
+}
+
+func oracle_form_group(enabled bool, ct *string, err *string) string {
+    if !enabled {
+        return ""
+    }
+    return fmt.Sprintf(`
+            <div id="oracle-part" class="flex flex-col gap-2 py-2">
+                <p>Padding Oracle Lab</p>
+                <p class="text-sm text-slate-500">CBC with the current key. /oracle only says whether the padding is valid</p>
+                <textarea readonly id="oracle-ciphertext" name="oracle-ciphertext" class="w-[600px] h-[100px] border-2 break-words">%s</textarea>
+                <div class="flex flex-row justify-start gap-2">
+                    <button hx-post="/oracle/challenge" hx-target="#form" class="border-2 bg-slate-100">
+                        New Challenge
+                    </button>
+                    <button hx-post="/oracle/attack" hx-target="#form" class="border-2 bg-slate-100">
+                        Attack
+                    </button>
+                </div>
+                %s
+            </div>
+        `, empty_if_nil(ct), error_p("oracle-error", err, false))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newOracleLab(t *testing.T) *PaddingOracleLab {
+    baes := new(BAESys128)
+    baes.SetProfile(REFERENCE_PROFILE)
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return NewPaddingOracleLab(baes)
+}
+
+// waitAttack waits for the attack handle_attack started to end
+func waitAttack(t *testing.T, lab *PaddingOracleLab) {
+    deadline := time.Now().Add(10 * time.Second)
+    for lab.running.Load() {
+        if time.Now().After(deadline) {
+            t.Fatal("attack still running")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestCBCRoundTrip(t *testing.T) {
+    lab := newOracleLab(t)
+    for _, msg := range []string{"", "hi", "exactly 16 bytes", "a bit more than two blocks of text"} {
+        ct, err := lab.baes.CBCEncrypt([]byte(msg))
+        if err != nil {
+            t.Fatal(err)
+        }
+        pt, err := lab.baes.CBCDecrypt(ct)
+        if err != nil || string(pt) != msg {
+            t.Errorf("expected %q, got %q %v", msg, pt, err)
+        }
+    }
+}
+
+func TestPaddingOracleAttack(t *testing.T) {
+    lab := newOracleLab(t)
+    secret := "the eagle lands at midnight, bring snacks"
+    ct, err := lab.baes.CBCEncrypt([]byte(secret))
+    if err != nil {
+        t.Fatal(err)
+    }
+    progress := 0
+    attack := PaddingOracleAttack{Oracle: lab.Check, Progress: func(OracleProgress) { progress++ }}
+    pt, err := attack.Run(ct)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(pt) != secret {
+        t.Errorf("expected %q, got %q", secret, pt)
+    }
+    blocks := len(ct) / BLOCK_SIZE - 1
+    if progress != blocks*BLOCK_SIZE {
+        t.Errorf("expected progress for each of %d bytes, got %d", blocks*BLOCK_SIZE, progress)
+    }
+    if int64(attack.Queries) != lab.Queries() {
+        t.Errorf("attacker counted %d queries but the oracle saw %d", attack.Queries, lab.Queries())
+    }
+    // at most 256 guesses a byte plus one check of the last byte of a block
+    if attack.Queries > blocks*(BLOCK_SIZE*256 + 256) {
+        t.Errorf("%d queries is more than the attack can need", attack.Queries)
+    }
+}
+
+func TestPaddingOracleOverHTTP(t *testing.T) {
+    lab := newOracleLab(t)
+    mux := http.NewServeMux()
+    mux.HandleFunc("/oracle", lab.handle_oracle)
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    oracle := HTTPPaddingOracle(server.URL + "/oracle")
+    ct, _ := lab.baes.CBCEncrypt([]byte("over the wire"))
+    valid, err := oracle(ct)
+    if err != nil || !valid {
+        t.Errorf("expected the challenge to have valid padding, got %v %v", valid, err)
+    }
+    tampered := append([]byte{}, ct...)
+    tampered[BLOCK_SIZE - 1] ^= 0xFF
+    valid, err = oracle(tampered)
+    if err != nil || valid {
+        t.Errorf("expected invalid padding, got %v %v", valid, err)
+    }
+    // a bad request is not a bad guess
+    _, err = oracle(ct[:BLOCK_SIZE])
+    if err == nil {
+        t.Errorf("expected an error for a ciphertext without blocks")
+    }
+
+    attack := PaddingOracleAttack{Oracle: oracle}
+    pt, err := attack.Run(ct)
+    if err != nil || string(pt) != "over the wire" {
+        t.Errorf("expected %q, got %q %v", "over the wire", pt, err)
+    }
+}
+
+func TestPaddingOracleNotServedByDefault(t *testing.T) {
+    baes := new(BAESys128)
+    if strings.Contains(parse_form(httptest.NewRequest("GET", "/", nil), baes).render(), "oracle") {
+        t.Errorf("padding oracle lab shown without -oracle")
+    }
+}
+
+func TestPaddingOracleChallenge(t *testing.T) {
+    lab := newOracleLab(t)
+    res := postForm(lab.handle_challenge, url.Values{"message": {"find me"}})
+    body := res.Body.String()
+    if !strings.Contains(body, "/oracle/attack") {
+        t.Fatalf("expected the lab in the form, got %s", body)
+    }
+    start := strings.Index(body, `name="oracle-ciphertext"`)
+    ctHex := body[strings.Index(body[start:], ">") + start + 1:]
+    ctHex = ctHex[:strings.Index(ctHex, "<")]
+    ct, err := hex.DecodeString(ctHex)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pt, err := lab.baes.CBCDecrypt(ct)
+    if err != nil || !bytes.Equal(pt, []byte("find me")) {
+        t.Errorf("expected the challenge to decrypt to the message, got %q %v", pt, err)
+    }
+}
+
+// the attack asks the lab directly, whatever Host the request names
+func TestPaddingOracleAttackIgnoresHost(t *testing.T) {
+    lab := newOracleLab(t)
+    ct, _ := lab.baes.CBCEncrypt([]byte("stay home"))
+    form := url.Values{"oracle-ciphertext": {hex.EncodeToString(ct)}}
+    req := httptest.NewRequest("POST", "/oracle/attack", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Host = "attacker.invalid"
+    lab.handle_attack(httptest.NewRecorder(), req)
+    waitAttack(t, lab)
+    // at least a guess for every byte, all answered by the lab
+    if lab.Queries() < int64(len(ct) - BLOCK_SIZE) {
+        t.Errorf("lab only saw %d queries", lab.Queries())
+    }
+}
+
+// the attack shares the Basys3 with the handlers. A key reset while it runs
+// waits for the query in flight instead of racing it, go test -race checks
+func TestPaddingOracleAttackAlongsideReset(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    baes.Negotiate()
+    if err := baes.SetKey([]byte("0123456789abcdef")); err != nil {
+        t.Fatal(err)
+    }
+    lab := NewPaddingOracleLab(baes)
+    ct, _ := baes.CBCEncrypt([]byte("a message long enough for a while"))
+    postForm(lab.handle_attack, url.Values{"oracle-ciphertext": {hex.EncodeToString(ct)}})
+    for lab.Queries() < 10 {
+        time.Sleep(time.Millisecond)
+    }
+    postForm(handle_reset_key(baes), url.Values{})
+    waitAttack(t, lab)
+    if baes.KeyState() != KEY_STATE_NONE {
+        t.Errorf("key is %s after the reset", baes.KeyState())
+    }
+    // the Basys3 is still in step with the server
+    if err := baes.SetKey([]byte("fedcba9876543210")); err != nil {
+        t.Errorf("SetKey after the attack failed: %v", err)
+    }
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PaddingScheme fills the last block of a message. Unpad is strict so a
+// ciphertext decrypted with the wrong key fails with ErrInvalidPadding
+// (except zero padding, which has nothing to check)
+type PaddingScheme struct {
+    Name string
+    Description string
+    Pad func(data []byte) ([]byte, error)
+    Unpad func(data []byte) ([]byte, error)
+}
+
+var PADDING_PKCS7 = PaddingScheme{
+    Name: "pkcs7",
+    Description: "PKCS#7: n bytes of value n",
+    Pad: func(data []byte) ([]byte, error) {
+        return pkcs7Pad(append([]byte{}, data...)), nil
+    },
+    Unpad: pkcs7Unpad,
+}
+
+var PADDING_ISO7816 = PaddingScheme{
+    Name: "iso7816",
+    Description: "ISO/IEC 7816-4: 0x80 then zeros",
+    Pad: func(data []byte) ([]byte, error) {
+        padded := append(append([]byte{}, data...), 0x80)
+        for len(padded) % BLOCK_SIZE != 0 {
+            padded = append(padded, 0)
+        }
+        return padded, nil
+    },
+    Unpad: func(data []byte) ([]byte, error) {
+        err := checkBlocks(data)
+        if err != nil {
+            return nil, err
+        }
+        for i := len(data) - 1; i >= len(data) - BLOCK_SIZE; i-- {
+            switch data[i] {
+            case 0:
+                continue
+            case 0x80:
+                return data[:i], nil
+            }
+            return nil, fmt.Errorf("%w: expected 0x80 or 0x00 but found 0x%02x %d bytes from the end", ErrInvalidPadding, data[i], len(data) - i)
+        }
+        return nil, fmt.Errorf("%w: no 0x80 marker in the last block", ErrInvalidPadding)
+    },
+}
+
+var PADDING_X923 = PaddingScheme{
+    Name: "x923",
+    Description: "ANSI X9.23: zeros then the pad length",
+    Pad: func(data []byte) ([]byte, error) {
+        padding := BLOCK_SIZE - (len(data) % BLOCK_SIZE)
+        padded := append(append([]byte{}, data...), make([]byte, padding)...)
+        padded[len(padded) - 1] = byte(padding)
+        return padded, nil
+    },
+    Unpad: func(data []byte) ([]byte, error) {
+        err := checkBlocks(data)
+        if err != nil {
+            return nil, err
+        }
+        padding := int(data[len(data) - 1])
+        if padding == 0 || padding > BLOCK_SIZE {
+            return nil, fmt.Errorf("%w: pad length %d is not between 1 and %d", ErrInvalidPadding, padding, BLOCK_SIZE)
+        }
+        for i, b := range data[len(data) - padding:len(data) - 1] {
+            if b != 0 {
+                return nil, fmt.Errorf("%w: pad byte %d is 0x%02x instead of 0x00", ErrInvalidPadding, i, b)
+            }
+        }
+        return data[:len(data) - padding], nil
+    },
+}
+
+// PADDING_ZERO can not tell trailing zeros in the message from padding,
+// does not pad messages that are already block aligned and so can not pad
+// an empty message
+var PADDING_ZERO = PaddingScheme{
+    Name: "zero",
+    Description: "zeros, trailing zeros in the message are lost",
+    Pad: func(data []byte) ([]byte, error) {
+        if len(data) == 0 {
+            return nil, fmt.Errorf("zero padding can not pad an empty message")
+        }
+        padded := append([]byte{}, data...)
+        for len(padded) % BLOCK_SIZE != 0 {
+            padded = append(padded, 0)
+        }
+        return padded, nil
+    },
+    Unpad: func(data []byte) ([]byte, error) {
+        err := checkBlocks(data)
+        if err != nil {
+            return nil, err
+        }
+        end := len(data)
+        for end > len(data) - BLOCK_SIZE + 1 && data[end - 1] == 0 {
+            end--
+        }
+        return data[:end], nil
+    },
+}
+
+var PADDING_NONE = PaddingScheme{
+    Name: "none",
+    Description: "no padding, the message must be block aligned",
+    Pad: func(data []byte) ([]byte, error) {
+        if len(data) == 0 || len(data) % BLOCK_SIZE != 0 {
+            return nil, fmt.Errorf("message is %d bytes long but without padding it must be a non-zero multiple of %d", len(data), BLOCK_SIZE)
+        }
+        return append([]byte{}, data...), nil
+    },
+    Unpad: func(data []byte) ([]byte, error) {
+        err := checkBlocks(data)
+        if err != nil {
+            return nil, err
+        }
+        return data, nil
+    },
+}
+
+// PADDINGS in the order they are offered in the UI. The first is the
+// default
+var PADDINGS = []PaddingScheme{PADDING_PKCS7, PADDING_ISO7816, PADDING_X923, PADDING_ZERO, PADDING_NONE}
+
+func checkBlocks(data []byte) error {
+    if len(data) == 0 || len(data) % BLOCK_SIZE != 0 {
+        return fmt.Errorf("%w: %d bytes is not a whole number of blocks", ErrInvalidPadding, len(data))
+    }
+    return nil
+}
+
+func ParsePadding(name string) (PaddingScheme, error) {
+    names := []string{}
+    for _, padding := range PADDINGS {
+        if padding.Name == strings.ToLower(name) {
+            return padding, nil
+        }
+        names = append(names, padding.Name)
+    }
+    return PaddingScheme{}, fmt.Errorf("unknown padding %q. Known paddings: %s", name, strings.Join(names, ", "))
+}
+
+// SetPadding sets the padding Encrypt and Decrypt use
+func (s *BAESys128) SetPadding(padding PaddingScheme) {
+    s.padding = &padding
+}
+
+// Padding is the padding in use, PKCS#7 unless another one was set
+func (s *BAESys128) Padding() PaddingScheme {
+    if s.padding == nil {
+        return PADDINGS[0]
+    }
+    return *s.padding
+}
+
+func padding_select(selected string) string {
+    options := ""
+    for _, padding := range PADDINGS {
+        attr := ""
+        if padding.Name == selected {
+            attr = "selected"
+        }
+        options += fmt.Sprintf(`<option value="%s" %s>%s</option>`, padding.Name, attr, padding.Description)
+    }
+    return fmt.Sprintf(`
+                <label for="padding">Padding</label>
+                <select id="padding" name="padding" class="border-2">%s</select>
+        `, options)
+}
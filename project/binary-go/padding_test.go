@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPaddingRoundTrip(t *testing.T) {
+    for _, padding := range PADDINGS {
+        for n := 0; n <= 3*BLOCK_SIZE; n++ {
+            msg := bytes.Repeat([]byte{'m'}, n)
+            padded, err := padding.Pad(msg)
+            rejected := padding.Name == PADDING_NONE.Name && n % BLOCK_SIZE != 0
+            if (padding.Name == PADDING_NONE.Name || padding.Name == PADDING_ZERO.Name) && n == 0 || rejected {
+                if err == nil {
+                    t.Errorf("%s: expected %d bytes to be rejected", padding.Name, n)
+                }
+                continue
+            }
+            if err != nil || len(padded) % BLOCK_SIZE != 0 {
+                t.Fatalf("%s: padding %d bytes gave %d bytes, %v", padding.Name, n, len(padded), err)
+            }
+            unpadded, err := padding.Unpad(padded)
+            if err != nil || !bytes.Equal(unpadded, msg) {
+                t.Errorf("%s: %d bytes did not survive padding: %q %v", padding.Name, n, unpadded, err)
+            }
+        }
+    }
+}
+
+func TestPaddingRejectsMalformed(t *testing.T) {
+    block := func(tail ...byte) []byte {
+        return append(bytes.Repeat([]byte{'a'}, BLOCK_SIZE - len(tail)), tail...)
+    }
+    tests := []struct {
+        padding PaddingScheme
+        data []byte
+    }{
+        {PADDING_PKCS7, block(1, 2, 3)},
+        {PADDING_ISO7816, block(0x80, 0, 1)},
+        {PADDING_ISO7816, block(0, 0)},
+        {PADDING_X923, block(1, 0, 3)},
+        {PADDING_X923, block(0)},
+        {PADDING_NONE, []byte("not a block")},
+        {PADDING_ZERO, nil},
+    }
+    for _, test := range tests {
+        if _, err := test.padding.Unpad(test.data); !errors.Is(err, ErrInvalidPadding) {
+            t.Errorf("%s: %x: expected %v, got %v", test.padding.Name, test.data, ErrInvalidPadding, err)
+        }
+    }
+}
+
+func TestWrongKeyIsInvalidPadding(t *testing.T) {
+    for _, padding := range []PaddingScheme{PADDING_PKCS7, PADDING_ISO7816, PADDING_X923} {
+        baes := new(BAESys128)
+        baes.SetKey([]byte("0123456789abcdef"))
+        res, _ := baes.EncryptWithPadding([]byte("attack at dawn"), padding)
+        baes.ResetKey()
+        baes.SetKey([]byte("fedcba9876543210"))
+        _, err := baes.DecryptWithPadding(res.Ciphertext, padding)
+        if !errors.Is(err, ErrInvalidPadding) || !strings.HasPrefix(err.Error(), "invalid padding") {
+            t.Errorf("%s: expected invalid padding, got %v", padding.Name, err)
+        }
+    }
+}
+
+func TestHandlersUsePadding(t *testing.T) {
+    baes := new(BAESys128)
+    form := url.Values{"key": {"0123456789abcdef"}, "message": {"not aligned"}, "padding": {"none"}}
+    w := postForm(handle_encrypt_message(baes), form)
+    if !strings.Contains(w.Body.String(), "without padding it must be") {
+        t.Errorf("expected the unaligned message to be rejected")
+    }
+    form.Set("padding", "rot13")
+    w = postForm(handle_encrypt_message(baes), form)
+    if !strings.Contains(w.Body.String(), "unknown padding") {
+        t.Errorf("expected the unknown padding to be rejected")
+    }
+    form.Set("padding", "iso7816")
+    w = postForm(handle_encrypt_message(baes), form)
+    if !strings.Contains(w.Body.String(), `value="iso7816" selected`) {
+        t.Errorf("expected the chosen padding to stay selected")
+    }
+}
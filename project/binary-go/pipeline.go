@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// SetWindow sets how many blocks can be written to the Basys3 before their
+// ciphertext has been read back. 1 is the strict write-one, read-one lock
+// step. Larger windows keep both directions of the UART busy
+func (s *BAESys128) SetWindow(window int) {
+    if window < 1 {
+        window = 1
+    }
+    s.window = window
+}
+
+func (s *BAESys128) Window() int {
+    if s.window < 1 {
+        return 1
+    }
+    return s.window
+}
+
+type inflightBlock struct {
+    index int
+    expected []byte
+}
+
+// writeBlock returns how many bytes reached the port, even when it fails
+func (s *BAESys128) writeBlock(port serial.Port, block []byte) (int, error) {
+    var n int
+    var err error
+    profile := s.Profile()
+    if s.protocol == PROTOCOL_V2 {
+        n, err = port.Write(encodeFrame(OP_ENCRYPT, profile.ToWire(block)))
+    } else {
+        n, err = port.Write(profile.ToWire(block))
+        time.Sleep(profile.BlockDelay())
+    }
+    return n, err
+}
+
+func (s *BAESys128) readBlock(port serial.Port) ([]byte, error) {
+    if s.protocol != PROTOCOL_V2 {
+        res := make([]byte, BLOCK_SIZE)
+        err := readFull(port, res)
+        if err != nil {
+            return nil, err
+        }
+        return s.Profile().FromWire(res), nil
+    }
+    status, res, err := readFrame(port)
+    if err != nil {
+        return nil, err
+    }
+    if status != STATUS_OK {
+        return nil, fmt.Errorf("Basys3 responded with %s", statusString(status))
+    }
+    if len(res) != BLOCK_SIZE {
+        return nil, fmt.Errorf("ENCRYPT response is %d bytes instead of %d", len(res), BLOCK_SIZE)
+    }
+    return s.Profile().FromWire(res), nil
+}
+
+// encryptPipelined keeps up to Window() blocks in flight. One goroutine
+// writes blocks while this one reads the ciphertext back in order. If a
+// write fails before any of its block was sent every block before it has
+// been read back, so the rest are done in lock step. If a read fails, or a
+// block was partly written, the blocks in flight may already have been
+// encrypted, and a trojan counting consecutive blocks would see them twice
+// if they were sent again, so the request fails instead.
+// NOTE: the raw protocol has no framing so lost bytes are only noticed when
+// the last read times out. Everything after the loss shows up as mismatches
+// instead of failing
+func (s *BAESys128) encryptPipelined(blocks [][]byte) (EncryptResult, error) {
+    var res EncryptResult
+    port := *s.port
+    err := port.SetReadTimeout(s.Profile().ReadTimeout())
+    if err != nil {
+        return res, fmt.Errorf("failed to set read timeout: %v", err)
+    }
+    defer port.SetReadTimeout(s.idleTimeout())
+
+    window := make(chan struct{}, s.Window())
+    inflight := make(chan inflightBlock, len(blocks))
+    done := make(chan struct{})
+    writeErr := make(chan error, 1)
+    // bytes of the failed block that were sent, set before writeErr
+    written := 0
+    go func() {
+        defer close(inflight)
+        for i, block := range blocks {
+            select {
+            case window <- struct{}{}:
+            case <-done:
+                return
+            }
+            n, err := s.writeBlock(port, block)
+            if err != nil {
+                written = n
+                writeErr <- err
+                return
+            }
+            // only once it is written, and in write order, so the trojan
+            // counter matches the Basys3
+            inflight <- inflightBlock{index: i, expected: s.aes.Encrypt(block)}
+        }
+    }()
+
+    next := 0
+    lost := false
+    for ; next < len(blocks); next++ {
+        block, ok := <-inflight
+        if !ok {
+            err = <-writeErr
+            lost = written > 0
+            break
+        }
+        actual, rerr := s.readBlock(port)
+        if rerr != nil {
+            err = rerr
+            lost = true
+            break
+        }
+        <-window
+        res.Ciphertext = append(res.Ciphertext, actual...)
+        res.Blocks = append(res.Blocks, s.verifyBlock(block.index, blocks[block.index], block.expected, actual))
+    }
+    close(done)
+    // wait for the writer to stop so it doesn't race the lock step
+    unread := 0
+    for range inflight {
+        unread++
+    }
+    if next == len(blocks) {
+        return res, nil
+    }
+    if lost {
+        s.log(COMPONENT_DEVICE).Error("Pipelined encryption lost blocks in flight", ATTR_BLOCK, next, "in_flight", unread + 1, errAttr(err))
+        return res, deviceError(ErrInFlightLost, "Lost the ciphertext of blocks %d to %d after %d of %d were read back: %s", next, next + unread, next, len(blocks), err)
+    }
+
+    s.log(COMPONENT_DEVICE).Warn("Pipelined encryption failed to write. Falling back to lock step", ATTR_BLOCK, next, errAttr(err))
+    err = drain(port)
+    if err != nil {
+        return res, fmt.Errorf("failed to clear Basys3 input buffer: %v", err)
+    }
+    for i := next; i < len(blocks); i++ {
+        actual, expected, err := s.encryptBlock(blocks[i])
+        if err != nil {
+            return res, err
+        }
+        res.Ciphertext = append(res.Ciphertext, actual...)
+        res.Blocks = append(res.Blocks, s.verifyBlock(i, blocks[i], expected, actual))
+    }
+    return res, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+func newModelBaes(t testing.TB, protocol Protocol, window int) (*BAESys128, *Basys3Model) {
+    board := NewBasys3Model(protocol)
+    baes := new(BAESys128)
+    baes.SetProtocol(protocol)
+    baes.SetPort(board.Port())
+    baes.SetWindow(window)
+    baes.Negotiate()
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    return baes, board
+}
+
+// trojanMessage is enough consecutive trojan activating blocks to set the
+// trojan off, so the ciphertext is only right if blocks stay in order
+func trojanMessage() []byte {
+    return bytes.Repeat(TROJAN_ACTIVATE_MASK[:], TROJAN_COUNT + 2)
+}
+
+func TestPipelinedMatchesLockStep(t *testing.T) {
+    for _, protocol := range []Protocol{PROTOCOL_RAW, PROTOCOL_V2} {
+        lockStep, _ := newModelBaes(t, protocol, 1)
+        pipelined, _ := newModelBaes(t, protocol, 4)
+        expected, err := lockStep.EncryptVerified(trojanMessage())
+        if err != nil {
+            t.Fatalf("%s: lock step Encrypt failed: %v", protocol, err)
+        }
+        actual, err := pipelined.EncryptVerified(trojanMessage())
+        if err != nil {
+            t.Fatalf("%s: pipelined Encrypt failed: %v", protocol, err)
+        }
+        if !bytes.Equal(expected.Ciphertext, actual.Ciphertext) {
+            t.Errorf("%s: pipelined ciphertext differs from lock step", protocol)
+        }
+        for _, block := range actual.Blocks {
+            if block.Status != VERIFY_MATCH {
+                t.Errorf("%s: block %d is %s", protocol, block.Index, block.Status)
+            }
+        }
+    }
+}
+
+// blocks in flight when a read fails may have been encrypted, so they are
+// not sent again
+func TestPipelinedReadErrorFails(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    frameSize := FRAME_HEADER_SIZE + BLOCK_SIZE + 1
+    // STATUS, SET_KEY, then corrupt the payload of the third ENCRYPT
+    offset := (FRAME_HEADER_SIZE + 2 + 1) + frameSize + 2*frameSize + FRAME_HEADER_SIZE
+    var port serial.Port = &corruptPort{Port: board, corruptAt: offset}
+    baes := new(BAESys128)
+    baes.SetPort(&port)
+    baes.SetWindow(4)
+    baes.Negotiate()
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    msg := []byte("a message that is a few blocks long, long enough to pipeline")
+    res, err := baes.EncryptVerified(msg)
+    if !errors.Is(err, ErrInFlightLost) {
+        t.Fatalf("expected the in flight blocks to be lost, got %v", err)
+    }
+    expected, _ := NewAES([]byte("0123456789abcdef"))
+    if !bytes.Equal(res.Ciphertext, expected.EncryptECB(pkcs7Pad(append([]byte{}, msg...)))[:2*BLOCK_SIZE]) {
+        t.Errorf("expected the 2 blocks read back before the error")
+    }
+}
+
+// failWritePort fails the write numbered failAt, counting from 1, after
+// sending partial bytes of it. It keeps the last read timeout set
+type failWritePort struct {
+    serial.Port
+    failAt int
+    partial int
+    writes int
+    timeout time.Duration
+}
+
+func (f *failWritePort) Write(p []byte) (int, error) {
+    f.writes++
+    if f.writes == f.failAt {
+        n, _ := f.Port.Write(p[:f.partial])
+        return n, fmt.Errorf("write failed")
+    }
+    return f.Port.Write(p)
+}
+
+func (f *failWritePort) SetReadTimeout(timeout time.Duration) error {
+    f.timeout = timeout
+    return f.Port.SetReadTimeout(timeout)
+}
+
+// a block that failed to write never reached the Basys3, so lock step picks
+// up from it without the trojan counting anything twice
+func TestPipelinedWriteErrorFallsBackToLockStep(t *testing.T) {
+    lockStep, _ := newModelBaes(t, PROTOCOL_V2, 1)
+    expected, err := lockStep.EncryptVerified(trojanMessage())
+    if err != nil {
+        t.Fatalf("lock step Encrypt failed: %v", err)
+    }
+
+    board := NewBasys3Model(PROTOCOL_V2)
+    // STATUS, SET_KEY, then the third ENCRYPT
+    failing := &failWritePort{Port: board, failAt: 5}
+    var port serial.Port = failing
+    baes := new(BAESys128)
+    baes.SetPort(&port)
+    baes.SetWindow(4)
+    baes.Negotiate()
+    err = baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    res, err := baes.EncryptVerified(trojanMessage())
+    if err != nil {
+        t.Fatalf("EncryptVerified failed: %v", err)
+    }
+    if failing.writes <= failing.failAt {
+        t.Fatalf("only %d writes, the write never failed", failing.writes)
+    }
+    if !bytes.Equal(res.Ciphertext, expected.Ciphertext) {
+        t.Errorf("ciphertext after fall back differs from lock step")
+    }
+    for _, block := range res.Blocks {
+        if block.Status != VERIFY_MATCH {
+            t.Errorf("block %d is %s", block.Index, block.Status)
+        }
+    }
+    if failing.timeout != PROTOCOL_TIMEOUT {
+        t.Errorf("read timeout left at %s", failing.timeout)
+    }
+}
+
+// part of a block that failed to write may have reached the Basys3, so it
+// is not sent again
+func TestPipelinedPartialWriteFails(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    failing := &failWritePort{Port: board, failAt: 5, partial: 3}
+    var port serial.Port = failing
+    baes := new(BAESys128)
+    baes.SetPort(&port)
+    baes.SetWindow(4)
+    baes.Negotiate()
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    res, err := baes.EncryptVerified(trojanMessage())
+    if !errors.Is(err, ErrInFlightLost) {
+        t.Fatalf("expected the partly written block to be lost, got %v", err)
+    }
+    if len(res.Ciphertext) != 2*BLOCK_SIZE || failing.writes != failing.failAt {
+        t.Errorf("expected 2 blocks back and no writes after the failed one, got %d bytes and %d writes", len(res.Ciphertext), failing.writes)
+    }
+    if failing.timeout != PROTOCOL_TIMEOUT {
+        t.Errorf("read timeout left at %s", failing.timeout)
+    }
+}
+
+func benchmarkEncrypt(b *testing.B, window int) {
+    baes, board := newModelBaes(b, PROTOCOL_RAW, window)
+    // 9600 baud like trojan_top with a couple ms of USB latency
+    board.SetTiming(PORT_MODE.BaudRate, 2*time.Millisecond)
+    msg := bytes.Repeat([]byte("benchmark block!"), 8)
+    blocks, _ := baes.Blocks(msg, PADDING_PKCS7)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        _, err := baes.EncryptVerified(msg)
+        if err != nil {
+            b.Fatalf("EncryptVerified failed: %v", err)
+        }
+    }
+    b.ReportMetric(float64(len(blocks)*b.N)/b.Elapsed().Seconds(), "blocks/s")
+}
+
+func BenchmarkEncryptLockStep(b *testing.B) {
+    benchmarkEncrypt(b, 1)
+}
+
+func BenchmarkEncryptPipelined(b *testing.B) {
+    benchmarkEncrypt(b, 8)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ByteOrder is the order of the bytes inside each 32 bit word on the wire
+type ByteOrder string
+
+const (
+    BYTE_ORDER_BIG_ENDIAN ByteOrder = "big-endian"
+    BYTE_ORDER_LITTLE_ENDIAN ByteOrder = "little-endian"
+)
+
+// WordOrder is the order of the four 32 bit words of a block on the wire
+type WordOrder string
+
+const (
+    WORD_ORDER_NORMAL WordOrder = "normal"
+    WORD_ORDER_REVERSED WordOrder = "reversed"
+)
+
+// KeyLoading is how the core gets its key
+type KeyLoading string
+
+const (
+    // the first block after reset (btnC) is the key, like trojan_top
+    KEY_LOADING_FIRST_BLOCK KeyLoading = "first-block"
+    // the key is baked into the bitstream. SetKey only sets the key the
+    // software reference uses
+    KEY_LOADING_FIXED KeyLoading = "fixed"
+)
+
+// EchoMode is what the core sends back after loading a key
+type EchoMode string
+
+const (
+    // the key encrypted with itself, like trojan_top
+    ECHO_ENCRYPTED EchoMode = "encrypted"
+    // the key unchanged
+    ECHO_PLAIN EchoMode = "plain"
+    ECHO_NONE EchoMode = "none"
+)
+
+// DeviceProfile describes the wire format of an AES core spoken to with the
+// raw (unframed) protocol. The v2 protocol is always framed the same way
+type DeviceProfile struct {
+    Name string `json:"name"`
+    Description string `json:"description"`
+    ByteOrder ByteOrder `json:"byte_order"`
+    WordOrder WordOrder `json:"word_order"`
+    KeyLoading KeyLoading `json:"key_loading"`
+    Echo EchoMode `json:"echo"`
+    BlockSize int `json:"block_size"`
+    // 0 detects the baud rate
+    Baud int `json:"baud"`
+    // how long to wait for an answer. 0 uses PROTOCOL_TIMEOUT
+    ReadTimeoutMs int `json:"read_timeout_ms"`
+    // pause after writing each block for cores without an input FIFO
+    BlockDelayMs int `json:"block_delay_ms"`
+    // whether the core has the trojan, so the software reference matches
+    Trojan bool `json:"trojan"`
+}
+
+// trojan_top loads the 128 bit register MSB first, so on the wire the whole
+// block is reversed: the words are in reverse order and so are the bytes in
+// each word
+var TROJAN_PROFILE = DeviceProfile{
+    Name: "trojan",
+    Description: "trojan_top from hdl/",
+    ByteOrder: BYTE_ORDER_LITTLE_ENDIAN,
+    WordOrder: WORD_ORDER_REVERSED,
+    KeyLoading: KEY_LOADING_FIRST_BLOCK,
+    Echo: ECHO_ENCRYPTED,
+    BlockSize: BLOCK_SIZE,
+    Trojan: true,
+}
+
+// REFERENCE_PROFILE is trojan_top with the trojan taken out
+var REFERENCE_PROFILE = DeviceProfile{
+    Name: "reference",
+    Description: "clean AES core with the trojan_top UART interface",
+    ByteOrder: BYTE_ORDER_LITTLE_ENDIAN,
+    WordOrder: WORD_ORDER_REVERSED,
+    KeyLoading: KEY_LOADING_FIRST_BLOCK,
+    Echo: ECHO_ENCRYPTED,
+    BlockSize: BLOCK_SIZE,
+    Trojan: false,
+}
+
+// NOTE: there is no built in profile for the design in forImposters/. Its
+// aes128 core takes the key and plaintext as parallel 128 bit ports and the
+// top level only drives the UWB transmitter, so there is no UART to talk
+// to. Once it has a UART wrapper it can be described in a profiles file
+var BUILTIN_PROFILES = []DeviceProfile{TROJAN_PROFILE, REFERENCE_PROFILE}
+
+func (p DeviceProfile) Validate() error {
+    if p.Name == "" {
+        return fmt.Errorf("profile has no name")
+    }
+    switch p.ByteOrder {
+    case BYTE_ORDER_BIG_ENDIAN, BYTE_ORDER_LITTLE_ENDIAN:
+    default:
+        return fmt.Errorf("profile %s: unknown byte order %q", p.Name, p.ByteOrder)
+    }
+    switch p.WordOrder {
+    case WORD_ORDER_NORMAL, WORD_ORDER_REVERSED:
+    default:
+        return fmt.Errorf("profile %s: unknown word order %q", p.Name, p.WordOrder)
+    }
+    switch p.KeyLoading {
+    case KEY_LOADING_FIRST_BLOCK, KEY_LOADING_FIXED:
+    default:
+        return fmt.Errorf("profile %s: unknown key loading %q", p.Name, p.KeyLoading)
+    }
+    switch p.Echo {
+    case ECHO_ENCRYPTED, ECHO_PLAIN, ECHO_NONE:
+    default:
+        return fmt.Errorf("profile %s: unknown echo %q", p.Name, p.Echo)
+    }
+    // the go AES and the Basys3 are AES-128
+    if p.BlockSize != BLOCK_SIZE {
+        return fmt.Errorf("profile %s: block size %d is not supported, only %d", p.Name, p.BlockSize, BLOCK_SIZE)
+    }
+    if p.Baud < 0 || p.ReadTimeoutMs < 0 || p.BlockDelayMs < 0 {
+        return fmt.Errorf("profile %s: timings can not be negative", p.Name)
+    }
+    return nil
+}
+
+// ToWire rearranges a block into the order the core expects it on the wire
+func (p DeviceProfile) ToWire(block []byte) []byte {
+    out := make([]byte, len(block))
+    words := len(block) / 4
+    for w := 0; w < words; w++ {
+        src := w
+        if p.WordOrder == WORD_ORDER_REVERSED {
+            src = words - w - 1
+        }
+        for b := 0; b < 4; b++ {
+            srcByte := b
+            if p.ByteOrder == BYTE_ORDER_LITTLE_ENDIAN {
+                srcByte = 3 - b
+            }
+            out[4*w + b] = block[4*src + srcByte]
+        }
+    }
+    return out
+}
+
+// FromWire undoes ToWire. Both rearrangements are their own inverse
+func (p DeviceProfile) FromWire(block []byte) []byte {
+    return p.ToWire(block)
+}
+
+// NewAES is the software reference for a core with this profile
+func (p DeviceProfile) NewAES(key []byte) (*AES, error) {
+    aes, err := NewAES(key)
+    if err != nil {
+        return nil, err
+    }
+    if !p.Trojan {
+        aes.DisableTrojan()
+    }
+    return aes, nil
+}
+
+func (p DeviceProfile) ReadTimeout() time.Duration {
+    if p.ReadTimeoutMs == 0 {
+        return PROTOCOL_TIMEOUT
+    }
+    return time.Duration(p.ReadTimeoutMs) * time.Millisecond
+}
+
+func (p DeviceProfile) BlockDelay() time.Duration {
+    return time.Duration(p.BlockDelayMs) * time.Millisecond
+}
+
+// LoadProfiles returns the built in profiles plus the ones in the JSON file
+// at path, which is a list of profiles. A profile in the file with the same
+// name as a built in one replaces it
+func LoadProfiles(path string) (map[string]DeviceProfile, error) {
+    profiles := map[string]DeviceProfile{}
+    for _, profile := range BUILTIN_PROFILES {
+        profiles[profile.Name] = profile
+    }
+    if path == "" {
+        return profiles, nil
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var loaded []DeviceProfile
+    err = json.Unmarshal(data, &loaded)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    for _, profile := range loaded {
+        if profile.BlockSize == 0 {
+            profile.BlockSize = BLOCK_SIZE
+        }
+        err = profile.Validate()
+        if err != nil {
+            return nil, err
+        }
+        profiles[profile.Name] = profile
+    }
+    return profiles, nil
+}
+
+func profileNames(profiles map[string]DeviceProfile) string {
+    names := []string{}
+    for name := range profiles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ", ")
+}
+
+func (s *BAESys128) SetProfile(profile DeviceProfile) {
+    s.profile = &profile
+}
+
+// Profile is the profile in use, trojan_top unless another one was set
+func (s *BAESys128) Profile() DeviceProfile {
+    if s.profile == nil {
+        return TROJAN_PROFILE
+    }
+    return *s.profile
+}
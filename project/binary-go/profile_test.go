@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrojanProfileReversesBlocks(t *testing.T) {
+    block := []byte("0123456789abcdef")
+    if !bytes.Equal(TROJAN_PROFILE.ToWire(block), reverse(block)) {
+        t.Errorf("trojan profile should reverse the whole block")
+    }
+    profile := TROJAN_PROFILE
+    profile.ByteOrder = BYTE_ORDER_BIG_ENDIAN
+    if wire := profile.ToWire(block); string(wire) != "cdef89ab45670123" {
+        t.Errorf("expected only the words to be reversed, got %s", wire)
+    }
+    if !bytes.Equal(profile.FromWire(profile.ToWire(block)), block) {
+        t.Errorf("FromWire does not undo ToWire")
+    }
+}
+
+func TestLoadProfiles(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "profiles.json")
+    os.WriteFile(path, []byte(`[
+        {"name": "natural", "byte_order": "big-endian", "word_order": "normal", "key_loading": "first-block", "echo": "plain", "baud": 115200},
+        {"name": "trojan", "byte_order": "little-endian", "word_order": "reversed", "key_loading": "first-block", "echo": "encrypted", "read_timeout_ms": 50, "trojan": true}
+    ]`), 0o644)
+    profiles, err := LoadProfiles(path)
+    if err != nil {
+        t.Fatalf("LoadProfiles failed: %v", err)
+    }
+    if _, ok := profiles["reference"]; !ok {
+        t.Errorf("built in profiles should still be there")
+    }
+    if profiles["natural"].Baud != 115200 || profiles["natural"].BlockSize != BLOCK_SIZE {
+        t.Errorf("natural profile not loaded right: %+v", profiles["natural"])
+    }
+    if profiles["trojan"].ReadTimeoutMs != 50 {
+        t.Errorf("profile from the file should replace the built in one")
+    }
+
+    os.WriteFile(path, []byte(`[{"name": "bad", "byte_order": "middle-endian", "word_order": "normal", "key_loading": "first-block", "echo": "none"}]`), 0o644)
+    if _, err := LoadProfiles(path); err == nil {
+        t.Errorf("expected an unknown byte order to be rejected")
+    }
+}
+
+func newProfileBaes(t *testing.T, profile DeviceProfile, fixedKey []byte) *BAESys128 {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    board.SetProfile(profile)
+    if fixedKey != nil {
+        board.SetFixedKey(fixedKey)
+    }
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetProfile(profile)
+    baes.SetPort(board.Port())
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("%s: SetKey failed: %v", profile.Name, err)
+    }
+    return baes
+}
+
+func TestProfilesDriveTheirCores(t *testing.T) {
+    natural := DeviceProfile{
+        Name: "natural",
+        ByteOrder: BYTE_ORDER_BIG_ENDIAN,
+        WordOrder: WORD_ORDER_NORMAL,
+        KeyLoading: KEY_LOADING_FIRST_BLOCK,
+        Echo: ECHO_PLAIN,
+        BlockSize: BLOCK_SIZE,
+    }
+    silent := natural
+    silent.Name = "silent"
+    silent.Echo = ECHO_NONE
+    fixed := natural
+    fixed.Name = "fixed"
+    fixed.KeyLoading = KEY_LOADING_FIXED
+
+    clean, _ := NewAES([]byte("0123456789abcdef"))
+    clean.DisableTrojan()
+    expected := clean.EncryptECB(pkcs7Pad(trojanMessage()))
+
+    tests := []struct {
+        profile DeviceProfile
+        fixedKey []byte
+    }{
+        {REFERENCE_PROFILE, nil},
+        {natural, nil},
+        {silent, nil},
+        {fixed, []byte("0123456789abcdef")},
+    }
+    for _, test := range tests {
+        baes := newProfileBaes(t, test.profile, test.fixedKey)
+        res, err := baes.EncryptVerified(trojanMessage())
+        if err != nil {
+            t.Fatalf("%s: EncryptVerified failed: %v", test.profile.Name, err)
+        }
+        if !bytes.Equal(res.Ciphertext, expected) {
+            t.Errorf("%s: expected clean AES ciphertext", test.profile.Name)
+        }
+        if mismatches := len(res.Mismatches()); mismatches != 0 {
+            t.Errorf("%s: %d blocks did not match the software reference", test.profile.Name, mismatches)
+        }
+    }
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Protocol is the wire format spoken with the Basys3.
+//
+// PROTOCOL_RAW is what trojan_top understands: no framing, the first 16
+// bytes after a reset are the key and every 16 bytes after that are a
+// plaintext block that is answered with 16 bytes of ciphertext.
+//
+// PROTOCOL_V2 wraps every command in a frame
+//
+//	request:  MAGIC VERSION opcode len payload[len] checksum
+//	response: MAGIC VERSION status len payload[len] checksum
+//
+// where checksum is the xor of every byte from VERSION through the payload.
+// A v2 device skips bytes until it sees MAGIC so zero bytes can be used to
+// pad a frame out to a full block.
+type Protocol int
+
+const (
+    PROTOCOL_AUTO Protocol = iota
+    PROTOCOL_RAW
+    PROTOCOL_V2
+)
+
+func (p Protocol) String() string {
+    switch p {
+    case PROTOCOL_AUTO:
+        return "auto"
+    case PROTOCOL_RAW:
+        return "raw"
+    case PROTOCOL_V2:
+        return "v2"
+    }
+    return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+func ParseProtocol(s string) (Protocol, error) {
+    switch s {
+    case "auto":
+        return PROTOCOL_AUTO, nil
+    case "raw":
+        return PROTOCOL_RAW, nil
+    case "v2":
+        return PROTOCOL_V2, nil
+    }
+    return PROTOCOL_AUTO, fmt.Errorf("unknown protocol %q. Expected one of auto, raw, v2", s)
+}
+
+const (
+    FRAME_MAGIC byte = 0xA5
+    FRAME_VERSION byte = 0x02
+    // MAGIC VERSION opcode/status len
+    FRAME_HEADER_SIZE int = 4
+    FRAME_MAX_PAYLOAD int = 255
+)
+
+const (
+    OP_SET_KEY byte = 0x01
+    OP_ENCRYPT byte = 0x02
+    OP_DECRYPT byte = 0x03
+    OP_RESET byte = 0x04
+    OP_STATUS byte = 0x05
+)
+
+const (
+    STATUS_OK byte = 0x00
+    STATUS_BAD_CHECKSUM byte = 0x01
+    STATUS_BAD_OPCODE byte = 0x02
+    STATUS_BAD_LENGTH byte = 0x03
+    STATUS_NO_KEY byte = 0x04
+)
+
+// how long to wait for a v2 response before giving up. A 16 byte block
+// takes ~17ms each way at 9600 baud so this is very generous
+const PROTOCOL_TIMEOUT = 500 * time.Millisecond
+
+// idleTimeout is the read timeout the port is left with between requests,
+// the PROTOCOL_TIMEOUT Negotiate sets for v2 and none for raw
+func (s *BAESys128) idleTimeout() time.Duration {
+    if s.protocol == PROTOCOL_V2 {
+        return PROTOCOL_TIMEOUT
+    }
+    return serial.NoTimeout
+}
+
+func statusString(status byte) string {
+    switch status {
+    case STATUS_OK:
+        return "ok"
+    case STATUS_BAD_CHECKSUM:
+        return "bad checksum"
+    case STATUS_BAD_OPCODE:
+        return "bad opcode"
+    case STATUS_BAD_LENGTH:
+        return "bad length"
+    case STATUS_NO_KEY:
+        return "no key set"
+    }
+    return fmt.Sprintf("unknown status 0x%02x", status)
+}
+
+func checksum(b []byte) byte {
+    var sum byte
+    for _, v := range b {
+        sum ^= v
+    }
+    return sum
+}
+
+// encodeFrame builds a v2 frame. code is the opcode for requests and the
+// status for responses
+func encodeFrame(code byte, payload []byte) []byte {
+    if len(payload) > FRAME_MAX_PAYLOAD {
+        panic(fmt.Sprintf("frame payload of %d bytes is too long", len(payload)))
+    }
+    frame := make([]byte, 0, FRAME_HEADER_SIZE + len(payload) + 1)
+    frame = append(frame, FRAME_MAGIC, FRAME_VERSION, code, byte(len(payload)))
+    frame = append(frame, payload...)
+    return append(frame, checksum(frame[1:]))
+}
+
+// decodeFrame checks a complete frame and returns its code and payload
+func decodeFrame(frame []byte) (code byte, payload []byte, err error) {
+    if len(frame) < FRAME_HEADER_SIZE + 1 {
+        return 0, nil, fmt.Errorf("frame of %d bytes is too short", len(frame))
+    }
+    if frame[0] != FRAME_MAGIC || frame[1] != FRAME_VERSION {
+        return 0, nil, fmt.Errorf("bad frame header %02x %02x", frame[0], frame[1])
+    }
+    length := int(frame[3])
+    if len(frame) != FRAME_HEADER_SIZE + length + 1 {
+        return 0, nil, fmt.Errorf("frame is %d bytes but header says %d", len(frame), FRAME_HEADER_SIZE + length + 1)
+    }
+    end := len(frame) - 1
+    if checksum(frame[1:end]) != frame[end] {
+        return 0, nil, fmt.Errorf("bad frame checksum")
+    }
+    return frame[2], frame[FRAME_HEADER_SIZE:end], nil
+}
+
+// readFull reads exactly len(buf) bytes from port. A read that returns no
+// bytes means the read timeout expired. Running out after some of the bytes
+// is ErrShortRead, before any of them ErrTimeout
+func readFull(port serial.Port, buf []byte) error {
+    for n := 0; n < len(buf); {
+        m, err := port.Read(buf[n:])
+        if err != nil && n + m > 0 {
+            return deviceError(ErrShortRead, "read %d of %d bytes before the Basys3 link failed: %v", n + m, len(buf), err)
+        }
+        if err != nil {
+            return fmt.Errorf("failed to read from Basys3: %w", err)
+        }
+        if m == 0 && n > 0 {
+            return deviceError(ErrShortRead, "timed out after reading %d of %d bytes", n, len(buf))
+        }
+        if m == 0 {
+            return deviceError(ErrTimeout, "timed out after reading 0 of %d bytes", len(buf))
+        }
+        n += m
+    }
+    return nil
+}
+
+func readFrame(port serial.Port) (code byte, payload []byte, err error) {
+    header := make([]byte, FRAME_HEADER_SIZE)
+    err = readFull(port, header)
+    if err != nil {
+        return 0, nil, err
+    }
+    if header[0] != FRAME_MAGIC || header[1] != FRAME_VERSION {
+        // the length can not be trusted, so throw away whatever follows
+        // instead of reading it as the start of the next response
+        drain(port)
+        return 0, nil, fmt.Errorf("bad frame header %02x %02x", header[0], header[1])
+    }
+    rest := make([]byte, int(header[3]) + 1)
+    err = readFull(port, rest)
+    if err != nil {
+        return 0, nil, err
+    }
+    return decodeFrame(append(header, rest...))
+}
+
+// drain throws away everything the Basys3 sends until it goes quiet for
+// PROTOCOL_TIMEOUT, so responses still on the wire are not mistaken for
+// the answer to the next request. Expects the read timeout to be set
+func drain(port serial.Port) error {
+    err := port.ResetInputBuffer()
+    if err != nil {
+        return err
+    }
+    buf := make([]byte, 256)
+    for {
+        n, err := port.Read(buf)
+        if err != nil {
+            return err
+        }
+        if n == 0 {
+            return nil
+        }
+    }
+}
+
+// transact sends a v2 command and waits for the response
+func (s *BAESys128) transact(op byte, payload []byte) ([]byte, error) {
+    if s.port == nil {
+        return nil, ErrNoDevice
+    }
+    port := *s.port
+    _, err := port.Write(encodeFrame(op, payload))
+    if err != nil {
+        return nil, fmt.Errorf("failed to write to Basys3: %w", err)
+    }
+    status, res, err := readFrame(port)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read response from Basys3: %w", err)
+    }
+    if status != STATUS_OK {
+        return nil, fmt.Errorf("Basys3 responded with %s", statusString(status))
+    }
+    return res, nil
+}
+
+// DeviceStatus is the answer to a v2 STATUS command
+type DeviceStatus struct {
+    Version byte
+    HasKey bool
+}
+
+func (s *BAESys128) Status() (DeviceStatus, error) {
+    if s.protocol != PROTOCOL_V2 {
+        return DeviceStatus{}, fmt.Errorf("STATUS requires protocol v2 but Basys3 speaks %s", s.protocol)
+    }
+    res, err := s.transact(OP_STATUS, nil)
+    if err != nil {
+        return DeviceStatus{}, err
+    }
+    if len(res) != 2 {
+        return DeviceStatus{}, fmt.Errorf("STATUS response is %d bytes instead of 2", len(res))
+    }
+    return DeviceStatus{Version: res[0], HasKey: res[1] != 0}, nil
+}
+
+// statusProbe is a v2 STATUS frame padded with zeros to a full block so a
+// raw device treats it as exactly one block and stays aligned
+func statusProbe() []byte {
+    probe := make([]byte, BLOCK_SIZE)
+    copy(probe, encodeFrame(OP_STATUS, nil))
+    return probe
+}
+
+// Negotiate works out which protocol the Basys3 speaks by sending a STATUS
+// probe. A v2 device answers with a STATUS frame. A raw device (trojan_top)
+// answers with 16 bytes of ciphertext. If it did not have a key yet it
+// loads the probe as its key, so it has to be reset before a real key can
+// be set. That is why auto is never the default, trojan_top is the core
+// most boards run
+func (s *BAESys128) Negotiate() error {
+    if s.port == nil {
+        return ErrNoDevice
+    }
+    port := *s.port
+    if s.protocol != PROTOCOL_AUTO {
+        s.log(COMPONENT_DEVICE).Info("Using protocol", "protocol", s.protocol)
+        if s.protocol == PROTOCOL_V2 {
+            return port.SetReadTimeout(PROTOCOL_TIMEOUT)
+        }
+        return nil
+    }
+    err := port.SetReadTimeout(PROTOCOL_TIMEOUT)
+    if err != nil {
+        return fmt.Errorf("failed to set read timeout: %v", err)
+    }
+    res, err := probe(port, s.Profile())
+    if err != nil {
+        return err
+    }
+    return s.adopt(port, res)
+}
+
+// ProbeResult is what the answer to the STATUS probe says about the Basys3
+type ProbeResult struct {
+    Protocol Protocol
+    // only for v2
+    Version byte
+    HasKey bool
+    // a raw device that was reset loads the probe as its key and echoes
+    // it encrypted with itself
+    LoadedProbe bool
+}
+
+// Verified is true when the answer could only have come from a working
+// Basys3, not from noise on a UART running at the wrong baud rate
+func (r ProbeResult) Verified() bool {
+    return r.Protocol == PROTOCOL_V2 || r.LoadedProbe
+}
+
+// probe sends the STATUS probe and reads the answer. A raw device is
+// expected to answer with the wire format in profile, so a core without a
+// key echo never answers. Expects the read timeout to be set
+func probe(port serial.Port, profile DeviceProfile) (ProbeResult, error) {
+    probe := statusProbe()
+    _, err := port.Write(probe)
+    if err != nil {
+        return ProbeResult{}, fmt.Errorf("failed to write protocol probe: %w", err)
+    }
+    res := make([]byte, BLOCK_SIZE)
+    err = readFull(port, res[:FRAME_HEADER_SIZE])
+    if err != nil {
+        return ProbeResult{}, fmt.Errorf("Basys3 did not answer protocol probe: %w", err)
+    }
+    // a STATUS response is always 2 bytes of payload so it fits in a block
+    n := FRAME_HEADER_SIZE
+    if res[0] == FRAME_MAGIC && res[1] == FRAME_VERSION && res[2] == STATUS_OK && res[3] == 2 {
+        n += 3
+        err = readFull(port, res[FRAME_HEADER_SIZE:n])
+        if err != nil {
+            return ProbeResult{}, fmt.Errorf("failed to read STATUS response: %w", err)
+        }
+        _, payload, err := decodeFrame(res[:n])
+        if err == nil {
+            return ProbeResult{Protocol: PROTOCOL_V2, Version: payload[0], HasKey: payload[1] != 0}, nil
+        }
+        // just ciphertext that happens to start like a STATUS response
+    }
+    err = readFull(port, res[n:])
+    if err != nil {
+        return ProbeResult{}, fmt.Errorf("failed to read protocol probe response: %w", err)
+    }
+    // the Basys3 saw the probe in its wire format, backwards for trojan_top
+    probeKey := profile.FromWire(probe)
+    expected := probeKey
+    if profile.Echo == ECHO_ENCRYPTED {
+        probeAES, _ := profile.NewAES(probeKey)
+        expected = probeAES.Encrypt(probeKey)
+    }
+    loaded := string(profile.FromWire(res)) == string(expected)
+    return ProbeResult{Protocol: PROTOCOL_RAW, HasKey: true, LoadedProbe: loaded}, nil
+}
+
+// adopt switches to the protocol the probe found
+func (s *BAESys128) adopt(port serial.Port, res ProbeResult) error {
+    s.protocol = res.Protocol
+    if res.Protocol == PROTOCOL_V2 {
+        s.keyState = KEY_STATE_NONE
+        if res.HasKey {
+            s.keyState = KEY_STATE_UNKNOWN
+        }
+        s.log(COMPONENT_DEVICE).Info("Basys3 speaks protocol v2", "protocol", PROTOCOL_V2, "firmware", res.Version)
+        return nil
+    }
+    err := port.SetReadTimeout(serial.NoTimeout)
+    if err != nil {
+        return fmt.Errorf("failed to clear read timeout: %v", err)
+    }
+    // either way the Basys3 now holds a key that is not ours
+    s.keyState = KEY_STATE_UNKNOWN
+    if res.LoadedProbe {
+        s.log(COMPONENT_DEVICE).Warn("Basys3 speaks the raw protocol and loaded the probe as its key. Press the center button (btnC) before setting a key", "protocol", PROTOCOL_RAW)
+    } else {
+        s.log(COMPONENT_DEVICE).Warn("Basys3 speaks the raw protocol and already had a key. Press the center button (btnC) before setting a key", "protocol", PROTOCOL_RAW)
+    }
+    return nil
+}
+
+func (s *BAESys128) resetV2() error {
+    _, err := s.transact(OP_RESET, nil)
+    if err != nil {
+        s.keyState = KEY_STATE_UNKNOWN
+        return fmt.Errorf("failed to reset Basys3: %w", err)
+    }
+    s.log(COMPONENT_KEY).Info("Reset key on Basys3")
+    return nil
+}
+
+// setKeyV2 resets the device if it has a key and loads the new one. The
+// device answers SET_KEY with the key check value (a zero block encrypted
+// with the key) which is checked against the go AES
+func (s *BAESys128) setKeyV2(key []byte) error {
+    if s.keyState != KEY_STATE_NONE {
+        err := s.resetV2()
+        if err != nil {
+            s.key = nil
+            s.aes = nil
+            return err
+        }
+    }
+    profile := s.Profile()
+    kcv, err := s.transact(OP_SET_KEY, profile.ToWire(key))
+    if err == nil && len(kcv) != BLOCK_SIZE {
+        err = deviceError(ErrShortRead, "key check value is %d bytes instead of %d", len(kcv), BLOCK_SIZE)
+    }
+    if err != nil {
+        s.key = nil
+        s.aes = nil
+        s.keyState = KEY_STATE_UNKNOWN
+        return fmt.Errorf("failed to set key on Basys3: %w", err)
+    }
+    check, _ := NewAES(key)
+    expected := check.Encrypt(make([]byte, BLOCK_SIZE))
+    kcv = profile.FromWire(kcv)
+    if string(kcv) != string(expected) {
+        s.key = nil
+        s.aes = nil
+        s.keyState = KEY_STATE_UNKNOWN
+        return deviceError(ErrKeyRejected, "Basys3 key check value %s does not match expected %s", hex.EncodeToString(kcv), hex.EncodeToString(expected))
+    }
+    s.keyState = KEY_STATE_SET
+    s.log(COMPONENT_KEY).Info("Basys3 loaded key", kcvAttr(key))
+    return nil
+}
+
+func (s *BAESys128) encryptBlockV2(block []byte) (actual []byte, expected []byte, err error) {
+    // keep the go AES (and its trojan counter) in step with the device
+    expected = s.aes.Encrypt(block)
+    profile := s.Profile()
+    res, err := s.transact(OP_ENCRYPT, profile.ToWire(block))
+    if err != nil {
+        return nil, nil, err
+    }
+    if len(res) != BLOCK_SIZE {
+        return nil, nil, fmt.Errorf("ENCRYPT response is %d bytes instead of %d", len(res), BLOCK_SIZE)
+    }
+    return profile.FromWire(res), expected, nil
+}
+
+func (s *BAESys128) decryptBlockV2(block []byte) ([]byte, error) {
+    profile := s.Profile()
+    res, err := s.transact(OP_DECRYPT, profile.ToWire(block))
+    if err != nil {
+        return nil, err
+    }
+    if len(res) != BLOCK_SIZE {
+        return nil, fmt.Errorf("DECRYPT response is %d bytes instead of %d", len(res), BLOCK_SIZE)
+    }
+    return profile.FromWire(res), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+    payload := []byte("0123456789abcdef")
+    frame := encodeFrame(OP_ENCRYPT, payload)
+    op, decoded, err := decodeFrame(frame)
+    if err != nil {
+        t.Fatalf("decodeFrame failed: %v", err)
+    }
+    if op != OP_ENCRYPT || !bytes.Equal(decoded, payload) {
+        t.Errorf("decodeFrame returned op %d payload %v", op, decoded)
+    }
+    frame[5] ^= 0x01
+    _, _, err = decodeFrame(frame)
+    if err == nil {
+        t.Errorf("decodeFrame accepted a corrupted frame")
+    }
+}
+
+func TestNegotiateV2(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    err := baes.Negotiate()
+    if err != nil {
+        t.Fatalf("Negotiate failed: %v", err)
+    }
+    if baes.Protocol() != PROTOCOL_V2 {
+        t.Fatalf("expected protocol %s, got %s", PROTOCOL_V2, baes.Protocol())
+    }
+    if baes.KeyState() != KEY_STATE_NONE {
+        t.Errorf("expected key state %s, got %s", KEY_STATE_NONE, baes.KeyState())
+    }
+}
+
+func TestNegotiateRawFallback(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    err := baes.Negotiate()
+    if err != nil {
+        t.Fatalf("Negotiate failed: %v", err)
+    }
+    if baes.Protocol() != PROTOCOL_RAW {
+        t.Fatalf("expected protocol %s, got %s", PROTOCOL_RAW, baes.Protocol())
+    }
+    // the probe was loaded as the key
+    if !baes.KeyLocked() {
+        t.Errorf("expected key to be locked after probing a raw device")
+    }
+    board.PressReset()
+    baes.ResetKey()
+    err = baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Errorf("SetKey after reset failed: %v", err)
+    }
+}
+
+func TestV2Rekey(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    baes := new(BAESys128)
+    baes.SetPort(board.Port())
+    baes.Negotiate()
+
+    keys := []string{"0123456789abcdef", "fedcba9876543210"}
+    for _, key := range keys {
+        err := baes.SetKey([]byte(key))
+        if err != nil {
+            t.Fatalf("SetKey(%s) failed: %v", key, err)
+        }
+        msg := []byte("a message that is longer than one block")
+        ct, err := baes.Encrypt(msg)
+        if err != nil {
+            t.Fatalf("Encrypt failed: %v", err)
+        }
+        expected, _ := NewAES([]byte(key))
+        if !bytes.Equal(ct, expected.EncryptECB(pkcs7Pad(append([]byte{}, msg...)))) {
+            t.Errorf("Basys3 did not encrypt with key %s", key)
+        }
+        pt, err := baes.Decrypt(ct)
+        if err != nil {
+            t.Fatalf("Decrypt failed: %v", err)
+        }
+        if !bytes.Equal(pt, msg) {
+            t.Errorf("Decrypt on device returned %q", pt)
+        }
+    }
+    status, err := baes.Status()
+    if err != nil {
+        t.Fatalf("Status failed: %v", err)
+    }
+    if !status.HasKey || status.Version != FRAME_VERSION {
+        t.Errorf("unexpected status %+v", status)
+    }
+}
+
+// corruptPort flips a bit in the byte at corruptAt in the stream it reads
+type corruptPort struct {
+    serial.Port
+    corruptAt int
+    read int
+}
+
+func (c *corruptPort) Read(p []byte) (int, error) {
+    n, err := c.Port.Read(p)
+    for i := 0; i < n; i++ {
+        if c.read + i == c.corruptAt {
+            p[i] ^= 0x01
+        }
+    }
+    c.read += n
+    return n, err
+}
+
+// a response with a bad header is thrown away whole, so the next one is
+// read from its start
+func TestReadFrameResyncs(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_V2)
+    var port serial.Port = &corruptPort{Port: board, corruptAt: 0}
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_V2)
+    baes.SetPort(&port)
+    baes.Negotiate()
+    if _, err := baes.Status(); err == nil {
+        t.Fatal("expected the corrupted STATUS response to fail")
+    }
+    if _, err := baes.Status(); err != nil {
+        t.Errorf("STATUS after a bad frame failed: %v", err)
+    }
+}
+
+// v2 payloads are in the byte order of the profile like raw blocks are
+func TestV2ProfileByteOrder(t *testing.T) {
+    natural := REFERENCE_PROFILE
+    natural.Name = "natural"
+    natural.ByteOrder = BYTE_ORDER_BIG_ENDIAN
+    natural.WordOrder = WORD_ORDER_NORMAL
+    board := NewBasys3Model(PROTOCOL_V2)
+    board.SetProfile(natural)
+    baes := new(BAESys128)
+    baes.SetProfile(natural)
+    baes.SetProtocol(PROTOCOL_V2)
+    baes.SetPort(board.Port())
+    baes.Negotiate()
+    if err := baes.SetKey([]byte("0123456789abcdef")); err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    msg := []byte("natural order")
+    ct, err := baes.Encrypt(msg)
+    if err != nil {
+        t.Fatalf("Encrypt failed: %v", err)
+    }
+    if pt, err := baes.Decrypt(ct); err != nil || !bytes.Equal(pt, msg) {
+        t.Errorf("expected %q back, got %q %v", msg, pt, err)
+    }
+}
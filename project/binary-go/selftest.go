@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// DeviceHealth is the outcome of a self test
+type DeviceHealth int
+
+const (
+    HEALTH_UNTESTED DeviceHealth = iota
+    HEALTH_HEALTHY
+    // the Basys3 loads the 128 bit register the other way around
+    HEALTH_WRONG_BYTE_ORDER
+    // the Basys3 decrypts instead of encrypting
+    HEALTH_WRONG_MODE
+    // the Basys3 answered with something that is not AES at all
+    HEALTH_WRONG_OUTPUT
+    HEALTH_UNRESPONSIVE
+)
+
+func (h DeviceHealth) String() string {
+    switch h {
+    case HEALTH_UNTESTED:
+        return "untested"
+    case HEALTH_HEALTHY:
+        return "healthy"
+    case HEALTH_WRONG_BYTE_ORDER:
+        return "wrong byte order"
+    case HEALTH_WRONG_MODE:
+        return "wrong mode"
+    case HEALTH_WRONG_OUTPUT:
+        return "wrong output"
+    case HEALTH_UNRESPONSIVE:
+        return "unresponsive"
+    }
+    return fmt.Sprintf("DeviceHealth(%d)", int(h))
+}
+
+type KnownAnswer struct {
+    Name string
+    Plaintext []byte
+    Ciphertext []byte
+}
+
+func mustHex(s string) []byte {
+    b, err := hex.DecodeString(s)
+    if err != nil {
+        panic(err)
+    }
+    return b
+}
+
+// SELF_TEST_KEY is the key from FIPS-197 Appendix B. A raw Basys3 can only
+// be given one key per reset so every known answer uses it
+var SELF_TEST_KEY = mustHex("2b7e151628aed2a6abf7158809cf4f3c")
+
+// KNOWN_ANSWERS are FIPS-197 Appendix B and the SP 800-38A F.1.1 ECB
+// blocks, all under SELF_TEST_KEY. None of them set off the trojan
+var KNOWN_ANSWERS = []KnownAnswer{
+    {"FIPS-197 B", mustHex("3243f6a8885a308d313198a2e0370734"), mustHex("3925841d02dc09fbdc118597196a0b32")},
+    {"SP 800-38A F.1.1 #1", mustHex("6bc1bee22e409f96e93d7e117393172a"), mustHex("3ad77bb40d7a3660a89ecaf32466ef97")},
+    {"SP 800-38A F.1.1 #2", mustHex("ae2d8a571e03ac9c9eb76fac45af8e51"), mustHex("f5d3d58503b9699de785895a96fdbaaf")},
+    {"SP 800-38A F.1.1 #3", mustHex("30c81c46a35ce411e5fbc1191a0a52ef"), mustHex("43b1cd7f598ece23881b00e3ed030688")},
+    {"SP 800-38A F.1.1 #4", mustHex("f69f2445df4f9b17ad2b417be66c3710"), mustHex("7b0c785e27e8ad3f8223207104725dd4")},
+}
+
+type VectorResult struct {
+    Name string
+    Health DeviceHealth
+    Expected []byte
+    Actual []byte
+    RoundTrip time.Duration
+}
+
+type SelfTestResult struct {
+    Health DeviceHealth
+    Vectors []VectorResult
+    // average round trip of the vectors that got an answer
+    RoundTrip time.Duration
+    Time time.Time
+}
+
+// classify works out what a Basys3 that answered actual for pt under key
+// is doing wrong, if anything
+func classify(key []byte, pt []byte, actual []byte) DeviceHealth {
+    ref, _ := NewAES(key)
+    if string(actual) == string(ref.Encrypt(pt)) {
+        return HEALTH_HEALTHY
+    }
+    swapped, _ := NewAES(reverse(key))
+    if string(actual) == string(reverse(swapped.Encrypt(reverse(pt)))) {
+        return HEALTH_WRONG_BYTE_ORDER
+    }
+    if string(actual) == string(ref.Decrypt(pt)) {
+        return HEALTH_WRONG_MODE
+    }
+    return HEALTH_WRONG_OUTPUT
+}
+
+func (s *BAESys128) Health() *SelfTestResult {
+    return s.health
+}
+
+// SelfTest loads SELF_TEST_KEY and checks the Basys3 against KNOWN_ANSWERS.
+// An error means the test could not be run, a broken Basys3 is reported in
+// the result. A v2 device is reset afterwards. A raw device keeps the test
+// key until the center button is pressed
+func (s *BAESys128) SelfTest() (SelfTestResult, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    result := SelfTestResult{Time: time.Now()}
+    if s.port == nil {
+        return result, ErrNoDevice
+    }
+    if s.keyLocked() {
+        return result, fmt.Errorf("Basys3 already has a key. Click Change Key and press the center button (btnC) before running the self test")
+    }
+    profile := s.Profile()
+    if s.protocol != PROTOCOL_V2 && profile.KeyLoading == KEY_LOADING_FIXED {
+        return result, fmt.Errorf("profile %s has the key fixed in the bitstream so the self test key can not be loaded", profile.Name)
+    }
+    port := *s.port
+    err := port.SetReadTimeout(profile.ReadTimeout())
+    if err != nil {
+        return result, fmt.Errorf("failed to set read timeout: %v", err)
+    }
+    if s.protocol != PROTOCOL_V2 {
+        defer port.SetReadTimeout(serial.NoTimeout)
+    }
+    s.log(COMPONENT_SELFTEST).Info("Running Basys3 self test")
+
+    // whatever key the Basys3 had is about to be replaced
+    s.key = nil
+    s.aes = nil
+    if s.protocol == PROTOCOL_V2 && s.keyState != KEY_STATE_NONE {
+        err = s.resetV2()
+        if err != nil {
+            return result, err
+        }
+    }
+    s.keyState = KEY_STATE_UNKNOWN
+
+    key := SELF_TEST_KEY
+    start := time.Now()
+    var keyCheck VectorResult
+    if s.protocol == PROTOCOL_V2 {
+        keyCheck = s.runVector(port, "key check value", key, make([]byte, BLOCK_SIZE), func() ([]byte, error) {
+            kcv, err := s.transact(OP_SET_KEY, profile.ToWire(key))
+            return profile.FromWire(kcv), err
+        })
+    } else if profile.Echo == ECHO_ENCRYPTED {
+        // the key echo is the key encrypted with itself
+        keyCheck = s.runVector(port, "key echo", key, key, func() ([]byte, error) {
+            _, err := s.writeBlock(port, key)
+            if err != nil {
+                return nil, err
+            }
+            return s.readBlock(port)
+        })
+    } else {
+        keyCheck = VectorResult{Name: "key echo", Health: HEALTH_HEALTHY}
+        _, err = s.writeBlock(port, key)
+        if err == nil && profile.Echo == ECHO_PLAIN {
+            keyCheck.Expected = key
+            keyCheck.Actual, err = s.readBlock(port)
+            if err == nil && string(keyCheck.Actual) != string(key) {
+                keyCheck.Health = HEALTH_WRONG_OUTPUT
+            }
+        }
+        if err != nil {
+            s.log(COMPONENT_SELFTEST).Error("No answer from Basys3", "vector", "key echo", errAttr(err))
+            keyCheck.Health = HEALTH_UNRESPONSIVE
+        }
+    }
+    keyCheck.RoundTrip = time.Since(start)
+    if s.protocol == PROTOCOL_V2 || profile.Echo != ECHO_NONE {
+        result.Vectors = append(result.Vectors, keyCheck)
+    }
+
+    if keyCheck.Health != HEALTH_UNRESPONSIVE {
+        for _, vector := range KNOWN_ANSWERS {
+            pt := vector.Plaintext
+            res := s.runVector(port, vector.Name, key, pt, func() ([]byte, error) {
+                _, err := s.writeBlock(port, pt)
+                if err != nil {
+                    return nil, err
+                }
+                return s.readBlock(port)
+            })
+            result.Vectors = append(result.Vectors, res)
+            if res.Health == HEALTH_UNRESPONSIVE {
+                break
+            }
+        }
+    }
+
+    result.Health = HEALTH_HEALTHY
+    var total time.Duration
+    answered := 0
+    for _, vector := range result.Vectors {
+        if vector.Health != HEALTH_UNRESPONSIVE {
+            total += vector.RoundTrip
+            answered++
+        }
+        if result.Health == HEALTH_HEALTHY && vector.Health != HEALTH_HEALTHY {
+            result.Health = vector.Health
+        }
+    }
+    if answered > 0 {
+        result.RoundTrip = total / time.Duration(answered)
+    }
+
+    if s.protocol == PROTOCOL_V2 && result.Health != HEALTH_UNRESPONSIVE {
+        err = s.resetV2()
+        if err == nil {
+            s.keyState = KEY_STATE_NONE
+        }
+    } else if result.Health == HEALTH_HEALTHY {
+        // the Basys3 is left holding the test key
+        s.key = key
+        s.aes, _ = profile.NewAES(key)
+        s.keyState = KEY_STATE_SET
+    }
+    s.health = &result
+    s.log(COMPONENT_SELFTEST).Info("Basys3 self test done", "health", result.Health, "round_trip", result.RoundTrip)
+    return result, nil
+}
+
+func (s *BAESys128) runVector(port serial.Port, name string, key []byte, pt []byte, do func() ([]byte, error)) VectorResult {
+    ref, _ := NewAES(key)
+    res := VectorResult{Name: name, Expected: ref.Encrypt(pt)}
+    start := time.Now()
+    actual, err := do()
+    res.RoundTrip = time.Since(start)
+    if err != nil {
+        s.log(COMPONENT_SELFTEST).Error("No answer from Basys3", "vector", name, errAttr(err))
+        res.Health = HEALTH_UNRESPONSIVE
+        return res
+    }
+    res.Actual = actual
+    res.Health = classify(key, pt, actual)
+    if res.Health != HEALTH_HEALTHY {
+        s.log(COMPONENT_SELFTEST).Error("Self test vector failed", "vector", name, "expected", hex.EncodeToString(res.Expected), "actual", hex.EncodeToString(actual), "health", res.Health)
+    }
+    return res
+}
+
+func device_form_group(has_device bool, protocol Protocol, profile string, health *SelfTestResult, device_err *string) string {
+    if !has_device {
+        return ""
+    }
+    status := "Not tested"
+    color := "text-slate-500"
+    note := ""
+    if protocol != PROTOCOL_V2 {
+        note = `<p class="text-sm text-slate-500">Loads the self test key. Click Change Key and press the center button (btnC) after it to set your own key</p>`
+    }
+    if health != nil {
+        status = fmt.Sprintf("%s, average round trip %s", health.Health, health.RoundTrip.Round(time.Millisecond))
+        color = "text-green-900"
+        if health.Health != HEALTH_HEALTHY {
+            color = "text-[#FF0000]"
+        }
+    }
+    return fmt.Sprintf(`
+            <div id="device-part" class="flex flex-row gap-2 py-2">
+                <p>Basys3 (<code>%s</code>, <code>%s</code>)</p>
+                <p class="%s">%s</p>
+                <button hx-post="/selftest" hx-target="#form" class="border-2 bg-slate-100">
+                    Self Test
+                </button>
+            </div>
+            %s
+            %s
+        `, protocol, profile, color, status, note, error_p("device-error", device_err, false))
+}
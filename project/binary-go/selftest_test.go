@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+func TestKnownAnswers(t *testing.T) {
+    for _, vector := range KNOWN_ANSWERS {
+        aes, _ := NewAES(SELF_TEST_KEY)
+        if ct := aes.Encrypt(vector.Plaintext); !bytes.Equal(ct, vector.Ciphertext) {
+            t.Errorf("%s: expected %x, got %x", vector.Name, vector.Ciphertext, ct)
+        }
+    }
+}
+
+// swappedPort reverses every block in both directions, like a Basys3 that
+// loads its 128 bit register the other way around
+type swappedPort struct {
+    serial.Port
+}
+
+func (s *swappedPort) Write(p []byte) (int, error) {
+    out := make([]byte, 0, len(p))
+    for i := 0; i + BLOCK_SIZE <= len(p); i += BLOCK_SIZE {
+        out = append(out, reverse(p[i:i + BLOCK_SIZE])...)
+    }
+    return s.Port.Write(out)
+}
+
+func (s *swappedPort) Read(p []byte) (int, error) {
+    if len(p) < BLOCK_SIZE {
+        return s.Port.Read(p)
+    }
+    block := make([]byte, BLOCK_SIZE)
+    err := readFull(s.Port, block)
+    if err != nil {
+        return 0, nil
+    }
+    return copy(p, reverse(block)), nil
+}
+
+// deafPort never delivers anything to the Basys3
+type deafPort struct {
+    serial.Port
+}
+
+func (d *deafPort) Write(p []byte) (int, error) {
+    return len(p), nil
+}
+
+func runSelfTest(t *testing.T, port serial.Port, protocol Protocol) (*BAESys128, SelfTestResult) {
+    baes := new(BAESys128)
+    baes.SetProtocol(protocol)
+    baes.SetPort(&port)
+    baes.Negotiate()
+    res, err := baes.SelfTest()
+    if err != nil {
+        t.Fatalf("%s: SelfTest failed: %v", protocol, err)
+    }
+    return baes, res
+}
+
+func TestSelfTestHealthy(t *testing.T) {
+    baes, res := runSelfTest(t, NewBasys3Model(PROTOCOL_RAW), PROTOCOL_RAW)
+    if res.Health != HEALTH_HEALTHY || len(res.Vectors) != len(KNOWN_ANSWERS) + 1 {
+        t.Errorf("raw: expected %s with every vector, got %s with %d", HEALTH_HEALTHY, res.Health, len(res.Vectors))
+    }
+    // the raw Basys3 keeps the test key
+    if baes.KeyState() != KEY_STATE_SET || !baes.HasKey(SELF_TEST_KEY) {
+        t.Errorf("raw: expected the test key to be set, got %s", baes.KeyState())
+    }
+    if baes.Health() == nil || baes.Health().Health != HEALTH_HEALTHY {
+        t.Errorf("raw: self test result was not kept")
+    }
+
+    baes, res = runSelfTest(t, NewBasys3Model(PROTOCOL_V2), PROTOCOL_V2)
+    if res.Health != HEALTH_HEALTHY {
+        t.Errorf("v2: expected %s, got %s", HEALTH_HEALTHY, res.Health)
+    }
+    if baes.KeyState() != KEY_STATE_NONE {
+        t.Errorf("v2: expected the Basys3 to be reset, got %s", baes.KeyState())
+    }
+}
+
+func TestSelfTestFaults(t *testing.T) {
+    decrypting := NewBasys3Model(PROTOCOL_RAW)
+    decrypting.SetDecrypt(true)
+    tests := []struct {
+        name string
+        port serial.Port
+        health DeviceHealth
+    }{
+        {"swapped", &swappedPort{NewBasys3Model(PROTOCOL_RAW)}, HEALTH_WRONG_BYTE_ORDER},
+        {"decrypting", decrypting, HEALTH_WRONG_MODE},
+        {"corrupt", &flipPort{Port: NewBasys3Model(PROTOCOL_RAW), flipAt: 3*BLOCK_SIZE}, HEALTH_WRONG_OUTPUT},
+        {"deaf", &deafPort{NewBasys3Model(PROTOCOL_RAW)}, HEALTH_UNRESPONSIVE},
+    }
+    for _, test := range tests {
+        baes, res := runSelfTest(t, test.port, PROTOCOL_RAW)
+        if res.Health != test.health {
+            t.Errorf("%s: expected %s, got %s", test.name, test.health, res.Health)
+        }
+        if baes.KeyState() == KEY_STATE_SET {
+            t.Errorf("%s: a failed self test should not leave the key set", test.name)
+        }
+    }
+}
+
+func TestSelfTestRefusesLockedKey(t *testing.T) {
+    baes, _ := newModelBaes(t, PROTOCOL_RAW, 1)
+    _, err := baes.SelfTest()
+    if err == nil {
+        t.Errorf("expected SelfTest to refuse a raw Basys3 that already has a key")
+    }
+}
+
+// a raw Basys3 keeps the test key, the page says a btnC press follows
+func TestSelfTestButtonWarnsRaw(t *testing.T) {
+    if html := device_form_group(true, PROTOCOL_RAW, TROJAN_PROFILE.Name, nil, nil); !strings.Contains(html, "btnC") {
+        t.Errorf("raw self test does not mention btnC: %s", html)
+    }
+    if html := device_form_group(true, PROTOCOL_V2, TROJAN_PROFILE.Name, nil, nil); strings.Contains(html, "btnC") {
+        t.Errorf("v2 self test mentions btnC: %s", html)
+    }
+}
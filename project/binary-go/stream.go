@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// STREAM_CHUNK is how much of a file is read at a time. Only this much (and
+// the ciphertext for it) is ever held in memory
+const STREAM_CHUNK = 64 * 1024
+
+type StreamResult struct {
+    // bytes read from the source and written to the destination
+    In int64
+    Out int64
+    // blocks the Basys3 got wrong, as in EncryptResult
+    Mismatches int
+}
+
+// streamBlocks feeds src through do a block at a time and writes the
+// result to dst. The last 1 to BLOCK_SIZE bytes are held back and given to
+// last, which does the padding. progress, if not nil, is called with the
+// bytes read so far after every chunk
+func streamBlocks(dst io.Writer, src io.Reader, progress func(int64), do func([]byte) ([]byte, error), last func([]byte) ([]byte, error)) (StreamResult, error) {
+    var res StreamResult
+    buf := make([]byte, STREAM_CHUNK)
+    pending := make([]byte, 0, STREAM_CHUNK + BLOCK_SIZE)
+    out := make([]byte, 0, STREAM_CHUNK + BLOCK_SIZE)
+    for {
+        n, readErr := src.Read(buf)
+        res.In += int64(n)
+        pending = append(pending, buf[:n]...)
+        keep := len(pending) % BLOCK_SIZE
+        if keep == 0 && len(pending) > 0 {
+            keep = BLOCK_SIZE
+        }
+        out = out[:0]
+        for i := 0; i < len(pending) - keep; i += BLOCK_SIZE {
+            block, err := do(pending[i:i + BLOCK_SIZE])
+            if err != nil {
+                return res, err
+            }
+            out = append(out, block...)
+        }
+        pending = append(pending[:0], pending[len(pending) - keep:]...)
+        if len(out) > 0 {
+            written, err := dst.Write(out)
+            res.Out += int64(written)
+            if err != nil {
+                return res, err
+            }
+        }
+        if progress != nil && n > 0 {
+            progress(res.In)
+        }
+        if readErr == io.EOF {
+            break
+        }
+        if readErr != nil {
+            return res, readErr
+        }
+    }
+    tail, err := last(pending)
+    if err != nil {
+        return res, err
+    }
+    written, err := dst.Write(tail)
+    res.Out += int64(written)
+    return res, err
+}
+
+// EncryptStream encrypts src into dst on the Basys3, or in software, without
+// holding more than STREAM_CHUNK of it in memory. Blocks are verified like
+// EncryptVerified but a mismatch does not stop the stream, it is counted
+func (s *BAESys128) EncryptStream(dst io.Writer, src io.Reader, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+    return s.encryptStream(dst, src, nil, padding, progress)
+}
+
+// EncryptCBCStream is EncryptStream in CBC mode. The IV is not written
+func (s *BAESys128) EncryptCBCStream(dst io.Writer, src io.Reader, iv []byte, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+    if len(iv) != BLOCK_SIZE {
+        return StreamResult{}, fmt.Errorf("IV is %d bytes but it must be %d bytes", len(iv), BLOCK_SIZE)
+    }
+    return s.encryptStream(dst, src, iv, padding, progress)
+}
+
+// streamKey is the go AES a stream starts with. Streams take the device
+// lock a block at a time so an upload does not hold up everything else, and
+// check the key is still this one for every block
+func (s *BAESys128) streamKey() (*AES, error) {
+    s.deviceMtx.Lock()
+    defer s.deviceMtx.Unlock()
+    if s.aes == nil {
+        return nil, fmt.Errorf("no key set")
+    }
+    return s.aes, nil
+}
+
+// lockStreamBlock takes the device lock for one block of a stream started
+// with aes. The lock is only held when the error is nil
+func (s *BAESys128) lockStreamBlock(aes *AES) error {
+    s.deviceMtx.Lock()
+    if s.aes != aes {
+        s.deviceMtx.Unlock()
+        return fmt.Errorf("key changed while streaming")
+    }
+    return nil
+}
+
+// encryptStream is ECB when iv is nil and CBC otherwise
+func (s *BAESys128) encryptStream(dst io.Writer, src io.Reader, iv []byte, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+    aes, err := s.streamKey()
+    if err != nil {
+        return StreamResult{}, err
+    }
+    mismatches := 0
+    index := 0
+    prev := iv
+    encrypt := func(block []byte) ([]byte, error) {
+        err := s.lockStreamBlock(aes)
+        if err != nil {
+            return nil, err
+        }
+        defer s.deviceMtx.Unlock()
+        if prev != nil {
+            block = xorBlocks(block, prev)
+        }
+        actual, expected, err := s.encryptBlock(block)
+        if err != nil {
+            return nil, err
+        }
+        if s.verifyBlock(index, block, expected, actual).Status == VERIFY_MISMATCH {
+            mismatches++
+        }
+        index++
+        if prev != nil {
+            prev = actual
+        }
+        return actual, nil
+    }
+    res, err := streamBlocks(dst, src, progress, encrypt, func(tail []byte) ([]byte, error) {
+        padded, err := padding.Pad(tail)
+        if err != nil {
+            return nil, err
+        }
+        out := []byte{}
+        for i := 0; i < len(padded); i += BLOCK_SIZE {
+            block, err := encrypt(padded[i:i + BLOCK_SIZE])
+            if err != nil {
+                return nil, err
+            }
+            out = append(out, block...)
+        }
+        return out, nil
+    })
+    res.Mismatches = mismatches
+    return res, err
+}
+
+// DecryptStream undoes EncryptStream. Only the last block is unpadded
+func (s *BAESys128) DecryptStream(dst io.Writer, src io.Reader, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+    return s.decryptStream(dst, src, nil, padding, progress)
+}
+
+// DecryptCBCStream undoes EncryptCBCStream
+func (s *BAESys128) DecryptCBCStream(dst io.Writer, src io.Reader, iv []byte, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+    if len(iv) != BLOCK_SIZE {
+        return StreamResult{}, fmt.Errorf("IV is %d bytes but it must be %d bytes", len(iv), BLOCK_SIZE)
+    }
+    return s.decryptStream(dst, src, iv, padding, progress)
+}
+
+func (s *BAESys128) decryptStream(dst io.Writer, src io.Reader, iv []byte, padding PaddingScheme, progress func(int64)) (StreamResult, error) {
+    aes, err := s.streamKey()
+    if err != nil {
+        return StreamResult{}, err
+    }
+    prev := iv
+    decrypt := func(block []byte) ([]byte, error) {
+        err := s.lockStreamBlock(aes)
+        if err != nil {
+            return nil, err
+        }
+        pt, err := s.decryptBlock(block)
+        s.deviceMtx.Unlock()
+        if err != nil || prev == nil {
+            return pt, err
+        }
+        pt = xorBlocks(pt, prev)
+        prev = append(prev[:0:0], block...)
+        return pt, nil
+    }
+    return streamBlocks(dst, src, progress, decrypt, func(tail []byte) ([]byte, error) {
+        if len(tail) != BLOCK_SIZE {
+            return nil, fmt.Errorf("ciphertext is not a whole number of blocks, it ends with %d bytes", len(tail))
+        }
+        block, err := decrypt(tail)
+        if err != nil {
+            return nil, err
+        }
+        return padding.Unpad(block)
+    })
+}
+
+// FileRequest is a multipart upload. The file is not read until it is
+// streamed, so every other field has to come before it
+type FileRequest struct {
+    Key []byte
+    Padding *PaddingScheme
+    Name string
+    // from the size field when the page sends it, 0 when unknown
+    Size int64
+    File io.Reader
+}
+
+func parseFileRequest(r *http.Request) (FileRequest, FieldErrors) {
+    errs := FieldErrors{}
+    req := FileRequest{}
+    reader, err := r.MultipartReader()
+    if err != nil {
+        errs.Add("file", fmt.Sprintf("Upload must be multipart/form-data: %s", err))
+        return req, errs
+    }
+    fields := map[string][]string{}
+    for {
+        part, err := reader.NextPart()
+        if err != nil {
+            errs.Add("file", "File is required and must be the last field")
+            return req, errs
+        }
+        if part.FormName() == "file" {
+            req.Name = part.FileName()
+            req.File = part
+            break
+        }
+        value, err := io.ReadAll(io.LimitReader(part, 4096))
+        if err != nil {
+            errs.Add(part.FormName(), err.Error())
+            return req, errs
+        }
+        fields[part.FormName()] = append(fields[part.FormName()], string(value))
+    }
+    // the form is read by hand so the parsers can not read it themselves
+    r.Form = fields
+    req.Key = parseKey(r, errs)
+    req.Padding = parsePadding(r, errs)
+    fmt.Sscan(r.FormValue("size"), &req.Size)
+    return req, errs
+}
+
+// downloadWriter only sends the download headers once there is something to
+// download, so an error before then can still be a normal error response
+type downloadWriter struct {
+    w http.ResponseWriter
+    name string
+    started bool
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+    if !d.started {
+        d.started = true
+        d.w.Header().Set("Content-Type", "application/octet-stream")
+        d.w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": d.name}))
+    }
+    return d.w.Write(p)
+}
+
+// progress_logger logs how far a stream is at most twice a second
+func progress_logger(what string, name string, total int64) func(int64) {
+    last := time.Now()
+    return func(done int64) {
+        if time.Since(last) < 500*time.Millisecond && (total == 0 || done < total) {
+            return
+        }
+        last = time.Now()
+        if total > 0 {
+            componentLog(COMPONENT_FILE).Info(what, "file", name, ATTR_BYTES, done, "total", total, "percent", done*100/total)
+        } else {
+            componentLog(COMPONENT_FILE).Info(what, "file", name, ATTR_BYTES, done)
+        }
+    }
+}
+
+// handle_file streams an upload through stream and sends the result back
+// as a download named after the upload
+func handle_file(baes *BAESys128, decrypt bool) Handler {
+    return func(w http.ResponseWriter, r *http.Request) {
+        what, suffix := "Encrypting", ".enc"
+        if decrypt {
+            what, suffix = "Decrypting", ".dec"
+        }
+        req, errs := parseFileRequest(r)
+        if len(errs) != 0 {
+            baes.log(COMPONENT_FILE).Warn("Invalid file request", errAttr(errs))
+            http.Error(w, errs.Error(), http.StatusBadRequest)
+            return
+        }
+        var stream func(io.Writer, io.Reader, PaddingScheme, func(int64)) (StreamResult, error)
+        var err error
+        if decrypt {
+            // like the decrypt form, the key on the Basys3 is left alone
+            var decrypter *BAESys128
+            decrypter, err = baes.Decrypter(req.Key)
+            if decrypter != nil {
+                stream = decrypter.DecryptStream
+            }
+        } else {
+            err = baes.SetKey(req.Key)
+            stream = baes.EncryptStream
+        }
+        if err != nil {
+            err_msg := error_message(err)
+            baes.log(COMPONENT_KEY).Error("Error while trying to set key", errAttr(err_msg))
+            http.Error(w, err_msg, http.StatusConflict)
+            return
+        }
+        padding := baes.Padding()
+        if req.Padding != nil {
+            padding = *req.Padding
+        }
+        name := req.Name
+        if name == "" {
+            name = "upload"
+        }
+        if decrypt && strings.HasSuffix(name, ".enc") {
+            name, suffix = strings.TrimSuffix(name, ".enc"), ""
+        }
+        baes.log(COMPONENT_FILE).Info(what, "file", name, "padding", padding.Name, "total", req.Size)
+        out := &downloadWriter{w: w, name: name + suffix}
+        start := time.Now()
+        res, err := stream(out, req.File, padding, progress_logger(what, name, req.Size))
+        if err != nil {
+            err_msg := error_message(err)
+            baes.log(COMPONENT_FILE).Error("Error while " + strings.ToLower(what), "file", name, ATTR_BYTES, res.In, errAttr(err_msg))
+            if !out.started {
+                http.Error(w, err_msg, http.StatusBadRequest)
+                return
+            }
+            // the download has started so the only way to say it is
+            // broken is to cut it off
+            panic(http.ErrAbortHandler)
+        }
+        baes.log(COMPONENT_FILE).Info(what + " done", "file", name, ATTR_BYTES, res.In, "out", res.Out, "took", time.Since(start).Round(time.Millisecond))
+        if res.Mismatches > 0 {
+            baes.log(COMPONENT_FILE).Warn("Blocks did not match the go AES", "file", name, "blocks", res.Mismatches)
+        }
+    }
+}
+
+// file_form_group is outside the main form since a download can not be
+// swapped in by htmx. It takes the key and padding from the main form when
+// submitted, and its response goes to a hidden frame so errors only show up
+// in the log
+func file_form_group() string {
+    return `
+            <form id="file-form" method="post" enctype="multipart/form-data" target="file-download" class="flex flex-col gap-2 py-2"
+                onsubmit="const form = document.getElementById('form').elements; for (const f of ['key', 'key-encoding', 'padding']) { this.elements[f].value = form[f] ? form[f].value : '' }; this.elements['size'].value = this.elements['file'].files[0] ? this.elements['file'].files[0].size : ''">
+                <p>File</p>
+                <p class="text-sm text-slate-500">Uses the key and padding above. Progress shows up in the log</p>
+                <input type="hidden" name="key"></input>
+                <input type="hidden" name="key-encoding"></input>
+                <input type="hidden" name="padding"></input>
+                <input type="hidden" name="size"></input>
+                <input type="file" name="file" required></input>
+                <div class="flex flex-row justify-start gap-2">
+                    <button formaction="/file/encrypt" class="border-2 bg-slate-100">
+                        Encrypt File
+                    </button>
+                    <button formaction="/file/decrypt" class="border-2 bg-slate-100">
+                        Decrypt File
+                    </button>
+                </div>
+                <iframe name="file-download" class="hidden"></iframe>
+            </form>
+        `
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func newStreamBaes(t *testing.T) *BAESys128 {
+    baes := new(BAESys128)
+    baes.SetProfile(REFERENCE_PROFILE)
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return baes
+}
+
+func TestStreamMatchesEncrypt(t *testing.T) {
+    baes := newStreamBaes(t)
+    for _, padding := range PADDINGS {
+        for _, size := range []int{0, 1, 15, 16, 17, 100, STREAM_CHUNK + 5} {
+            msg := make([]byte, size)
+            rand.Read(msg)
+            expected, err := baes.EncryptWithPadding(msg, padding)
+            var ct bytes.Buffer
+            // odd sized reads so blocks straddle them
+            _, streamErr := baes.EncryptStream(&ct, iotest.HalfReader(bytes.NewReader(msg)), padding, nil)
+            if (err != nil) != (streamErr != nil) {
+                t.Errorf("%s %d: expected error %v, got %v", padding.Name, size, err, streamErr)
+                continue
+            }
+            if err != nil {
+                continue
+            }
+            if !bytes.Equal(ct.Bytes(), expected.Ciphertext) {
+                t.Errorf("%s %d: stream does not match EncryptWithPadding", padding.Name, size)
+            }
+            var pt bytes.Buffer
+            _, err = baes.DecryptStream(&pt, iotest.OneByteReader(&ct), padding, nil)
+            expectedPt, _ := baes.DecryptWithPadding(expected.Ciphertext, padding)
+            if err != nil || !bytes.Equal(pt.Bytes(), expectedPt) {
+                t.Errorf("%s %d: expected %x back, got %x %v", padding.Name, size, expectedPt, pt.Bytes(), err)
+            }
+        }
+    }
+}
+
+// a few megabytes through encrypt and decrypt, piped so neither side ever
+// has the whole thing
+func TestStreamLargeFile(t *testing.T) {
+    baes := newStreamBaes(t)
+    const size = 2 << 20
+    src := io.LimitReader(rand.New(rand.NewSource(1)), size)
+    srcHash := sha256.New()
+    ctReader, ctWriter := io.Pipe()
+    go func() {
+        _, err := baes.EncryptStream(ctWriter, io.TeeReader(src, srcHash), PADDING_PKCS7, nil)
+        ctWriter.CloseWithError(err)
+    }()
+    dstHash := sha256.New()
+    calls := 0
+    res, err := baes.DecryptStream(dstHash, ctReader, PADDING_PKCS7, func(int64) { calls++ })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if res.Out != size || !bytes.Equal(srcHash.Sum(nil), dstHash.Sum(nil)) {
+        t.Errorf("expected %d bytes back unchanged, got %d", size, res.Out)
+    }
+    if calls < size / STREAM_CHUNK {
+        t.Errorf("expected progress at least every chunk, got %d calls", calls)
+    }
+}
+
+func TestStreamWritesBeforeEOF(t *testing.T) {
+    baes := newStreamBaes(t)
+    broken := io.MultiReader(bytes.NewReader(make([]byte, 3*STREAM_CHUNK)), iotest.ErrReader(errors.New("unplugged")))
+    var ct bytes.Buffer
+    res, err := baes.EncryptStream(&ct, broken, PADDING_PKCS7, nil)
+    if err == nil {
+        t.Fatalf("expected the read error")
+    }
+    if res.Out == 0 || int64(ct.Len()) != res.Out {
+        t.Errorf("expected output before the error, got %d bytes", ct.Len())
+    }
+}
+
+func TestDecryptStreamPartialBlock(t *testing.T) {
+    baes := newStreamBaes(t)
+    var pt bytes.Buffer
+    _, err := baes.DecryptStream(&pt, bytes.NewReader(make([]byte, 20)), PADDING_PKCS7, nil)
+    if err == nil {
+        t.Errorf("expected an error for 20 bytes of ciphertext")
+    }
+}
+
+func fileUpload(t *testing.T, handler Handler, fields [][2]string, file []byte) *httptest.ResponseRecorder {
+    body, writer := io.Pipe()
+    form := multipart.NewWriter(writer)
+    go func() {
+        for _, field := range fields {
+            if field[0] == "file" {
+                part, _ := form.CreateFormFile("file", field[1])
+                part.Write(file)
+                continue
+            }
+            form.WriteField(field[0], field[1])
+        }
+        writer.CloseWithError(form.Close())
+    }()
+    req := httptest.NewRequest("POST", "/file/encrypt", body)
+    req.Header.Set("Content-Type", form.FormDataContentType())
+    w := httptest.NewRecorder()
+    handler(w, req)
+    return w
+}
+
+func TestHandleFile(t *testing.T) {
+    baes := newStreamBaes(t)
+    file := make([]byte, 100000)
+    rand.Read(file)
+    w := fileUpload(t, handle_file(baes, false), [][2]string{{"key", "0123456789abcdef"}, {"padding", "iso7816"}, {"file", "data.bin"}}, file)
+    if w.Code != http.StatusOK {
+        t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+    }
+    if !strings.Contains(w.Header().Get("Content-Disposition"), "data.bin.enc") {
+        t.Errorf("expected data.bin.enc as the download, got %q", w.Header().Get("Content-Disposition"))
+    }
+    expected, _ := baes.EncryptWithPadding(file, PADDING_ISO7816)
+    if !bytes.Equal(w.Body.Bytes(), expected.Ciphertext) {
+        t.Errorf("download does not match EncryptWithPadding")
+    }
+
+    ct := w.Body.Bytes()
+    w = fileUpload(t, handle_file(baes, true), [][2]string{{"key", "0123456789abcdef"}, {"padding", "iso7816"}, {"file", "data.bin.enc"}}, ct)
+    if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), file) {
+        t.Errorf("expected the file back, got %d", w.Code)
+    }
+    if !strings.HasSuffix(w.Header().Get("Content-Disposition"), "filename=data.bin") {
+        t.Errorf("expected data.bin as the download, got %q", w.Header().Get("Content-Disposition"))
+    }
+}
+
+func TestHandleFileErrors(t *testing.T) {
+    baes := newStreamBaes(t)
+    cases := map[string][][2]string{
+        "no file": {{"key", "0123456789abcdef"}},
+        "key after file": {{"file", "a.bin"}, {"key", "0123456789abcdef"}},
+        "bad key": {{"key", "short"}, {"file", "a.bin"}},
+    }
+    for name, fields := range cases {
+        w := fileUpload(t, handle_file(baes, false), fields, []byte("hello"))
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("%s: expected 400, got %d", name, w.Code)
+        }
+        if w.Header().Get("Content-Disposition") != "" {
+            t.Errorf("%s: an error should not be a download", name)
+        }
+    }
+    // not whole blocks, found out before anything is sent
+    w := fileUpload(t, handle_file(baes, true), [][2]string{{"key", "0123456789abcdef"}, {"file", "a.enc"}}, []byte("hello"))
+    if w.Code != http.StatusBadRequest {
+        t.Errorf("expected 400 for a partial block, got %d", w.Code)
+    }
+}
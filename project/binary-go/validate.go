@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// FieldErrors maps a form field to what is wrong with it
+type FieldErrors map[string]string
+
+func (e FieldErrors) Add(field string, msg string) {
+    if _, ok := e[field]; !ok {
+        e[field] = msg
+    }
+}
+
+// Get is the error for field as the form groups want it, nil if the field
+// is fine
+func (e FieldErrors) Get(field string) *string {
+    msg, ok := e[field]
+    if !ok {
+        return nil
+    }
+    return &msg
+}
+
+func (e FieldErrors) Error() string {
+    fields := []string{}
+    for field := range e {
+        fields = append(fields, field)
+    }
+    sort.Strings(fields)
+    msgs := []string{}
+    for _, field := range fields {
+        msgs = append(msgs, fmt.Sprintf("%s: %s", field, e[field]))
+    }
+    return strings.Join(msgs, "; ")
+}
+
+// KDF is nil unless the key was derived from a passphrase
+type KeyRequest struct {
+    Key []byte
+    KDF *KDFParams
+}
+
+// Padding is nil when the request leaves it up to the server
+type EncryptRequest struct {
+    Key []byte
+    KDF *KDFParams
+    Message []byte
+    Padding *PaddingScheme
+    // FORMAT_BARE, FORMAT_CONTAINER or FORMAT_ARMORED
+    Format string
+    Mode CipherMode
+    KeyID string
+}
+
+// Container is set when Ciphertext is one, Padding is then ignored
+type DecryptRequest struct {
+    Key []byte
+    KDF *KDFParams
+    Ciphertext []byte
+    Container *Container
+    Padding *PaddingScheme
+}
+
+func formField(r *http.Request, field string) *string {
+    f := r.FormValue(field)
+    if f == "" {
+        return nil
+    }
+    return &f
+}
+
+// validate_key checks the decoded key. Any bytes will do, there just have
+// to be KEY_SIZE of them
+func validate_key(key []byte) *string {
+    var msg = ""
+    if key == nil {
+        msg = "Key is required"
+    } else if len(key) != KEY_SIZE {
+        msg = fmt.Sprintf("Key is %d bytes long but it must be %d bytes long", len(key), KEY_SIZE)
+    }
+    if msg == "" {
+        return nil
+    }
+    return &msg
+}
+
+// parseKey reads the key in the encoding picked for it, UTF-8 text unless
+// told otherwise
+func parseKey(r *http.Request, errs FieldErrors) []byte {
+    key, _, err := fieldBytes(r, "key", ENCODING_UTF8)
+    if err != nil {
+        errs.Add("key", fmt.Sprintf("Key is %s", err))
+        return nil
+    }
+    if msg := validate_key(key); msg != nil {
+        errs.Add("key", *msg)
+        return nil
+    }
+    return key
+}
+
+// parseKDF is the parameters in the form if they are for the key derivation
+// picked, otherwise new ones with a fresh salt
+func parseKDF(r *http.Request, errs FieldErrors) *KDFParams {
+    algorithm := KDF_ARGON2ID
+    if name := formField(r, "kdf"); name != nil {
+        algorithm = *name
+    }
+    if text := formField(r, "kdf-params"); text != nil {
+        params, err := ParseKDFParams(*text)
+        if err != nil {
+            errs.Add("passphrase", fmt.Sprintf("Parameters are invalid: %s", err))
+            return nil
+        }
+        if params.Algorithm == algorithm {
+            return &params
+        }
+    }
+    params, err := NewKDFParams(algorithm)
+    if err != nil {
+        errs.Add("passphrase", err.Error())
+        return nil
+    }
+    return &params
+}
+
+// parseKeyOrPassphrase derives the key when there is a passphrase, with
+// params if given (from a ciphertext) or those in the form, and otherwise
+// reads it like parseKey
+func parseKeyOrPassphrase(r *http.Request, errs FieldErrors, params *KDFParams) ([]byte, *KDFParams) {
+    passphrase := formField(r, "passphrase")
+    if passphrase == nil {
+        return parseKey(r, errs), nil
+    }
+    if params == nil {
+        params = parseKDF(r, errs)
+        if params == nil {
+            return nil, nil
+        }
+    }
+    key, err := params.DeriveKey([]byte(*passphrase))
+    if err != nil {
+        errs.Add("passphrase", fmt.Sprintf("Could not derive key: %s", err))
+        return nil, nil
+    }
+    return key, params
+}
+
+// splitKDFHeader splits the key derivation parameters encrypting with a
+// passphrase puts on the first line of the ciphertext from the ciphertext
+// itself. The parameters are nil when there is no such line
+func splitKDFHeader(text string) (*KDFParams, string, error) {
+    if !strings.HasPrefix(strings.TrimSpace(text), "$") {
+        return nil, text, nil
+    }
+    header, rest, _ := strings.Cut(strings.TrimSpace(text), "\n")
+    params, err := ParseKDFParams(header)
+    if err != nil {
+        return nil, rest, err
+    }
+    return &params, rest, nil
+}
+
+// withKDFHeader is ct, already encoded, with the parameters in front
+func withKDFHeader(params *KDFParams, ct string) string {
+    if params == nil {
+        return ct
+    }
+    return params.String() + "\n" + ct
+}
+
+// parseContainerOptions reads how the ciphertext should be wrapped. ECB
+// without a container unless told otherwise
+func parseContainerOptions(r *http.Request, errs FieldErrors) (string, CipherMode, string) {
+    format := FORMAT_BARE
+    if f := formField(r, "ciphertext-format"); f != nil {
+        format = *f
+    }
+    if format != FORMAT_BARE && format != FORMAT_CONTAINER && format != FORMAT_ARMORED {
+        errs.Add("ciphertext-format", fmt.Sprintf("Unknown format %q", format))
+        return FORMAT_BARE, MODE_ECB, ""
+    }
+    mode := MODE_ECB
+    if name := formField(r, "mode"); name != nil {
+        var err error
+        mode, err = ParseCipherMode(*name)
+        if err != nil {
+            errs.Add("ciphertext-format", err.Error())
+        }
+    }
+    if mode != MODE_ECB && format == FORMAT_BARE {
+        errs.Add("ciphertext-format", fmt.Sprintf("%s needs a container to keep the IV in", strings.ToUpper(mode.String())))
+    }
+    keyID := empty_if_nil(formField(r, "key-id"))
+    if len(keyID) > 255 {
+        errs.Add("ciphertext-format", "Key ID must be at most 255 bytes")
+    }
+    return format, mode, keyID
+}
+
+func parsePadding(r *http.Request, errs FieldErrors) *PaddingScheme {
+    name := formField(r, "padding")
+    if name == nil {
+        return nil
+    }
+    padding, err := ParsePadding(*name)
+    if err != nil {
+        errs.Add("padding", err.Error())
+        return nil
+    }
+    return &padding
+}
+
+func parseKeyRequest(r *http.Request) (KeyRequest, FieldErrors) {
+    errs := FieldErrors{}
+    return KeyRequest{Key: parseKey(r, errs)}, errs
+}
+
+// parseDeriveKeyRequest needs a passphrase, the key field is ignored
+func parseDeriveKeyRequest(r *http.Request) (KeyRequest, FieldErrors) {
+    errs := FieldErrors{}
+    if formField(r, "passphrase") == nil {
+        errs.Add("passphrase", "Passphrase is required")
+        return KeyRequest{}, errs
+    }
+    req := KeyRequest{}
+    req.Key, req.KDF = parseKeyOrPassphrase(r, errs, nil)
+    return req, errs
+}
+
+func parseEncryptRequest(r *http.Request) (EncryptRequest, FieldErrors) {
+    errs := FieldErrors{}
+    req := EncryptRequest{Padding: parsePadding(r, errs)}
+    req.Key, req.KDF = parseKeyOrPassphrase(r, errs, nil)
+    message, _, err := fieldBytes(r, "message", ENCODING_UTF8)
+    if err != nil {
+        errs.Add("message", fmt.Sprintf("Message is %s", err))
+        return req, errs
+    }
+    if len(message) == 0 {
+        errs.Add("message", "Message is required")
+        return req, errs
+    }
+    req.Message = message
+    req.Format, req.Mode, req.KeyID = parseContainerOptions(r, errs)
+    if req.Padding != nil {
+        if _, err := req.Padding.Pad(req.Message); err != nil {
+            errs.Add("message", err.Error())
+        }
+    }
+    return req, errs
+}
+
+// parseCiphertext reads the ciphertext as a container, armored or not, or
+// as bare blocks with an optional key derivation line in front. params is
+// whichever of the two says how the key was derived
+func parseCiphertext(r *http.Request, errs FieldErrors) ([]byte, *Container, *KDFParams) {
+    text := formField(r, "ciphertext")
+    if text != nil && IsContainer([]byte(*text)) {
+        // armor is text whatever the encoding says
+        c, err := ParseContainer([]byte(*text))
+        if err != nil {
+            errs.Add("ciphertext", err.Error())
+            return nil, nil, nil
+        }
+        return []byte(*text), c, c.KDF
+    }
+    var params *KDFParams
+    if text != nil {
+        var rest string
+        var err error
+        params, rest, err = splitKDFHeader(*text)
+        if err != nil {
+            errs.Add("ciphertext", fmt.Sprintf("Ciphertext parameters are invalid: %s", err))
+            return nil, nil, nil
+        }
+        // the parameters are not in the ciphertext's encoding
+        r.Form.Set("ciphertext", rest)
+    }
+    ct, _, err := fieldBytes(r, "ciphertext", ENCODING_HEX)
+    if err != nil {
+        errs.Add("ciphertext", fmt.Sprintf("Ciphertext is %s", err))
+        return nil, nil, params
+    }
+    if ct == nil {
+        errs.Add("ciphertext", "Ciphertext is required. Encrypt a message first")
+        return nil, nil, params
+    }
+    if IsContainer(ct) {
+        c, err := ParseContainer(ct)
+        if err != nil {
+            errs.Add("ciphertext", err.Error())
+            return nil, nil, params
+        }
+        return ct, c, c.KDF
+    }
+    if len(ct) == 0 || len(ct) % BLOCK_SIZE != 0 {
+        errs.Add("ciphertext", fmt.Sprintf("Ciphertext is %d bytes long but it must be a non-zero multiple of %d", len(ct), BLOCK_SIZE))
+        return nil, nil, params
+    }
+    return ct, nil, params
+}
+
+func parseDecryptRequest(r *http.Request) (DecryptRequest, FieldErrors) {
+    errs := FieldErrors{}
+    req := DecryptRequest{Padding: parsePadding(r, errs)}
+    ct, c, params := parseCiphertext(r, errs)
+    req.Key, req.KDF = parseKeyOrPassphrase(r, errs, params)
+    req.Ciphertext, req.Container = ct, c
+    return req, errs
+}
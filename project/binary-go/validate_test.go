@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPkcs7UnpadStrict(t *testing.T) {
+    good := pkcs7Pad([]byte("hello"))
+    pt, err := pkcs7Unpad(good)
+    if err != nil || string(pt) != "hello" {
+        t.Errorf("expected hello, got %q %v", pt, err)
+    }
+    bad := [][]byte{
+        nil,
+        []byte("short"),
+        append(bytes.Repeat([]byte{'a'}, 15), 0),
+        append(bytes.Repeat([]byte{'a'}, 15), 17),
+        // last byte says 3 but the two before it disagree
+        append(bytes.Repeat([]byte{'a'}, 14), 2, 3),
+    }
+    for _, data := range bad {
+        if _, err := pkcs7Unpad(data); !errors.Is(err, ErrInvalidPadding) {
+            t.Errorf("%x: expected %v, got %v", data, ErrInvalidPadding, err)
+        }
+    }
+}
+
+func TestDecryptWrongKeyIsInvalidPadding(t *testing.T) {
+    baes := new(BAESys128)
+    baes.SetKey([]byte("0123456789abcdef"))
+    ct, _ := baes.Encrypt([]byte("attack at dawn"))
+    baes.ResetKey()
+    baes.SetKey([]byte("fedcba9876543210"))
+    if _, err := baes.Decrypt(ct); !errors.Is(err, ErrInvalidPadding) {
+        t.Errorf("expected %v, got %v", ErrInvalidPadding, err)
+    }
+}
+
+func TestFieldErrors(t *testing.T) {
+    form := url.Values{"key": {"short"}, "ciphertext": {"abc"}}
+    req := httptest.NewRequest("POST", "/decrypt", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    _, errs := parseDecryptRequest(req)
+    if errs.Get("key") == nil || errs.Get("ciphertext") == nil {
+        t.Errorf("expected key and ciphertext errors, got %v", errs)
+    }
+    if errs.Get("message") != nil {
+        t.Errorf("decrypt does not need a message")
+    }
+}
+
+func postForm(handler Handler, form url.Values) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    w := httptest.NewRecorder()
+    handler(w, req)
+    return w
+}
+
+func TestHandlersShowFieldErrors(t *testing.T) {
+    baes := new(BAESys128)
+    w := postForm(handle_encrypt_message(baes), url.Values{"key": {"0123456789abcdef"}})
+    if !strings.Contains(w.Body.String(), "Message is required") {
+        t.Errorf("expected a message error, got %s", w.Body.String())
+    }
+    w = postForm(handle_decrypt_message(baes), url.Values{"key": {"0123456789abcdef"}})
+    if !strings.Contains(w.Body.String(), "Ciphertext is required") {
+        t.Errorf("expected a ciphertext error, got %s", w.Body.String())
+    }
+}
+
+// an error that echoes the form can not get out of the error's value
+func TestFieldErrorsEscaped(t *testing.T) {
+    baes := new(BAESys128)
+    w := postForm(handle_encrypt_message(baes), url.Values{
+        "key": {"0123456789abcdef"},
+        "message": {"hello"},
+        "ciphertext-format": {`x" autofocus onfocus="alert(1)`},
+    })
+    body := w.Body.String()
+    if !strings.Contains(body, "Unknown format") || strings.Contains(body, `" autofocus`) {
+        t.Errorf("error not escaped: %s", body)
+    }
+}
+
+func FuzzHandlers(f *testing.F) {
+    f.Add("", "", "")
+    f.Add("0123456789abcdef", "hello", "")
+    f.Add("0123456789abcdef", "", "00112233445566778899aabbccddeeff")
+    f.Add("0123456789abcdef", "x", "zz")
+    f.Add("0123456789abcdef", "x", "0011")
+    f.Add("\x00\xff", "\x00", "00")
+    baes := new(BAESys128)
+    handlers := []Handler{
+        index(baes, true),
+        handle_submit(baes),
+        handle_set_key(baes),
+        handle_reset_key(baes),
+        handle_encrypt_message(baes),
+        handle_decrypt_message(baes),
+        handle_random_key(baes),
+        handle_self_test(baes),
+    }
+    f.Fuzz(func(t *testing.T, key string, message string, ciphertext string) {
+        form := url.Values{"key": {key}, "message": {message}, "ciphertext": {ciphertext}}
+        for _, handler := range handlers {
+            w := postForm(handler, form)
+            if w.Code != http.StatusOK {
+                t.Errorf("handler returned %d", w.Code)
+            }
+        }
+    })
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// VerifyStatus is how a block read back from the Basys3 compares to the
+// same block encrypted by the go AES
+type VerifyStatus int
+
+const (
+    VERIFY_MATCH VerifyStatus = iota
+    VERIFY_MISMATCH
+    // no Basys3 connected so the go AES is the only output there is
+    VERIFY_NO_REFERENCE
+)
+
+func (v VerifyStatus) String() string {
+    switch v {
+    case VERIFY_MATCH:
+        return "match"
+    case VERIFY_MISMATCH:
+        return "mismatch"
+    case VERIFY_NO_REFERENCE:
+        return "no-reference"
+    }
+    return fmt.Sprintf("VerifyStatus(%d)", int(v))
+}
+
+type BlockResult struct {
+    Index int
+    Status VerifyStatus
+    Plaintext []byte
+    // Expected is the go AES output, Actual is what the Basys3 sent back
+    Expected []byte
+    Actual []byte
+    // number of bits that differ between Expected and Actual
+    BitDiff int
+}
+
+type EncryptResult struct {
+    Ciphertext []byte
+    Blocks []BlockResult
+}
+
+// Mismatches returns the blocks where the Basys3 and go AES disagree
+func (r EncryptResult) Mismatches() []BlockResult {
+    var mismatches []BlockResult
+    for _, block := range r.Blocks {
+        if block.Status == VERIFY_MISMATCH {
+            mismatches = append(mismatches, block)
+        }
+    }
+    return mismatches
+}
+
+// Err is ErrVerifyMismatch if any block did not match, otherwise nil
+func (r EncryptResult) Err() error {
+    mismatches := r.Mismatches()
+    if len(mismatches) == 0 {
+        return nil
+    }
+    return deviceError(ErrVerifyMismatch, "%d of %d blocks from the Basys3 do not match the go AES, first at block %d", len(mismatches), len(r.Blocks), mismatches[0].Index)
+}
+
+// VerifyStats counts block results over the whole session
+type VerifyStats struct {
+    Blocks int
+    Matches int
+    Mismatches int
+    NoReference int
+    BitsDiffered int
+}
+
+func (v *VerifyStats) add(block BlockResult) {
+    v.Blocks++
+    v.BitsDiffered += block.BitDiff
+    switch block.Status {
+    case VERIFY_MATCH:
+        v.Matches++
+    case VERIFY_MISMATCH:
+        v.Mismatches++
+    case VERIFY_NO_REFERENCE:
+        v.NoReference++
+    }
+}
+
+func bitDiff(a []byte, b []byte) int {
+    diff := 0
+    for i := 0; i < len(a) || i < len(b); i++ {
+        var x, y byte
+        if i < len(a) {
+            x = a[i]
+        }
+        if i < len(b) {
+            y = b[i]
+        }
+        diff += bits.OnesCount8(x ^ y)
+    }
+    return diff
+}
+
+func (s *BAESys128) verifyBlock(index int, plaintext []byte, expected []byte, actual []byte) BlockResult {
+    result := BlockResult{
+        Index: index,
+        Plaintext: plaintext,
+        Expected: expected,
+        Actual: actual,
+    }
+    switch {
+    case s.port == nil:
+        result.Status = VERIFY_NO_REFERENCE
+    case string(expected) == string(actual):
+        result.Status = VERIFY_MATCH
+    default:
+        result.Status = VERIFY_MISMATCH
+        result.BitDiff = bitDiff(expected, actual)
+        s.log(COMPONENT_DEVICE).Warn("Block from Basys3 does not match the go AES", ATTR_BLOCK, index, "actual", hex.EncodeToString(actual), "expected", hex.EncodeToString(expected), "bits", result.BitDiff)
+    }
+    s.statsMtx.Lock()
+    s.stats.add(result)
+    s.statsMtx.Unlock()
+    return result
+}
+
+// VerifyStats returns the block counts since the server started
+func (s *BAESys128) VerifyStats() VerifyStats {
+    s.statsMtx.Lock()
+    defer s.statsMtx.Unlock()
+    return s.stats
+}
+
+func verify_form_group(result *EncryptResult, stats VerifyStats) string {
+    if result == nil {
+        return ""
+    }
+    var counts [3]int
+    for _, block := range result.Blocks {
+        counts[block.Status]++
+    }
+    var diffs strings.Builder
+    for _, block := range result.Mismatches() {
+        diffs.WriteString(block_diff_table(block))
+    }
+    color := "text-green-900"
+    if counts[VERIFY_MISMATCH] > 0 {
+        color = "text-[#FF0000]"
+    }
+    return fmt.Sprintf(`
+            <div id="verify-part" class="flex flex-col gap-2 py-2 w-[600px]">
+                <p>Verification</p>
+                <p class="font-mono text-sm %s">%d blocks: %d match, %d mismatch, %d no reference</p>
+                <p class="font-mono text-sm text-slate-500">Session: %d blocks, %d match, %d mismatch, %d no reference, %d bits differed</p>
+                %s
+            </div>
+        `,
+        color, len(result.Blocks), counts[VERIFY_MATCH], counts[VERIFY_MISMATCH], counts[VERIFY_NO_REFERENCE],
+        stats.Blocks, stats.Matches, stats.Mismatches, stats.NoReference, stats.BitsDiffered,
+        diffs.String(),
+    )
+}
+
+// block_diff_table shows the expected and actual bytes of a block one above
+// the other with the differing bytes highlighted
+func block_diff_table(block BlockResult) string {
+    row := func(label string, b []byte, other []byte) string {
+        var cells strings.Builder
+        for i := 0; i < BLOCK_SIZE; i++ {
+            cell := "--"
+            if i < len(b) {
+                cell = fmt.Sprintf("%02X", b[i])
+            }
+            class := ""
+            if i >= len(b) || i >= len(other) || b[i] != other[i] {
+                class = ` class="bg-[#FF0000]/25"`
+            }
+            fmt.Fprintf(&cells, `<td%s>%s</td>`, class, cell)
+        }
+        return fmt.Sprintf(`<tr><th class="text-left pr-2">%s</th>%s</tr>`, label, cells.String())
+    }
+    return fmt.Sprintf(`
+                <div class="border-2 p-1">
+                    <p class="text-sm">Block %d: %d bits differ</p>
+                    <table class="font-mono text-xs">
+                        %s
+                        %s
+                    </table>
+                </div>
+        `,
+        block.Index, block.BitDiff,
+        row("expected", block.Expected, block.Actual),
+        row("actual", block.Actual, block.Expected),
+    )
+}
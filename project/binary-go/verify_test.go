@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"go.bug.st/serial"
+)
+
+// flipPort flips the low bit of every byte at flipAt in the stream it reads
+type flipPort struct {
+    serial.Port
+    flipAt int
+    read int
+}
+
+func (f *flipPort) Read(p []byte) (int, error) {
+    n, err := f.Port.Read(p)
+    for i := 0; i < n; i++ {
+        if f.read + i == f.flipAt {
+            p[i] ^= 0x01
+        }
+    }
+    f.read += n
+    return n, err
+}
+
+func TestBitDiff(t *testing.T) {
+    if d := bitDiff([]byte{0x00, 0xFF}, []byte{0x01, 0x0F}); d != 5 {
+        t.Errorf("expected 5 bits to differ, got %d", d)
+    }
+    if d := bitDiff([]byte{0xFF}, nil); d != 8 {
+        t.Errorf("expected missing bytes to count as differing, got %d", d)
+    }
+}
+
+func TestEncryptVerifiedReportsMismatch(t *testing.T) {
+    board := NewBasys3Model(PROTOCOL_RAW)
+    // skip the key echo and the first block
+    var port serial.Port = &flipPort{Port: board, flipAt: 2*BLOCK_SIZE + 3}
+    baes := new(BAESys128)
+    baes.SetProtocol(PROTOCOL_RAW)
+    baes.SetPort(&port)
+    err := baes.SetKey([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatalf("SetKey failed: %v", err)
+    }
+    res, err := baes.EncryptVerified([]byte("two blocks of message text"))
+    if err != nil {
+        t.Fatalf("EncryptVerified failed: %v", err)
+    }
+    if len(res.Blocks) != 2 {
+        t.Fatalf("expected 2 block results, got %d", len(res.Blocks))
+    }
+    if res.Blocks[0].Status != VERIFY_MATCH {
+        t.Errorf("block 0: expected %s, got %s", VERIFY_MATCH, res.Blocks[0].Status)
+    }
+    if res.Blocks[1].Status != VERIFY_MISMATCH || res.Blocks[1].BitDiff != 1 {
+        t.Errorf("block 1: expected a 1 bit %s, got %s with %d bits", VERIFY_MISMATCH, res.Blocks[1].Status, res.Blocks[1].BitDiff)
+    }
+    stats := baes.VerifyStats()
+    if stats.Blocks != 2 || stats.Matches != 1 || stats.Mismatches != 1 || stats.BitsDiffered != 1 {
+        t.Errorf("unexpected session stats %+v", stats)
+    }
+}
+
+func TestEncryptVerifiedWithoutDevice(t *testing.T) {
+    baes := new(BAESys128)
+    baes.SetKey([]byte("0123456789abcdef"))
+    res, err := baes.EncryptVerified([]byte("hello"))
+    if err != nil {
+        t.Fatalf("EncryptVerified failed: %v", err)
+    }
+    if res.Blocks[0].Status != VERIFY_NO_REFERENCE {
+        t.Errorf("expected %s without a Basys3, got %s", VERIFY_NO_REFERENCE, res.Blocks[0].Status)
+    }
+}